@@ -0,0 +1,1184 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+warp2api command line tool
+
+Server commands (every config key is also available as a flag, see --help):
+
+    warp2api bridge [--port 28888] [--socket PATH]   protobuf bridge server
+    warp2api serve  [--port 28889]                   OpenAI-compatible server
+    warp2api all                                     both servers in one process
+    warp2api <command> --print-config                show effective config and exit
+
+Background operation:
+
+    warp2api all --daemon [--pidfile PATH]           detach (Unix), see stop / status
+    warp2api stop|status [all|bridge|serve]          manage a --daemon instance
+    warp2api service install|remove|start|stop|status
+                                                     Windows service (needs pywin32)
+
+Client commands:
+
+    warp2api chat [--model claude-4-sonnet] [--url URL | --inprocess]
+                                                     interactive chat REPL
+    warp2api bench  [--concurrency 4] [--requests 20] [--stream]
+                                                     synthetic load test
+    warp2api doctor [--offline] [--json]             diagnose common setup problems and missing extras
+    warp2api init   [--output config.yaml] [--yes]   write a config file interactively
+
+Offline utilities that use the embedded protobuf schemas directly, without a
+running bridge:
+
+    warp2api decode <file> [--type MSG] [--framing none|varint|sse] [--wire]
+
+Precedence: command line flags > environment > .env > config file > defaults.
+"""
+from __future__ import annotations
+
+import argparse
+import asyncio
+import base64
+import gzip
+import json
+import os
+import re
+import sys
+from typing import Any, Dict, Iterator, List, Optional, Tuple
+from urllib.parse import urlsplit
+
+DEFAULT_MESSAGE_TYPE = "warp.multi_agent.v1.ResponseEvent"
+DEFAULT_CHAT_MODEL = "claude-4-sonnet"
+DEFAULT_OPENAI_URL = "http://127.0.0.1:28889"
+
+DEFAULT_BENCH_PROMPT = "Count from 1 to 10, then say the number {i}."
+
+DOCTOR_MARKS = {"pass": "✓", "warn": "!", "fail": "✗", "skip": "-"}
+# 可选依赖：(extra 名称, 模块, 用途, 当前配置是否需要)
+OPTIONAL_EXTRAS = (
+    ("yaml", "yaml", "YAML 配置文件", lambda: _env("WARP2API_CONFIG").lower().endswith((".yaml", ".yml"))),
+    ("toml", "tomllib" if sys.version_info >= (3, 11) else "tomli", "TOML 配置文件",
+     lambda: _env("WARP2API_CONFIG").lower().endswith(".toml")),
+    ("redis", "redis", "Redis 响应缓存 / 共享 token 存储",
+     lambda: _env("RESPONSE_CACHE_BACKEND").lower() == "redis" or _env("WARP_TOKEN_STORE").startswith("redis")),
+    ("tokens", "tiktoken", "本地 token 计数", lambda: False),
+    ("hooks", "lupa", "Lua 脚本钩子", lambda: bool(_env("SCRIPT_HOOKS_PATH"))),
+    ("acme", "cryptography", "ACME 自动证书", lambda: bool(_env("TLS_ACME_DOMAIN"))),
+    ("tracing", "opentelemetry.sdk", "OpenTelemetry 追踪", lambda: bool(_env("OTEL_EXPORTER_OTLP_ENDPOINT"))),
+    ("windows", "win32service", "Windows 服务", lambda: False),
+)
+PROXY_HINT = "不需要代理时在 .env 中清空代理：HTTP_PROXY=、HTTPS_PROXY=、NO_PROXY=127.0.0.1,localhost"
+
+CHAT_HELP = """\
+/model [名称]     切换模型（不带参数显示当前模型）
+/models           列出可用模型
+/system [文本]    设置系统提示（不带参数则清除）
+/stream on|off    切换流式输出
+/clear            清空对话历史
+/help             显示本帮助
+/exit             退出（也可以 Ctrl-D）"""
+
+
+def _read_input(path: str) -> bytes:
+    if path == "-":
+        return sys.stdin.buffer.read()
+    with open(path, "rb") as f:
+        data = f.read()
+    if data[:2] == b"\x1f\x8b":
+        data = gzip.decompress(data)
+    return data
+
+
+def _looks_like_jsonl(data: bytes) -> bool:
+    head = data.lstrip()[:1]
+    return head in (b"{", b"[")
+
+
+def _maybe_text_payload(data: bytes) -> Optional[bytes]:
+    """Captures are often saved as hex or base64 text; return decoded bytes if so."""
+    try:
+        text = data.decode("ascii").strip()
+    except UnicodeDecodeError:
+        return None
+    if not text or not re.fullmatch(r"[0-9A-Za-z+/=_\-\s]+", text):
+        return None
+    from warp2protobuf.warp.bridge_service import parse_payload_bytes
+    return parse_payload_bytes(text)
+
+
+def _iter_sse_payloads(data: bytes) -> Iterator[bytes]:
+    from warp2protobuf.warp.bridge_service import parse_payload_bytes
+    current = ""
+    for line in data.decode("utf-8", errors="replace").splitlines() + [""]:
+        if line.startswith("data:"):
+            payload = line[5:].strip()
+            if payload and payload != "[DONE]":
+                current += payload
+            continue
+        if line.strip() == "" and current:
+            raw = parse_payload_bytes(current)
+            current = ""
+            if raw is not None:
+                yield raw
+
+
+def _decode_one(raw: bytes, args: argparse.Namespace) -> Dict[str, Any]:
+    if args.wire:
+        from warp2protobuf.core.wire_debug import annotate_wire
+        return annotate_wire(raw)
+    from warp2protobuf.core.protobuf_utils import protobuf_to_dict
+    try:
+        return protobuf_to_dict(raw, args.type, emit_defaults=args.emit_defaults, json_names=args.json_names)
+    except Exception as e:
+        return {"_error": str(getattr(e, "detail", e)), "_size": len(raw), "_hex": raw[:64].hex()}
+
+
+def _decode_messages(data: bytes, args: argparse.Namespace) -> List[Dict[str, Any]]:
+    if args.framing == "sse":
+        return [_decode_one(raw, args) for raw in _iter_sse_payloads(data)]
+    if args.framing == "varint":
+        from warp2protobuf.core.stream_processor import StreamDecoder
+        if args.wire:
+            raise SystemExit("--wire 不支持 varint 分帧，请先用 --framing none 解码单帧")
+        decoder = StreamDecoder(args.type)
+        events = decoder.feed(data)
+        out = [ev.get("json_data") or {"_error": ev.get("error"), "_frame": ev.get("frame_index")} for ev in events]
+        if decoder.pending_bytes:
+            out.append({"_error": f"trailing incomplete frame ({decoder.pending_bytes} bytes)"})
+        return out
+    return [_decode_one(data, args)]
+
+
+def _dump(obj: Any, args: argparse.Namespace) -> str:
+    if args.compact:
+        return json.dumps(obj, ensure_ascii=False, default=str)
+    return json.dumps(obj, ensure_ascii=False, indent=2, default=str)
+
+
+def _decode_jsonl(data: bytes, args: argparse.Namespace) -> int:
+    """Pretty-print a /api/packets/export capture, decoding embedded protobuf_bytes."""
+    count = 0
+    for line in data.decode("utf-8", errors="replace").splitlines():
+        line = line.strip()
+        if not line:
+            continue
+        try:
+            packet = json.loads(line)
+        except ValueError as e:
+            print(f"# 跳过无法解析的行: {e}", file=sys.stderr)
+            continue
+        count += 1
+        header = f"# [{packet.get('id', count)}] {packet.get('timestamp', '')} {packet.get('type', '?')}"
+        if packet.get("message_type"):
+            header += f" ({packet['message_type']})"
+        header += f" size={packet.get('size', '?')}"
+        print(header)
+        body = packet.get("full_data", packet)
+        if isinstance(body, dict) and isinstance(body.get("protobuf_bytes"), str):
+            raw = base64.b64decode(body["protobuf_bytes"])
+            body = _decode_one(raw, args)
+        print(_dump(body, args))
+    return count
+
+
+def cmd_decode(args: argparse.Namespace) -> int:
+    data = _read_input(args.file)
+    if args.framing == "none" and not args.raw and _looks_like_jsonl(data):
+        n = _decode_jsonl(data, args)
+        print(f"# {n} 个数据包", file=sys.stderr)
+        return 0
+    if args.framing != "sse" and not args.raw:
+        text_bytes = _maybe_text_payload(data)
+        if text_bytes is not None:
+            data = text_bytes
+    messages = _decode_messages(data, args)
+    for i, msg in enumerate(messages):
+        if len(messages) > 1:
+            print(f"# message {i}")
+        print(_dump(msg, args))
+    print(f"# {len(messages)} 条消息, 类型 {args.type}", file=sys.stderr)
+    return 1 if any(isinstance(m, dict) and "_error" in m for m in messages) else 0
+
+
+def _config_flag_parser() -> argparse.ArgumentParser:
+    """Parent parser with one --<section>-<key> flag per config key (see config_file.SECTION_ENV)."""
+    from warp2protobuf.config.config_file import SECTION_ENV
+    parent = argparse.ArgumentParser(add_help=False)
+    parent.add_argument("--config", metavar="PATH", help="配置文件路径（YAML / TOML / JSON），等同 WARP2API_CONFIG")
+    parent.add_argument("--profile", help="选择配置文件中 profiles 下的环境配置（dev / staging / prod ...），等同 WARP2API_PROFILE")
+    parent.add_argument("--print-config", action="store_true", help="打印合并后的有效配置（密钥已脱敏）后退出")
+    parent.add_argument("--mock-upstream", action="store_true",
+                        help="用确定性的模拟上游代替 Warp（无需凭据，离线开发 / CI），等同 MOCK_UPSTREAM=true")
+    for section, mapping in SECTION_ENV.items():
+        group = parent.add_argument_group(f"{section} 配置")
+        for key, env_name in mapping.items():
+            group.add_argument(f"--{section}-{key.replace('_', '-')}", dest=f"env__{env_name}",
+                               metavar="VALUE", help=f"覆盖 {env_name}")
+    return parent
+
+
+def _apply_config_flags(args: argparse.Namespace) -> None:
+    """Export flag values before any settings module is imported (flags win over env)."""
+    if getattr(args, "config", None):
+        os.environ["WARP2API_CONFIG"] = args.config
+    if getattr(args, "profile", None):
+        os.environ["WARP2API_PROFILE"] = args.profile
+    if getattr(args, "mock_upstream", False):
+        os.environ["MOCK_UPSTREAM"] = "true"
+    for name, value in vars(args).items():
+        if name.startswith("env__") and value is not None:
+            os.environ[name[len("env__"):]] = value
+
+
+def _print_config_if_requested(args: argparse.Namespace) -> bool:
+    if not args.print_config:
+        return False
+    from warp2protobuf.config.config_file import apply_config_file, effective_config
+    apply_config_file()
+    print(json.dumps(effective_config(redact=True), ensure_ascii=False, indent=2))
+    return True
+
+
+def _default_pidfile(command: str) -> str:
+    from warp2protobuf.config.settings import LOGS_DIR
+    return str(LOGS_DIR / f"warp2api-{command}.pid")
+
+
+def _running_pid(pidfile: str) -> Optional[int]:
+    """The pid recorded in `pidfile` if that process is still alive."""
+    try:
+        with open(pidfile, encoding="ascii") as f:
+            pid = int(f.read().strip())
+        os.kill(pid, 0)
+    except PermissionError:
+        # 进程存在，只是属于其他用户
+        return pid
+    except (OSError, ValueError):
+        return None
+    return pid
+
+
+def _daemonize(args: argparse.Namespace, roles: Tuple[str, ...]) -> None:
+    """--daemon: check the config in the foreground, then detach (double fork) and write the pidfile."""
+    import atexit
+
+    if not args.daemon:
+        return
+    if os.name == "nt":
+        raise SystemExit("Windows 不支持 --daemon，请用 warp2api service install 安装为 Windows 服务")
+    from warp2protobuf.config.validation import check_config_or_exit
+    for role in roles:
+        check_config_or_exit(role)
+    pidfile = os.path.abspath(args.pidfile or _default_pidfile(args.command))
+    running = _running_pid(pidfile)
+    if running:
+        raise SystemExit(f"已有实例在运行 (pid {running}，{pidfile})，先执行 warp2api stop {args.command}")
+    log_path = os.path.splitext(pidfile)[0] + ".out"
+    os.makedirs(os.path.dirname(pidfile), exist_ok=True)
+    sys.stdout.flush()
+    sys.stderr.flush()
+    child = os.fork()
+    if child > 0:
+        # 等中间进程打印守护进程 pid 后再返回 shell
+        os.waitpid(child, 0)
+        os._exit(0)
+    os.setsid()
+    daemon = os.fork()
+    if daemon > 0:
+        print(f"已在后台启动 (pid {daemon})，pidfile: {pidfile}，输出: {log_path}")
+        os._exit(0)
+    # 保持当前工作目录：.env、配置文件和相对路径都相对它解析
+    with open(os.devnull, "rb") as devnull:
+        os.dup2(devnull.fileno(), 0)
+    with open(log_path, "ab") as out:
+        os.dup2(out.fileno(), 1)
+        os.dup2(out.fileno(), 2)
+    with open(pidfile, "w", encoding="ascii") as f:
+        f.write(f"{os.getpid()}\n")
+
+    def _remove_pidfile() -> None:
+        if _running_pid(pidfile) == os.getpid():
+            os.remove(pidfile)
+    atexit.register(_remove_pidfile)
+
+
+def cmd_stop(args: argparse.Namespace) -> int:
+    import signal
+    import time
+
+    if os.name == "nt":
+        print("Windows 上请使用 warp2api service stop", file=sys.stderr)
+        return 1
+    pidfile = args.pidfile or _default_pidfile(args.target)
+    pid = _running_pid(pidfile)
+    if pid is None:
+        print(f"没有运行中的实例 ({pidfile})")
+        return 0
+    # SIGTERM 与 Ctrl-C 一样先排空进行中的请求
+    os.kill(pid, signal.SIGTERM)
+    deadline = time.monotonic() + args.timeout
+    while time.monotonic() < deadline:
+        if _running_pid(pidfile) != pid:
+            print(f"已停止 (pid {pid})")
+            return 0
+        time.sleep(0.2)
+    print(f"pid {pid} 在 {args.timeout:.0f}s 内未退出，可再次执行以强制退出，或 kill -9 {pid}", file=sys.stderr)
+    return 1
+
+
+def cmd_status(args: argparse.Namespace) -> int:
+    pidfile = args.pidfile or _default_pidfile(args.target)
+    pid = _running_pid(pidfile)
+    print(f"运行中 (pid {pid})" if pid else f"未运行 ({pidfile})")
+    return 0 if pid else 1
+
+
+def cmd_service(args: argparse.Namespace) -> int:
+    if os.name != "nt":
+        print("warp2api service 仅适用于 Windows；Unix 上使用 warp2api all --daemon（或 systemd）在后台运行", file=sys.stderr)
+        return 1
+    try:
+        import winservice
+    except ImportError:
+        print("安装 Windows 服务需要 pywin32 (pip install pywin32)", file=sys.stderr)
+        return 1
+    import pywintypes
+    try:
+        if args.action == "install":
+            options = {"cwd": os.getcwd(), "config": os.path.abspath(args.config) if args.config else None,
+                       "profile": args.profile, "port": args.port, "bridge_port": args.bridge_port}
+            winservice.install(args.name, options, auto_start=not args.manual)
+            print(f"已安装服务 {args.name}（工作目录 {os.getcwd()}），启动: warp2api service start")
+        elif args.action == "remove":
+            winservice.remove(args.name)
+            print(f"已删除服务 {args.name}")
+        elif args.action == "start":
+            winservice.start(args.name)
+            print(f"已启动服务 {args.name}，输出见 logs\\service.log")
+        elif args.action == "stop":
+            winservice.stop(args.name)
+            print(f"已停止服务 {args.name}")
+        else:
+            print(f"{args.name}: {winservice.status(args.name)}")
+    except pywintypes.error as e:
+        # 最常见的是 5（拒绝访问，需要管理员权限）和 1060（服务未安装）
+        print(f"{args.action} 失败: {e.strerror} ({e.winerror})", file=sys.stderr)
+        return 1
+    return 0
+
+
+def cmd_bridge(args: argparse.Namespace) -> int:
+    _apply_config_flags(args)
+    if _print_config_if_requested(args):
+        return 0
+    _daemonize(args, ("bridge",))
+    from server import run_bridge
+    run_bridge(args.port, args.socket if args.socket is not None else _env("BRIDGE_SOCKET"))
+    return 0
+
+
+def cmd_serve(args: argparse.Namespace) -> int:
+    _apply_config_flags(args)
+    if _print_config_if_requested(args):
+        return 0
+    _daemonize(args, ("openai",))
+    from openai_compat import run_openai_server
+    run_openai_server(args.port)
+    return 0
+
+
+def _env(name: str) -> str:
+    return os.getenv(name, "")
+
+
+async def serve_all(bridge_port: int, openai_port: int, socket_path: str, servers: Optional[List[Any]] = None) -> None:
+    """Run both servers until they exit; `servers` receives the uvicorn servers so another thread can stop them."""
+    import uvicorn
+    from server import build_bridge_app, bind_unix_socket
+    from warp2protobuf.config.settings import BRIDGE_SOCKET_MODE, SHUTDOWN_GRACE_PERIOD
+    from warp2protobuf.api.access_log import uvicorn_access_log
+    from warp2protobuf.core.listeners import ListenSpec, bind_tcp_socket, close_listeners, open_server_sockets, reuse_port_enabled, server_tls_files, start_certificate_renewal
+    from openai_compat import app as openai_app
+    from protobuf2openai.shutdown import graceful_server
+
+    sock = None
+    if socket_path or reuse_port_enabled():
+        sock = bind_unix_socket(socket_path, BRIDGE_SOCKET_MODE) if socket_path else bind_tcp_socket("0.0.0.0", bridge_port, reuse_port=True)
+        bridge_config = uvicorn.Config(build_bridge_app(), fd=sock.fileno(), log_level="info", access_log=uvicorn_access_log(),
+                                       timeout_graceful_shutdown=SHUTDOWN_GRACE_PERIOD)
+    else:
+        bridge_config = uvicorn.Config(build_bridge_app(), host="0.0.0.0", port=bridge_port, log_level="info",
+                                       access_log=uvicorn_access_log(), timeout_graceful_shutdown=SHUTDOWN_GRACE_PERIOD)
+    certfile, keyfile = server_tls_files()
+    openai_config = uvicorn.Config(openai_app, log_level="info", access_log=uvicorn_access_log(),
+                                   ssl_certfile=certfile, ssl_keyfile=keyfile)
+    start_certificate_renewal(openai_config, certfile)
+    # OPENAI_LISTEN: OpenAI 兼容服务器同时监听多个地址（TCP / IPv6 / Unix socket）；REUSE_PORT / LISTEN_FDS 用于无中断重启
+    listen_specs, listen_socks = open_server_sockets(_env("OPENAI_LISTEN"), _env("HOST") or "127.0.0.1", openai_port,
+                                                     int(_env("OPENAI_SOCKET_MODE") or "600", 8))
+    bridge_server, openai_server = uvicorn.Server(bridge_config), graceful_server(openai_config)
+    if servers is not None:
+        servers += [openai_server, bridge_server]
+    try:
+        # OpenAI 服务器后注册信号处理，先收到 SIGTERM 并排空流式响应，退出后信号再转交给 bridge
+        await asyncio.gather(bridge_server.serve(), openai_server.serve(sockets=listen_socks))
+    finally:
+        close_listeners(listen_socks, listen_specs)
+        if sock is not None:
+            close_listeners([sock], [ListenSpec(raw=socket_path, path=socket_path)] if socket_path else [])
+
+
+def cmd_all(args: argparse.Namespace) -> int:
+    _apply_config_flags(args)
+    if _print_config_if_requested(args):
+        return 0
+    from warp2protobuf.config.validation import check_config_or_exit
+    check_config_or_exit("bridge")
+    check_config_or_exit("openai")
+    _daemonize(args, ())
+    socket_path = args.socket if args.socket is not None else _env("BRIDGE_SOCKET")
+    try:
+        asyncio.run(serve_all(args.bridge_port, args.port, socket_path))
+    except KeyboardInterrupt:
+        pass
+    return 0
+
+
+def _start_inprocess_server() -> str:
+    """Serve the OpenAI app, with the bridge in-process, on a free loopback port; returns its base URL."""
+    import threading
+    import time
+    import uvicorn
+    from warp2protobuf.core.listeners import bind_tcp_socket
+
+    os.environ["WARP_BRIDGE_TRANSPORT"] = "inprocess"
+    from openai_compat import app as openai_app
+    sock = bind_tcp_socket("127.0.0.1", 0)
+    server = uvicorn.Server(uvicorn.Config(openai_app, log_level="warning", access_log=False))
+    threading.Thread(target=server.run, kwargs={"sockets": [sock]}, daemon=True).start()
+    deadline = time.monotonic() + 60
+    while not server.started:
+        if time.monotonic() > deadline:
+            raise SystemExit("进程内服务器启动超时")
+        time.sleep(0.05)
+    return f"http://127.0.0.1:{sock.getsockname()[1]}"
+
+
+def _api_error(response: Any) -> str:
+    try:
+        error = response.json().get("error")
+        message = error.get("message") if isinstance(error, dict) else error
+    except Exception:
+        message = None
+    return f"HTTP {response.status_code}: {message or response.text[:200]}"
+
+
+def _chat_turn(client: Any, payload: Dict[str, Any]) -> str:
+    """Send one completion request, printing the reply as it arrives; returns the full reply text."""
+    if not payload["stream"]:
+        response = client.post("/v1/chat/completions", json=payload)
+        if response.status_code != 200:
+            raise RuntimeError(_api_error(response))
+        text = (response.json()["choices"][0]["message"].get("content") or "")
+        print(text)
+        return text
+    parts: List[str] = []
+    with client.stream("POST", "/v1/chat/completions", json=payload) as response:
+        if response.status_code != 200:
+            response.read()
+            raise RuntimeError(_api_error(response))
+        for line in response.iter_lines():
+            if not line.startswith("data:"):
+                continue
+            data = line[5:].strip()
+            if data == "[DONE]":
+                break
+            chunk = json.loads(data)
+            if chunk.get("error"):
+                raise RuntimeError(str(chunk["error"].get("message") or chunk["error"]))
+            for choice in chunk.get("choices") or []:
+                delta = (choice.get("delta") or {}).get("content")
+                if delta:
+                    parts.append(delta)
+                    print(delta, end="", flush=True)
+    print()
+    return "".join(parts)
+
+
+def _list_models(client: Any) -> List[str]:
+    response = client.get("/v1/models")
+    if response.status_code != 200:
+        raise RuntimeError(_api_error(response))
+    return [m["id"] for m in response.json().get("data") or []]
+
+
+def cmd_chat(args: argparse.Namespace) -> int:
+    _apply_config_flags(args)
+    import httpx
+    from warp2protobuf.config.config_file import apply_config_file
+
+    apply_config_file()
+    base_url = _start_inprocess_server() if args.inprocess else args.url.rstrip("/")
+    api_key = args.api_key or _env("API_TOKEN")
+    headers = {"Authorization": f"Bearer {api_key}"} if api_key else {}
+    try:
+        import readline  # noqa: F401  启用行编辑与历史记录（Windows 上可能不可用）
+    except ImportError:
+        pass
+
+    model, system, stream = args.model, args.system, not args.no_stream
+    history: List[Dict[str, Any]] = []
+    print(f"已连接 {base_url}，模型 {model}。输入 /help 查看命令，Ctrl-D 退出。")
+    with httpx.Client(base_url=base_url, headers=headers, timeout=httpx.Timeout(10.0, read=None)) as client:
+        while True:
+            try:
+                line = input(f"{model}> ").strip()
+            except EOFError:
+                print()
+                return 0
+            except KeyboardInterrupt:
+                print()
+                continue
+            if not line:
+                continue
+            if line.startswith("/"):
+                command, _, rest = line[1:].partition(" ")
+                rest = rest.strip()
+                if command in ("exit", "quit", "q"):
+                    return 0
+                if command == "help":
+                    print(CHAT_HELP)
+                elif command == "model":
+                    model = rest or model
+                    print(f"当前模型: {model}")
+                elif command == "models":
+                    try:
+                        print("\n".join(_list_models(client)))
+                    except (httpx.HTTPError, RuntimeError) as e:
+                        print(f"✗ {e}", file=sys.stderr)
+                elif command == "system":
+                    system = rest or None
+                    print(f"系统提示: {system}" if system else "已清除系统提示")
+                elif command == "stream" and rest in ("on", "off"):
+                    stream = rest == "on"
+                    print(f"流式输出: {rest}")
+                elif command == "clear":
+                    history.clear()
+                    print("已清空对话历史")
+                else:
+                    print(f"未知命令: {line}（输入 /help 查看命令）", file=sys.stderr)
+                continue
+
+            messages = ([{"role": "system", "content": system}] if system else []) + history
+            messages.append({"role": "user", "content": line})
+            try:
+                reply = _chat_turn(client, {"model": model, "messages": messages, "stream": stream})
+            except KeyboardInterrupt:
+                # 中断的一轮不计入历史
+                print("\n(已中断)")
+                continue
+            except (httpx.HTTPError, RuntimeError, ValueError, KeyError) as e:
+                print(f"\n✗ {e}", file=sys.stderr)
+                continue
+            history.append({"role": "user", "content": line})
+            history.append({"role": "assistant", "content": reply})
+
+
+async def _bench_one(client: Any, payload: Dict[str, Any]) -> Dict[str, Any]:
+    """One timed completion request: latency, time to first content (streams) and output size."""
+    import time
+    start = time.perf_counter()
+    result: Dict[str, Any] = {"ok": False, "ttft": None, "chars": 0}
+    try:
+        if payload["stream"]:
+            async with client.stream("POST", "/v1/chat/completions", json=payload) as response:
+                if response.status_code != 200:
+                    await response.aread()
+                    result["error"] = _api_error(response)
+                else:
+                    async for line in response.aiter_lines():
+                        if not line.startswith("data:") or line[5:].strip() == "[DONE]":
+                            continue
+                        chunk = json.loads(line[5:])
+                        if chunk.get("error"):
+                            result["error"] = str(chunk["error"].get("message") or chunk["error"])
+                            break
+                        for choice in chunk.get("choices") or []:
+                            delta = (choice.get("delta") or {}).get("content")
+                            if delta:
+                                if result["ttft"] is None:
+                                    result["ttft"] = time.perf_counter() - start
+                                result["chars"] += len(delta)
+                    result["ok"] = "error" not in result
+        else:
+            response = await client.post("/v1/chat/completions", json=payload)
+            if response.status_code != 200:
+                result["error"] = _api_error(response)
+            else:
+                result["chars"] = len(response.json()["choices"][0]["message"].get("content") or "")
+                result["ok"] = True
+    except Exception as e:
+        result["error"] = f"{type(e).__name__}: {e}"
+    result["latency"] = time.perf_counter() - start
+    return result
+
+
+def _percentiles(values: List[float]) -> Dict[str, Optional[float]]:
+    """p50 / p95 / p99 (nearest rank) in milliseconds."""
+    ordered = sorted(values)
+    out: Dict[str, Optional[float]] = {}
+    for name, q in (("p50", 0.50), ("p95", 0.95), ("p99", 0.99)):
+        out[name] = round(ordered[min(len(ordered) - 1, int(q * len(ordered)))] * 1000, 1) if ordered else None
+    return out
+
+
+async def _run_bench(base_url: str, headers: Dict[str, str], args: argparse.Namespace) -> Dict[str, Any]:
+    import time
+    import httpx
+
+    pending = iter(range(args.requests))
+    results: List[Dict[str, Any]] = []
+
+    async def worker(client: Any) -> None:
+        # 每个 worker 依次取下一个请求序号，保持并发数恒定
+        for i in pending:
+            payload = {"model": args.model, "stream": args.stream,
+                       "messages": [{"role": "user", "content": args.prompt.replace("{i}", str(i))}]}
+            if args.max_tokens:
+                payload["max_tokens"] = args.max_tokens
+            results.append(await _bench_one(client, payload))
+
+    limits = httpx.Limits(max_connections=args.concurrency, max_keepalive_connections=args.concurrency)
+    async with httpx.AsyncClient(base_url=base_url, headers=headers, limits=limits,
+                                 timeout=httpx.Timeout(10.0, read=args.timeout)) as client:
+        start = time.perf_counter()
+        await asyncio.gather(*(worker(client) for _ in range(args.concurrency)))
+        elapsed = time.perf_counter() - start
+
+    ok = [r for r in results if r["ok"]]
+    errors: Dict[str, int] = {}
+    for r in results:
+        if not r["ok"]:
+            errors[r.get("error") or "unknown"] = errors.get(r.get("error") or "unknown", 0) + 1
+    return {
+        "url": base_url, "model": args.model, "stream": args.stream,
+        "concurrency": args.concurrency, "requests": len(results), "succeeded": len(ok), "failed": len(results) - len(ok),
+        "duration_s": round(elapsed, 3),
+        "throughput_rps": round(len(ok) / elapsed, 2) if elapsed else None,
+        "output_chars_per_s": round(sum(r["chars"] for r in ok) / elapsed, 1) if elapsed else None,
+        "latency_ms": _percentiles([r["latency"] for r in ok]),
+        "ttft_ms": _percentiles([r["ttft"] for r in ok if r["ttft"] is not None]) if args.stream else None,
+        "errors": errors,
+    }
+
+
+def _print_bench_report(report: Dict[str, Any]) -> None:
+    def fmt(p: Optional[Dict[str, Optional[float]]]) -> str:
+        if not p or p["p50"] is None:
+            return "-"
+        return "  ".join(f"{k}={v:.1f}" for k, v in p.items())
+
+    print(f"目标        {report['url']}  模型 {report['model']}  {'流式' if report['stream'] else '非流式'}  并发 {report['concurrency']}")
+    print(f"请求        {report['requests']} 个, 成功 {report['succeeded']}, 失败 {report['failed']}, 耗时 {report['duration_s']:.2f}s")
+    print(f"吞吐        {report['throughput_rps']} req/s, {report['output_chars_per_s']} 输出字符/s")
+    print(f"延迟 (ms)   {fmt(report['latency_ms'])}")
+    if report["stream"]:
+        print(f"TTFT (ms)   {fmt(report['ttft_ms'])}")
+    for message, count in sorted(report["errors"].items(), key=lambda kv: -kv[1]):
+        print(f"✗ {count} × {message}")
+
+
+def cmd_bench(args: argparse.Namespace) -> int:
+    _apply_config_flags(args)
+    from warp2protobuf.config.config_file import apply_config_file
+
+    if args.concurrency < 1 or args.requests < 1:
+        raise SystemExit("--concurrency 和 --requests 必须大于 0")
+    apply_config_file()
+    base_url = _start_inprocess_server() if args.inprocess else args.url.rstrip("/")
+    api_key = args.api_key or _env("API_TOKEN")
+    headers = {"Authorization": f"Bearer {api_key}"} if api_key else {}
+    report = asyncio.run(_run_bench(base_url, headers, args))
+    if args.json:
+        print(json.dumps(report, ensure_ascii=False, indent=2))
+    else:
+        _print_bench_report(report)
+    return 0 if report["failed"] == 0 else 1
+
+
+def _display_width(text: str) -> int:
+    # 中文字符在终端中占两列
+    import unicodedata
+    return sum(2 if unicodedata.east_asian_width(c) in ("W", "F") else 1 for c in text)
+
+
+def _check(name: str, status: str, detail: str, hint: str = "") -> Dict[str, str]:
+    return {"name": name, "status": status, "detail": detail, "hint": hint}
+
+
+def _proxy_env() -> Dict[str, str]:
+    return {name: os.getenv(name) or os.getenv(name.lower()) or "" for name in ("HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "NO_PROXY")}
+
+
+def _bypasses_proxy(host: str) -> bool:
+    hosts = [h.strip().lstrip(".") for h in _proxy_env()["NO_PROXY"].split(",") if h.strip()]
+    return "*" in hosts or any(host == h or host.endswith("." + h) for h in hosts)
+
+
+def _doctor_config() -> Dict[str, str]:
+    from warp2protobuf.config.validation import validate_config
+    errors: List[str] = []
+    warnings: List[str] = []
+    for role in ("bridge", "openai"):
+        role_errors, role_warnings = validate_config(role)
+        errors += [e for e in role_errors if e not in errors]
+        warnings += [w for w in role_warnings if w not in warnings]
+    if errors:
+        return _check("配置", "fail", "; ".join(errors), "按提示修改 .env 或配置文件（warp2api all --print-config 查看合并后的配置）")
+    if warnings:
+        return _check("配置", "warn", "; ".join(warnings))
+    return _check("配置", "pass", "配置有效")
+
+
+async def _doctor_token() -> Dict[str, str]:
+    from warp2protobuf.core.account_pool import get_account_pool
+    from warp2protobuf.core.auth import credential_status, refresh_jwt_token
+
+    refresh, source = os.getenv("WARP_REFRESH_TOKEN", "").strip(), "WARP_REFRESH_TOKEN"
+    pool = get_account_pool()
+    account = next((a for a in pool.accounts if a.enabled), None) if pool is not None else None
+    if account is not None:
+        refresh, source = account.refresh_token, f"账号 {account.label}"
+    if not refresh:
+        ok, detail = credential_status()
+        if not ok:
+            return _check("Token 刷新", "fail", detail, "在 .env 中设置有效的 WARP_REFRESH_TOKEN")
+        if os.getenv("WARP_JWT", "").strip():
+            return _check("Token 刷新", "warn", f"{detail}，但未设置 WARP_REFRESH_TOKEN，过期后无法自动刷新",
+                          "设置 WARP_REFRESH_TOKEN 以便自动续期")
+        return _check("Token 刷新", "warn", "未配置凭据，将使用匿名token（额度有限）", "设置 WARP_REFRESH_TOKEN 或配置文件 accounts")
+    data = await refresh_jwt_token(refresh)
+    if data.get("access_token"):
+        return _check("Token 刷新", "pass", f"{source} 刷新成功")
+    return _check("Token 刷新", "fail", f"{source} 刷新失败",
+                  "refresh token 可能已失效，请重新获取；若 Warp 连通性检查也失败，先解决网络问题")
+
+
+def _doctor_bridge() -> Dict[str, str]:
+    import httpx
+
+    if (_env("WARP_BRIDGE_TRANSPORT").lower() or "http") == "inprocess":
+        return _check("Bridge 连通性", "skip", "WARP_BRIDGE_TRANSPORT=inprocess，bridge 在 OpenAI 服务器进程内调用")
+    url = (_env("WARP_BRIDGE_URL") or "http://127.0.0.1:28888").rstrip("/")
+    sock = _env("BRIDGE_SOCKET")
+    target = f"unix:{sock}" if sock else url
+    hint = "先启动桥接服务器（warp2api bridge 或 warp2api all），并检查 WARP_BRIDGE_URL / BRIDGE_SOCKET"
+    host = urlsplit(url).hostname or ""
+    proxied = not sock and any(v for k, v in _proxy_env().items() if k != "NO_PROXY") and not _bypasses_proxy(host)
+    if proxied:
+        hint += f"；当前设置了代理且 NO_PROXY 未包含 {host}，请求会经过代理"
+    # 与 OpenAI 服务器访问 bridge 的方式一致：Unix socket 不走代理，TCP 遵循代理环境变量
+    transport = httpx.HTTPTransport(uds=sock) if sock else None
+    try:
+        with httpx.Client(transport=transport, trust_env=not sock, timeout=5.0) as client:
+            response = client.get(f"{url}/healthz")
+    except httpx.HTTPError as e:
+        return _check("Bridge 连通性", "fail", f"无法连接 {target}: {type(e).__name__}: {e}", hint)
+    if response.status_code != 200:
+        return _check("Bridge 连通性", "fail", f"{target}/healthz 返回 HTTP {response.status_code}", hint)
+    return _check("Bridge 连通性", "pass", f"{target} 正常")
+
+
+async def _doctor_warp() -> Tuple[Dict[str, str], Optional[float]]:
+    """Warp reachability, plus the local clock's offset from Warp's Date header (None if unknown)."""
+    import time
+    from email.utils import parsedate_to_datetime
+    import httpx
+    from warp2protobuf.config.settings import WARP_URL
+
+    parts = urlsplit(WARP_URL)
+    origin = f"{parts.scheme}://{parts.netloc}"
+    insecure = _env("WARP_INSECURE_TLS").lower() in ("1", "true", "yes")
+    try:
+        async with httpx.AsyncClient(trust_env=True, verify=not insecure, timeout=10.0) as client:
+            start = time.time()
+            response = await client.get(origin + "/")
+            local = (start + time.time()) / 2
+    except httpx.ProxyError as e:
+        return _check("Warp 连通性", "fail", f"经代理连接 {origin} 失败: {e}", PROXY_HINT), None
+    except httpx.HTTPError as e:
+        hint = "检查网络、防火墙与 DNS；需要代理才能访问外网时设置 HTTPS_PROXY"
+        if "CERTIFICATE" in str(e).upper():
+            hint = "TLS 证书校验失败（常见于企业代理做 HTTPS 解密）：安装代理的根证书，或临时设置 WARP_INSECURE_TLS=true"
+        return _check("Warp 连通性", "fail", f"无法连接 {origin}: {type(e).__name__}: {e}", hint), None
+    check = _check("Warp 连通性", "pass", f"{origin} 可访问 (HTTP {response.status_code}, {(time.time() - start) * 1000:.0f}ms)")
+    try:
+        return check, local - parsedate_to_datetime(response.headers["date"]).timestamp()
+    except (KeyError, TypeError, ValueError):
+        return check, None
+
+
+def _doctor_clock(skew: Optional[float]) -> Dict[str, str]:
+    if skew is None:
+        return _check("时钟偏差", "skip", "无法从 Warp 获取服务器时间")
+    detail = f"本机时钟比 Warp {'快' if skew > 0 else '慢'} {abs(skew):.0f}s"
+    hint = "启用 NTP 时间同步（如 timedatectl set-ntp true）；时钟偏差会导致 JWT 被误判为过期或未生效"
+    # Date 头只精确到秒，再算上网络往返，几秒以内的偏差都不可靠
+    if abs(skew) > 300:
+        return _check("时钟偏差", "fail", detail, hint)
+    if abs(skew) > 30:
+        return _check("时钟偏差", "warn", detail, hint)
+    return _check("时钟偏差", "pass", detail)
+
+
+def _doctor_proxy() -> Dict[str, str]:
+    import socket
+
+    proxies = {k: v for k, v in _proxy_env().items() if k != "NO_PROXY" and v}
+    if not proxies:
+        return _check("出站代理", "pass", "未设置 HTTP_PROXY / HTTPS_PROXY / ALL_PROXY，直接连接")
+    problems: List[str] = []
+    shown: List[str] = []
+    for name, url in proxies.items():
+        parts = urlsplit(url if "://" in url else f"http://{url}")
+        # 只显示主机和端口，代理地址中可能带有账号密码
+        port = parts.port or (1080 if parts.scheme.startswith("socks") else 8080)
+        address = f"{parts.hostname}:{port}"
+        shown.append(f"{name}={parts.scheme}://{address}")
+        try:
+            socket.create_connection((parts.hostname, port), timeout=3).close()
+        except (OSError, TypeError) as e:
+            problems.append(f"{name} 代理 {address} 无法连接: {e}")
+    if problems:
+        return _check("出站代理", "fail", "; ".join(problems), PROXY_HINT)
+    local = [h for h in ("127.0.0.1", "localhost") if not _bypasses_proxy(h)]
+    if local:
+        return _check("出站代理", "warn", f"{', '.join(shown)}；NO_PROXY 未包含 {', '.join(local)}",
+                      "在 NO_PROXY 中加入 127.0.0.1,localhost，避免 OpenAI 服务器到 bridge 的请求经过代理")
+    return _check("出站代理", "pass", ", ".join(shown))
+
+
+def _module_installed(name: str) -> bool:
+    import importlib.util
+
+    try:
+        return importlib.util.find_spec(name) is not None
+    except ImportError:
+        return False
+
+
+def _doctor_extras() -> Dict[str, str]:
+    extras = [e for e in OPTIONAL_EXTRAS if e[0] != "windows" or sys.platform == "win32"]
+    missing = [(extra, purpose, needed()) for extra, module, purpose, needed in extras if not _module_installed(module)]
+    if not missing:
+        return _check("可选依赖", "pass", "全部已安装")
+    detail = "未安装: " + ", ".join(f"{extra}（{purpose}）" for extra, purpose, _ in missing)
+    required = [extra for extra, _, needed in missing if needed]
+    if required:
+        return _check("可选依赖", "warn", detail + f"；当前配置需要 {', '.join(required)}",
+                      f"pip install 'warp2api[{','.join(required)}]'")
+    return _check("可选依赖", "pass", detail)
+
+
+async def _run_doctor(offline: bool) -> List[Dict[str, str]]:
+    from warp2protobuf.config.config_file import ConfigFileError, apply_config_file
+
+    try:
+        apply_config_file()
+    except ConfigFileError as e:
+        # 配置文件本身无法解析时，其余检查都没有意义
+        return [_check("配置", "fail", str(e), "修正配置文件（WARP2API_CONFIG / --config）的格式")]
+    results = [_doctor_config()]
+    if offline:
+        results.append(_check("Token 刷新", "skip", "--offline"))
+    else:
+        results.append(await _doctor_token())
+    results.append(_doctor_bridge())
+    if offline:
+        results += [_check("Warp 连通性", "skip", "--offline"), _check("时钟偏差", "skip", "--offline")]
+    else:
+        warp, skew = await _doctor_warp()
+        results += [warp, _doctor_clock(skew)]
+    results.append(_doctor_proxy())
+    results.append(_doctor_extras())
+    if not offline:
+        from warp2protobuf.warp.http_client import close_warp_http_client
+        await close_warp_http_client()
+    return results
+
+
+def cmd_doctor(args: argparse.Namespace) -> int:
+    _apply_config_flags(args)
+    results = asyncio.run(_run_doctor(args.offline))
+    if args.json:
+        print(json.dumps(results, ensure_ascii=False, indent=2))
+    else:
+        width = max(_display_width(r["name"]) for r in results)
+        for r in results:
+            pad = " " * (width - _display_width(r["name"]))
+            print(f"{DOCTOR_MARKS[r['status']]} {r['name']}{pad}  {r['detail']}")
+            if r["hint"] and r["status"] in ("warn", "fail"):
+                print(f"  {'':<{width}}  → {r['hint']}")
+        failed = sum(r["status"] == "fail" for r in results)
+        print(f"\n{failed} 项失败" if failed else "\n全部检查通过")
+    return 1 if any(r["status"] == "fail" for r in results) else 0
+
+
+def _ask(prompt: str, default: str = "", assume_yes: bool = False) -> str:
+    if assume_yes:
+        return default
+    answer = input(f"{prompt} [{default}]: " if default else f"{prompt}: ").strip()
+    return answer or default
+
+
+def _confirm(prompt: str, default: bool, assume_yes: bool = False) -> bool:
+    answer = _ask(f"{prompt} ({'Y/n' if default else 'y/N'})", "", assume_yes).lower()
+    return default if not answer else answer in ("y", "yes", "是")
+
+
+def _init_refresh_token(assume_yes: bool) -> str:
+    import getpass
+
+    current = os.getenv("WARP_REFRESH_TOKEN", "").strip()
+    if assume_yes:
+        return current
+    print("Warp refresh token：在已登录的 Warp 客户端中获取，留空则使用匿名token（额度有限）")
+    while True:
+        token = getpass.getpass("WARP_REFRESH_TOKEN（输入不回显）: ").strip() or current
+        if not token or not _confirm("现在向 Warp 验证该 token", True):
+            return token
+        from warp2protobuf.core.auth import refresh_jwt_token
+        if asyncio.run(refresh_jwt_token(token)).get("access_token"):
+            print("✓ token 刷新成功")
+            return token
+        print("✗ token 刷新失败（已失效，或网络 / 代理有问题，可稍后运行 warp2api doctor 排查）")
+        if _confirm("仍然写入该 token", False):
+            return token
+
+
+def _init_port(prompt: str, default: int, assume_yes: bool) -> int:
+    while True:
+        value = _ask(prompt, str(default), assume_yes)
+        if value.isdigit() and 0 < int(value) < 65536:
+            return int(value)
+        print(f"无效端口: {value}")
+
+
+def _init_keys(assume_yes: bool) -> List[Dict[str, Any]]:
+    import secrets
+
+    names = _ask("为不同客户端额外生成的命名 API key（逗号分隔的名称，留空跳过）", "", assume_yes)
+    return [{"key": f"sk-{secrets.token_urlsafe(24)}", "name": n.strip()} for n in names.split(",") if n.strip()]
+
+
+def _init_model_map(assume_yes: bool) -> Dict[str, str]:
+    from warp2protobuf.config.models import get_all_unique_models
+
+    if assume_yes:
+        return {}
+    known = sorted(m["id"] for m in get_all_unique_models())
+    print(f"模型映射：把客户端使用的模型名映射到 Warp 模型（可用: {', '.join(known)}）")
+    model_map: Dict[str, str] = {}
+    while True:
+        pair = _ask("别名=模型（如 gpt-4o-mini=claude-4-sonnet，留空结束）")
+        if not pair:
+            return model_map
+        alias, _, target = (p.strip() for p in pair.partition("="))
+        if not alias or not target:
+            print("格式应为 别名=模型")
+            continue
+        if target not in known and not _confirm(f"{target} 不在已知模型中，Warp 会按 auto 处理，仍然使用", False):
+            continue
+        model_map[alias] = target
+
+
+def _init_output_format(path: str) -> str:
+    """Checked before any prompt, so an unwritable format doesn't cost the user a whole session."""
+    suffix = os.path.splitext(path)[1].lower()
+    if suffix == ".json":
+        return "json"
+    if suffix not in (".yaml", ".yml"):
+        raise SystemExit(f"init 只能写入 .yaml / .yml / .json 配置: {path}")
+    try:
+        import yaml  # noqa: F401
+    except ImportError:
+        raise SystemExit("写入 YAML 配置需要 PyYAML (pip install pyyaml)，或改用 --output config.json")
+    return "yaml"
+
+
+def _write_config(path: str, data: Dict[str, Any]) -> None:
+    if _init_output_format(path) == "yaml":
+        import yaml
+        text = "# 由 warp2api init 生成；全部配置项见 config.example.yaml\n" + \
+            yaml.safe_dump(data, allow_unicode=True, sort_keys=False)
+    else:
+        text = json.dumps(data, ensure_ascii=False, indent=2) + "\n"
+    # 文件中含有凭据，只允许所有者读写
+    fd = os.open(path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+    with os.fdopen(fd, "w", encoding="utf-8") as f:
+        f.write(text)
+    os.chmod(path, 0o600)
+
+
+def cmd_init(args: argparse.Namespace) -> int:
+    import pathlib
+    import secrets
+    from warp2protobuf.config.config_file import ConfigFileError, apply_config_file
+    from warp2protobuf.config.validation import validate_config
+
+    yes = args.yes
+    _init_output_format(args.output)
+    if os.path.exists(args.output) and not args.force and not _confirm(f"{args.output} 已存在，覆盖", False, yes):
+        print("已取消", file=sys.stderr)
+        return 1
+    try:
+        refresh_token = _init_refresh_token(yes)
+        host = _ask("OpenAI 兼容服务器监听地址（0.0.0.0 允许其他机器访问）", "127.0.0.1", yes)
+        port = _init_port("OpenAI 兼容服务器端口", 28889, yes)
+        bridge_port = _init_port("桥接服务器端口", 28888, yes)
+        api_token = _ask("客户端使用的 API token（留空自动生成）", "", yes) or f"sk-{secrets.token_urlsafe(24)}"
+        admin_token = secrets.token_urlsafe(24) if _confirm("生成管理端点 (/admin/*) 专用的 admin token", True, yes) else ""
+        keys = _init_keys(yes)
+        model_map = _init_model_map(yes)
+    except (EOFError, KeyboardInterrupt):
+        print("\n已取消", file=sys.stderr)
+        return 1
+
+    server: Dict[str, Any] = {"host": host, "api_token": api_token}
+    if port != 28889:
+        # 端口只能通过 --port 或 listen 指定，写入 listen 后启动时无需再带参数
+        server["listen"] = [f"[{host}]:{port}" if ":" in host else f"{host}:{port}"]
+    if admin_token:
+        server["admin_token"] = admin_token
+    data: Dict[str, Any] = {"server": server, "bridge": {"url": f"http://127.0.0.1:{bridge_port}", "transport": "http"}}
+    if refresh_token:
+        data["warp"] = {"refresh_token": refresh_token}
+    if keys:
+        data["keys"] = keys
+    if model_map:
+        data["model_map"] = model_map
+    _write_config(args.output, data)
+    print(f"\n已写入 {args.output}（权限 600）")
+
+    errors: List[str] = []
+    warnings: List[str] = []
+    try:
+        # 环境变量和 .env 的优先级高于配置文件，校验的是实际生效的合并结果
+        apply_config_file(pathlib.Path(args.output), force=True)
+        for role in ("bridge", "openai"):
+            role_errors, role_warnings = validate_config(role)
+            errors += [e for e in role_errors if e not in errors]
+            warnings += [w for w in role_warnings if w not in warnings]
+    except ConfigFileError as e:
+        errors.append(str(e))
+    for w in warnings:
+        print(f"! {w}")
+    for e in errors:
+        print(f"✗ {e}")
+    print(f"\nAPI token: {api_token}")
+    for key in keys:
+        print(f"API key {key['name']}: {key['key']}")
+    start = f"warp2api all --config {args.output}" + (f" --bridge-port {bridge_port}" if bridge_port != 28888 else "")
+    print(f"\n启动: {start}\n检查: warp2api doctor --config {args.output}")
+    return 1 if errors else 0
+
+
+def build_parser() -> argparse.ArgumentParser:
+    parser = argparse.ArgumentParser(prog="warp2api", description="Warp2Api 命令行工具")
+    sub = parser.add_subparsers(dest="command", required=True)
+    config_flags = _config_flag_parser()
+
+    p_bridge = sub.add_parser("bridge", parents=[config_flags], help="启动 protobuf 桥接服务器")
+    p_bridge.add_argument("--port", type=int, default=28888, help="监听端口 (默认: 28888)")
+    p_bridge.add_argument("--socket", default=None, help="监听Unix domain socket路径（默认读取 BRIDGE_SOCKET）")
+    p_bridge.set_defaults(func=cmd_bridge)
+
+    p_serve = sub.add_parser("serve", parents=[config_flags], help="启动 OpenAI 兼容服务器")
+    p_serve.add_argument("--port", type=int, default=28889, help="监听端口 (默认: 28889)")
+    p_serve.set_defaults(func=cmd_serve)
+
+    p_all = sub.add_parser("all", parents=[config_flags], help="在同一进程中同时启动两个服务器")
+    p_all.add_argument("--port", type=int, default=28889, help="OpenAI 兼容服务器端口 (默认: 28889)")
+    p_all.add_argument("--bridge-port", type=int, default=28888, help="桥接服务器端口 (默认: 28888)")
+    p_all.add_argument("--socket", default=None, help="桥接服务器改为监听该Unix domain socket")
+    p_all.set_defaults(func=cmd_all)
+
+    for p_server in (p_bridge, p_serve, p_all):
+        p_server.add_argument("--daemon", action="store_true", help="检查配置后转入后台运行（仅 Unix；Windows 请用 service）")
+        p_server.add_argument("--pidfile", default=None, help="--daemon 的 pid 文件 (默认: logs/warp2api-<命令>.pid)")
+
+    p_stop = sub.add_parser("stop", help="停止 --daemon 启动的后台实例（按 pid 文件）")
+    p_stop.add_argument("target", nargs="?", choices=["all", "bridge", "serve"], default="all", help="启动时的命令 (默认: all)")
+    p_stop.add_argument("--pidfile", default=None, help="pid 文件（与启动时的 --pidfile 相同）")
+    p_stop.add_argument("--timeout", type=float, default=90.0, help="等待进程退出的秒数 (默认: 90)")
+    p_stop.set_defaults(func=cmd_stop)
+
+    p_status = sub.add_parser("status", help="查看 --daemon 启动的后台实例是否在运行")
+    p_status.add_argument("target", nargs="?", choices=["all", "bridge", "serve"], default="all", help="启动时的命令 (默认: all)")
+    p_status.add_argument("--pidfile", default=None, help="pid 文件（与启动时的 --pidfile 相同）")
+    p_status.set_defaults(func=cmd_status)
+
+    p_service = sub.add_parser("service", help="安装 / 管理 Windows 服务（开机启动，注销后继续运行；需要 pywin32）")
+    p_service.add_argument("action", choices=["install", "remove", "start", "stop", "status"])
+    p_service.add_argument("--name", default="Warp2Api", help="服务名 (默认: Warp2Api)")
+    p_service.add_argument("--config", default=None, help="install: 服务使用的配置文件")
+    p_service.add_argument("--profile", default=None, help="install: 配置文件中的 profile")
+    p_service.add_argument("--port", type=int, default=28889, help="install: OpenAI 兼容服务器端口 (默认: 28889)")
+    p_service.add_argument("--bridge-port", type=int, default=28888, help="install: 桥接服务器端口 (默认: 28888)")
+    p_service.add_argument("--manual", action="store_true", help="install: 手动启动（默认随 Windows 自动启动）")
+    p_service.set_defaults(func=cmd_service)
+
+    p_chat = sub.add_parser("chat", parents=[config_flags], help="在终端中与代理对话（交互式 REPL）")
+    p_chat.add_argument("-m", "--model", default=DEFAULT_CHAT_MODEL, help=f"模型 (默认: {DEFAULT_CHAT_MODEL})，可用 /model 切换")
+    p_chat.add_argument("--url", default=DEFAULT_OPENAI_URL, help=f"OpenAI 兼容服务器地址 (默认: {DEFAULT_OPENAI_URL})")
+    p_chat.add_argument("--api-key", default=None, help="API key（默认读取 API_TOKEN）")
+    p_chat.add_argument("--inprocess", action="store_true", help="不连接已运行的服务器，在当前进程中启动服务（桥接同样进程内调用）")
+    p_chat.add_argument("--system", default=None, help="系统提示")
+    p_chat.add_argument("--no-stream", action="store_true", help="关闭流式输出，等待完整回复")
+    p_chat.set_defaults(func=cmd_chat)
+
+    p_bench = sub.add_parser("bench", parents=[config_flags], help="向代理发送合成请求，报告吞吐、TTFT 和延迟分位数")
+    p_bench.add_argument("-c", "--concurrency", type=int, default=4, help="并发请求数 (默认: 4)")
+    p_bench.add_argument("-n", "--requests", type=int, default=20, help="请求总数 (默认: 20)")
+    p_bench.add_argument("--stream", action="store_true", help="使用流式请求（同时统计首个 token 时间 TTFT）")
+    p_bench.add_argument("-m", "--model", default=DEFAULT_CHAT_MODEL, help=f"模型 (默认: {DEFAULT_CHAT_MODEL})")
+    p_bench.add_argument("--prompt", default=DEFAULT_BENCH_PROMPT,
+                         help="请求内容，{i} 替换为请求序号，使每个请求不同、不命中响应缓存")
+    p_bench.add_argument("--max-tokens", type=int, default=None, help="每个请求的 max_tokens")
+    p_bench.add_argument("--timeout", type=float, default=300.0, help="单个请求的读取超时秒数 (默认: 300)")
+    p_bench.add_argument("--url", default=DEFAULT_OPENAI_URL, help=f"OpenAI 兼容服务器地址 (默认: {DEFAULT_OPENAI_URL})")
+    p_bench.add_argument("--api-key", default=None, help="API key（默认读取 API_TOKEN）")
+    p_bench.add_argument("--inprocess", action="store_true", help="在当前进程中启动服务进行测试")
+    p_bench.add_argument("--json", action="store_true", help="以 JSON 输出结果，便于比较多次运行")
+    p_bench.set_defaults(func=cmd_bench)
+
+    p_doctor = sub.add_parser("doctor", parents=[config_flags], help="检查配置、token 刷新、bridge / Warp 连通性、时钟与代理设置")
+    p_doctor.add_argument("--offline", action="store_true", help="跳过需要访问 Warp 的检查（token 刷新、连通性、时钟偏差）")
+    p_doctor.add_argument("--json", action="store_true", help="以 JSON 输出检查结果")
+    p_doctor.set_defaults(func=cmd_doctor)
+
+    p_init = sub.add_parser("init", help="交互式生成配置文件（凭据、端口、API key、模型映射），写入后自动校验")
+    p_init.add_argument("-o", "--output", default="config.yaml", help="输出路径，.yaml / .yml / .json (默认: config.yaml)")
+    p_init.add_argument("--force", action="store_true", help="输出文件已存在时直接覆盖")
+    p_init.add_argument("-y", "--yes", action="store_true", help="不提问，全部使用默认值（refresh token 取自 WARP_REFRESH_TOKEN）")
+    p_init.set_defaults(func=cmd_init)
+
+    p_decode = sub.add_parser("decode", help="离线解码 protobuf 抓包或 JSONL 导出文件")
+    p_decode.add_argument("file", help="输入文件（原始字节 / hex / base64 / SSE文本 / JSONL导出），'-' 表示stdin")
+    p_decode.add_argument("-t", "--type", default=DEFAULT_MESSAGE_TYPE, help=f"消息类型 (默认: {DEFAULT_MESSAGE_TYPE})")
+    p_decode.add_argument("--framing", choices=["none", "varint", "sse"], default="none", help="输入分帧方式")
+    p_decode.add_argument("--raw", action="store_true", help="按原始二进制处理，不做 hex/base64/JSONL 自动识别")
+    p_decode.add_argument("--wire", action="store_true", help="不使用schema，输出wire格式字段树")
+    p_decode.add_argument("--emit-defaults", action="store_true", help="输出默认值字段")
+    p_decode.add_argument("--json-names", action="store_true", help="使用lowerCamelCase的JSON字段名")
+    p_decode.add_argument("--compact", action="store_true", help="单行JSON输出")
+    p_decode.set_defaults(func=cmd_decode)
+    return parser
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    args = build_parser().parse_args(argv)
+    return args.func(args)
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -14,14 +14,17 @@ import asyncio
 from protobuf2openai.app import app  # FastAPI app
 
 
-if __name__ == "__main__":
-    import argparse
+def run_openai_server(port: int = 28889, host: str = "") -> None:
+    """检查配置并以阻塞方式运行 OpenAI 兼容服务器
+
+    设置 OPENAI_LISTEN（逗号分隔的多个地址，可含 unix:路径）时同时监听所有地址，忽略 host/port。
+    REUSE_PORT=true 或由 systemd 传入监听socket（LISTEN_FDS）时，可与旧进程并行启动后再停止旧进程，实现无中断重启。
+    """
     import uvicorn
-    
-    # 解析命令行参数
-    parser = argparse.ArgumentParser(description="OpenAI兼容API服务器")
-    parser.add_argument("--port", type=int, default=28889, help="服务器监听端口 (默认: 28889)")
-    args = parser.parse_args()
+
+    # 启动前一次性检查全部配置问题
+    from warp2protobuf.config.validation import check_config_or_exit
+    check_config_or_exit("openai")
     
     # Refresh JWT on startup before running the server
     try:
@@ -29,9 +32,30 @@ if __name__ == "__main__":
         asyncio.run(_refresh_jwt())
     except Exception:
         pass
-    uvicorn.run(
-        app,
-        host=os.getenv("HOST", "127.0.0.1"),
-        port=args.port,
-        log_level="info",
-    )
+    from warp2protobuf.core.listeners import close_listeners, open_server_sockets, server_tls_files, start_certificate_renewal
+    from warp2protobuf.api.access_log import uvicorn_access_log
+    from protobuf2openai.shutdown import graceful_server
+    certfile, keyfile = server_tls_files()
+    specs, socks = open_server_sockets(os.getenv("OPENAI_LISTEN", ""), host or os.getenv("HOST", "127.0.0.1"), port,
+                                       int(os.getenv("OPENAI_SOCKET_MODE", "600"), 8))
+    try:
+        print(f"OpenAI 兼容服务器监听: {', '.join(s.describe() for s in specs)}")
+        config = uvicorn.Config(app, log_level="info", access_log=uvicorn_access_log(), ssl_certfile=certfile, ssl_keyfile=keyfile)
+        start_certificate_renewal(config, certfile)
+        graceful_server(config).run(sockets=socks)
+    finally:
+        close_listeners(socks, specs)
+
+
+def main() -> None:
+    import argparse
+    
+    # 解析命令行参数
+    parser = argparse.ArgumentParser(description="OpenAI兼容API服务器")
+    parser.add_argument("--port", type=int, default=28889, help="服务器监听端口 (默认: 28889)")
+    args = parser.parse_args()
+    run_openai_server(args.port)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,297 @@
+from __future__ import annotations
+
+import asyncio
+import hmac
+import time
+from contextlib import aclosing
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Optional
+
+from fastapi import APIRouter, Depends, HTTPException, Query, Request
+
+from warp2protobuf.config.config_file import ConfigFileError, get_config_section, loaded_config_path, mask_secret
+from warp2protobuf.core.log_tail import LogFilter
+from warp2protobuf.core.request_context import request_fields
+
+from .logging import logger, log_tail
+from .models import AdminAccountUpdate, AdminKeyUpdate, AdminLimitsUpdate
+from .auth import auth
+from .transport import get_bridge_transport, BridgeError
+from .sse import with_heartbeat, until_event, encode_json, format_sse, SSEStreamingResponse
+from .drain import DRAIN
+from .alerts import ALERTS
+from .audit import audit_log, aggregate_usage, USAGE_GROUPS
+from .load_shed import inflight_limiter
+from .rate_limit import rate_limiter
+from .response_cache import RESPONSE_CACHE
+from .script_hooks import SCRIPT_HOOKS
+from .singleflight import COMPLETIONS_FLIGHT
+from .upstream_queue import UPSTREAM_QUEUE
+from .config import ADMIN_TOKEN, RATE_LIMIT_BY, SSE_HEARTBEAT_INTERVAL, SSE_WRITE_TIMEOUT
+from .config import api_key_enabled, api_key_id, reload_keys_and_model_map, set_api_key_enabled
+
+
+async def authenticate_admin(request: Request) -> None:
+    """Bearer ADMIN_TOKEN; without ADMIN_TOKEN the admin endpoints are not served at all."""
+    if not ADMIN_TOKEN:
+        # API key 属于各个调用方，不能用来排空服务、改动其他 key 或读取日志
+        raise HTTPException(404, "Not Found")
+    authorization = request.headers.get("authorization") or ""
+    token = authorization[7:] if authorization.startswith("Bearer ") else ""
+    if not token or not hmac.compare_digest(token.encode(), ADMIN_TOKEN.encode()):
+        raise HTTPException(401, "Invalid admin key provided", headers={"WWW-Authenticate": "Bearer"})
+    request_fields()["key_id"] = "admin"
+
+
+# 运维端点：运行时配置、账号、API key、用量、缓存、维护模式与限流调整，统一使用管理员密钥
+admin_router = APIRouter(prefix="/admin", dependencies=[Depends(authenticate_admin)])
+
+
+@admin_router.get("/drain")
+async def admin_drain_status():
+    return DRAIN.status()
+
+
+@admin_router.post("/drain")
+async def admin_drain_start(request: Request):
+    """Enter drain mode; optional JSON body {"message": "..."} is returned to rejected callers."""
+    try:
+        body = await request.json()
+    except Exception:
+        body = {}
+    message = body.get("message") if isinstance(body, dict) else None
+    DRAIN.start(message if isinstance(message, str) else "")
+    logger.warning("[OpenAI Compat] 进入维护模式，进行中的请求: %d", DRAIN.active)
+    return DRAIN.status()
+
+
+# POST /admin/undrain 供只能发送 POST 的负载均衡器健康检查 / 运维脚本使用
+@admin_router.delete("/drain")
+@admin_router.post("/undrain")
+async def admin_drain_stop():
+    DRAIN.stop()
+    logger.info("[OpenAI Compat] 退出维护模式")
+    return DRAIN.status()
+
+
+@admin_router.post("/reload")
+async def admin_reload():
+    """Re-read the API keys and the model alias map from the config file without a restart.
+
+    Other settings need a restart; on an invalid file the running keys and aliases stay in effect.
+    """
+    try:
+        sections = await asyncio.to_thread(reload_keys_and_model_map)
+    except ConfigFileError as e:
+        raise HTTPException(400, f"重新加载失败，继续使用原配置: {e}")
+    keys = sections["keys"] or []
+    aliases = sections["model_map"] or {}
+    logger.info("[OpenAI Compat] 已重新加载 keys (%d) 与 model_map (%d)", len(keys), len(aliases))
+    return {
+        "path": str(loaded_config_path()),
+        "keys": [{"id": api_key_id(k), "enabled": api_key_enabled(k)} for k in keys],
+        "model_aliases": aliases,
+    }
+
+
+@admin_router.get("/config")
+async def admin_config():
+    """Effective merged configuration of this process, secrets masked."""
+    from warp2protobuf.config.config_file import effective_config
+    from . import config as cfg
+    return {
+        "config": effective_config(redact=True),
+        # 解析后的实际取值（包含未显式设置时使用的默认值）
+        "runtime": {
+            "bridge_url": cfg.BRIDGE_BASE_URL,
+            "bridge_transport": get_bridge_transport().name,
+            "bridge_socket": cfg.BRIDGE_SOCKET or None,
+            "bridge_token_set": bool(cfg.BRIDGE_TOKEN),
+            "max_choices": cfg.MAX_CHOICES,
+            "http_request_timeout": cfg.HTTP_REQUEST_TIMEOUT,
+            "route_timeouts": cfg.ROUTE_TIMEOUTS,
+            "sse_streaming": cfg.SSE_STREAMING,
+            "sse_heartbeat_interval": cfg.SSE_HEARTBEAT_INTERVAL,
+            "sse_flush_interval_ms": cfg.SSE_FLUSH_INTERVAL_MS,
+            "sse_flush_bytes": cfg.SSE_FLUSH_BYTES,
+            "sse_write_timeout": cfg.SSE_WRITE_TIMEOUT,
+            "model_aliases": sorted(cfg.model_alias_map()),
+            "extra_api_keys": len(cfg.extra_api_keys()),
+            "inflight": inflight_limiter.stats(),
+        },
+    }
+
+
+@admin_router.get("/accounts/usage")
+async def admin_account_usage():
+    """Per Warp account: requests, share, tokens, failures, last use and last upstream error."""
+    try:
+        return await get_bridge_transport().account_usage()
+    except BridgeError as e:
+        raise HTTPException(502, f"bridge_error: {e.detail}")
+
+
+@admin_router.get("/alerts")
+async def admin_alerts():
+    """Alert rules with their latest value, breach start and recent firing / resolved notifications."""
+    return ALERTS.status()
+
+
+@admin_router.get("/upstream_queue")
+async def admin_upstream_queue():
+    """Whether Warp is currently rate limiting us, and the requests waiting for their turn."""
+    return UPSTREAM_QUEUE.status()
+
+
+@admin_router.get("/script_hooks")
+async def admin_script_hooks():
+    """The loaded Lua hook script, its hook functions, limits and call / error / veto counters."""
+    return SCRIPT_HOOKS.status()
+
+
+@admin_router.post("/script_hooks/reload")
+async def admin_script_hooks_reload():
+    """Reload the hook script after editing it; on a load error the previous hooks stay active."""
+    if not SCRIPT_HOOKS.path:
+        raise HTTPException(404, "脚本钩子未启用 (SCRIPT_HOOKS_PATH)")
+    await asyncio.to_thread(SCRIPT_HOOKS.reload)
+    return SCRIPT_HOOKS.status()
+
+
+@admin_router.get("/cache")
+async def admin_cache():
+    """Response cache settings, entry count and hit / miss counters, plus in-flight deduplication."""
+    return dict(RESPONSE_CACHE.status(), dedup=COMPLETIONS_FLIGHT.stats())
+
+
+@admin_router.delete("/cache")
+async def admin_cache_clear():
+    return {"cleared": await RESPONSE_CACHE.clear()}
+
+
+@admin_router.get("/logs/stream")
+async def admin_logs_stream(request: Request, level: str = "", logger_name: str = Query("", alias="logger"), request_id: str = "", q: str = "", backlog: int = 100):
+    """Tail this server's log over SSE: recent matching entries, then live ones (resumable with Last-Event-ID)."""
+    if log_tail is None:
+        raise HTTPException(404, "日志实时查看未启用 (LOG_TAIL_BUFFER=0)")
+    try:
+        log_filter = LogFilter(level=level, logger=logger_name, request_id=request_id, query=q)
+    except ValueError as e:
+        raise HTTPException(400, str(e))
+    last_event_id = request.headers.get("last-event-id", "")
+    after_seq = int(last_event_id) if last_event_id.isdigit() else 0
+
+    async def _frames():
+        async with aclosing(log_tail.follow(log_filter, max(0, min(backlog, 1000)), after_seq)) as entries:
+            async for entry in entries:
+                entry = {k: v for k, v in entry.items() if k != "levelno" and v is not None}
+                yield format_sse(encode_json(entry), event="log", event_id=str(entry["seq"]))
+
+    # 停机时结束流，避免阻塞优雅退出
+    frames = until_event(with_heartbeat(_frames(), SSE_HEARTBEAT_INTERVAL or 15), DRAIN.streams_cut, [])
+    return SSEStreamingResponse(frames, write_timeout=SSE_WRITE_TIMEOUT, headers={"Cache-Control": "no-cache", "X-Accel-Buffering": "no"})
+
+
+@admin_router.get("/usage")
+async def admin_usage(group_by: str = "model", days: int = 7, since: Optional[str] = None, until: Optional[str] = None):
+    """Aggregate the audit ledger: totals, daily series and per model / key / day breakdown."""
+    if audit_log is None:
+        raise HTTPException(404, "审计日志未启用 (AUDIT_LOG_PATH)")
+    if group_by not in USAGE_GROUPS:
+        raise HTTPException(400, f"group_by 必须是 {' / '.join(USAGE_GROUPS)} 之一")
+    try:
+        end = _parse_time(until) if until else time.time()
+        start = _parse_time(since) if since else end - max(1, min(days, 366)) * 86400
+    except ValueError as e:
+        raise HTTPException(400, f"无效的时间参数: {e}")
+    # 账本可能较大，聚合放到线程中执行，避免阻塞事件循环
+    report = await asyncio.to_thread(lambda: aggregate_usage(audit_log.iter_records(start, end), group_by))
+    return {"group_by": group_by, "since": start, "until": end, **report}
+
+
+def _parse_time(value: str) -> float:
+    """Unix seconds or an ISO-8601 date / datetime (UTC when no offset is given)."""
+    try:
+        return float(value)
+    except ValueError:
+        pass
+    parsed = datetime.fromisoformat(value)
+    if parsed.tzinfo is None:
+        parsed = parsed.replace(tzinfo=timezone.utc)
+    return parsed.timestamp()
+
+
+@admin_router.patch("/accounts/{label}")
+async def admin_update_account(label: str, body: AdminAccountUpdate):
+    """Enable / disable a pooled Warp account, change its weight or end its cooldown (until restart)."""
+    try:
+        account = await get_bridge_transport().update_account(label, body.dict(exclude_none=True))
+    except BridgeError as e:
+        raise HTTPException(e.status_code if e.status_code in (400, 404) else 502, f"bridge_error: {e.detail}")
+    logger.warning("[OpenAI Compat] 管理员更新了账号 %s: %s", label, body.dict(exclude_none=True))
+    return account
+
+
+def _key_row(entry: Dict[str, Any]) -> Dict[str, Any]:
+    return {
+        "id": api_key_id(entry),
+        "key": mask_secret(entry["key"]),
+        "enabled": api_key_enabled(entry),
+        "configured_enabled": bool(entry.get("enabled", True)),
+        # 按 key 的设置（prompt_template、pii_scrub 等），不含密钥本身
+        "settings": {k: v for k, v in entry.items() if k not in ("key", "name", "enabled")},
+    }
+
+
+@admin_router.get("/keys")
+async def admin_keys():
+    """The config file's API keys (masked) with their effective enabled state and per-key settings."""
+    rows: List[Dict[str, Any]] = [_key_row(entry) for entry in get_config_section("keys", []) or []]
+    return {"api_token_set": bool(auth.expected_token), "keys": rows}
+
+
+@admin_router.patch("/keys/{key_id}")
+async def admin_update_key(key_id: str, body: AdminKeyUpdate):
+    """Enable / disable an API key until restart (the config file is not changed)."""
+    if not set_api_key_enabled(key_id, body.enabled):
+        raise HTTPException(404, f"API key 不存在: {key_id}")
+    logger.warning("[OpenAI Compat] 管理员%s了 API key %s", "启用" if body.enabled else "停用", key_id)
+    entry = next(e for e in get_config_section("keys", []) or [] if api_key_id(e) == key_id)
+    return _key_row(entry)
+
+
+def _limits() -> Dict[str, Any]:
+    return {
+        "rate_limit": dict(rate_limiter.stats(), enabled=rate_limiter.enabled, by=RATE_LIMIT_BY),
+        "inflight": dict(inflight_limiter.stats(), queue_size=inflight_limiter.queue_size,
+                         queue_timeout=inflight_limiter.queue_timeout),
+        "upstream_queue": {"max_waiting": UPSTREAM_QUEUE.max_waiting, "max_wait": UPSTREAM_QUEUE.max_wait,
+                           "waiting": UPSTREAM_QUEUE.waiting()},
+    }
+
+
+@admin_router.get("/limits")
+async def admin_limits():
+    """Current per-client rate limit, concurrency limit and upstream queue bounds."""
+    return _limits()
+
+
+@admin_router.patch("/limits")
+async def admin_update_limits(body: AdminLimitsUpdate):
+    """Adjust the limiters at runtime (until restart); 0 disables the rate limit / concurrency cap / queue."""
+    changes = body.dict(exclude_none=True)
+    if "rate_limit_rps" in changes or "rate_limit_burst" in changes:
+        rate_limiter.configure(changes.get("rate_limit_rps"), changes.get("rate_limit_burst"))
+    if "inflight_queue_size" in changes:
+        inflight_limiter.queue_size = changes["inflight_queue_size"]
+    if "inflight_queue_timeout" in changes:
+        inflight_limiter.queue_timeout = changes["inflight_queue_timeout"]
+    if "max_in_flight" in changes:
+        inflight_limiter.resize(changes["max_in_flight"])
+    if "upstream_queue_size" in changes:
+        UPSTREAM_QUEUE.max_waiting = changes["upstream_queue_size"]
+    if "upstream_queue_timeout" in changes:
+        UPSTREAM_QUEUE.max_wait = changes["upstream_queue_timeout"]
+    if changes:
+        logger.warning("[OpenAI Compat] 管理员调整了限流设置: %s", changes)
+    return _limits()
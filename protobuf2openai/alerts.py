@@ -0,0 +1,181 @@
+from __future__ import annotations
+
+import asyncio
+import time
+from dataclasses import dataclass, field
+from typing import Any, Dict, List, Optional
+
+import httpx
+
+from .config import (
+    ALERT_INTERVAL, ALERT_FOR_MINUTES, ALERT_COOLDOWN_MINUTES, ALERT_ERROR_RATE_PCT, ALERT_P99_LATENCY_MS,
+    ALERT_MIN_AVAILABLE_ACCOUNTS, ALERT_WEBHOOK_URL,
+)
+from .logging import logger
+from .metrics import openai_metrics
+from .transport import get_bridge_transport
+
+# 评估窗口内 /v1 请求少于该数量时不计算错误率，避免 1/1 = 100% 之类的误报
+MIN_WINDOW_REQUESTS = 10
+
+
+@dataclass
+class AlertRule:
+    name: str
+    description: str
+    threshold: float
+    # 最近一次评估的取值（无数据时为 None）
+    value: Optional[float] = None
+    breached_since: Optional[float] = None
+    firing: bool = False
+    last_notified: float = 0.0
+    history: List[Dict[str, Any]] = field(default_factory=list)
+
+    def status(self) -> Dict[str, Any]:
+        return {
+            "name": self.name,
+            "description": self.description,
+            "threshold": self.threshold,
+            "value": self.value,
+            "breached_since": self.breached_since,
+            "firing": self.firing,
+            "last_notified": self.last_notified or None,
+        }
+
+
+class AlertEvaluator:
+    """Checks error rate, p99 latency and usable Warp accounts every ALERT_INTERVAL seconds.
+
+    A rule fires once its threshold has been breached for ALERT_FOR_MINUTES, is re-sent at
+    most every ALERT_COOLDOWN_MINUTES while it stays breached, and sends "resolved" once.
+    """
+
+    def __init__(self, interval: float, for_seconds: float, cooldown_seconds: float, webhook_url: str):
+        self.interval = interval
+        self.for_seconds = for_seconds
+        self.cooldown_seconds = cooldown_seconds
+        self.webhook_url = webhook_url
+        self.rules: Dict[str, AlertRule] = {}
+        if ALERT_ERROR_RATE_PCT > 0:
+            self.rules["error_rate"] = AlertRule("error_rate", "Percentage of /v1 requests answered with 5xx", ALERT_ERROR_RATE_PCT)
+        if ALERT_P99_LATENCY_MS > 0:
+            self.rules["p99_latency"] = AlertRule("p99_latency", "p99 /v1 request duration in ms (streams: until the last byte)", ALERT_P99_LATENCY_MS)
+        if ALERT_MIN_AVAILABLE_ACCOUNTS > 0:
+            self.rules["available_accounts"] = AlertRule(
+                "available_accounts", "Warp accounts not exhausted / cooling down (alerts when below the threshold)",
+                ALERT_MIN_AVAILABLE_ACCOUNTS,
+            )
+        self._task: Optional[asyncio.Task] = None
+        self._last_requests: Dict[str, float] = {}
+        self._last_latency: Any = None
+
+    @property
+    def enabled(self) -> bool:
+        return self.interval > 0 and bool(self.rules)
+
+    def start(self) -> None:
+        if self.enabled and self._task is None:
+            logger.info("[OpenAI Compat] 告警评估已启用: %s", ", ".join(self.rules))
+            self._task = asyncio.create_task(self._run())
+
+    async def stop(self) -> None:
+        if self._task is not None:
+            self._task.cancel()
+            try:
+                await self._task
+            except asyncio.CancelledError:
+                pass
+            self._task = None
+
+    async def _run(self) -> None:
+        # 首次采样只建立基线
+        self._window_values()
+        while True:
+            await asyncio.sleep(self.interval)
+            try:
+                await self.evaluate()
+            except Exception as e:
+                logger.warning("[OpenAI Compat] 告警评估失败: %s", e)
+
+    def _window_values(self) -> Dict[str, Optional[float]]:
+        """Error rate and p99 over the requests completed since the previous call."""
+        totals: Dict[str, float] = {}
+        for labels, value in openai_metrics.counter_series("openai_http_requests_total"):
+            if labels.get("route", "").startswith("/v1/"):
+                bucket = "error" if labels.get("status", "").startswith("5") else "ok"
+                totals[bucket] = totals.get(bucket, 0) + value
+        previous, self._last_requests = self._last_requests, totals
+        errors = totals.get("error", 0) - previous.get("error", 0)
+        requests = errors + totals.get("ok", 0) - previous.get("ok", 0)
+
+        latency = openai_metrics.merged_histogram(
+            "openai_http_request_duration_seconds", lambda labels: labels.get("route", "").startswith("/v1/"))
+        window = latency.minus(self._last_latency) if latency is not None else None
+        self._last_latency = latency
+        return {
+            "error_rate": round(errors / requests * 100, 2) if requests >= MIN_WINDOW_REQUESTS else None,
+            "p99_latency": round(window.quantile(0.99) * 1000, 1) if window is not None and window.count else None,
+        }
+
+    async def evaluate(self) -> None:
+        values: Dict[str, Optional[float]] = self._window_values()
+        if "available_accounts" in self.rules:
+            try:
+                values["available_accounts"] = (await get_bridge_transport().account_status())["available"]
+            except Exception as e:
+                logger.warning("[OpenAI Compat] 获取账号状态失败: %s", e)
+                values["available_accounts"] = None
+        now = time.time()
+        for name, rule in self.rules.items():
+            rule.value = values.get(name)
+            if rule.value is None:
+                # 无数据：保持当前状态，不计入持续时间也不视为恢复
+                continue
+            breached = rule.value < rule.threshold if name == "available_accounts" else rule.value > rule.threshold
+            if not breached:
+                rule.breached_since = None
+                if rule.firing:
+                    rule.firing = False
+                    await self._notify(rule, "resolved", now)
+                continue
+            if rule.breached_since is None:
+                rule.breached_since = now
+            if now - rule.breached_since < self.for_seconds:
+                continue
+            if not rule.firing or now - rule.last_notified >= self.cooldown_seconds:
+                rule.firing = True
+                await self._notify(rule, "firing", now)
+
+    async def _notify(self, rule: AlertRule, state: str, now: float) -> None:
+        rule.last_notified = now
+        text = f"[warp2api] {rule.name} {state}: {rule.value} (threshold {rule.threshold}) - {rule.description}"
+        if state == "firing":
+            logger.warning("[OpenAI Compat] 告警 %s", text)
+        else:
+            logger.info("[OpenAI Compat] 告警 %s", text)
+        rule.history = (rule.history + [{"state": state, "value": rule.value, "at": now}])[-20:]
+        if not self.webhook_url:
+            return
+        # text 字段兼容 Slack / 飞书等常见 incoming webhook，其余字段供自定义接收方使用
+        payload = {"text": text, "alert": rule.name, "state": state, "value": rule.value,
+                   "threshold": rule.threshold, "breached_since": rule.breached_since, "at": now}
+        try:
+            async with httpx.AsyncClient(timeout=10.0) as client:
+                resp = await client.post(self.webhook_url, json=payload)
+            if resp.status_code >= 400:
+                logger.warning("[OpenAI Compat] 告警 webhook 返回 HTTP %d", resp.status_code)
+        except Exception as e:
+            logger.warning("[OpenAI Compat] 告警 webhook 发送失败: %s", e)
+
+    def status(self) -> Dict[str, Any]:
+        return {
+            "enabled": self.enabled,
+            "interval": self.interval,
+            "for_seconds": self.for_seconds,
+            "cooldown_seconds": self.cooldown_seconds,
+            "webhook": bool(self.webhook_url),
+            "rules": [dict(rule.status(), history=rule.history) for rule in self.rules.values()],
+        }
+
+
+ALERTS = AlertEvaluator(ALERT_INTERVAL, ALERT_FOR_MINUTES * 60, ALERT_COOLDOWN_MINUTES * 60, ALERT_WEBHOOK_URL)
@@ -2,41 +2,227 @@ from __future__ import annotations
 
 import asyncio
 import json
+import logging
+import math
 
-import httpx
-from fastapi import FastAPI
+from fastapi import FastAPI, Request
+from fastapi.responses import JSONResponse
 
-from .logging import logger
+from warp2protobuf.api.access_log import access_log_enabled, install_access_log
+from warp2protobuf.api.client_ip import client_ip
+from warp2protobuf.api.compression import CompressionMiddleware
+from warp2protobuf.core.tracing import install_tracing
+from warp2protobuf.core.memory import memory_watch
+from warp2protobuf.core.request_context import REQUEST_ID_HEADER, accept_request_id, reset_request_id, set_request_id
 
-from .config import BRIDGE_BASE_URL, WARMUP_INIT_RETRIES, WARMUP_INIT_DELAY_S
-from .bridge import initialize_once
+from .logging import logger, log_tail
+from .alerts import ALERTS
+from .response_cache import RESPONSE_CACHE, load_cache_snapshot, save_cache_snapshot
+
+from .config import BRIDGE_BASE_URL, BRIDGE_SOCKET, WARMUP_INIT_RETRIES, WARMUP_INIT_DELAY_S, HTTP_REQUEST_TIMEOUT, ROUTE_TIMEOUTS
+from .config import HTTP_COMPRESSION, HTTP_COMPRESSION_MIN_SIZE, ACCESS_LOG
+from .config import ADMIN_TOKEN, DEBUG_PROFILING
+from .config import RATE_LIMIT_BY
+from .auth import auth
+from .rate_limit import rate_limiter
+from .load_shed import inflight_limiter
+from .recovery import recover
+from .drain import DRAIN, DRAIN_RETRY_AFTER_S
+from .metrics import observe_request
+from .audit import observe_request as audit_observer
+from .bridge import initialize_once, close_sync_client
 from .router import router
+from .admin import admin_router
+from .transport import get_bridge_transport, is_inprocess
 
 
 app = FastAPI(title="OpenAI Chat Completions (Warp bridge) - Streaming")
 app.include_router(router)
+app.include_router(admin_router)
+if DEBUG_PROFILING and ADMIN_TOKEN:
+    from .profiling import debug_router
+    app.include_router(debug_router)
+    logger.warning("[OpenAI Compat] /debug/pprof 已启用（需 ADMIN_TOKEN）")
+
+
+@app.middleware("http")
+async def _route_timeout(request: Request, call_next):
+    # call_next 在响应头发出时即返回：流式响应只受“首包”时间限制，之后可持续任意时长
+    timeout = ROUTE_TIMEOUTS.get(request.url.path, HTTP_REQUEST_TIMEOUT)
+    if timeout <= 0:
+        return await call_next(request)
+    try:
+        return await asyncio.wait_for(call_next(request), timeout=timeout)
+    except asyncio.TimeoutError:
+        logger.warning("[OpenAI Compat] 请求超时 (%.0fs): %s %s", timeout, request.method, request.url.path)
+        return JSONResponse(status_code=504, content={"error": {"message": f"request timed out after {timeout:.0f}s", "type": "timeout"}})
+
+
+@app.middleware("http")
+async def _load_shed(request: Request, call_next):
+    # 超过并发上限时短暂排队，仍无名额则直接 503，避免请求和上游连接在流量高峰时堆积
+    if not inflight_limiter.enabled or not request.url.path.startswith("/v1/"):
+        return await call_next(request)
+    if not await inflight_limiter.acquire():
+        retry_after = max(1, math.ceil(inflight_limiter.queue_timeout))
+        logger.warning("[OpenAI Compat] 并发已满 (%d)，拒绝请求 %s %s", inflight_limiter.max_in_flight, request.method, request.url.path)
+        return JSONResponse(
+            status_code=503,
+            content={"error": {"message": "server is at capacity, please retry", "type": "overloaded_error", "code": "server_overloaded"}},
+            headers={"Retry-After": str(retry_after)},
+        )
+    try:
+        response = await call_next(request)
+    except BaseException:
+        inflight_limiter.release()
+        raise
+    body = response.body_iterator
+
+    async def _release_after_body():
+        # 流式响应在正文发送完毕后才释放名额
+        try:
+            async for chunk in body:
+                yield chunk
+        finally:
+            inflight_limiter.release()
+
+    response.body_iterator = _release_after_body()
+    return response
+
+
+@app.middleware("http")
+async def _rate_limit(request: Request, call_next):
+    # 每个客户端（IP 和/或 API key）独立的令牌桶，避免单个客户端耗尽全部额度
+    if not rate_limiter.enabled or not request.url.path.startswith("/v1/"):
+        return await call_next(request)
+    keys = []
+    if RATE_LIMIT_BY in ("ip", "both"):
+        keys.append(f"ip:{client_ip(request)}")
+    if RATE_LIMIT_BY in ("key", "both"):
+        keys.append(f"key:{auth.identify(request.headers.get('authorization')) or 'anonymous'}")
+    for key in keys:
+        allowed, retry_after = rate_limiter.check(key)
+        if not allowed:
+            logger.warning("[OpenAI Compat] 触发限流 %s (%s %s)", key, request.method, request.url.path)
+            return JSONResponse(
+                status_code=429,
+                content={"error": {"message": f"rate limit exceeded, retry after {retry_after}s", "type": "rate_limit_error", "code": "rate_limit_exceeded"}},
+                headers={"Retry-After": str(retry_after)},
+            )
+    return await call_next(request)
+
+
+# /v1/models、非流式补全等完整JSON响应按 Accept-Encoding 压缩；SSE 流不压缩
+app.add_middleware(CompressionMiddleware, mode=HTTP_COMPRESSION, minimum_size=HTTP_COMPRESSION_MIN_SIZE)
+
+
+@app.middleware("http")
+async def _drain(request: Request, call_next):
+    # 维护模式：新请求直接 503，已在处理中的请求（包括流式输出）照常完成
+    if not request.url.path.startswith("/v1/"):
+        return await call_next(request)
+    if DRAIN.draining:
+        return JSONResponse(
+            status_code=503,
+            content={"error": {"message": DRAIN.message, "type": "overloaded_error", "code": "maintenance"}},
+            headers={"Retry-After": str(DRAIN_RETRY_AFTER_S)},
+        )
+    DRAIN.active += 1
+    try:
+        response = await call_next(request)
+    except BaseException:
+        DRAIN.active -= 1
+        raise
+    body = response.body_iterator
+
+    async def _count_until_sent():
+        try:
+            async for chunk in body:
+                yield chunk
+        finally:
+            DRAIN.active -= 1
+
+    response.body_iterator = _count_until_sent()
+    return response
+
+
+# 未捕获的异常返回与路由协议一致的 500 JSON，而不是框架默认的错误页
+app.middleware("http")(recover)
+
+
+install_access_log(app, "protobuf2openai.access", ACCESS_LOG, observers=[observe_request, audit_observer])
+if log_tail is not None and access_log_enabled(ACCESS_LOG):
+    logging.getLogger("protobuf2openai.access").addHandler(log_tail)
+install_tracing(app, "warp2api-openai")
+
+
+@app.middleware("http")
+async def _request_id(request: Request, call_next):
+    # 最外层中间件（最后注册）：超时等响应也带上 x-request-id，并转发给 bridge / Warp
+    request_id = accept_request_id(request.headers.get(REQUEST_ID_HEADER))
+    request.state.request_id = request_id
+    token = set_request_id(request_id)
+    try:
+        response = await call_next(request)
+    finally:
+        reset_request_id(token)
+    response.headers[REQUEST_ID_HEADER] = request_id
+    return response
+
+
+@app.on_event("startup")
+async def _start_alerts():
+    ALERTS.start()
+    memory_watch.start()
+
+
+@app.on_event("shutdown")
+async def _stop_alerts():
+    await ALERTS.stop()
+
+
+@app.on_event("shutdown")
+async def _close_bridge_clients():
+    await get_bridge_transport().aclose()
+    close_sync_client()
+
+
+@app.on_event("startup")
+async def _load_response_cache():
+    await asyncio.to_thread(load_cache_snapshot)
+
+
+@app.on_event("shutdown")
+async def _save_response_cache():
+    await asyncio.to_thread(save_cache_snapshot)
+    await RESPONSE_CACHE.backend.close()
 
 
 @app.on_event("startup")
 async def _on_startup():
     try:
         logger.info("[OpenAI Compat] Server starting. BRIDGE_BASE_URL=%s", BRIDGE_BASE_URL)
-        logger.info("[OpenAI Compat] Endpoints: GET /healthz, GET /v1/models, POST /v1/chat/completions")
+        logger.info("[OpenAI Compat] Endpoints: GET /healthz, GET /v1/models, POST /v1/chat/completions, GET /admin/config")
     except Exception:
         pass
 
-    url = f"{BRIDGE_BASE_URL}/healthz"
+    if is_inprocess():
+        logger.info("[OpenAI Compat] Using in-process bridge transport; skipping bridge health check")
+        # 同一进程内没有 bridge 的启动钩子，在这里预热到 Warp 的连接
+        from warp2protobuf.warp.http_client import prewarm_connections
+        await prewarm_connections()
+        return
+
+    url = f"unix:{BRIDGE_SOCKET}" if BRIDGE_SOCKET else f"{BRIDGE_BASE_URL}/healthz"
     retries = WARMUP_INIT_RETRIES
     delay_s = WARMUP_INIT_DELAY_S
     for attempt in range(1, retries + 1):
         try:
-            async with httpx.AsyncClient(timeout=5.0, trust_env=True) as client:
-                resp = await client.get(url)
-            if resp.status_code == 200:
+            if await get_bridge_transport().healthz():
                 logger.info("[OpenAI Compat] Bridge server is ready at %s", url)
                 break
             else:
-                logger.warning("[OpenAI Compat] Bridge health at %s -> HTTP %s", url, resp.status_code)
+                logger.warning("[OpenAI Compat] Bridge health at %s -> not ready", url)
         except Exception as e:
             logger.warning("[OpenAI Compat] Bridge health attempt %s/%s failed: %s", attempt, retries, e)
         await asyncio.sleep(delay_s)
@@ -0,0 +1,223 @@
+from __future__ import annotations
+
+import json
+import os
+import sqlite3
+import threading
+import time
+from datetime import datetime, timezone
+from typing import Any, Dict, Iterator, Optional
+
+from warp2protobuf.core.metrics import route_label
+
+from .config import AUDIT_LOG_PATH, AUDIT_RETENTION_DAYS
+from .logging import logger
+
+# 账本字段（顺序即 SQLite 列顺序）
+AUDIT_FIELDS = (
+    "ts", "request_id", "key_id", "route", "model", "stream", "status", "prompt_tokens",
+    "completion_tokens", "latency_ms", "account", "finish_reason", "error",
+)
+
+_SQLITE_SUFFIXES = (".db", ".sqlite", ".sqlite3")
+
+
+class AuditLog:
+    """Append-only ledger of completed API requests; the source for usage reporting."""
+
+    def record(self, entry: Dict[str, Any]) -> None:
+        raise NotImplementedError
+
+    def iter_records(self, since: Optional[float] = None, until: Optional[float] = None) -> Iterator[Dict[str, Any]]:
+        raise NotImplementedError
+
+    def close(self) -> None:
+        pass
+
+
+class JSONLinesAuditLog(AuditLog):
+    """One JSON object per line, appended to a file (easy to ship to a log pipeline)."""
+
+    def __init__(self, path: str):
+        self.path = path
+        self._lock = threading.Lock()
+        self._file = open(path, "a", encoding="utf-8")
+
+    def record(self, entry: Dict[str, Any]) -> None:
+        line = json.dumps(entry, ensure_ascii=False, default=str)
+        with self._lock:
+            self._file.write(line + "\n")
+            self._file.flush()
+
+    def iter_records(self, since: Optional[float] = None, until: Optional[float] = None) -> Iterator[Dict[str, Any]]:
+        with open(self.path, "r", encoding="utf-8") as f:
+            for line in f:
+                try:
+                    entry = json.loads(line)
+                except ValueError:
+                    continue
+                ts = entry.get("ts") or 0
+                if (since is None or ts >= since) and (until is None or ts < until):
+                    yield entry
+
+    def close(self) -> None:
+        with self._lock:
+            self._file.close()
+
+
+class SQLiteAuditLog(AuditLog):
+    """SQLite ledger with age-based retention (indexed by time, key and model for aggregation)."""
+
+    def __init__(self, path: str, retention_days: float = 0):
+        self.path = path
+        self.retention_seconds = retention_days * 86400
+        self._lock = threading.Lock()
+        self._last_prune = 0.0
+        self._conn = sqlite3.connect(path, check_same_thread=False)
+        self._conn.execute("PRAGMA journal_mode=WAL")
+        self._conn.execute(
+            "CREATE TABLE IF NOT EXISTS audit ("
+            " id INTEGER PRIMARY KEY,"
+            " ts REAL NOT NULL, request_id TEXT, key_id TEXT, route TEXT, model TEXT, stream INTEGER,"
+            " status INTEGER, prompt_tokens INTEGER, completion_tokens INTEGER, latency_ms REAL,"
+            " account TEXT, finish_reason TEXT, error TEXT)"
+        )
+        self._conn.execute("CREATE INDEX IF NOT EXISTS idx_audit_ts ON audit(ts)")
+        self._conn.execute("CREATE INDEX IF NOT EXISTS idx_audit_key ON audit(key_id, ts)")
+        self._conn.execute("CREATE INDEX IF NOT EXISTS idx_audit_model ON audit(model, ts)")
+        self._conn.commit()
+
+    def record(self, entry: Dict[str, Any]) -> None:
+        values = [entry.get(name) for name in AUDIT_FIELDS]
+        with self._lock:
+            self._conn.execute(
+                f"INSERT INTO audit ({', '.join(AUDIT_FIELDS)}) VALUES ({', '.join('?' * len(AUDIT_FIELDS))})", values
+            )
+            now = time.time()
+            if self.retention_seconds > 0 and now - self._last_prune > 3600:
+                # 每小时最多清理一次过期记录
+                self._conn.execute("DELETE FROM audit WHERE ts < ?", (now - self.retention_seconds,))
+                self._last_prune = now
+            self._conn.commit()
+
+    def iter_records(self, since: Optional[float] = None, until: Optional[float] = None) -> Iterator[Dict[str, Any]]:
+        query = f"SELECT {', '.join(AUDIT_FIELDS)} FROM audit WHERE ts >= ? AND ts < ? ORDER BY ts"
+        with self._lock:
+            rows = self._conn.execute(query, (since or 0, until or float("inf"))).fetchall()
+        for row in rows:
+            entry = dict(zip(AUDIT_FIELDS, row))
+            entry["stream"] = bool(entry["stream"])
+            yield entry
+
+    def close(self) -> None:
+        with self._lock:
+            self._conn.close()
+
+
+def open_audit_log(path: str, retention_days: float) -> Optional[AuditLog]:
+    """SQLite for *.db / *.sqlite paths, JSON lines otherwise; failures are logged and auditing stays off."""
+    if not path:
+        return None
+    try:
+        if path.lower().endswith(_SQLITE_SUFFIXES):
+            sink: AuditLog = SQLiteAuditLog(path, retention_days)
+        else:
+            sink = JSONLinesAuditLog(path)
+        logger.info("[OpenAI Compat] 请求审计日志: %s", path)
+        return sink
+    except Exception as e:
+        logger.warning("[OpenAI Compat] 无法打开审计日志 %s: %s", path, e)
+        return None
+
+
+audit_log = open_audit_log(os.path.expanduser(AUDIT_LOG_PATH), AUDIT_RETENTION_DAYS)
+
+
+def observe_request(request: Any, status: int, latency: float, fields: Dict[str, Any]) -> None:
+    """Access-log observer: one ledger entry per completed /v1 request."""
+    if audit_log is None or not request.url.path.startswith("/v1/") or request.method == "GET":
+        return
+    error = fields.get("error")
+    if error is None and status >= 400:
+        error = f"HTTP {status}"
+    now = time.time()
+    audit_log.record({
+        "ts": now,
+        "time": datetime.fromtimestamp(now, timezone.utc).isoformat(timespec="milliseconds"),
+        "request_id": getattr(request.state, "request_id", None),
+        "key_id": fields.get("key_id"),
+        "route": route_label(request),
+        "model": fields.get("model"),
+        "stream": bool(fields.get("stream")),
+        "status": status,
+        "prompt_tokens": fields.get("prompt_tokens", 0),
+        "completion_tokens": fields.get("completion_tokens", 0),
+        "latency_ms": round(latency * 1000, 1),
+        "account": fields.get("account"),
+        "finish_reason": fields.get("finish_reason"),
+        "error": error,
+    })
+
+
+USAGE_GROUPS = ("model", "key", "day")
+
+
+def _day(ts: float) -> str:
+    return datetime.fromtimestamp(ts, timezone.utc).strftime("%Y-%m-%d")
+
+
+def _new_totals() -> Dict[str, Any]:
+    return {"requests": 0, "errors": 0, "prompt_tokens": 0, "completion_tokens": 0, "total_tokens": 0, "latency_ms": 0.0}
+
+
+def _add(totals: Dict[str, Any], entry: Dict[str, Any]) -> None:
+    prompt = entry.get("prompt_tokens") or 0
+    completion = entry.get("completion_tokens") or 0
+    totals["requests"] += 1
+    totals["errors"] += 1 if entry.get("error") else 0
+    totals["prompt_tokens"] += prompt
+    totals["completion_tokens"] += completion
+    totals["total_tokens"] += prompt + completion
+    totals["latency_ms"] += entry.get("latency_ms") or 0
+
+
+def _finish(totals: Dict[str, Any]) -> Dict[str, Any]:
+    # 累加的是总耗时，输出时换成平均值
+    latency = totals.pop("latency_ms")
+    totals["avg_latency_ms"] = round(latency / totals["requests"], 1) if totals["requests"] else 0
+    return totals
+
+
+def aggregate_usage(records: Iterator[Dict[str, Any]], group_by: str) -> Dict[str, Any]:
+    """Totals, per-group totals and daily (UTC) series for each group, from ledger entries."""
+    totals = _new_totals()
+    series: Dict[str, Dict[str, Any]] = {}
+    groups: Dict[str, Dict[str, Any]] = {}
+    group_series: Dict[str, Dict[str, Dict[str, Any]]] = {}
+    for entry in records:
+        day = _day(entry.get("ts") or 0)
+        if group_by == "day":
+            group = day
+        else:
+            group = entry.get("key_id" if group_by == "key" else "model") or "unknown"
+        _add(totals, entry)
+        _add(series.setdefault(day, _new_totals()), entry)
+        _add(groups.setdefault(group, _new_totals()), entry)
+        if group_by != "day":
+            _add(group_series.setdefault(group, {}).setdefault(day, _new_totals()), entry)
+
+    out_groups = []
+    for group, group_totals in groups.items():
+        item: Dict[str, Any] = {group_by: group, **_finish(group_totals)}
+        if group_by != "day":
+            item["series"] = [{"day": day, **_finish(t)} for day, t in sorted(group_series[group].items())]
+        out_groups.append(item)
+    if group_by == "day":
+        out_groups.sort(key=lambda item: item["day"])
+    else:
+        out_groups.sort(key=lambda item: (-item["total_tokens"], -item["requests"]))
+    return {
+        "totals": _finish(totals),
+        "series": [{"day": day, **_finish(t)} for day, t in sorted(series.items())],
+        "groups": out_groups,
+    }
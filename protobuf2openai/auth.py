@@ -5,6 +5,11 @@ from typing import Optional
 from fastapi import HTTPException, Request, status
 from fastapi.responses import JSONResponse
 
+from warp2protobuf.core.request_context import request_fields
+from warp2protobuf.core.tracing import traced
+
+from .config import extra_api_keys, extra_api_key_ids
+
 
 class BearerTokenAuth:
     """Bearer Token 认证中间件"""
@@ -18,13 +23,24 @@ class BearerTokenAuth:
         """
         self.expected_token = expected_token or os.getenv("API_TOKEN")
 
-        # 如果没有设置token，强制要求设置
-        if not self.expected_token:
+        # 如果没有设置token，强制要求设置（配置文件提供了 keys 时也可以只用 keys）
+        if not self.expected_token and not extra_api_keys():
             print("❌ 错误: 未设置 API_TOKEN 环境变量，API将被锁定")
             print("   请在 .env 文件中设置: API_TOKEN=001")
             print("   或设置环境变量: export API_TOKEN=001")
             self.expected_token = None  # 强制为None，确保认证失败
 
+    def identify(self, authorization: Optional[str]) -> Optional[str]:
+        """Key id of a valid Bearer token ("api_token" or the keys entry name), None when invalid."""
+        if not authorization or not authorization.startswith("Bearer "):
+            return None
+        token = authorization[7:]
+        if not token:
+            return None
+        if token == self.expected_token:
+            return "api_token"
+        return extra_api_key_ids().get(token)
+
     def authenticate(self, authorization: Optional[str]) -> bool:
         """
         验证Bearer token
@@ -35,10 +51,6 @@ class BearerTokenAuth:
         Returns:
             bool: 验证是否通过
         """
-        # 如果没有设置预期的token，拒绝所有请求
-        if not self.expected_token:
-            return False
-
         if not authorization:
             return False
 
@@ -47,7 +59,12 @@ class BearerTokenAuth:
             return False
 
         token = authorization[7:]  # 移除 "Bearer " 前缀
-        return token == self.expected_token
+        if not token:
+            return False
+        if token == self.expected_token:
+            return True
+        # 配置文件 keys 段中的附加密钥
+        return token in extra_api_keys()
 
     def get_auth_error_response(self) -> JSONResponse:
         """获取认证失败的响应"""
@@ -68,6 +85,7 @@ class BearerTokenAuth:
 auth = BearerTokenAuth()
 
 
+@traced("auth.api_key")
 async def authenticate_request(request: Request) -> None:
     """
     FastAPI中间件函数 - 验证请求的认证
@@ -82,12 +100,14 @@ async def authenticate_request(request: Request) -> None:
     authorization = request.headers.get("authorization") or request.headers.get("Authorization")
 
     # 验证token
-    if not auth.authenticate(authorization):
+    key_id = auth.identify(authorization)
+    if key_id is None:
         raise HTTPException(
             status_code=status.HTTP_401_UNAUTHORIZED,
             detail="Invalid API key provided",
             headers={"WWW-Authenticate": "Bearer"}
         )
+    request_fields()["key_id"] = key_id
 
 
 def require_auth(func):
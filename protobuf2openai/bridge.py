@@ -5,11 +5,14 @@ import time
 import uuid
 from typing import Any, Dict, Optional
 
-import requests
+import httpx
 from .logging import logger
 
 from .config import (
     BRIDGE_BASE_URL,
+    BRIDGE_TRANSPORT,
+    BRIDGE_SOCKET,
+    bridge_headers,
     FALLBACK_BRIDGE_URLS,
     WARMUP_INIT_RETRIES,
     WARMUP_INIT_DELAY_S,
@@ -20,6 +23,25 @@ from .packets import packet_template
 from .state import STATE, ensure_tool_ids
 
 
+_sync_http: Optional[httpx.Client] = None
+
+
+def _sync_client() -> httpx.Client:
+    """Keep-alive client for the synchronous warmup calls, shared instead of built per call."""
+    global _sync_http
+    if _sync_http is None or _sync_http.is_closed:
+        transport = httpx.HTTPTransport(uds=BRIDGE_SOCKET) if BRIDGE_SOCKET else None
+        _sync_http = httpx.Client(timeout=httpx.Timeout(180.0, connect=5.0), transport=transport, trust_env=not BRIDGE_SOCKET)
+    return _sync_http
+
+
+def close_sync_client() -> None:
+    global _sync_http
+    if _sync_http is not None:
+        _sync_http.close()
+    _sync_http = None
+
+
 def bridge_send_stream(packet: Dict[str, Any]) -> Dict[str, Any]:
     last_exc: Optional[Exception] = None
     for base in FALLBACK_BRIDGE_URLS:
@@ -31,7 +53,7 @@ def bridge_send_stream(packet: Dict[str, Any]) -> Dict[str, Any]:
                 logger.info("[OpenAI Compat] Bridge request payload: %s", json.dumps(wrapped_packet, ensure_ascii=False))
             except Exception:
                 logger.info("[OpenAI Compat] Bridge request payload serialization failed for URL %s", url)
-            r = requests.post(url, json=wrapped_packet, timeout=(5.0, 180.0))
+            r = _sync_client().post(url, json=wrapped_packet, headers=bridge_headers())
             if r.status_code == 200:
                 try:
                     logger.info("[OpenAI Compat] Bridge response (raw text): %s", r.text)
@@ -58,6 +80,10 @@ def initialize_once() -> None:
     first_task_id = STATE.baseline_task_id or str(uuid.uuid4())
     STATE.baseline_task_id = first_task_id
 
+    if BRIDGE_TRANSPORT == "inprocess":
+        # 同进程模式下 bridge 无需健康检查，会话由首个真实请求建立
+        return
+
     health_urls = [f"{base}/healthz" for base in FALLBACK_BRIDGE_URLS]
     last_err: Optional[str] = None
     for _ in range(WARMUP_INIT_RETRIES):
@@ -66,7 +92,7 @@ def initialize_once() -> None:
             last_err = None
             for h in health_urls:
                 try:
-                    resp = requests.get(h, timeout=5.0)
+                    resp = _sync_client().get(h, timeout=5.0)
                     if resp.status_code == 200:
                         ok = True
                         break
@@ -1,6 +1,17 @@
 from __future__ import annotations
 
+import hashlib
 import os
+from typing import Any, Dict, List, Optional
+
+from warp2protobuf.config.config_file import apply_config_file, get_config_section, reload_config_sections
+from warp2protobuf.config.validation import ensure_valid_values, parse_model_ttls
+from warp2protobuf.core.redaction import reset_secret_literals
+from warp2protobuf.core.request_context import with_request_context
+
+# Config file (WARP2API_CONFIG / config.yaml ...) fills in anything the environment leaves unset
+apply_config_file()
+ensure_valid_values()
 
 BRIDGE_BASE_URL = os.getenv("WARP_BRIDGE_URL", "http://127.0.0.1:28888")
 FALLBACK_BRIDGE_URLS = [
@@ -8,7 +19,243 @@ FALLBACK_BRIDGE_URLS = [
     "http://127.0.0.1:28888",
 ]
 
+# How to reach the bridge: "http" (separate process) or "inprocess" (direct calls, same process)
+BRIDGE_TRANSPORT = os.getenv("WARP_BRIDGE_TRANSPORT", "http").strip().lower()
+
+# Bridge Unix domain socket (must match the bridge's BRIDGE_SOCKET); empty means TCP via WARP_BRIDGE_URL
+BRIDGE_SOCKET = os.getenv("BRIDGE_SOCKET", "")
+
+# Shared secret sent to the bridge (must match the bridge's BRIDGE_TOKEN)
+BRIDGE_TOKEN = os.getenv("BRIDGE_TOKEN", "")
+
+
+def bridge_headers(extra: Optional[Dict[str, str]] = None) -> Dict[str, str]:
+    headers: Dict[str, str] = with_request_context(dict(extra or {}))
+    if BRIDGE_TOKEN:
+        headers["Authorization"] = f"Bearer {BRIDGE_TOKEN}"
+    return headers
+
+# Recent log records kept in memory for GET /admin/logs/stream (0 disables the live tail)
+LOG_TAIL_BUFFER = int(os.getenv("LOG_TAIL_BUFFER", "1000"))
+
+# Alerting: every ALERT_INTERVAL seconds (0 disables) compare the /v1 5xx rate (%), p99 request
+# latency (ms) and the number of usable Warp accounts against their thresholds (0 = rule off); a
+# rule breached for ALERT_FOR_MINUTES is logged and POSTed to ALERT_WEBHOOK_URL, then repeated at
+# most every ALERT_COOLDOWN_MINUTES until it recovers
+ALERT_INTERVAL = float(os.getenv("ALERT_INTERVAL", "60"))
+ALERT_FOR_MINUTES = float(os.getenv("ALERT_FOR_MINUTES", "5"))
+ALERT_COOLDOWN_MINUTES = float(os.getenv("ALERT_COOLDOWN_MINUTES", "30"))
+ALERT_ERROR_RATE_PCT = float(os.getenv("ALERT_ERROR_RATE_PCT", "0"))
+ALERT_P99_LATENCY_MS = float(os.getenv("ALERT_P99_LATENCY_MS", "0"))
+ALERT_MIN_AVAILABLE_ACCOUNTS = int(os.getenv("ALERT_MIN_AVAILABLE_ACCOUNTS", "0"))
+ALERT_WEBHOOK_URL = os.getenv("ALERT_WEBHOOK_URL", "").strip()
+
+# Audit ledger: one record per completed /v1 request (key, model, tokens, latency, account, finish
+# reason, error). *.db / *.sqlite paths use SQLite (pruned after AUDIT_RETENTION_DAYS), others JSON lines
+AUDIT_LOG_PATH = os.getenv("AUDIT_LOG_PATH", "")
+AUDIT_RETENTION_DAYS = float(os.getenv("AUDIT_RETENTION_DAYS", "90"))
+
+# Organisation-wide system prompt added to every chat request: prepend / append it to the client's
+# system prompt, or replace the client's system messages with it. keys[].system_prompt (and
+# system_prompt_mode) override both per API key; an empty system_prompt exempts that key
+SYSTEM_PROMPT = os.getenv("SYSTEM_PROMPT", "")
+SYSTEM_PROMPT_MODE = os.getenv("SYSTEM_PROMPT_MODE", "prepend").strip().lower()
+
+# Mask PII (PII_SCRUB_TYPES: email, phone, api_key, plus the config file's pii_patterns regexes) in
+# chat messages before they are sent to Warp, and in the log lines of those requests (responses
+# included); keys[].pii_scrub turns it on / off per API key
+PII_SCRUB = os.getenv("PII_SCRUB", "").strip().lower() in ("1", "true", "yes")
+PII_SCRUB_TYPES = [t.strip() for t in os.getenv("PII_SCRUB_TYPES", "email,phone,api_key").split(",") if t.strip()]
+
+# Streaming responses with post_processors (model_overrides / keys) hold back this many characters
+# so a regex_replace match can span chunks; longer matches are only seen by non-streaming responses
+POST_PROCESS_WINDOW = int(os.getenv("POST_PROCESS_WINDOW", "256"))
+
+# Lua script (needs `pip install lupa`) whose on_request / on_response functions may rewrite or
+# veto chat requests and rewrite non-streaming responses. Each call gets SCRIPT_HOOK_TIMEOUT_MS of
+# CPU time and the interpreter SCRIPT_HOOK_MEMORY_MB of memory; a failing hook is skipped unless
+# SCRIPT_HOOKS_FAIL_CLOSED, which turns it into a 500
+SCRIPT_HOOKS_PATH = os.getenv("SCRIPT_HOOKS_PATH", "").strip()
+SCRIPT_HOOK_TIMEOUT_MS = float(os.getenv("SCRIPT_HOOK_TIMEOUT_MS", "50"))
+SCRIPT_HOOK_MEMORY_MB = float(os.getenv("SCRIPT_HOOK_MEMORY_MB", "32"))
+SCRIPT_HOOKS_FAIL_CLOSED = os.getenv("SCRIPT_HOOKS_FAIL_CLOSED", "").strip().lower() in ("1", "true", "yes")
+
+# Conversation store behind /v1/conversations (SQLite file, or ":memory:"); empty disables it.
+# Conversations not updated for CONVERSATION_RETENTION_DAYS are deleted (0 = keep forever)
+CONVERSATION_STORE_PATH = os.getenv("CONVERSATION_STORE_PATH", "")
+CONVERSATION_RETENTION_DAYS = float(os.getenv("CONVERSATION_RETENTION_DAYS", "30"))
+# Requests naming a stored conversation (X-Conversation-Id) send only their new messages; the stored
+# history is prepended, keeping the system messages and at most this many of the newest others (0 = all)
+CONVERSATION_CONTEXT_MAX_MESSAGES = int(os.getenv("CONVERSATION_CONTEXT_MAX_MESSAGES", "200"))
+
+# What to do when the prompt would not fit the model's context window (model_overrides context_window,
+# else CONTEXT_WINDOW_TOKENS, else the built-in table), leaving room for max_tokens or
+# CONTEXT_RESERVE_TOKENS of output: off | drop_oldest | summarize_oldest | error
+CONTEXT_STRATEGY = os.getenv("CONTEXT_STRATEGY", "off").strip().lower()
+CONTEXT_WINDOW_TOKENS = int(os.getenv("CONTEXT_WINDOW_TOKENS", "0"))
+CONTEXT_RESERVE_TOKENS = int(os.getenv("CONTEXT_RESERVE_TOKENS", "4096"))
+# Warp model that writes the summary for summarize_oldest (empty = the request's model)
+CONTEXT_SUMMARY_MODEL = os.getenv("CONTEXT_SUMMARY_MODEL", "").strip()
+
+# Response cache for identical non-streaming chat completions: entries live RESPONSE_CACHE_TTL
+# seconds (0 = off) unless RESPONSE_CACHE_MODEL_TTLS ("model=seconds,...") overrides that model
+RESPONSE_CACHE_TTL = float(os.getenv("RESPONSE_CACHE_TTL", "0"))
+# LRU bounds of the response cache: entry count and approximate total size of the cached bodies (0 = no limit)
+RESPONSE_CACHE_MAX_ENTRIES = int(os.getenv("RESPONSE_CACHE_MAX_ENTRIES", "1000"))
+RESPONSE_CACHE_MAX_MB = float(os.getenv("RESPONSE_CACHE_MAX_MB", "64"))
+# Where cached responses live: "memory" (per process, bounded by the LRU limits above) or "redis"
+# (RESPONSE_CACHE_REDIS_URL, shared by every instance using the same key prefix)
+RESPONSE_CACHE_BACKEND = os.getenv("RESPONSE_CACHE_BACKEND", "memory").strip().lower()
+RESPONSE_CACHE_REDIS_URL = os.getenv("RESPONSE_CACHE_REDIS_URL", "redis://127.0.0.1:6379/0").strip()
+RESPONSE_CACHE_REDIS_PASSWORD = os.getenv("RESPONSE_CACHE_REDIS_PASSWORD", "")
+RESPONSE_CACHE_REDIS_PREFIX = os.getenv("RESPONSE_CACHE_REDIS_PREFIX", "warp2api:cache:")
+# Seconds GET /v1/models answers from the cache backend before asking the bridge again (0 = always ask)
+MODELS_CACHE_TTL = float(os.getenv("MODELS_CACHE_TTL", "0"))
+# After the TTL the cached list is still served for this many seconds while it is refreshed in the
+# background (stale-while-revalidate), so polling clients never wait for the bridge
+MODELS_CACHE_STALE = float(os.getenv("MODELS_CACHE_STALE", "600"))
+# File the response cache is saved to on shutdown and reloaded from on start (empty = not persisted)
+RESPONSE_CACHE_SNAPSHOT = os.getenv("RESPONSE_CACHE_SNAPSHOT", "").strip()
+
+# Identical non-streaming chat completions in flight at the same time (same API key, model,
+# messages and params, e.g. a client retry storm) share one upstream call
+REQUEST_DEDUP = os.getenv("REQUEST_DEDUP", "true").strip().lower() in ("1", "true", "yes")
+
+
+def response_cache_model_ttls() -> Dict[str, float]:
+    return parse_model_ttls(os.getenv("RESPONSE_CACHE_MODEL_TTLS", ""))
+
+
+# Separate admin credential for the /admin endpoints and /debug/pprof; unrelated to API_TOKEN / keys.
+# Unset, /admin and /debug/pprof are not served (404)
+ADMIN_TOKEN = os.getenv("ADMIN_TOKEN", "")
+
+# Mount /debug/pprof (CPU profile, heap, task dump); off by default and only with ADMIN_TOKEN set
+DEBUG_PROFILING = os.getenv("DEBUG_PROFILING", "").strip().lower() in ("1", "true", "yes")
+
+# Compression of complete JSON responses (gzip / br / off); SSE streams are always sent uncompressed
+HTTP_COMPRESSION = os.getenv("HTTP_COMPRESSION", "gzip").strip().lower()
+HTTP_COMPRESSION_MIN_SIZE = int(os.getenv("HTTP_COMPRESSION_MIN_SIZE", "1024"))
+
+# Access log per request (json / text / off): method, path, status, latency, key id, model, tokens, account
+ACCESS_LOG = os.getenv("ACCESS_LOG", "json").strip().lower()
+
+# After SIGTERM: new requests get 503, active SSE streams get this many seconds to finish; streams still
+# running shortly before the deadline are ended with an error chunk and [DONE] instead of being truncated
+SHUTDOWN_GRACE_PERIOD = float(os.getenv("SHUTDOWN_GRACE_PERIOD", "60"))
+
+# Per-client rate limit on /v1/* (token bucket per client IP and/or API key); RATE_LIMIT_RPS=0 disables.
+# RATE_LIMIT_BY: "ip", "key" or "both"; RATE_LIMIT_MAX_KEYS bounds the LRU of tracked clients
+RATE_LIMIT_RPS = float(os.getenv("RATE_LIMIT_RPS", "0"))
+RATE_LIMIT_BURST = int(os.getenv("RATE_LIMIT_BURST", "10"))
+RATE_LIMIT_BY = os.getenv("RATE_LIMIT_BY", "ip").strip().lower()
+RATE_LIMIT_MAX_KEYS = int(os.getenv("RATE_LIMIT_MAX_KEYS", "10000"))
+
+# Concurrent /v1/* requests (streams count until they finish); 0 = unlimited. Up to INFLIGHT_QUEUE_SIZE
+# requests wait at most INFLIGHT_QUEUE_TIMEOUT seconds for a slot, the rest get 503 + Retry-After
+MAX_INFLIGHT_REQUESTS = int(os.getenv("MAX_INFLIGHT_REQUESTS", "0"))
+INFLIGHT_QUEUE_SIZE = int(os.getenv("INFLIGHT_QUEUE_SIZE", "16"))
+INFLIGHT_QUEUE_TIMEOUT = float(os.getenv("INFLIGHT_QUEUE_TIMEOUT", "2"))
+
+# When Warp answers 429, hold new requests for UPSTREAM_RATE_LIMIT_BACKOFF seconds in a queue of up to
+# UPSTREAM_QUEUE_SIZE requests (0 = fail right away), then release them one per
+# UPSTREAM_QUEUE_DRAIN_INTERVAL seconds, round-robin over API keys; a request gives up (429) after
+# UPSTREAM_QUEUE_TIMEOUT seconds. Queued streams get ": queued <position>" comments when
+# UPSTREAM_QUEUE_PROGRESS is on, plain keep-alive comments otherwise
+UPSTREAM_QUEUE_SIZE = int(os.getenv("UPSTREAM_QUEUE_SIZE", "0"))
+UPSTREAM_QUEUE_TIMEOUT = float(os.getenv("UPSTREAM_QUEUE_TIMEOUT", "60"))
+UPSTREAM_RATE_LIMIT_BACKOFF = float(os.getenv("UPSTREAM_RATE_LIMIT_BACKOFF", "5"))
+UPSTREAM_QUEUE_DRAIN_INTERVAL = float(os.getenv("UPSTREAM_QUEUE_DRAIN_INTERVAL", "0.5"))
+UPSTREAM_QUEUE_PROGRESS = os.getenv("UPSTREAM_QUEUE_PROGRESS", "true").strip().lower() in ("1", "true", "yes")
+
+# Upper bound for the `n` request parameter; every choice is a separate upstream Warp request
+MAX_CHOICES = int(os.getenv("OPENAI_MAX_CHOICES", "4"))
+
+# Per-route limits on the time until response headers are sent (0 = no limit). Streaming
+# responses send headers immediately, so their bodies are never cut off by these limits.
+HTTP_REQUEST_TIMEOUT = float(os.getenv("HTTP_REQUEST_TIMEOUT", "30"))
+COMPLETION_TIMEOUT = float(os.getenv("COMPLETION_TIMEOUT", "600"))
+ROUTE_TIMEOUTS = {
+    "/v1/chat/completions": COMPLETION_TIMEOUT,
+    # runs for its ?seconds= parameter (at most 300s, see profiling.py) before responding
+    "/debug/pprof/profile": 0,
+}
+
+# Seconds of stream inactivity before a ": ping" SSE comment is sent to the client; 0 disables
+SSE_HEARTBEAT_INTERVAL = float(os.getenv("SSE_HEARTBEAT_INTERVAL", "15"))
+
+# "auto": stream when the client connection can carry SSE (HTTP/1.1+), otherwise fall back to a
+# single buffered JSON response; "off": always fall back (e.g. behind a proxy that buffers bodies)
+SSE_STREAMING = os.getenv("SSE_STREAMING", "auto").strip().lower()
+
+# Streaming writes: small deltas are batched for up to SSE_FLUSH_INTERVAL_MS (0 = write every
+# frame immediately) or until SSE_FLUSH_BYTES; a write blocked longer than SSE_WRITE_TIMEOUT
+# seconds (slow/stalled client, 0 = no limit) aborts the stream
+SSE_FLUSH_INTERVAL_MS = float(os.getenv("SSE_FLUSH_INTERVAL_MS", "20"))
+SSE_FLUSH_BYTES = int(os.getenv("SSE_FLUSH_BYTES", "4096"))
+SSE_WRITE_TIMEOUT = float(os.getenv("SSE_WRITE_TIMEOUT", "30"))
+
 WARMUP_INIT_RETRIES = int(os.getenv("WARP_COMPAT_INIT_RETRIES", "10"))
 WARMUP_INIT_DELAY_S = float(os.getenv("WARP_COMPAT_INIT_DELAY", "0.5"))
 WARMUP_REQUEST_RETRIES = int(os.getenv("WARP_COMPAT_WARMUP_RETRIES", "3"))
-WARMUP_REQUEST_DELAY_S = float(os.getenv("WARP_COMPAT_WARMUP_DELAY", "1.5")) 
\ No newline at end of file
+WARMUP_REQUEST_DELAY_S = float(os.getenv("WARP_COMPAT_WARMUP_DELAY", "1.5")) 
+
+
+def model_alias_map() -> Dict[str, str]:
+    """Client-facing model name -> Warp model name, from the config file's model_map section."""
+    return get_config_section("model_map", {}) or {}
+
+
+# keys entries enabled / disabled through PATCH /admin/keys/{id}: key id -> enabled (until restart or /admin/reload)
+_key_overrides: Dict[str, bool] = {}
+
+
+def api_key_id(entry: Dict[str, Any]) -> str:
+    """Id of a keys entry in logs and per-key settings: its `name`, or a hash of the key."""
+    if entry.get("name"):
+        return str(entry["name"])
+    # 哈希整个 key：只取末尾几位时，不同的 key 可能得到相同的 id
+    return "key-" + hashlib.sha256(entry["key"].encode("utf-8")).hexdigest()[:12]
+
+
+def api_key_enabled(entry: Dict[str, Any]) -> bool:
+    return _key_overrides.get(api_key_id(entry), bool(entry.get("enabled", True)))
+
+
+def set_api_key_enabled(key_id: str, enabled: bool) -> bool:
+    """Enable / disable the keys entry with this id at runtime; False if there is none."""
+    if not any(api_key_id(entry) == key_id for entry in get_config_section("keys", []) or []):
+        return False
+    _key_overrides[key_id] = enabled
+    return True
+
+
+def extra_api_key_ids() -> Dict[str, str]:
+    """Enabled extra API key -> id for logs (see api_key_id)."""
+    return {entry["key"]: api_key_id(entry) for entry in get_config_section("keys", []) or [] if api_key_enabled(entry)}
+
+
+def reload_keys_and_model_map() -> Dict[str, Any]:
+    """Re-read keys and model_map from the config file (POST /admin/reload).
+
+    The file is the source of truth again afterwards, so runtime enable / disable
+    overrides from PATCH /admin/keys are dropped.
+    """
+    sections = reload_config_sections(("keys", "model_map"))
+    _key_overrides.clear()
+    # 新增的 API key 同样要在日志中脱敏
+    reset_secret_literals()
+    return sections
+
+
+def api_key_entry(key_id: str) -> Optional[Dict[str, Any]]:
+    """The enabled keys entry whose id (see api_key_id) is key_id, for per-key settings."""
+    for entry in get_config_section("keys", []) or []:
+        if api_key_enabled(entry) and api_key_id(entry) == key_id:
+            return entry
+    return None
+
+
+def extra_api_keys() -> List[str]:
+    """Enabled API keys from the config file's keys section (accepted alongside API_TOKEN)."""
+    return [k["key"] for k in (get_config_section("keys", []) or []) if api_key_enabled(k)]
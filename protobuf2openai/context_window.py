@@ -0,0 +1,127 @@
+from __future__ import annotations
+
+from typing import Dict, List, Optional, Tuple
+
+from warp2protobuf.core.request_context import request_fields
+
+from .config import CONTEXT_STRATEGY, CONTEXT_WINDOW_TOKENS, CONTEXT_RESERVE_TOKENS, CONTEXT_SUMMARY_MODEL
+from .logging import logger
+from .model_overrides import model_setting
+from .models import ChatMessage
+from .packets import packet_template
+from .tokens import count_message, count_messages, message_text
+from .transport import get_bridge_transport
+
+# Warp 后端模型的上下文窗口（tokens）；model_overrides 中的 context_window 优先
+MODEL_CONTEXT_WINDOWS: Dict[str, int] = {
+    "claude-4-sonnet": 200_000,
+    "claude-4-opus": 200_000,
+    "claude-4.1-opus": 200_000,
+    "gpt-5": 400_000,
+    "gpt-4o": 128_000,
+    "gpt-4.1": 1_000_000,
+    "o3": 200_000,
+    "o4-mini": 200_000,
+    "gemini-2.5-pro": 1_000_000,
+}
+
+_SUMMARY_PROMPT = (
+    "Summarize the following earlier part of a conversation in a few short paragraphs. Keep facts, "
+    "decisions, names, numbers and open questions; drop pleasantries. Reply with the summary only.\n\n"
+)
+
+
+class ContextWindowExceeded(Exception):
+    def __init__(self, tokens: int, window: int, model: Optional[str]):
+        super().__init__(
+            f"请求约 {tokens} tokens，超出模型 {model or 'default'} 的上下文窗口 {window} tokens (context_length_exceeded)"
+        )
+        self.tokens = tokens
+        self.window = window
+
+
+def context_window_for(model: Optional[str], warp_model: Optional[str]) -> int:
+    configured = model_setting(model, warp_model, "context_window")
+    if configured:
+        return int(configured)
+    if CONTEXT_WINDOW_TOKENS > 0:
+        return CONTEXT_WINDOW_TOKENS
+    return MODEL_CONTEXT_WINDOWS.get(warp_model or "", 0)
+
+
+def _split_oldest(history: List[ChatMessage], budget: int, model: Optional[str]) -> Tuple[List[ChatMessage], List[ChatMessage], int]:
+    """(dropped, kept, kept tokens): the fewest oldest non-system messages to drop so the rest fits."""
+    others = [m for m in history if m.role != "system"]
+    costs = [count_message(m, model) for m in others]
+    total = count_messages(history, model)
+    cut = 0
+    # 最后一条（本次输入）始终保留
+    while cut < len(others) - 1 and total > budget:
+        total -= costs[cut]
+        cut += 1
+    # 不以孤立的工具结果开头：发起调用的 assistant 消息已被丢弃
+    while cut < len(others) - 1 and others[cut].role == "tool":
+        total -= costs[cut]
+        cut += 1
+    dropped_ids = {id(m) for m in others[:cut]}
+    kept = [m for m in history if id(m) not in dropped_ids]
+    return others[:cut], kept, total
+
+
+async def _summarize(messages: List[ChatMessage], warp_model: Optional[str]) -> str:
+    transcript = "\n\n".join(f"{m.role}: {message_text(m)}" for m in messages)
+    packet = packet_template()
+    packet["input"]["user_inputs"]["inputs"].append({"user_query": {"query": _SUMMARY_PROMPT + transcript}})
+    model = CONTEXT_SUMMARY_MODEL or warp_model
+    if model:
+        packet["settings"]["model_config"]["base"] = model
+    resp = await get_bridge_transport().send_stream(packet)
+    return (resp.get("response") or "").strip()
+
+
+async def fit_context(history: List[ChatMessage], model: Optional[str], warp_model: Optional[str], max_tokens: Optional[int]) -> List[ChatMessage]:
+    """Apply the model's context strategy when the prompt would not fit its context window.
+
+    Raises ContextWindowExceeded for the "error" strategy, when even the last message alone is too
+    large, and (whatever the strategy) when the prompt by itself exceeds the window: Warp would
+    reject it anyway, after spending quota.
+    """
+    window = context_window_for(model, warp_model)
+    if window <= 0:
+        return history
+    strategy = model_setting(model, warp_model, "context_strategy") or CONTEXT_STRATEGY
+    used = count_messages(history, warp_model)
+    if strategy == "off":
+        if used > window:
+            raise ContextWindowExceeded(used, window, model)
+        return history
+    budget = window - (max_tokens or CONTEXT_RESERVE_TOKENS)
+    if used <= budget:
+        return history
+    if strategy == "error":
+        raise ContextWindowExceeded(used, window, model)
+    dropped, kept, kept_tokens = _split_oldest(history, budget, warp_model)
+    if kept_tokens > budget:
+        raise ContextWindowExceeded(used, window, model)
+
+    summarized = False
+    if strategy == "summarize_oldest" and dropped:
+        try:
+            summary = await _summarize(dropped, warp_model)
+        except Exception as e:
+            summary = ""
+            logger.warning("[OpenAI Compat] 摘要较早的消息失败，改为直接丢弃: %s", e)
+        note = ChatMessage(role="system", content=f"Summary of the earlier part of this conversation:\n{summary}")
+        if summary and kept_tokens + count_message(note, warp_model) <= budget:
+            leading = 0
+            while leading < len(kept) and kept[leading].role == "system":
+                leading += 1
+            kept = kept[:leading] + [note] + kept[leading:]
+            summarized = True
+
+    logger.info(
+        "[OpenAI Compat] 上下文约 %s tokens 超出预算 %s（窗口 %s），%s %s 条较早的消息",
+        used, budget, window, "摘要" if summarized else "丢弃", len(dropped),
+    )
+    request_fields().update(context_trimmed=len(dropped), context_summarized=summarized)
+    return kept
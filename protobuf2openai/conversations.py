@@ -0,0 +1,226 @@
+from __future__ import annotations
+
+import json
+import os
+import sqlite3
+import threading
+import time
+import uuid
+from typing import Any, Dict, List, Optional
+
+from .config import CONVERSATION_STORE_PATH, CONVERSATION_RETENTION_DAYS
+from .logging import logger
+
+# 带此请求头的对话请求只需发送新消息，之前的上下文由服务端从会话中补全
+CONVERSATION_HEADER = "X-Conversation-Id"
+
+
+def _conversation_id() -> str:
+    return f"conv_{uuid.uuid4().hex}"
+
+
+class ConversationStore:
+    """SQLite store of conversations: model, metadata and the ordered OpenAI-format messages.
+
+    Every conversation belongs to the API key that created it; lookups with another key
+    behave as if it did not exist. Conversations untouched for `retention_days` are pruned.
+    """
+
+    def __init__(self, path: str, retention_days: float = 0):
+        self.path = path
+        self.retention_seconds = retention_days * 86400
+        self._lock = threading.Lock()
+        self._last_prune = 0.0
+        self._conn = sqlite3.connect(path, check_same_thread=False)
+        self._conn.execute("PRAGMA journal_mode=WAL")
+        self._conn.execute("PRAGMA foreign_keys=ON")
+        self._conn.execute(
+            "CREATE TABLE IF NOT EXISTS conversations ("
+            " id TEXT PRIMARY KEY, key_id TEXT NOT NULL, model TEXT, metadata TEXT NOT NULL,"
+            " created_at REAL NOT NULL, updated_at REAL NOT NULL)"
+        )
+        self._conn.execute(
+            "CREATE TABLE IF NOT EXISTS conversation_messages ("
+            " id INTEGER PRIMARY KEY,"
+            " conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,"
+            " message TEXT NOT NULL, created_at REAL NOT NULL)"
+        )
+        self._conn.execute("CREATE INDEX IF NOT EXISTS idx_conversations_key ON conversations(key_id, updated_at)")
+        self._conn.execute("CREATE INDEX IF NOT EXISTS idx_conversation_messages ON conversation_messages(conversation_id, id)")
+        self._conn.commit()
+
+    @staticmethod
+    def _row(row: tuple) -> Dict[str, Any]:
+        conv_id, model, metadata, created_at, updated_at, count = row
+        return {
+            "id": conv_id,
+            "object": "conversation",
+            "model": model,
+            "metadata": json.loads(metadata),
+            "created_at": int(created_at),
+            "updated_at": int(updated_at),
+            "message_count": count,
+        }
+
+    def _fetch(self, key_id: str, conv_id: str) -> Optional[Dict[str, Any]]:
+        row = self._conn.execute(
+            "SELECT c.id, c.model, c.metadata, c.created_at, c.updated_at,"
+            " (SELECT COUNT(*) FROM conversation_messages m WHERE m.conversation_id = c.id)"
+            " FROM conversations c WHERE c.id = ? AND c.key_id = ?",
+            (conv_id, key_id),
+        ).fetchone()
+        return self._row(row) if row else None
+
+    def _insert_messages(self, conv_id: str, messages: List[Dict[str, Any]], now: float) -> None:
+        self._conn.executemany(
+            "INSERT INTO conversation_messages (conversation_id, message, created_at) VALUES (?, ?, ?)",
+            [(conv_id, json.dumps(m, ensure_ascii=False), now) for m in messages],
+        )
+
+    def _maybe_prune(self, now: float) -> None:
+        if self.retention_seconds > 0 and now - self._last_prune > 3600:
+            # 每小时最多清理一次长期未更新的会话（消息随外键级联删除）
+            self._conn.execute("DELETE FROM conversations WHERE updated_at < ?", (now - self.retention_seconds,))
+            self._last_prune = now
+
+    def create(self, key_id: str, model: Optional[str], metadata: Dict[str, Any], messages: List[Dict[str, Any]]) -> Dict[str, Any]:
+        conv_id = _conversation_id()
+        now = time.time()
+        with self._lock:
+            self._conn.execute(
+                "INSERT INTO conversations (id, key_id, model, metadata, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+                (conv_id, key_id, model, json.dumps(metadata, ensure_ascii=False), now, now),
+            )
+            self._insert_messages(conv_id, messages, now)
+            self._maybe_prune(now)
+            self._conn.commit()
+            return self._fetch(key_id, conv_id)
+
+    def get(self, key_id: str, conv_id: str, with_messages: bool = True) -> Optional[Dict[str, Any]]:
+        with self._lock:
+            conversation = self._fetch(key_id, conv_id)
+            if conversation is None or not with_messages:
+                return conversation
+            rows = self._conn.execute(
+                "SELECT message FROM conversation_messages WHERE conversation_id = ? ORDER BY id", (conv_id,)
+            ).fetchall()
+        conversation["messages"] = [json.loads(message) for (message,) in rows]
+        return conversation
+
+    def list(self, key_id: str, limit: int = 20) -> List[Dict[str, Any]]:
+        """The key's conversations, most recently updated first (without messages)."""
+        with self._lock:
+            rows = self._conn.execute(
+                "SELECT c.id, c.model, c.metadata, c.created_at, c.updated_at,"
+                " (SELECT COUNT(*) FROM conversation_messages m WHERE m.conversation_id = c.id)"
+                " FROM conversations c WHERE c.key_id = ? ORDER BY c.updated_at DESC LIMIT ?",
+                (key_id, limit),
+            ).fetchall()
+        return [self._row(row) for row in rows]
+
+    def append(self, key_id: str, conv_id: str, messages: List[Dict[str, Any]], model: Optional[str] = None) -> Optional[Dict[str, Any]]:
+        """Add messages to the end of a conversation (and switch its model when given); None if it does not exist."""
+        now = time.time()
+        with self._lock:
+            exists = self._conn.execute(
+                "SELECT 1 FROM conversations WHERE id = ? AND key_id = ?", (conv_id, key_id)
+            ).fetchone()
+            if not exists:
+                return None
+            self._insert_messages(conv_id, messages, now)
+            self._conn.execute(
+                "UPDATE conversations SET updated_at = ?, model = COALESCE(?, model) WHERE id = ?", (now, model, conv_id)
+            )
+            self._maybe_prune(now)
+            self._conn.commit()
+            return self._fetch(key_id, conv_id)
+
+    def delete(self, key_id: str, conv_id: str) -> bool:
+        with self._lock:
+            deleted = self._conn.execute(
+                "DELETE FROM conversations WHERE id = ? AND key_id = ?", (conv_id, key_id)
+            ).rowcount
+            self._conn.commit()
+        return deleted > 0
+
+    def close(self) -> None:
+        with self._lock:
+            self._conn.close()
+
+
+def trim_context(messages: List[Dict[str, Any]], max_messages: int) -> List[Dict[str, Any]]:
+    """Keep every system message plus the newest `max_messages` others (0 = no limit)."""
+    if max_messages <= 0:
+        return messages
+    others = [i for i, m in enumerate(messages) if m.get("role") != "system"]
+    if len(others) <= max_messages:
+        return messages
+    dropped = set(others[:len(others) - max_messages])
+    trimmed: List[Dict[str, Any]] = []
+    leading = True
+    for i, m in enumerate(messages):
+        if i in dropped:
+            continue
+        # 裁剪后不能以工具结果开头：发起调用的 assistant 消息已被丢弃
+        if leading and m.get("role") == "tool":
+            continue
+        if m.get("role") != "system":
+            leading = False
+        trimmed.append(m)
+    return trimmed
+
+
+class StreamedReply:
+    """Rebuilds the first choice's assistant message from chat.completion.chunk SSE frames."""
+
+    def __init__(self):
+        self.content: List[str] = []
+        self.tool_calls: Dict[int, Dict[str, Any]] = {}
+        self.finish_reason: Optional[str] = None
+
+    def feed(self, frame: str) -> None:
+        for line in frame.splitlines():
+            if not line.startswith("data: ") or line == "data: [DONE]":
+                continue
+            try:
+                chunk = json.loads(line[6:])
+            except ValueError:
+                continue
+            for choice in chunk.get("choices") or []:
+                if choice.get("index", 0) != 0:
+                    continue
+                delta = choice.get("delta") or {}
+                if delta.get("content"):
+                    self.content.append(delta["content"])
+                for tc in delta.get("tool_calls") or []:
+                    call = self.tool_calls.setdefault(tc.get("index", 0), {
+                        "id": None, "type": "function", "function": {"name": "", "arguments": ""},
+                    })
+                    call["id"] = tc.get("id") or call["id"]
+                    fn = tc.get("function") or {}
+                    call["function"]["name"] += fn.get("name") or ""
+                    call["function"]["arguments"] += fn.get("arguments") or ""
+                if choice.get("finish_reason"):
+                    self.finish_reason = choice["finish_reason"]
+
+    def message(self) -> Dict[str, Any]:
+        message: Dict[str, Any] = {"role": "assistant", "content": "".join(self.content)}
+        if self.tool_calls:
+            message["tool_calls"] = [self.tool_calls[i] for i in sorted(self.tool_calls)]
+        return message
+
+
+def open_conversation_store(path: str, retention_days: float) -> Optional[ConversationStore]:
+    """None when no path is configured; failures are logged and the store stays off."""
+    if not path:
+        return None
+    try:
+        store = ConversationStore(path, retention_days)
+        logger.info("[OpenAI Compat] 会话存储: %s", path)
+        return store
+    except Exception as e:
+        logger.warning("[OpenAI Compat] 无法打开会话存储 %s: %s", path, e)
+        return None
+
+
+conversation_store = open_conversation_store(os.path.expanduser(CONVERSATION_STORE_PATH), CONVERSATION_RETENTION_DAYS)
@@ -0,0 +1,58 @@
+from __future__ import annotations
+
+import asyncio
+import time
+from typing import Any, Dict, Optional
+
+# 维护模式下新请求收到的 Retry-After（秒），负载均衡器会在此期间转发到其他实例
+DRAIN_RETRY_AFTER_S = 30
+
+
+class DrainState:
+    """Maintenance / drain mode: new /v1 requests get 503, in-flight ones (and their streams) finish.
+
+    `active` counts /v1 requests whose response has not been fully sent yet, so an
+    operator (or the shutdown hook) can tell when the instance is idle.
+    """
+
+    def __init__(self) -> None:
+        self.draining = False
+        self.since: Optional[float] = None
+        self.message = ""
+        self.active = 0
+        self.shutting_down = False
+        # 关机宽限期即将结束时置位：仍在进行的流式响应收到该信号后主动以结束标记收尾
+        self.streams_cut = asyncio.Event()
+
+    def start(self, message: str = "") -> None:
+        if not self.draining:
+            self.since = time.time()
+        self.draining = True
+        self.message = message or "server is in maintenance, please retry on another instance"
+
+    def stop(self) -> None:
+        if self.shutting_down:
+            # 进程正在退出，不允许再恢复接收请求
+            return
+        self.draining = False
+        self.since = None
+        self.message = ""
+
+    def begin_shutdown(self) -> None:
+        self.shutting_down = True
+        self.start("server is shutting down, please retry on another instance")
+
+    def cut_streams(self) -> None:
+        self.streams_cut.set()
+
+    def status(self) -> Dict[str, Any]:
+        return {
+            "draining": self.draining,
+            "shutting_down": self.shutting_down,
+            "since": self.since,
+            "message": self.message or None,
+            "active_requests": self.active,
+        }
+
+
+DRAIN = DrainState()
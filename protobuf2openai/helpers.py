@@ -1,6 +1,8 @@
 from __future__ import annotations
 
-from typing import Any, Dict, List
+from typing import Any, Dict, List, Optional
+
+from warp2protobuf.core.usage import extract_usage_from_event
 
 
 def _get(d: Dict[str, Any], *names: str) -> Any:
@@ -51,4 +53,34 @@ def segments_to_warp_results(segments: List[Dict[str, Any]]) -> List[Dict[str, A
     for seg in segments:
         if isinstance(seg, dict) and seg.get("type") == "text" and isinstance(seg.get("text"), str):
             results.append({"text": {"text": seg.get("text")}})
-    return results 
\ No newline at end of file
+    return results 
+
+
+def extract_usage_from_parsed_events(parsed_events: List[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+    """Return usage from the last StreamFinished event in a bridge parsed_events list."""
+    usage: Optional[Dict[str, Any]] = None
+    for ev in parsed_events or []:
+        if not isinstance(ev, dict):
+            continue
+        evd = ev.get("parsed_data") or ev.get("raw_data") or {}
+        found = extract_usage_from_event(evd) if isinstance(evd, dict) else None
+        if found is not None:
+            usage = found
+    return usage
+
+
+def merge_usage(usages: List[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+    """Sum per-choice usage objects (n > 1 issues one upstream request per choice)."""
+    if not usages:
+        return None
+    if len(usages) == 1:
+        return usages[0]
+    merged: Dict[str, Any] = {"prompt_tokens": 0, "completion_tokens": 0, "total_tokens": 0}
+    cached = 0
+    for usage in usages:
+        for key in ("prompt_tokens", "completion_tokens", "total_tokens"):
+            merged[key] += int(usage.get(key) or 0)
+        cached += int((usage.get("prompt_tokens_details") or {}).get("cached_tokens") or 0)
+    if cached:
+        merged["prompt_tokens_details"] = {"cached_tokens": cached}
+    return merged
@@ -0,0 +1,134 @@
+from __future__ import annotations
+
+import json
+from typing import Any, Dict, List, Optional
+
+from .logging import logger
+
+_CLOSERS = {"{": "}", "[": "]"}
+
+
+def json_mode_of(response_format: Optional[Dict[str, Any]]) -> Optional[str]:
+    """Return "json_object" / "json_schema" when the request asks for JSON output."""
+    if not isinstance(response_format, dict):
+        return None
+    kind = response_format.get("type")
+    return kind if kind in ("json_object", "json_schema") else None
+
+
+def json_mode_instruction(response_format: Dict[str, Any]) -> str:
+    text = "Respond with a single valid JSON value only. Do not wrap it in markdown code fences or add any text before or after it."
+    schema = (response_format.get("json_schema") or {}).get("schema") if response_format.get("type") == "json_schema" else None
+    if schema:
+        text += "\nThe JSON must conform to this JSON Schema:\n" + json.dumps(schema, ensure_ascii=False)
+    return text
+
+
+class StreamingJSONGuard:
+    """Filter streamed model text so the concatenated output is one parseable JSON value.
+
+    Text before the first `{`/`[` (prose, ```json fences) and everything after the
+    top-level value closes is suppressed. A trailing comma is held back until the
+    next value starts, so a truncated or early-closed stream can still be repaired
+    by finish(), which closes any open string and containers.
+    """
+
+    def __init__(self) -> None:
+        self._stack: List[str] = []
+        self._in_string = False
+        self._escape = False
+        self._started = False
+        self._done = False
+        self._held = ""
+        self._last = ""
+        self._emitted: List[str] = []
+        self.suppressed = 0
+
+    def feed(self, text: str) -> str:
+        out: List[str] = []
+        for c in text:
+            if self._done:
+                self.suppressed += 1
+                continue
+            if not self._started:
+                if c in _CLOSERS:
+                    self._started = True
+                    self._stack.append(c)
+                    out.append(c)
+                    self._last = c
+                else:
+                    self.suppressed += 1
+                continue
+            if self._in_string:
+                out.append(c)
+                if self._escape:
+                    self._escape = False
+                elif c == "\\":
+                    self._escape = True
+                elif c == '"':
+                    self._in_string = False
+                    self._last = c
+                continue
+            if c.isspace():
+                if not self._held:
+                    out.append(c)
+                continue
+            if c == ",":
+                self._held = c
+                continue
+            if c in "}]":
+                self._held = ""
+                if not self._stack or _CLOSERS[self._stack[-1]] != c:
+                    # 括号不匹配：模型输出已不是合法JSON，停止继续输出
+                    logger.warning("[OpenAI Compat] JSON模式: 第%d个字符处括号不匹配，截断后续输出", len("".join(self._emitted)) + len(out))
+                    self._done = True
+                    self.suppressed += 1
+                    continue
+                self._stack.pop()
+                out.append(c)
+                self._last = c
+                if not self._stack:
+                    self._done = True
+                continue
+            if self._held:
+                out.append(self._held)
+                self._held = ""
+            if c == '"':
+                self._in_string = True
+            elif c in _CLOSERS:
+                self._stack.append(c)
+            out.append(c)
+            self._last = c
+        chunk = "".join(out)
+        if chunk:
+            self._emitted.append(chunk)
+        return chunk
+
+    def finish(self) -> str:
+        """Return the text needed to complete the value (or "{}" if none was produced)."""
+        if not self._started:
+            tail = "{}"
+        else:
+            parts: List[str] = []
+            if self._in_string:
+                if self._escape:
+                    parts.append("\\")
+                parts.append('"')
+            elif self._last == ":":
+                parts.append("null")
+            parts.extend(_CLOSERS[o] for o in reversed(self._stack))
+            tail = "".join(parts)
+        self._held = ""
+        self._stack.clear()
+        self._in_string = False
+        self._done = True
+        full = "".join(self._emitted) + tail
+        try:
+            json.loads(full)
+        except ValueError as e:
+            logger.warning("[OpenAI Compat] JSON模式: 补全后的输出仍无法解析: %s", e)
+        if self.suppressed:
+            logger.info("[OpenAI Compat] JSON模式: 已丢弃 %d 个非JSON字符", self.suppressed)
+        if tail:
+            self._emitted.append(tail)
+        return tail
@@ -0,0 +1,77 @@
+from __future__ import annotations
+
+import asyncio
+from collections import deque
+from typing import Deque, Dict
+
+from .config import MAX_INFLIGHT_REQUESTS, INFLIGHT_QUEUE_SIZE, INFLIGHT_QUEUE_TIMEOUT
+
+
+class InFlightLimiter:
+    """Caps concurrent requests; a few callers may wait briefly for a slot, the rest are shed.
+
+    A released slot is handed straight to the oldest waiter, so queued requests are
+    served in arrival order and cannot be overtaken by newcomers.
+    """
+
+    def __init__(self, max_in_flight: int, queue_size: int = 0, queue_timeout: float = 0.0):
+        self.max_in_flight = max_in_flight
+        self.queue_size = queue_size
+        self.queue_timeout = queue_timeout
+        self.in_flight = 0
+        self.shed_total = 0
+        self._waiters: Deque[asyncio.Future] = deque()
+
+    @property
+    def enabled(self) -> bool:
+        return self.max_in_flight > 0
+
+    async def acquire(self) -> bool:
+        if self.in_flight < self.max_in_flight and not self._waiters:
+            self.in_flight += 1
+            return True
+        if len(self._waiters) >= self.queue_size or self.queue_timeout <= 0:
+            self.shed_total += 1
+            return False
+        waiter = asyncio.get_running_loop().create_future()
+        self._waiters.append(waiter)
+        try:
+            await asyncio.wait_for(waiter, timeout=self.queue_timeout)
+            return True
+        except asyncio.TimeoutError:
+            self.shed_total += 1
+            return False
+        finally:
+            try:
+                self._waiters.remove(waiter)
+            except ValueError:
+                pass
+
+    def release(self) -> None:
+        while self._waiters:
+            waiter = self._waiters.popleft()
+            if not waiter.done():
+                # 名额直接转交给排队最久的请求，in_flight 不变
+                waiter.set_result(None)
+                return
+        self.in_flight -= 1
+
+    def resize(self, max_in_flight: int) -> None:
+        """Change the limit at runtime; waiters get the slots a higher limit (or 0 = unlimited) frees."""
+        self.max_in_flight = max_in_flight
+        while self._waiters and (not self.enabled or self.in_flight < self.max_in_flight):
+            waiter = self._waiters.popleft()
+            if not waiter.done():
+                self.in_flight += 1
+                waiter.set_result(None)
+
+    def stats(self) -> Dict[str, int]:
+        return {
+            "max_in_flight": self.max_in_flight,
+            "in_flight": self.in_flight,
+            "queued": len(self._waiters),
+            "shed_total": self.shed_total,
+        }
+
+
+inflight_limiter = InFlightLimiter(MAX_INFLIGHT_REQUESTS, INFLIGHT_QUEUE_SIZE, INFLIGHT_QUEUE_TIMEOUT)
@@ -4,9 +4,17 @@
 Local logging for protobuf2openai package to avoid cross-package dependencies.
 """
 import logging
-from logging.handlers import RotatingFileHandler
 from pathlib import Path
 
+from warp2protobuf.core.log_rotation import log_file_handler
+from warp2protobuf.core.log_tail import open_log_tail
+from warp2protobuf.core.redaction import add_redaction
+from warp2protobuf.core.request_context import RequestIdFilter
+
+# 先加载配置（含配置文件），LOG_* 设置才会在创建文件 handler 前生效
+from .config import LOG_TAIL_BUFFER
+from .pii import add_pii_scrubbing
+
 LOG_DIR = Path("logs")
 LOG_DIR.mkdir(exist_ok=True)
 
@@ -17,16 +25,27 @@ _logger.setLevel(logging.INFO)
 for h in _logger.handlers[:]:
     _logger.removeHandler(h)
 
-file_handler = RotatingFileHandler(LOG_DIR / "openai_compat.log", maxBytes=5*1024*1024, backupCount=3, encoding="utf-8")
+# LOG_FILE 覆盖默认路径；按大小 / 时间轮转、压缩并清理旧归档（LOG_* 设置）
+file_handler = log_file_handler(LOG_DIR / "openai_compat.log")
 file_handler.setLevel(logging.INFO)
 console_handler = logging.StreamHandler()
 console_handler.setLevel(logging.INFO)
 
-fmt = logging.Formatter('%(asctime)s - %(name)s - %(levelname)s - %(funcName)s:%(lineno)d - %(message)s')
+fmt = logging.Formatter('%(asctime)s - %(name)s - %(levelname)s - [%(request_context)s] %(funcName)s:%(lineno)d - %(message)s')
 file_handler.setFormatter(fmt)
 console_handler.setFormatter(fmt)
+# 每行日志带上当前请求的 x-request-id、API key 与模型（请求之外为 "-"）
+file_handler.addFilter(RequestIdFilter())
+console_handler.addFilter(RequestIdFilter())
+# 日志中的 JWT / refresh token / API key（及可选的消息内容）在写出前脱敏（LOG_REDACT）
+add_redaction((file_handler, console_handler))
+# 开启 PII_SCRUB（或该 API key 的 pii_scrub）时，请求期间的日志（含响应内容）中的邮箱 / 电话 / 密钥被遮盖
+add_pii_scrubbing([file_handler, console_handler])
 
 _logger.addHandler(file_handler)
 _logger.addHandler(console_handler)
 
-logger = _logger 
\ No newline at end of file
+logger = _logger
+
+# /admin/logs/stream 的内存日志缓冲（访问日志在 app 中另行挂载）
+log_tail = open_log_tail(LOG_TAIL_BUFFER, [_logger]) 
\ No newline at end of file
@@ -0,0 +1,83 @@
+from __future__ import annotations
+
+import time
+from typing import Any, Dict, Iterable, Tuple
+
+from warp2protobuf.core.memory import memory_help, memory_watch
+from warp2protobuf.core.metrics import MetricsRegistry, route_label
+
+from .drain import DRAIN
+from .load_shed import inflight_limiter
+
+_HELP = {
+    "openai_http_requests_total": "HTTP requests served, by route, model and status",
+    "openai_http_request_duration_seconds": "Request duration until the response body was fully sent",
+    "openai_tokens_total": "Tokens reported by Warp, by model and type (prompt / completion)",
+    "openai_stream_duration_seconds": "Duration of streamed (SSE) completions",
+    "openai_time_to_first_token_seconds": "Time from request start until the first streamed content / tool call delta",
+    "openai_response_cache_total": "Non-streaming completions looked up in the response cache, by model and result (hit / miss)",
+    "openai_deduplicated_requests_total": "Non-streaming completions answered by an identical request already in flight, by model",
+    "openai_upstream_requests_total": "Calls to the bridge / Warp, by transport, operation and outcome",
+    "openai_upstream_request_duration_seconds": "Duration of calls to the bridge / Warp (streams: until the last event)",
+    "openai_active_requests": "/v1 requests whose response has not been fully sent",
+    "openai_inflight_queued": "Requests waiting for an in-flight slot",
+    "openai_shed_requests": "Requests rejected by the in-flight limiter since start",
+    "openai_draining": "1 while the server is in drain / shutdown mode",
+    **memory_help("openai"),
+}
+
+# 首 token 延迟通常在数秒内，使用更细的桶以便估算分位数
+openai_metrics = MetricsRegistry(_HELP, "openai_uptime_seconds", buckets={
+    "openai_time_to_first_token_seconds": (0.1, 0.25, 0.5, 0.75, 1.0, 1.5, 2.0, 3.0, 5.0, 7.5, 10.0, 20.0, 30.0, 60.0),
+})
+
+
+def observe_request(request: Any, status: int, latency: float, fields: Dict[str, Any]) -> None:
+    """Access-log observer: request counters, latency, token usage, stream duration and time to first token."""
+    route = route_label(request)
+    model = fields.get("model") or ""
+    openai_metrics.inc("openai_http_requests_total", route=route, model=model, status=status)
+    openai_metrics.observe("openai_http_request_duration_seconds", latency, route=route, model=model)
+    for kind in ("prompt", "completion"):
+        tokens = fields.get(f"{kind}_tokens")
+        if tokens:
+            openai_metrics.inc("openai_tokens_total", tokens, model=model, type=kind)
+    if fields.get("cache"):
+        openai_metrics.inc("openai_response_cache_total", model=model, result=fields["cache"])
+    if fields.get("deduplicated"):
+        openai_metrics.inc("openai_deduplicated_requests_total", model=model)
+    if fields.get("stream"):
+        openai_metrics.observe("openai_stream_duration_seconds", latency, model=model)
+        ttft_ms = fields.get("ttft_ms")
+        if ttft_ms is not None:
+            openai_metrics.observe("openai_time_to_first_token_seconds", ttft_ms / 1000, model=model)
+
+
+def latency_stats() -> Dict[str, Any]:
+    """Percentile view of the request histograms, per route and per model, plus streaming TTFT per model."""
+    return {
+        "uptime_seconds": round(time.time() - openai_metrics.started_at, 1),
+        "routes": openai_metrics.latency_summary("openai_http_request_duration_seconds", "route"),
+        "models": openai_metrics.latency_summary("openai_http_request_duration_seconds", "model"),
+        "stream_duration": openai_metrics.latency_summary("openai_stream_duration_seconds", "model"),
+        "time_to_first_token": openai_metrics.latency_summary("openai_time_to_first_token_seconds", "model"),
+        "upstream": openai_metrics.latency_summary("openai_upstream_request_duration_seconds", "operation"),
+    }
+
+
+def observe_upstream(transport: str, operation: str, outcome: str, seconds: float) -> None:
+    openai_metrics.inc("openai_upstream_requests_total", transport=transport, operation=operation, outcome=outcome)
+    openai_metrics.observe("openai_upstream_request_duration_seconds", seconds, transport=transport, operation=operation)
+
+
+def _live_gauges() -> Iterable[Tuple[str, Dict[str, str], float]]:
+    yield "openai_active_requests", {}, DRAIN.active
+    yield "openai_draining", {}, 1 if DRAIN.draining else 0
+    if inflight_limiter.enabled:
+        stats = inflight_limiter.stats()
+        yield "openai_inflight_queued", {}, stats["queued"]
+        yield "openai_shed_requests", {}, stats["shed_total"]
+
+
+openai_metrics.add_collector(_live_gauges)
+openai_metrics.add_collector(lambda: memory_watch.gauges("openai"))
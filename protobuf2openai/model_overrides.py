@@ -0,0 +1,63 @@
+from __future__ import annotations
+
+from typing import Any, Dict, List, Optional
+
+from warp2protobuf.config.config_file import get_config_section
+
+from .logging import logger
+
+# Sampling parameters that can be defaulted / clamped per model
+OVERRIDABLE_PARAMS = ("temperature", "top_p", "max_tokens")
+
+
+def _rules_for(model: Optional[str], warp_model: Optional[str]) -> Dict[str, Any]:
+    """Merge "*" < warp model name < client-facing model name rules from the model_overrides section."""
+    table = get_config_section("model_overrides", {}) or {}
+    merged: Dict[str, Any] = {}
+    for name in ("*", warp_model, model):
+        if name and isinstance(table.get(name), dict):
+            merged.update(table[name])
+    return merged
+
+
+def model_setting(model: Optional[str], warp_model: Optional[str], name: str) -> Any:
+    """One non-parameter setting (e.g. context_window) from the model_overrides rules, None when unset."""
+    return _rules_for(model, warp_model).get(name)
+
+
+def _apply_param(name: str, value: Any, rule: Any) -> Any:
+    # 纯数字规则等价于 {"default": 数字}
+    if not isinstance(rule, dict):
+        rule = {"default": rule}
+    if rule.get("force") is not None:
+        return rule["force"]
+    if value is None:
+        return rule.get("default")
+    lo, hi = rule.get("min"), rule.get("max")
+    if lo is not None and value < lo:
+        return lo
+    if hi is not None and value > hi:
+        return hi
+    return value
+
+
+def apply_model_overrides(req: Any, warp_model: Optional[str]) -> Optional[str]:
+    """Default/clamp req sampling parameters in place; returns the model's system preamble, if any."""
+    rules = _rules_for(getattr(req, "model", None), warp_model)
+    if not rules:
+        return None
+    changed: List[str] = []
+    for name in OVERRIDABLE_PARAMS:
+        if name not in rules:
+            continue
+        before = getattr(req, name, None)
+        after = _apply_param(name, before, rules[name])
+        if name == "max_tokens" and after is not None:
+            after = int(after)
+        if after != before:
+            setattr(req, name, after)
+            changed.append(f"{name}: {before} -> {after}")
+    if changed:
+        logger.info("[OpenAI Compat] 模型参数覆盖 (%s): %s", req.model, ", ".join(changed))
+    preamble = rules.get("system_preamble")
+    return preamble if isinstance(preamble, str) and preamble.strip() else None
@@ -23,9 +23,44 @@ class OpenAITool(BaseModel):
     function: OpenAIFunctionDef
 
 
+class ConversationCreateRequest(BaseModel):
+    model: Optional[str] = None
+    metadata: Optional[Dict[str, Any]] = None
+    messages: List[ChatMessage] = []
+
+
+class ConversationAppendRequest(BaseModel):
+    messages: List[ChatMessage]
+    model: Optional[str] = None
+
+
 class ChatCompletionsRequest(BaseModel):
     model: Optional[str] = None
     messages: List[ChatMessage]
     stream: Optional[bool] = False
+    n: Optional[int] = 1
+    temperature: Optional[float] = None
+    top_p: Optional[float] = None
+    max_tokens: Optional[int] = None
+    response_format: Optional[Dict[str, Any]] = None
     tools: Optional[List[OpenAITool]] = None
-    tool_choice: Optional[Any] = None 
\ No newline at end of file
+    tool_choice: Optional[Any] = None 
+
+class AdminAccountUpdate(BaseModel):
+    enabled: Optional[bool] = None
+    weight: Optional[float] = Field(None, gt=0)
+    reset_cooldown: bool = False
+
+
+class AdminKeyUpdate(BaseModel):
+    enabled: bool
+
+
+class AdminLimitsUpdate(BaseModel):
+    rate_limit_rps: Optional[float] = Field(None, ge=0)
+    rate_limit_burst: Optional[int] = Field(None, ge=1)
+    max_in_flight: Optional[int] = Field(None, ge=0)
+    inflight_queue_size: Optional[int] = Field(None, ge=0)
+    inflight_queue_timeout: Optional[float] = Field(None, ge=0)
+    upstream_queue_size: Optional[int] = Field(None, ge=0)
+    upstream_queue_timeout: Optional[float] = Field(None, ge=0)
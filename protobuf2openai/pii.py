@@ -0,0 +1,129 @@
+from __future__ import annotations
+
+import logging
+import re
+from typing import Any, Callable, Dict, List, Optional, Tuple, Union
+
+from warp2protobuf.config.config_file import get_config_section
+from warp2protobuf.core.request_context import request_fields
+
+from .config import PII_SCRUB, PII_SCRUB_TYPES, api_key_entry
+
+_Replacement = Union[str, Callable[["re.Match[str]"], str]]
+
+
+def _phone(match: "re.Match[str]") -> str:
+    # 纯数字串只在 11–15 位时视为电话号码（如手机号），带 + / 分隔符时 7 位以上即可，避免误伤年份、金额与 ID
+    raw = match.group(0)
+    digits = sum(c.isdigit() for c in raw)
+    formatted = raw.startswith("+") or not raw.isdigit()
+    if (formatted and 7 <= digits <= 15) or 11 <= digits <= 15:
+        return "[PHONE]"
+    return raw
+
+
+BUILTIN_PATTERNS: Dict[str, List[Tuple["re.Pattern[str]", _Replacement]]] = {
+    "email": [(re.compile(r"\b[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}\b"), "[EMAIL]")],
+    "phone": [(re.compile(r"(?<![\w.+-])\+?\(?\d[\d\s().-]{5,}\d(?![\w.-])"), _phone)],
+    "api_key": [
+        (re.compile(r"\b(?:sk|pk|rk)-(?:[A-Za-z0-9]+-)*[A-Za-z0-9_-]{16,}"), "[API_KEY]"),
+        (re.compile(r"\b(?:AKIA|ASIA)[0-9A-Z]{16}\b"), "[API_KEY]"),
+        (re.compile(r"\b(?:ghp|gho|ghs|ghu|ghr)_[A-Za-z0-9]{30,}\b|\bgithub_pat_[A-Za-z0-9_]{40,}"), "[API_KEY]"),
+        (re.compile(r"\bxox[abprs]-[A-Za-z0-9-]{10,}"), "[API_KEY]"),
+        (re.compile(r"\bAIza[0-9A-Za-z_-]{35}\b"), "[API_KEY]"),
+        (re.compile(r"\beyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]*"), "[API_KEY]"),
+    ],
+}
+
+_compiled: Optional[List[Tuple["re.Pattern[str]", _Replacement]]] = None
+
+
+def _patterns() -> List[Tuple["re.Pattern[str]", _Replacement]]:
+    """Enabled built-in patterns, then the config file's pii_patterns."""
+    global _compiled
+    if _compiled is None:
+        patterns: List[Tuple["re.Pattern[str]", _Replacement]] = []
+        for kind in PII_SCRUB_TYPES:
+            patterns.extend(BUILTIN_PATTERNS.get(kind, []))
+        for custom in get_config_section("pii_patterns", []) or []:
+            replacement = custom.get("replacement") or f"[{str(custom['name']).upper()}]"
+            patterns.append((re.compile(custom["pattern"]), replacement))
+        _compiled = patterns
+    return _compiled
+
+
+def scrub_enabled(key_id: Optional[str]) -> bool:
+    """PII_SCRUB, unless the API key's entry sets pii_scrub."""
+    entry = (api_key_entry(key_id) if key_id else None) or {}
+    return bool(entry.get("pii_scrub", PII_SCRUB))
+
+
+def scrub_text(text: str) -> Tuple[str, int]:
+    """Mask every PII match; returns the text and the number of replacements."""
+    total = 0
+
+    def replace(match: "re.Match[str]", replacement: _Replacement) -> str:
+        nonlocal total
+        out = replacement(match) if callable(replacement) else match.expand(replacement)
+        # 启发式规则可能保留原文（如 _phone 放过年份），不计入遮盖次数
+        if out != match.group(0):
+            total += 1
+        return out
+
+    for pattern, replacement in _patterns():
+        text = pattern.sub(lambda m: replace(m, replacement), text)
+    return text, total
+
+
+def _scrub_content(content: Any) -> Tuple[Any, int]:
+    if isinstance(content, str):
+        return scrub_text(content)
+    if isinstance(content, list):
+        out, total = [], 0
+        for item in content:
+            if isinstance(item, dict) and isinstance(item.get("text"), str):
+                text, count = scrub_text(item["text"])
+                item = {**item, "text": text}
+                total += count
+            out.append(item)
+        return out, total
+    return content, 0
+
+
+def scrub_messages(messages: List[Any]) -> List[Any]:
+    """Copies of the chat messages with PII masked in their content and tool-call arguments."""
+    scrubbed, total = [], 0
+    for message in messages:
+        data = message.dict()
+        data["content"], count = _scrub_content(data.get("content"))
+        total += count
+        for call in data.get("tool_calls") or []:
+            arguments = (call.get("function") or {}).get("arguments")
+            if isinstance(arguments, str):
+                call["function"]["arguments"], count = scrub_text(arguments)
+                total += count
+        scrubbed.append(type(message)(**data))
+    if total:
+        request_fields()["pii_masked"] = request_fields().get("pii_masked", 0) + total
+    return scrubbed
+
+
+class PiiLogFilter(logging.Filter):
+    """Mask PII in log lines written while serving a request whose key has scrubbing on."""
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        if getattr(record, "_pii_scrubbed", False) or not scrub_enabled(request_fields().get("key_id")):
+            return True
+        try:
+            record.msg = scrub_text(record.getMessage())[0]
+            record.args = None
+        except Exception:
+            pass
+        record._pii_scrubbed = True
+        return True
+
+
+def add_pii_scrubbing(handlers: List[logging.Handler]) -> None:
+    for handler in handlers:
+        if not any(isinstance(f, PiiLogFilter) for f in handler.filters):
+            handler.addFilter(PiiLogFilter())
@@ -0,0 +1,180 @@
+from __future__ import annotations
+
+import re
+from typing import Any, Dict, List, Optional
+
+from .config import POST_PROCESS_WINDOW, api_key_entry
+from .model_overrides import model_setting
+
+
+class _RegexReplace:
+    """re.sub over the text; a match may span chunks as long as it fits in the window."""
+
+    def __init__(self, spec: Dict[str, Any], window: int):
+        self.pattern = re.compile(spec["pattern"], re.MULTILINE)
+        self.replacement = spec.get("replacement") or ""
+        self.window = window
+        self._buf = ""
+
+    def _drain(self, final: bool) -> str:
+        buf = self._buf
+        cut = len(buf) if final else len(buf) - self.window
+        if cut <= 0:
+            return ""
+        out: List[str] = []
+        pos = 0
+        for match in self.pattern.finditer(buf):
+            if match.start() >= cut:
+                break
+            if match.end() > cut and not final:
+                # 跨越窗口边界的匹配等更多文本到达后再处理
+                cut = match.start()
+                break
+            out.append(buf[pos:match.start()])
+            out.append(match.expand(self.replacement))
+            pos = match.end()
+        out.append(buf[pos:cut])
+        self._buf = buf[max(pos, cut):]
+        return "".join(out)
+
+    def feed(self, text: str) -> str:
+        self._buf += text
+        return self._drain(final=False)
+
+    def flush(self) -> str:
+        return self._drain(final=True)
+
+
+class _StripFences:
+    """Drop markdown code fence lines (``` / ```lang), keeping the code between them."""
+
+    def __init__(self, spec: Dict[str, Any], window: int):
+        self._line = ""
+
+    @staticmethod
+    def _is_fence(line: str) -> bool:
+        return line.strip().startswith("```")
+
+    def feed(self, text: str) -> str:
+        out: List[str] = []
+        self._line += text
+        while "\n" in self._line:
+            line, self._line = self._line.split("\n", 1)
+            if not self._is_fence(line):
+                out.append(line + "\n")
+        # 未结束的一行只要不可能是围栏就直接输出
+        stripped = self._line.lstrip()
+        if stripped and not "```".startswith(stripped[:3]):
+            out.append(self._line)
+            self._line = ""
+        return "".join(out)
+
+    def flush(self) -> str:
+        line, self._line = self._line, ""
+        return "" if self._is_fence(line) else line
+
+
+class _TrimAfterStop:
+    """Cut the text at the first stop marker (the marker itself is dropped too)."""
+
+    def __init__(self, spec: Dict[str, Any], window: int):
+        self.markers = [m for m in spec["markers"] if m]
+        self.hold = max((len(m) for m in self.markers), default=1) - 1
+        self.stopped = False
+        self._buf = ""
+
+    def feed(self, text: str) -> str:
+        if self.stopped:
+            return ""
+        self._buf += text
+        hits = [i for i in (self._buf.find(m) for m in self.markers) if i >= 0]
+        if hits:
+            out, self._buf = self._buf[:min(hits)], ""
+            self.stopped = True
+            return out
+        # 保留可能是标记开头的尾部
+        cut = max(len(self._buf) - self.hold, 0)
+        out, self._buf = self._buf[:cut], self._buf[cut:]
+        return out
+
+    def flush(self) -> str:
+        out, self._buf = self._buf, ""
+        return out
+
+
+class _DedupeWhitespace:
+    """Collapse runs of spaces / tabs between words, trailing spaces and runs of blank lines.
+
+    Leading indentation is kept, so code blocks survive.
+    """
+
+    def __init__(self, spec: Dict[str, Any], window: int):
+        self._buf = ""
+        self._prev = ""
+
+    def _collapse(self, text: str) -> str:
+        # 带上已输出的最后一个字符，词间空白的判断才不受分块影响
+        out = re.sub(r"[ \t]+\n", "\n", self._prev + text)
+        out = re.sub(r"\n{3,}", "\n\n", out)
+        out = re.sub(r"(?<=\S)[ \t]{2,}", " ", out)[len(self._prev):]
+        self._prev = out[-1:] or self._prev
+        return out
+
+    def feed(self, text: str) -> str:
+        self._buf += text
+        # 末尾的空白要等下一个非空白字符到达后才能确定如何合并
+        end = len(self._buf.rstrip(" \t\n"))
+        if end == 0:
+            return ""
+        chunk, self._buf = self._buf[:end], self._buf[end:]
+        return self._collapse(chunk)
+
+    def flush(self) -> str:
+        chunk, self._buf = self._buf, ""
+        return self._collapse(chunk) if chunk else ""
+
+
+PROCESSOR_TYPES = {
+    "regex_replace": _RegexReplace,
+    "strip_markdown_fences": _StripFences,
+    "trim_after_stop": _TrimAfterStop,
+    "dedupe_whitespace": _DedupeWhitespace,
+}
+
+
+class PostProcessor:
+    """A chain of post-processors over one choice's text.
+
+    feed() returns what can be emitted now; text that a later chunk could still change
+    (a possible stop marker, a partial fence line, the regex window) is held back until
+    the next feed or flush(). Processing all text at once gives the same result.
+    """
+
+    def __init__(self, specs: List[Dict[str, Any]], window: int = POST_PROCESS_WINDOW):
+        self.stages = [PROCESSOR_TYPES[spec["type"]](spec, window) for spec in specs]
+
+    def feed(self, text: str) -> str:
+        for stage in self.stages:
+            if not text:
+                break
+            text = stage.feed(text)
+        return text
+
+    def flush(self) -> str:
+        text = ""
+        for stage in self.stages:
+            text = (stage.feed(text) if text else "") + stage.flush()
+        return text
+
+    def process(self, text: str) -> str:
+        return self.feed(text) + self.flush()
+
+
+def post_processors_for(key_id: Optional[str], model: Optional[str], warp_model: Optional[str]) -> List[Dict[str, Any]]:
+    """The model's post_processors (model_overrides) followed by the API key's (keys[])."""
+    entry = (api_key_entry(key_id) if key_id else None) or {}
+    return list(model_setting(model, warp_model, "post_processors") or []) + list(entry.get("post_processors") or [])
+
+
+def build_post_processor(specs: Optional[List[Dict[str, Any]]]) -> Optional[PostProcessor]:
+    return PostProcessor(specs) if specs else None
@@ -0,0 +1,116 @@
+from __future__ import annotations
+
+import asyncio
+import cProfile
+import hmac
+import io
+import marshal
+import pstats
+import sys
+import threading
+import time
+import traceback
+import tracemalloc
+from typing import List
+
+from fastapi import APIRouter, HTTPException, Query, Request
+from fastapi.responses import PlainTextResponse, Response
+
+from .config import ADMIN_TOKEN
+from .logging import logger
+
+# 仅在 DEBUG_PROFILING 开启且设置了 ADMIN_TOKEN 时挂载（见 app.py）
+debug_router = APIRouter(prefix="/debug/pprof")
+
+_cpu_lock = asyncio.Lock()
+_MAX_PROFILE_SECONDS = 300
+
+
+def _require_admin(request: Request) -> None:
+    authorization = request.headers.get("authorization") or ""
+    token = authorization[7:] if authorization.startswith("Bearer ") else ""
+    if not ADMIN_TOKEN or not hmac.compare_digest(token.encode(), ADMIN_TOKEN.encode()):
+        # 与未启用时一致返回 404，不暴露调试端点的存在
+        raise HTTPException(status_code=404, detail="Not Found")
+
+
+@debug_router.get("/")
+async def index(request: Request):
+    _require_admin(request)
+    return PlainTextResponse(
+        "/debug/pprof/profile?seconds=30[&format=pstats]  CPU profile of the event loop thread (cProfile)\n"
+        "/debug/pprof/heap[?limit=50]                     allocation sites (tracemalloc; first call starts tracing)\n"
+        "/debug/pprof/heap/stop                           stop tracemalloc and free its overhead\n"
+        "/debug/pprof/tasks                               stacks of all asyncio tasks and threads\n"
+    )
+
+
+@debug_router.get("/profile")
+async def cpu_profile(request: Request, seconds: float = Query(30, gt=0, le=_MAX_PROFILE_SECONDS),
+                      format: str = Query("text", pattern="^(text|pstats)$"), sort: str = Query("cumulative")):
+    """Profile everything the event loop runs for `seconds` (text report, or a .prof file for snakeviz)."""
+    _require_admin(request)
+    if _cpu_lock.locked():
+        raise HTTPException(status_code=409, detail="a CPU profile is already running")
+    async with _cpu_lock:
+        logger.warning("[OpenAI Compat] 开始 CPU profile (%.0fs)", seconds)
+        profiler = cProfile.Profile()
+        profiler.enable()
+        try:
+            await asyncio.sleep(seconds)
+        finally:
+            profiler.disable()
+    if format == "pstats":
+        profiler.create_stats()
+        return Response(marshal.dumps(profiler.stats), media_type="application/octet-stream",
+                        headers={"Content-Disposition": f'attachment; filename="cpu-{int(time.time())}.prof"'})
+    out = io.StringIO()
+    try:
+        pstats.Stats(profiler, stream=out).sort_stats(sort).print_stats(80)
+    except KeyError:
+        raise HTTPException(status_code=400, detail=f"unknown sort key: {sort}")
+    return PlainTextResponse(out.getvalue())
+
+
+@debug_router.get("/heap")
+async def heap(request: Request, limit: int = Query(50, gt=0, le=1000), group_by: str = Query("lineno", pattern="^(lineno|filename|traceback)$")):
+    _require_admin(request)
+    if not tracemalloc.is_tracing():
+        tracemalloc.start(16)
+        return PlainTextResponse("tracemalloc started; request this endpoint again after some traffic to see allocation sites\n")
+    snapshot = tracemalloc.take_snapshot()
+    current, peak = tracemalloc.get_traced_memory()
+    lines: List[str] = [f"traced: current={current / 1048576:.1f} MiB peak={peak / 1048576:.1f} MiB", ""]
+    for stat in snapshot.statistics(group_by)[:limit]:
+        lines.append(str(stat))
+        if group_by == "traceback":
+            lines.extend("    " + line for line in stat.traceback.format())
+    return PlainTextResponse("\n".join(lines) + "\n")
+
+
+@debug_router.get("/heap/stop")
+async def heap_stop(request: Request):
+    _require_admin(request)
+    tracemalloc.stop()
+    return PlainTextResponse("tracemalloc stopped\n")
+
+
+@debug_router.get("/tasks")
+async def tasks(request: Request):
+    """Stack of every asyncio task and thread, the closest analogue to a goroutine dump."""
+    _require_admin(request)
+    out = io.StringIO()
+    all_tasks = asyncio.all_tasks()
+    out.write(f"asyncio tasks: {len(all_tasks)}\n\n")
+    for task in sorted(all_tasks, key=lambda t: t.get_name()):
+        out.write(f"--- {task.get_name()} {task.get_coro()!r}\n")
+        task.print_stack(limit=20, file=out)
+        out.write("\n")
+    frames = sys._current_frames()
+    out.write(f"threads: {len(frames)}\n\n")
+    names = {t.ident: t.name for t in threading.enumerate()}
+    for ident, frame in frames.items():
+        out.write(f"--- thread {names.get(ident, ident)}\n")
+        out.write("".join(traceback.format_stack(frame, limit=20)))
+        out.write("\n")
+    return PlainTextResponse(out.getvalue())
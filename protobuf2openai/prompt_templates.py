@@ -0,0 +1,88 @@
+from __future__ import annotations
+
+from typing import Any, Dict, List, Optional
+
+from warp2protobuf.config.config_file import get_config_section
+
+from .config import api_key_entry, SYSTEM_PROMPT, SYSTEM_PROMPT_MODE
+from .helpers import normalize_content_to_list
+from .logging import logger
+from .model_overrides import model_setting
+from .models import ChatMessage
+
+
+def apply_system_prompt_policy(history: List[ChatMessage], key_id: Optional[str]) -> List[ChatMessage]:
+    """Prepend / append the configured system prompt, or replace the client's system messages with it."""
+    entry = (api_key_entry(key_id) if key_id else None) or {}
+    text = entry.get("system_prompt", SYSTEM_PROMPT)
+    if not text:
+        return history
+    mode = entry.get("system_prompt_mode") or SYSTEM_PROMPT_MODE
+    policy = ChatMessage(role="system", content=text)
+    if mode == "replace":
+        return [policy] + [m for m in history if m.role != "system"]
+    if mode == "append":
+        last_system = max((i for i, m in enumerate(history) if m.role == "system"), default=-1)
+        return history[:last_system + 1] + [policy] + history[last_system + 1:]
+    return [policy] + history
+
+
+def template_for(key_id: Optional[str], model: Optional[str], warp_model: Optional[str]) -> Optional[str]:
+    """Name of the prompt template to apply: the API key's (keys[].prompt_template) over the model's."""
+    entry = api_key_entry(key_id) if key_id else None
+    name = (entry or {}).get("prompt_template") or model_setting(model, warp_model, "prompt_template")
+    return str(name) if name else None
+
+
+def _wrap_user(message: ChatMessage, prefix: str, suffix: str) -> ChatMessage:
+    if isinstance(message.content, str):
+        content: Any = f"{prefix}{message.content}{suffix}"
+    else:
+        # 多段内容（含图片等）只在首尾追加文本段
+        content = normalize_content_to_list(message.content)
+        if prefix:
+            content = [{"type": "text", "text": prefix}] + content
+        if suffix:
+            content = content + [{"type": "text", "text": suffix}]
+    return ChatMessage(role=message.role, content=content, name=message.name)
+
+
+def apply_prompt_template(history: List[ChatMessage], key_id: Optional[str], model: Optional[str],
+                          warp_model: Optional[str], has_tools: bool) -> List[ChatMessage]:
+    """Return history with the selected template's system text, few-shot examples and user wrapping applied."""
+    name = template_for(key_id, model, warp_model)
+    if not name:
+        return history
+    template: Dict[str, Any] = (get_config_section("prompt_templates", {}) or {}).get(name) or {}
+    if not template:
+        logger.warning("[OpenAI Compat] 提示词模板不存在: %s", name)
+        return history
+
+    out = list(history)
+    leading = 0
+    while leading < len(out) and out[leading].role == "system":
+        leading += 1
+    # 示例对话放在前导 system 消息之后、真实历史之前
+    examples: List[ChatMessage] = []
+    for example in template.get("examples") or []:
+        examples.append(ChatMessage(role="user", content=example["user"]))
+        examples.append(ChatMessage(role="assistant", content=example["assistant"]))
+    out[leading:leading] = examples
+
+    # system 消息按出现顺序拼接成系统提示，后缀放在最后一条 system 之后（不能成为最后一条消息）
+    suffixes = [template.get("system_suffix")]
+    if has_tools:
+        suffixes.append(template.get("tool_preamble"))
+    last_system = max((i for i, m in enumerate(out) if m.role == "system"), default=-1)
+    for text in reversed([s for s in suffixes if s]):
+        out.insert(last_system + 1, ChatMessage(role="system", content=text))
+    if template.get("system_prefix"):
+        out.insert(0, ChatMessage(role="system", content=template["system_prefix"]))
+
+    prefix, suffix = template.get("user_prefix") or "", template.get("user_suffix") or ""
+    if prefix or suffix:
+        for i in range(len(out) - 1, -1, -1):
+            if out[i].role == "user":
+                out[i] = _wrap_user(out[i], prefix, suffix)
+                break
+    return out
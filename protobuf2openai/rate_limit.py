@@ -0,0 +1,76 @@
+from __future__ import annotations
+
+import math
+import time
+from collections import OrderedDict
+from typing import Any, Dict, Optional, Tuple
+
+from .config import RATE_LIMIT_RPS, RATE_LIMIT_BURST, RATE_LIMIT_MAX_KEYS
+
+
+class TokenBucket:
+    __slots__ = ("rate", "burst", "tokens", "updated")
+
+    def __init__(self, rate: float, burst: int, now: float):
+        self.rate = rate
+        self.burst = burst
+        self.tokens = float(burst)
+        self.updated = now
+
+    def take(self, now: float) -> float:
+        """Consume one token; returns 0 on success, else seconds until one is available."""
+        self.tokens = min(self.burst, self.tokens + (now - self.updated) * self.rate)
+        self.updated = now
+        if self.tokens >= 1:
+            self.tokens -= 1
+            return 0.0
+        return (1 - self.tokens) / self.rate
+
+
+class KeyedRateLimiter:
+    """One token bucket per client key, kept in an LRU so idle clients do not accumulate.
+
+    Evicting a key only forgets its history: a returning client starts with a full
+    burst, which errs on the side of letting traffic through.
+    """
+
+    def __init__(self, rate: float, burst: int, max_keys: int = 10000):
+        self.rate = rate
+        self.burst = max(1, burst)
+        self.max_keys = max(1, max_keys)
+        self._buckets: "OrderedDict[str, TokenBucket]" = OrderedDict()
+
+    @property
+    def enabled(self) -> bool:
+        return self.rate > 0
+
+    def configure(self, rate: Optional[float] = None, burst: Optional[int] = None) -> None:
+        """Change the limits at runtime; clients start over with a full bucket at the new rate."""
+        if rate is not None:
+            self.rate = rate
+        if burst is not None:
+            self.burst = max(1, burst)
+        self._buckets.clear()
+
+    def stats(self) -> Dict[str, Any]:
+        return {"rate": self.rate, "burst": self.burst, "max_keys": self.max_keys, "tracked_keys": len(self._buckets)}
+
+    def check(self, key: str, now: Optional[float] = None) -> Tuple[bool, int]:
+        """(allowed, retry_after_seconds) for one request from `key`."""
+        now = time.monotonic() if now is None else now
+        bucket = self._buckets.get(key)
+        if bucket is None:
+            bucket = TokenBucket(self.rate, self.burst, now)
+            self._buckets[key] = bucket
+            if len(self._buckets) > self.max_keys:
+                self._buckets.popitem(last=False)
+        else:
+            self._buckets.move_to_end(key)
+        wait = bucket.take(now)
+        return wait == 0, math.ceil(wait)
+
+    def __len__(self) -> int:
+        return len(self._buckets)
+
+
+rate_limiter = KeyedRateLimiter(RATE_LIMIT_RPS, RATE_LIMIT_BURST, RATE_LIMIT_MAX_KEYS)
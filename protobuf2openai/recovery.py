@@ -0,0 +1,40 @@
+from __future__ import annotations
+
+import traceback
+from typing import Any, Dict
+
+from fastapi import Request
+from fastapi.responses import JSONResponse
+
+from warp2protobuf.core.request_context import current_request_id
+
+from .logging import logger
+
+# Anthropic Messages 风格的路由返回 Anthropic 错误结构，其余返回 OpenAI 结构
+_ANTHROPIC_PREFIXES = ("/v1/messages",)
+
+
+def is_anthropic_route(path: str) -> bool:
+    return path.startswith(_ANTHROPIC_PREFIXES)
+
+
+def internal_error_body(path: str, request_id: str | None) -> Dict[str, Any]:
+    message = "internal server error"
+    if request_id:
+        message += f" (request id {request_id})"
+    if is_anthropic_route(path):
+        body: Dict[str, Any] = {"type": "error", "error": {"type": "api_error", "message": message}}
+        if request_id:
+            body["request_id"] = request_id
+        return body
+    return {"error": {"message": message, "type": "server_error", "code": "internal_error"}}
+
+
+async def recover(request: Request, call_next):
+    """Turn unhandled exceptions into a 500 in the route's API error schema (logged with stack)."""
+    try:
+        return await call_next(request)
+    except Exception as e:
+        request_id = getattr(request.state, "request_id", None) or current_request_id()
+        logger.error("[OpenAI Compat] 未处理异常 %s %s: %s\n%s", request.method, request.url.path, e, traceback.format_exc())
+        return JSONResponse(status_code=500, content=internal_error_body(request.url.path, request_id))
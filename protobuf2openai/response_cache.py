@@ -0,0 +1,322 @@
+from __future__ import annotations
+
+import copy
+import hashlib
+import json
+import os
+import pathlib
+import threading
+import time
+from collections import OrderedDict
+from typing import Any, Dict, Optional, Tuple
+from urllib.parse import urlparse
+
+from .config import (
+    RESPONSE_CACHE_TTL, RESPONSE_CACHE_MAX_ENTRIES, RESPONSE_CACHE_MAX_MB, RESPONSE_CACHE_SNAPSHOT, MODELS_CACHE_TTL, MODELS_CACHE_STALE,
+    RESPONSE_CACHE_BACKEND, RESPONSE_CACHE_REDIS_URL, RESPONSE_CACHE_REDIS_PREFIX, RESPONSE_CACHE_REDIS_PASSWORD,
+    response_cache_model_ttls,
+)
+from .logging import logger
+from .models import ChatCompletionsRequest
+
+# 不影响生成结果的字段不参与缓存键
+_IGNORED_FIELDS = ("stream", "stream_options")
+
+_SNAPSHOT_VERSION = 1
+
+
+def request_cache_key(req: ChatCompletionsRequest, key_id: Optional[str] = None) -> str:
+    """Hash of the normalized request (model, messages, sampling params, tools), per API key.
+
+    None-valued fields are dropped and keys are sorted, so requests that differ only in
+    field order or explicit nulls share an entry; the API key id keeps tenants apart.
+    """
+    body = {k: v for k, v in req.dict(exclude_none=True).items() if k not in _IGNORED_FIELDS}
+    canonical = json.dumps({"key": key_id or "", "request": body}, sort_keys=True, ensure_ascii=False, separators=(",", ":"))
+    return hashlib.sha256(canonical.encode("utf-8")).hexdigest()
+
+
+class CacheBackend:
+    """Storage for cached JSON bodies with a per-entry expiry; failures are the caller's to absorb."""
+
+    name = "none"
+
+    async def get(self, key: str) -> Optional[Dict[str, Any]]:
+        raise NotImplementedError
+
+    async def set(self, key: str, body: Dict[str, Any], ttl: float) -> None:
+        raise NotImplementedError
+
+    async def clear(self) -> int:
+        raise NotImplementedError
+
+    async def close(self) -> None:
+        pass
+
+    def status(self) -> Dict[str, Any]:
+        return {"backend": self.name}
+
+
+class MemoryCacheBackend(CacheBackend):
+    """Per-process LRU, bounded by max_entries and an approximate byte budget (0 = no limit).
+
+    Sizes are those of the bodies as compact JSON; the least recently used entries are
+    evicted first. Can be saved to / restored from a snapshot file across restarts.
+    """
+
+    name = "memory"
+
+    def __init__(self, max_entries: int = 0, max_bytes: int = 0):
+        self.max_entries = max_entries
+        self.max_bytes = max_bytes
+        # key -> (过期时间, 响应体, 估算字节数)，按最近使用排序
+        self._entries: "OrderedDict[str, Tuple[float, Dict[str, Any], int]]" = OrderedDict()
+        self._bytes = 0
+        self._lock = threading.Lock()
+        self.evictions = 0
+
+    async def get(self, key: str) -> Optional[Dict[str, Any]]:
+        now = time.time()
+        with self._lock:
+            entry = self._entries.get(key)
+            if entry is not None and entry[0] <= now:
+                self._drop(key)
+                entry = None
+            if entry is None:
+                return None
+            self._entries.move_to_end(key)
+            return copy.deepcopy(entry[1])
+
+    async def set(self, key: str, body: Dict[str, Any], ttl: float) -> None:
+        self._store(key, time.time() + ttl, body)
+
+    def _store(self, key: str, expires: float, body: Dict[str, Any]) -> None:
+        size = len(json.dumps(body, ensure_ascii=False, separators=(",", ":")).encode("utf-8"))
+        if self.max_bytes and size > self.max_bytes:
+            return
+        now = time.time()
+        with self._lock:
+            if key in self._entries:
+                self._drop(key)
+            # 顺带清理已过期的条目
+            for stale in [k for k, (expires, _, _) in self._entries.items() if expires <= now]:
+                self._drop(stale)
+            self._entries[key] = (expires, copy.deepcopy(body), size)
+            self._bytes += size
+            while self._entries and ((self.max_entries and len(self._entries) > self.max_entries)
+                                     or (self.max_bytes and self._bytes > self.max_bytes)):
+                self._drop(next(iter(self._entries)))
+                self.evictions += 1
+
+    def _drop(self, key: str) -> None:
+        _, _, size = self._entries.pop(key)
+        self._bytes -= size
+
+    async def clear(self) -> int:
+        with self._lock:
+            count = len(self._entries)
+            self._entries.clear()
+            self._bytes = 0
+            return count
+
+    def save(self, path: pathlib.Path) -> int:
+        """Write the unexpired entries (least recently used first) to `path`; returns how many."""
+        now = time.time()
+        with self._lock:
+            entries = [[key, expires, body] for key, (expires, body, _) in self._entries.items() if expires > now]
+        path.parent.mkdir(parents=True, exist_ok=True)
+        tmp = path.with_name(path.name + ".tmp")
+        with open(tmp, "w", encoding="utf-8") as f:
+            json.dump({"version": _SNAPSHOT_VERSION, "saved_at": now, "entries": entries}, f, ensure_ascii=False)
+        # 先写临时文件再替换，关机中途被杀也不会留下半个快照
+        os.replace(tmp, path)
+        return len(entries)
+
+    def load(self, path: pathlib.Path) -> int:
+        """Restore entries saved by save() that have not expired since; returns how many."""
+        with open(path, encoding="utf-8") as f:
+            data = json.load(f)
+        if not isinstance(data, dict) or data.get("version") != _SNAPSHOT_VERSION:
+            raise ValueError(f"unsupported snapshot format: {path}")
+        now = time.time()
+        loaded = 0
+        for key, expires, body in data.get("entries") or []:
+            if expires > now and isinstance(body, dict):
+                self._store(key, expires, body)
+                loaded += 1
+        return loaded
+
+    def status(self) -> Dict[str, Any]:
+        with self._lock:
+            entries, size = len(self._entries), self._bytes
+        return {
+            "backend": self.name,
+            "entries": entries,
+            "max_entries": self.max_entries,
+            "bytes": size,
+            "max_bytes": self.max_bytes,
+            "evictions": self.evictions,
+        }
+
+
+class RedisCacheBackend(CacheBackend):
+    """Redis-backed cache shared by every instance pointing at the same server and prefix.
+
+    Entries expire through Redis TTLs; eviction under memory pressure is left to the
+    server's maxmemory-policy.
+    """
+
+    name = "redis"
+
+    def __init__(self, url: str, prefix: str, password: str = ""):
+        import redis.asyncio as redis
+        self.url = url
+        self.prefix = prefix
+        self._client = redis.from_url(url, password=password or None, decode_responses=True)
+
+    async def get(self, key: str) -> Optional[Dict[str, Any]]:
+        raw = await self._client.get(self.prefix + key)
+        return json.loads(raw) if raw else None
+
+    async def set(self, key: str, body: Dict[str, Any], ttl: float) -> None:
+        await self._client.set(self.prefix + key, json.dumps(body, ensure_ascii=False), px=max(1, int(ttl * 1000)))
+
+    async def clear(self) -> int:
+        count = 0
+        # 只删除本前缀下的键，不影响同一库中的其他数据
+        async for name in self._client.scan_iter(match=self.prefix + "*", count=500):
+            count += await self._client.delete(name)
+        return count
+
+    async def close(self) -> None:
+        await self._client.aclose()
+
+    def status(self) -> Dict[str, Any]:
+        password = urlparse(self.url).password
+        url = self.url.replace(f":{password}@", ":***@") if password else self.url
+        return {"backend": self.name, "url": url, "prefix": self.prefix}
+
+
+def open_cache_backend() -> CacheBackend:
+    """Backend selected by RESPONSE_CACHE_BACKEND ("memory" or "redis")."""
+    if RESPONSE_CACHE_BACKEND == "redis":
+        return RedisCacheBackend(RESPONSE_CACHE_REDIS_URL, RESPONSE_CACHE_REDIS_PREFIX, RESPONSE_CACHE_REDIS_PASSWORD)
+    return MemoryCacheBackend(RESPONSE_CACHE_MAX_ENTRIES, int(RESPONSE_CACHE_MAX_MB * 1024 * 1024))
+
+
+class ResponseCache:
+    """Per-model TTL policy for cached non-streaming chat completions (and the model list) over a backend.
+
+    Backend errors are logged and treated as misses, so an unreachable Redis only costs
+    the cache, never the request.
+    """
+
+    def __init__(self, default_ttl: float, model_ttls: Dict[str, float], backend: CacheBackend,
+                 models_ttl: float = 0, models_stale: float = 0):
+        self.default_ttl = default_ttl
+        self.model_ttls = model_ttls
+        self.models_ttl = models_ttl
+        self.models_stale = models_stale
+        self.backend = backend
+        self.hits = 0
+        self.misses = 0
+        self.errors = 0
+
+    @property
+    def enabled(self) -> bool:
+        return self.default_ttl > 0 or any(ttl > 0 for ttl in self.model_ttls.values())
+
+    def ttl_for(self, model: Optional[str]) -> float:
+        return self.model_ttls.get(model or "", self.default_ttl)
+
+    async def get(self, key: str) -> Optional[Dict[str, Any]]:
+        try:
+            body = await self.backend.get("completion:" + key)
+        except Exception as e:
+            self.errors += 1
+            logger.warning("[OpenAI Compat] 响应缓存读取失败 (%s): %s", self.backend.name, e)
+            body = None
+        if body is None:
+            self.misses += 1
+        else:
+            self.hits += 1
+        return body
+
+    async def put(self, key: str, model: Optional[str], body: Dict[str, Any]) -> None:
+        ttl = self.ttl_for(model)
+        if ttl > 0:
+            await self._set("completion:" + key, body, ttl)
+
+    async def get_models(self) -> Tuple[Optional[Dict[str, Any]], bool]:
+        """Cached model list and whether it is past models_ttl (still servable, but due for a refresh)."""
+        if self.models_ttl <= 0:
+            return None, False
+        try:
+            entry = await self.backend.get("models")
+        except Exception as e:
+            self.errors += 1
+            logger.warning("[OpenAI Compat] 模型列表缓存读取失败 (%s): %s", self.backend.name, e)
+            return None, False
+        if not isinstance(entry, dict) or not isinstance(entry.get("body"), dict):
+            return None, False
+        return entry["body"], time.time() - float(entry.get("fetched_at") or 0) >= self.models_ttl
+
+    async def put_models(self, body: Dict[str, Any]) -> None:
+        if self.models_ttl > 0:
+            # 后端中多保留 stale 秒，过期后仍可先返回旧列表再在后台刷新
+            await self._set("models", {"fetched_at": time.time(), "body": body}, self.models_ttl + self.models_stale)
+
+    async def _set(self, key: str, body: Dict[str, Any], ttl: float) -> None:
+        try:
+            await self.backend.set(key, body, ttl)
+        except Exception as e:
+            self.errors += 1
+            logger.warning("[OpenAI Compat] 响应缓存写入失败 (%s): %s", self.backend.name, e)
+
+    async def clear(self) -> int:
+        return await self.backend.clear()
+
+    def status(self) -> Dict[str, Any]:
+        return dict(
+            self.backend.status(),
+            enabled=self.enabled,
+            default_ttl=self.default_ttl,
+            model_ttls=self.model_ttls,
+            models_ttl=self.models_ttl,
+            models_stale=self.models_stale,
+            hits=self.hits,
+            misses=self.misses,
+            errors=self.errors,
+        )
+
+
+RESPONSE_CACHE = ResponseCache(
+    RESPONSE_CACHE_TTL, response_cache_model_ttls(), open_cache_backend(), MODELS_CACHE_TTL, MODELS_CACHE_STALE
+)
+
+
+def load_cache_snapshot() -> None:
+    """Reload the response cache saved at the previous shutdown (RESPONSE_CACHE_SNAPSHOT, memory backend only)."""
+    backend = RESPONSE_CACHE.backend
+    if not RESPONSE_CACHE_SNAPSHOT or not isinstance(backend, MemoryCacheBackend):
+        return
+    path = pathlib.Path(RESPONSE_CACHE_SNAPSHOT).expanduser()
+    if not path.is_file():
+        return
+    try:
+        loaded = backend.load(path)
+        logger.info("[OpenAI Compat] 已从快照恢复响应缓存: %d 条 (%s)", loaded, path)
+    except Exception as e:
+        logger.warning("[OpenAI Compat] 响应缓存快照读取失败，忽略: %s", e)
+
+
+def save_cache_snapshot() -> None:
+    backend = RESPONSE_CACHE.backend
+    if not RESPONSE_CACHE_SNAPSHOT or not isinstance(backend, MemoryCacheBackend):
+        return
+    path = pathlib.Path(RESPONSE_CACHE_SNAPSHOT).expanduser()
+    try:
+        saved = backend.save(path)
+        logger.info("[OpenAI Compat] 响应缓存已写入快照: %d 条 (%s)", saved, path)
+    except Exception as e:
+        logger.warning("[OpenAI Compat] 响应缓存快照写入失败: %s", e)
@@ -4,23 +4,42 @@ import asyncio
 import json
 import time
 import uuid
+from contextlib import aclosing
 from typing import Any, Dict, List, Optional
 
-import requests
 from fastapi import APIRouter, HTTPException, Request
-from fastapi.responses import StreamingResponse
+from fastapi.responses import JSONResponse, PlainTextResponse
+
+from warp2protobuf.core.request_context import current_request_id, record_finish, record_usage, request_fields
 
 from .logging import logger
 
-from .models import ChatCompletionsRequest, ChatMessage
+from .models import ChatCompletionsRequest, ChatMessage, ConversationCreateRequest, ConversationAppendRequest
 from .reorder import reorder_messages_for_anthropic
-from .helpers import normalize_content_to_list, segments_to_text
+from .helpers import normalize_content_to_list, segments_to_text, extract_usage_from_parsed_events, merge_usage
 from .packets import packet_template, map_history_to_warp_messages, attach_user_and_tools_to_inputs
 from .state import STATE
-from .config import BRIDGE_BASE_URL
 from .bridge import initialize_once
-from .sse_transform import stream_openai_sse
+from .sse_transform import stream_openai_sse_choices
+from .sse import with_heartbeat, until_event, format_sse, sse_done, SSE_PING, SSEStreamingResponse, streaming_unsupported_reason
+from .transport import get_bridge_transport, BridgeError
 from .auth import authenticate_request
+from .model_overrides import apply_model_overrides
+from .drain import DRAIN
+from .metrics import openai_metrics, latency_stats
+from .context_window import fit_context, ContextWindowExceeded
+from .prompt_templates import apply_prompt_template, apply_system_prompt_policy
+from .pii import scrub_enabled, scrub_messages
+from .post_process import build_post_processor, post_processors_for
+from .script_hooks import SCRIPT_HOOKS, ScriptHookError, ScriptVeto
+from .tokens import count_messages, count_anthropic_request, local_usage, message_text, tokenizer_for
+from .conversations import conversation_store, ConversationStore, CONVERSATION_HEADER, StreamedReply, trim_context
+from .response_cache import RESPONSE_CACHE, request_cache_key
+from .singleflight import COMPLETIONS_FLIGHT
+from .upstream_queue import UPSTREAM_QUEUE, UpstreamQueueRejected
+from .json_stream import StreamingJSONGuard, json_mode_of, json_mode_instruction
+from .config import model_alias_map, MAX_CHOICES, SSE_STREAMING, SSE_HEARTBEAT_INTERVAL, SSE_FLUSH_INTERVAL_MS, SSE_FLUSH_BYTES, SSE_WRITE_TIMEOUT
+from .config import UPSTREAM_QUEUE_PROGRESS, CONVERSATION_CONTEXT_MAX_MESSAGES
 
 
 router = APIRouter()
@@ -36,14 +55,71 @@ def health_check():
     return {"status": "ok", "service": "OpenAI Chat Completions (Warp bridge) - Streaming"}
 
 
+@router.get("/livez")
+def liveness_check():
+    # 只表示进程存活；依赖是否可用由 /readyz 判断
+    return {"status": "ok"}
+
+
+@router.get("/readyz")
+async def readiness_check():
+    """Ready = not draining, config valid, bridge reachable with a working Warp credential."""
+    # 维护模式下返回 503，负载均衡器据此摘除实例
+    if DRAIN.draining:
+        return JSONResponse(status_code=503, content={"status": "draining", **DRAIN.status()})
+    from warp2protobuf.config.validation import validate_config
+    errors, _warnings = validate_config("openai")
+    transport = await get_bridge_transport().readiness()
+    ready = not errors and transport.get("ready", False)
+    checks = {"config": {"ok": not errors, "errors": errors}, "transport": transport}
+    return JSONResponse(status_code=200 if ready else 503, content={"status": "ready" if ready else "not_ready", "checks": checks})
+
+
+@router.get("/metrics")
+async def metrics(request: Request):
+    """Prometheus exposition of this server's metrics (same authentication as the API)."""
+    await authenticate_request(request)
+    return PlainTextResponse(openai_metrics.render_prometheus(), media_type="text/plain; version=0.0.4; charset=utf-8")
+
+
+@router.get("/stats")
+async def stats(request: Request):
+    """Latency percentiles (p50 / p95 / p99) per route and model, and time to first token for streams."""
+    await authenticate_request(request)
+    return latency_stats()
+
+
+_models_refresh: Optional[asyncio.Task] = None
+
+
+async def _fetch_models() -> Dict[str, Any]:
+    models = await get_bridge_transport().list_models()
+    await RESPONSE_CACHE.put_models(models)
+    return models
+
+
+async def _refresh_models() -> None:
+    try:
+        await _fetch_models()
+    except Exception as e:
+        logger.warning("[OpenAI Compat] 后台刷新模型列表失败，继续使用缓存: %s", e)
+
+
 @router.get("/v1/models")
-def list_models():
-    """OpenAI-compatible model listing. Forwards to bridge, with local fallback."""
+async def list_models():
+    """OpenAI-compatible model listing. Forwards to bridge, with local fallback.
+
+    With MODELS_CACHE_TTL a cached list is served; once it is older than the TTL it is
+    still served while a single background task fetches a fresh one.
+    """
+    global _models_refresh
+    cached, stale = await RESPONSE_CACHE.get_models()
+    if cached is not None:
+        if stale and (_models_refresh is None or _models_refresh.done()):
+            _models_refresh = asyncio.ensure_future(_refresh_models())
+        return cached
     try:
-        resp = requests.get(f"{BRIDGE_BASE_URL}/v1/models", timeout=10.0)
-        if resp.status_code != 200:
-            raise HTTPException(resp.status_code, f"bridge_error: {resp.text}")
-        return resp.json()
+        return await _fetch_models()
     except Exception as e:
         try:
             # Local fallback: construct models directly if bridge is unreachable
@@ -54,6 +130,77 @@ def list_models():
             raise HTTPException(502, f"bridge_unreachable: {e}")
 
 
+async def _conversations(request: Request) -> ConversationStore:
+    await authenticate_request(request)
+    if conversation_store is None:
+        raise HTTPException(404, "会话存储未启用 (CONVERSATION_STORE_PATH)")
+    return conversation_store
+
+
+def _stored_messages(messages: List[ChatMessage]) -> List[Dict[str, Any]]:
+    return [m.dict(exclude_none=True) for m in messages]
+
+
+@router.post("/v1/conversations", status_code=201)
+async def create_conversation(body: ConversationCreateRequest, request: Request):
+    store = await _conversations(request)
+    return await asyncio.to_thread(
+        store.create, request_fields()["key_id"], body.model, body.metadata or {}, _stored_messages(body.messages)
+    )
+
+
+@router.get("/v1/conversations")
+async def list_conversations(request: Request, limit: int = 20):
+    store = await _conversations(request)
+    items = await asyncio.to_thread(store.list, request_fields()["key_id"], max(1, min(limit, 100)))
+    return {"object": "list", "data": items}
+
+
+@router.get("/v1/conversations/{conversation_id}")
+async def get_conversation(conversation_id: str, request: Request):
+    store = await _conversations(request)
+    conversation = await asyncio.to_thread(store.get, request_fields()["key_id"], conversation_id)
+    if conversation is None:
+        raise HTTPException(404, f"会话不存在: {conversation_id}")
+    return conversation
+
+
+@router.post("/v1/conversations/{conversation_id}/messages")
+async def append_conversation_messages(conversation_id: str, body: ConversationAppendRequest, request: Request):
+    store = await _conversations(request)
+    if not body.messages:
+        raise HTTPException(400, "messages 不能为空")
+    conversation = await asyncio.to_thread(
+        store.append, request_fields()["key_id"], conversation_id, _stored_messages(body.messages), body.model
+    )
+    if conversation is None:
+        raise HTTPException(404, f"会话不存在: {conversation_id}")
+    return conversation
+
+
+@router.delete("/v1/conversations/{conversation_id}")
+async def delete_conversation(conversation_id: str, request: Request):
+    store = await _conversations(request)
+    if not await asyncio.to_thread(store.delete, request_fields()["key_id"], conversation_id):
+        raise HTTPException(404, f"会话不存在: {conversation_id}")
+    return {"id": conversation_id, "object": "conversation.deleted", "deleted": True}
+
+
+@router.post("/v1/messages/count_tokens")
+async def count_tokens(request: Request):
+    """Anthropic-compatible token count of a Messages request, computed locally (no upstream call)."""
+    await authenticate_request(request)
+    try:
+        body = await request.json()
+    except ValueError:
+        raise HTTPException(400, "请求体必须是 JSON")
+    if not isinstance(body, dict) or not isinstance(body.get("messages"), list):
+        raise HTTPException(400, "messages 必须是数组")
+    model = body.get("model")
+    warp_model = model_alias_map().get(model, model) if model else None
+    return {"input_tokens": count_anthropic_request(body, warp_model), "tokenizer": tokenizer_for(warp_model)}
+
+
 @router.post("/v1/chat/completions")
 async def chat_completions(req: ChatCompletionsRequest, request: Request = None):
     # 认证检查
@@ -68,6 +215,46 @@ async def chat_completions(req: ChatCompletionsRequest, request: Request = None)
     if not req.messages:
         raise HTTPException(400, "messages 不能为空")
 
+    # 运维脚本钩子（SCRIPT_HOOKS_PATH）可以改写或拒绝请求
+    hook_ctx = {"key_id": request_fields().get("key_id"), "request_id": current_request_id(), "stream": bool(req.stream)}
+    if SCRIPT_HOOKS.enabled:
+        try:
+            req = await _apply_request_hook(req, hook_ctx)
+        except ScriptVeto as e:
+            record_finish("error", str(e))
+            raise HTTPException(e.status, str(e))
+
+    # 消息离开本机（发往 Warp、写入日志或会话存储）之前遮盖 PII
+    if scrub_enabled(request_fields().get("key_id")):
+        req.messages = scrub_messages(req.messages)
+
+    # 引用已保存的会话时客户端只发送新消息，历史由服务端补全（并裁剪）
+    conversation_id = request.headers.get(CONVERSATION_HEADER) if request else None
+    new_messages: List[Dict[str, Any]] = []
+    if conversation_id:
+        if conversation_store is None:
+            raise HTTPException(404, "会话存储未启用 (CONVERSATION_STORE_PATH)")
+        conversation = await asyncio.to_thread(conversation_store.get, request_fields().get("key_id"), conversation_id)
+        if conversation is None:
+            raise HTTPException(404, f"会话不存在: {conversation_id}")
+        new_messages = _stored_messages(req.messages)
+        context = trim_context(conversation["messages"] + new_messages, CONVERSATION_CONTEXT_MAX_MESSAGES)
+        req.messages = [ChatMessage(**m) for m in context]
+        req.model = req.model or conversation["model"]
+        request_fields()["conversation_id"] = conversation_id
+
+    async def _remember_turn(reply: Dict[str, Any]) -> None:
+        """Append this turn (the new messages and the first choice's reply) to the referenced conversation."""
+        if not conversation_id:
+            return
+        reply = {k: v for k, v in reply.items() if v is not None}
+        try:
+            await asyncio.to_thread(
+                conversation_store.append, request_fields().get("key_id"), conversation_id, new_messages + [reply], req.model
+            )
+        except Exception as e:
+            logger.warning("[OpenAI Compat] 保存会话 %s 失败: %s", conversation_id, e)
+
     # 1) 打印接收到的 Chat Completions 原始请求体
     try:
         logger.info("[OpenAI Compat] 接收到的 Chat Completions 请求体(原始): %s", json.dumps(req.dict(), ensure_ascii=False))
@@ -86,6 +273,20 @@ async def chat_completions(req: ChatCompletionsRequest, request: Request = None)
     except Exception:
         logger.info("[OpenAI Compat] 整理后的请求体(post-reorder) 序列化失败")
 
+    warp_model = model_alias_map().get(req.model, req.model) if req.model else None
+    # 全局（或按 API key）的系统提示：前置 / 追加，或替换客户端的 system 消息
+    history = apply_system_prompt_policy(history, request_fields().get("key_id"))
+    # 按 API key / 模型套用提示词模板（系统提示前后缀、示例对话、工具前言、用户消息包装）
+    history = apply_prompt_template(history, request_fields().get("key_id"), req.model, warp_model, bool(req.tools))
+    # 超出模型上下文窗口时按配置丢弃 / 摘要较早的消息，或直接拒绝
+    try:
+        history = await fit_context(history, req.model, warp_model, req.max_tokens)
+    except ContextWindowExceeded as e:
+        record_finish("error", str(e))
+        raise HTTPException(400, str(e))
+    # 本地计算的 prompt tokens，上游未报告用量时用于补全 usage
+    prompt_tokens = count_messages(history, warp_model)
+
     system_prompt_text: Optional[str] = None
     try:
         chunks: List[str] = []
@@ -99,6 +300,20 @@ async def chat_completions(req: ChatCompletionsRequest, request: Request = None)
     except Exception:
         system_prompt_text = None
 
+    # 按模型的参数默认值/上下限与系统前言（配置文件 model_overrides 段）
+    request_fields().update(model=req.model, warp_model=warp_model, stream=bool(req.stream))
+    preamble = apply_model_overrides(req, warp_model)
+    if preamble:
+        system_prompt_text = f"{preamble}\n\n{system_prompt_text}" if system_prompt_text else preamble
+
+    # 按模型 / API key 配置的响应后处理（正则替换、去除代码围栏、停止标记截断、合并空白）
+    post_processors = post_processors_for(request_fields().get("key_id"), req.model, warp_model)
+
+    json_mode = json_mode_of(req.response_format)
+    if json_mode:
+        instruction = json_mode_instruction(req.response_format)
+        system_prompt_text = f"{system_prompt_text}\n\n{instruction}" if system_prompt_text else instruction
+
     task_id = STATE.baseline_task_id or str(uuid.uuid4())
     packet = packet_template()
     packet["task_context"] = {
@@ -112,7 +327,7 @@ async def chat_completions(req: ChatCompletionsRequest, request: Request = None)
     }
 
     packet.setdefault("settings", {}).setdefault("model_config", {})
-    packet["settings"]["model_config"]["base"] = req.model or packet["settings"]["model_config"].get("base") or "claude-4.1-opus"
+    packet["settings"]["model_config"]["base"] = warp_model or packet["settings"]["model_config"].get("base") or "claude-4.1-opus"
 
     if STATE.conversation_id:
         packet.setdefault("metadata", {})["conversation_id"] = STATE.conversation_id
@@ -142,42 +357,201 @@ async def chat_completions(req: ChatCompletionsRequest, request: Request = None)
     completion_id = str(uuid.uuid4())
     model_id = req.model or "warp-default"
 
-    if req.stream:
+    n_choices = req.n if req.n is not None else 1
+    if n_choices < 1 or n_choices > MAX_CHOICES:
+        raise HTTPException(400, f"n 必须在 1 到 {MAX_CHOICES} 之间")
+
+    stream = bool(req.stream)
+    if stream:
+        fallback_reason = streaming_unsupported_reason(request, SSE_STREAMING)
+        if fallback_reason:
+            logger.warning("[OpenAI Compat] 无法流式输出 (%s)，降级为非流式响应", fallback_reason)
+            stream = False
+
+    # Warp 限流期间按 API key 轮流排队
+    queue_key = request_fields().get("key_id") or "anonymous"
+
+    if stream:
+        # 队列已满时在开始流式响应之前直接返回 429
+        try:
+            UPSTREAM_QUEUE.check_capacity()
+        except UpstreamQueueRejected as e:
+            record_finish("error", str(e))
+            raise HTTPException(429, str(e), headers={"Retry-After": str(e.retry_after)})
+
         async def _agen():
-            async for chunk in stream_openai_sse(packet, completion_id, created_ts, model_id):
-                yield chunk
-        return StreamingResponse(_agen(), media_type="text/event-stream", headers={"Cache-Control": "no-cache", "Connection": "keep-alive"})
-
-    def _post_once() -> requests.Response:
-        return requests.post(
-            f"{BRIDGE_BASE_URL}/api/warp/send_stream",
-            json={"json_data": packet, "message_type": "warp.multi_agent.v1.Request"},
-            timeout=(5.0, 180.0),
+            try:
+                async for position in UPSTREAM_QUEUE.queued(queue_key, report_every=SSE_HEARTBEAT_INTERVAL or 15):
+                    yield f": queued {position}\n\n" if UPSTREAM_QUEUE_PROGRESS else SSE_PING
+            except UpstreamQueueRejected as e:
+                record_finish("error", str(e))
+                yield format_sse({
+                    "id": completion_id,
+                    "object": "chat.completion.chunk",
+                    "created": created_ts,
+                    "model": model_id,
+                    "choices": [{"index": i, "delta": {}, "finish_reason": "error"} for i in range(n_choices)],
+                    "error": {"message": str(e), "type": "rate_limit_error", "code": "upstream_rate_limited"},
+                })
+                yield sse_done("openai")
+                return
+            frames = stream_openai_sse_choices(packet, n_choices, completion_id, created_ts, model_id,
+                                               json_mode=bool(json_mode), prompt_tokens=prompt_tokens,
+                                               post_processors=post_processors)
+            # 关机宽限期将尽时主动收尾，客户端收到 finish_reason=error 与 [DONE]，而不是被截断的连接
+            cut_chunk = {
+                "id": completion_id,
+                "object": "chat.completion.chunk",
+                "created": created_ts,
+                "model": model_id,
+                "choices": [{"index": i, "delta": {}, "finish_reason": "error"} for i in range(n_choices)],
+                "error": {"message": "server is shutting down, the response was cut short", "type": "server_error", "code": "server_shutdown"},
+            }
+            reply = StreamedReply() if conversation_id else None
+            try:
+                relayed = until_event(with_heartbeat(frames, SSE_HEARTBEAT_INTERVAL), DRAIN.streams_cut, [format_sse(cut_chunk), sse_done("openai")])
+                async with aclosing(relayed) as relay:
+                    async for chunk in relay:
+                        if DRAIN.streams_cut.is_set():
+                            record_finish("error", "server shutdown")
+                        if request is not None and await request.is_disconnected():
+                            logger.info("[OpenAI Compat] 客户端已断开，取消上游流: %s", completion_id)
+                            record_finish("client_disconnected")
+                            break
+                        if reply is not None:
+                            reply.feed(chunk)
+                        yield chunk
+                # 只保存完整结束的回复
+                if reply is not None and reply.finish_reason not in (None, "error"):
+                    await _remember_turn(reply.message())
+            finally:
+                # 先关闭心跳中继（取消挂起的读取），再关闭上游生成器
+                await frames.aclose()
+        return SSEStreamingResponse(
+            _agen(),
+            flush_interval=SSE_FLUSH_INTERVAL_MS / 1000.0,
+            flush_bytes=SSE_FLUSH_BYTES,
+            write_timeout=SSE_WRITE_TIMEOUT,
+            headers={"Cache-Control": "no-cache", "Connection": "keep-alive"},
         )
 
-    try:
-        resp = _post_once()
-        if resp.status_code == 429:
+    # 相同的非流式请求在 TTL 内直接返回缓存结果（X-Cache: HIT）
+    request_key = request_cache_key(req, request_fields().get("key_id"))
+    use_cache = RESPONSE_CACHE.enabled and RESPONSE_CACHE.ttl_for(req.model) > 0
+    if use_cache:
+        cached = await RESPONSE_CACHE.get(request_key)
+        request_fields()["cache"] = "hit" if cached is not None else "miss"
+        if cached is not None:
+            cached.update(id=completion_id, created=created_ts)
+            cached = await _apply_response_hook(cached, hook_ctx)
+            choices = cached.get("choices") or []
+            record_finish(choices[0].get("finish_reason") if choices else None)
+            if choices:
+                await _remember_turn(choices[0]["message"])
+            return JSONResponse(cached, headers={"X-Cache": "HIT"})
+
+    async def _complete() -> Dict[str, Any]:
+        for attempt in range(2):
             try:
-                r = requests.post(f"{BRIDGE_BASE_URL}/api/auth/refresh", timeout=10.0)
-                logger.warning("[OpenAI Compat] Bridge returned 429. Tried JWT refresh -> HTTP %s", getattr(r, 'status_code', 'N/A'))
-            except Exception as _e:
-                logger.warning("[OpenAI Compat] JWT refresh attempt failed after 429: %s", _e)
-            resp = _post_once()
-        if resp.status_code != 200:
-            raise HTTPException(resp.status_code, f"bridge_error: {resp.text}")
-        bridge_resp = resp.json()
-    except Exception as e:
-        raise HTTPException(502, f"bridge_unreachable: {e}")
+                async for _ in UPSTREAM_QUEUE.queued(queue_key):
+                    pass
+            except UpstreamQueueRejected as e:
+                raise HTTPException(429, str(e), headers={"Retry-After": str(e.retry_after)})
+            results = await asyncio.gather(
+                *(get_bridge_transport().send_stream(packet) for _ in range(n_choices)), return_exceptions=True
+            )
+            if not any(isinstance(res, BridgeError) and res.status_code == 429 for res in results):
+                break
+            UPSTREAM_QUEUE.note_rate_limited()
+            # 被限流时重新排队，轮到后再试一次
+            if not UPSTREAM_QUEUE.enabled:
+                break
+        for res in results:
+            if isinstance(res, BridgeError):
+                raise HTTPException(res.status_code, f"bridge_error: {res.detail}")
+            if isinstance(res, BaseException):
+                raise HTTPException(502, f"bridge_unreachable: {res}")
+        bridge_resp = results[0]
 
+        try:
+            STATE.conversation_id = bridge_resp.get("conversation_id") or STATE.conversation_id
+            ret_task_id = bridge_resp.get("task_id")
+            if isinstance(ret_task_id, str) and ret_task_id:
+                STATE.baseline_task_id = ret_task_id
+        except Exception:
+            pass
+
+        choices = []
+        usages = []
+        for index, resp in enumerate(results):
+            choice, usage = _choice_from_bridge_response(resp, index, bool(json_mode), post_processors)
+            choices.append(choice)
+            if usage is None:
+                usage = local_usage(prompt_tokens, message_text(choice["message"]), warp_model)
+            usages.append(usage)
+
+        return {
+            "id": completion_id,
+            "object": "chat.completion",
+            "created": created_ts,
+            "model": model_id,
+            "choices": choices,
+            "usage": merge_usage(usages) or {"prompt_tokens": 0, "completion_tokens": 0, "total_tokens": 0},
+        }
+
+    # 同时到达的相同请求（如客户端重试风暴）合并为一次上游调用
     try:
-        STATE.conversation_id = bridge_resp.get("conversation_id") or STATE.conversation_id
-        ret_task_id = bridge_resp.get("task_id")
-        if isinstance(ret_task_id, str) and ret_task_id:
-            STATE.baseline_task_id = ret_task_id
-    except Exception:
-        pass
+        final, shared = await COMPLETIONS_FLIGHT.do(request_key, _complete)
+    except HTTPException as e:
+        record_finish("error", str(e.detail))
+        raise
+    choices = final["choices"]
+    if shared:
+        # 上游 token 只记在发起调用的请求上
+        final.update(id=completion_id, created=created_ts)
+        request_fields()["deduplicated"] = True
+    else:
+        record_usage(final["usage"])
+    record_finish(choices[0]["finish_reason"] if choices else None)
+    if use_cache:
+        # 缓存脚本钩子处理之前的响应，命中时再按本次请求处理
+        await RESPONSE_CACHE.put(request_key, req.model, final)
+    final = await _apply_response_hook(final, hook_ctx)
+    choices = final.get("choices") or []
+    if choices:
+        await _remember_turn(choices[0]["message"])
+    if use_cache:
+        return JSONResponse(final, headers={"X-Cache": "MISS"})
+    return final
+
+
+async def _apply_request_hook(req: ChatCompletionsRequest, ctx: Dict[str, Any]) -> ChatCompletionsRequest:
+    try:
+        # Lua 调用放到线程中，超时前不会卡住事件循环
+        body = await asyncio.to_thread(SCRIPT_HOOKS.on_request, req.dict(), ctx)
+        return req if body is None else ChatCompletionsRequest(**body)
+    except ScriptHookError as e:
+        raise HTTPException(500, f"script_hook_error: {e}")
+    except (TypeError, ValueError) as e:
+        # 钩子返回的请求体不是有效的 Chat Completions 请求
+        if SCRIPT_HOOKS.fail_closed:
+            raise HTTPException(500, f"script_hook_error: on_request returned an invalid request: {e}")
+        logger.warning("[OpenAI Compat] 脚本钩子 on_request 返回的请求无效，已忽略: %s", e)
+        return req
+
+
+async def _apply_response_hook(body: Dict[str, Any], ctx: Dict[str, Any]) -> Dict[str, Any]:
+    if not SCRIPT_HOOKS.enabled:
+        return body
+    try:
+        return await asyncio.to_thread(SCRIPT_HOOKS.on_response, body, ctx)
+    except ScriptHookError as e:
+        raise HTTPException(500, f"script_hook_error: {e}")
+
 
+def _choice_from_bridge_response(bridge_resp: Dict[str, Any], index: int, json_mode: bool = False,
+                                 post_processors: Optional[List[Dict[str, Any]]] = None):
+    """Build one `choices[]` entry (and its usage) from a bridge send_stream result."""
     tool_calls: List[Dict[str, Any]] = []
     try:
         parsed_events = bridge_resp.get("parsed_events", []) or []
@@ -211,14 +585,14 @@ async def chat_completions(req: ChatCompletionsRequest, request: Request = None)
         finish_reason = "tool_calls"
     else:
         response_text = bridge_resp.get("response", "")
+        post = build_post_processor(post_processors)
+        if post is not None:
+            response_text = post.process(response_text)
+        if json_mode:
+            guard = StreamingJSONGuard()
+            response_text = guard.feed(response_text) + guard.finish()
         msg_payload = {"role": "assistant", "content": response_text}
         finish_reason = "stop"
 
-    final = {
-        "id": completion_id,
-        "object": "chat.completion",
-        "created": created_ts,
-        "model": model_id,
-        "choices": [{"index": 0, "message": msg_payload, "finish_reason": finish_reason}],
-    }
-    return final 
\ No newline at end of file
+    usage = extract_usage_from_parsed_events(bridge_resp.get("parsed_events", []) or [])
+    return {"index": index, "message": msg_payload, "finish_reason": finish_reason}, usage
@@ -0,0 +1,229 @@
+from __future__ import annotations
+
+import os
+import threading
+from typing import Any, Dict, Optional, Tuple
+
+from .config import SCRIPT_HOOKS_PATH, SCRIPT_HOOK_TIMEOUT_MS, SCRIPT_HOOK_MEMORY_MB, SCRIPT_HOOKS_FAIL_CLOSED
+from .logging import logger
+
+# Runs before any script code: keeps what the hook runner needs in locals, then removes everything
+# that reaches outside the interpreter (files, processes, modules, Python objects, debug hooks)
+_BOOTSTRAP = """
+local sethook, clock, pcall, load, error = debug.sethook, os.clock, pcall, load, error
+local pack, unpack, getmetatable, setmetatable, pairs = table.pack, table.unpack, getmetatable, setmetatable, pairs
+local ARRAY_MT = {}
+-- 超时时抛出的专用错误值：脚本自己的错误信息无法伪造成超时
+local TIMEOUT = setmetatable({}, {__tostring = function() return "script hook timed out" end})
+
+local function run(limit, fn, ...)
+  local deadline = clock() + limit
+  sethook(function()
+    if clock() > deadline then error(TIMEOUT, 2) end
+  end, "", 1000)
+  local results = pack(pcall(fn, ...))
+  sethook()
+  if not results[1] and results[2] == TIMEOUT then
+    return false, "script hook timed out", true
+  end
+  return unpack(results, 1, results.n)
+end
+
+local function compile(source, name)
+  return load(source, "=" .. name, "t", _ENV)
+end
+
+local function array(t)
+  return setmetatable(t or {}, ARRAY_MT)
+end
+
+local function is_array(t)
+  if getmetatable(t) == ARRAY_MT then return true end
+  local n, count = #t, 0
+  if n == 0 then return false end
+  for _ in pairs(t) do count = count + 1 end
+  return count == n
+end
+
+for _, name in ipairs({"io", "package", "require", "dofile", "loadfile", "load", "loadstring",
+                       "debug", "collectgarbage", "coroutine", "python"}) do
+  _ENV[name] = nil
+end
+os = {time = os.time, clock = os.clock, date = os.date}
+string.dump = nil
+return run, compile, array, is_array
+"""
+
+# Python → Lua → Python conversions stop this deep (guards against self-referencing tables)
+_MAX_DEPTH = 64
+
+
+class ScriptVeto(Exception):
+    """on_request returned false: the request is refused with this status and message."""
+
+    def __init__(self, message: str, status: int = 403):
+        super().__init__(message)
+        self.status = status
+
+
+class ScriptHookError(Exception):
+    pass
+
+
+class ScriptHookTimeout(ScriptHookError):
+    """The hook exceeded SCRIPT_HOOK_TIMEOUT_MS."""
+
+
+def _deny_attributes(obj: Any, name: Any, is_setting: bool) -> Any:
+    raise AttributeError("access to Python objects is not allowed in script hooks")
+
+
+class ScriptHooks:
+    """Operator-supplied Lua hooks that can rewrite or veto chat requests and rewrite responses.
+
+    The script defines global functions `on_request(request, ctx)` and/or `on_response(response, ctx)`,
+    which receive the OpenAI-format bodies as tables and return the (modified) table, nil to leave it
+    unchanged, or from on_request `false, message[, status]` to refuse the request. Each call runs
+    with a CPU time limit, the whole interpreter with a memory limit, and without io / os / require.
+    Errors and timeouts are logged and the hook is skipped, unless fail_closed turns them into errors.
+
+    The router calls the hooks from a worker thread, so a slow hook does not stall the event loop,
+    but there is a single interpreter: hook calls of concurrent requests run one at a time.
+    """
+
+    def __init__(self, path: str, timeout_ms: float = 50, memory_mb: float = 0, fail_closed: bool = False):
+        self.path = path
+        self.timeout = timeout_ms / 1000.0
+        self.memory_mb = memory_mb
+        self.fail_closed = fail_closed
+        self.error: Optional[str] = None
+        self.hooks: Dict[str, Any] = {}
+        self._lock = threading.Lock()
+        self._stats = {"calls": 0, "errors": 0, "timeouts": 0, "vetoes": 0}
+        if path:
+            self.reload()
+
+    @property
+    def enabled(self) -> bool:
+        return bool(self.hooks)
+
+    def _runtime(self) -> Any:
+        from lupa import LuaRuntime
+        kwargs: Dict[str, Any] = dict(unpack_returned_tuples=True, register_eval=False, attribute_filter=_deny_attributes)
+        if self.memory_mb > 0:
+            kwargs["max_memory"] = int(self.memory_mb * 1024 * 1024)
+        try:
+            return LuaRuntime(register_builtins=False, **kwargs)
+        except TypeError:
+            # 旧版 lupa 不支持 register_builtins / max_memory
+            kwargs.pop("max_memory", None)
+            if self.memory_mb > 0:
+                logger.warning("[OpenAI Compat] 当前 lupa 版本不支持内存限制 (SCRIPT_HOOK_MEMORY_MB)，请升级到 lupa 2.x")
+            return LuaRuntime(**kwargs)
+
+    def reload(self) -> None:
+        """(Re)load the script; on failure the previously loaded hooks stay active."""
+        try:
+            with open(os.path.expanduser(self.path), encoding="utf-8") as f:
+                source = f.read()
+            lua = self._runtime()
+            run, compile_chunk, array, is_array = lua.execute(_BOOTSTRAP)
+            lua.globals()["array"] = array
+            lua.globals()["log"] = lambda *parts: logger.info("[OpenAI Compat] script hook: %s", " ".join(str(p) for p in parts))
+            chunk, error = compile_chunk(source, os.path.basename(self.path))
+            if chunk is None:
+                raise ScriptHookError(str(error))
+            results = run(self.timeout, chunk)
+            ok = results[0] if isinstance(results, tuple) else results
+            if not ok:
+                raise ScriptHookError(str(results[1]))
+            hooks = {name: lua.globals()[name] for name in ("on_request", "on_response") if lua.globals()[name] is not None}
+        except ImportError:
+            self.error = "lupa is not installed (pip install lupa)"
+            logger.warning("[OpenAI Compat] 脚本钩子需要 lupa (pip install lupa)，已禁用: %s", self.path)
+            return
+        except Exception as e:
+            self.error = str(e)
+            logger.warning("[OpenAI Compat] 无法加载脚本钩子 %s: %s", self.path, e)
+            return
+        with self._lock:
+            self._lua, self._run, self._array, self._is_array = lua, run, array, is_array
+            self.hooks = hooks
+            self.error = None
+        logger.info("[OpenAI Compat] 已加载脚本钩子 %s: %s", self.path, ", ".join(hooks) or "(无钩子函数)")
+
+    def _to_lua(self, value: Any, depth: int = 0) -> Any:
+        if depth > _MAX_DEPTH:
+            raise ScriptHookError("value nested too deeply")
+        if isinstance(value, dict):
+            return self._lua.table_from({str(k): self._to_lua(v, depth + 1) for k, v in value.items() if v is not None})
+        if isinstance(value, (list, tuple)):
+            return self._array(self._lua.table_from([self._to_lua(v, depth + 1) for v in value]))
+        return value
+
+    def _from_lua(self, value: Any, depth: int = 0) -> Any:
+        from lupa import lua_type
+        if depth > _MAX_DEPTH:
+            raise ScriptHookError("table nested too deeply (or self-referencing)")
+        kind = lua_type(value)
+        if kind is None and (value is None or isinstance(value, (str, int, float, bool))):
+            return value
+        if kind != "table":
+            raise ScriptHookError(f"hooks may only return tables, strings, numbers and booleans (got a {kind or 'Python object'})")
+        if self._is_array(value):
+            return [self._from_lua(value[i], depth + 1) for i in range(1, len(value) + 1)]
+        return {str(k): self._from_lua(v, depth + 1) for k, v in value.items()}
+
+    def _call(self, name: str, body: Dict[str, Any], ctx: Dict[str, Any]) -> Tuple[Any, ...]:
+        with self._lock:
+            self._stats["calls"] += 1
+            try:
+                results = self._run(self.timeout, self.hooks[name], self._to_lua(body), self._to_lua(ctx))
+                results = results if isinstance(results, tuple) else (results,)
+                if not results[0]:
+                    if len(results) > 2 and results[2] is True:
+                        raise ScriptHookTimeout(str(results[1]))
+                    raise ScriptHookError(str(results[1]) if len(results) > 1 else "unknown error")
+                return tuple(self._from_lua(r) for r in results[1:]) or (None,)
+            except Exception as e:
+                self._stats["errors"] += 1
+                if isinstance(e, ScriptHookTimeout):
+                    self._stats["timeouts"] += 1
+                logger.warning("[OpenAI Compat] 脚本钩子 %s 失败: %s", name, e)
+                if self.fail_closed:
+                    raise ScriptHookError(f"{name} failed: {e}")
+                return (None,)
+
+    def on_request(self, body: Dict[str, Any], ctx: Dict[str, Any]) -> Dict[str, Any]:
+        """The rewritten request body; raises ScriptVeto when the script refuses the request."""
+        if "on_request" not in self.hooks:
+            return body
+        result = self._call("on_request", body, ctx)
+        if result[0] is False:
+            with self._lock:
+                self._stats["vetoes"] += 1
+            message = str(result[1]) if len(result) > 1 and result[1] is not None else "request refused by script hook"
+            status = result[2] if len(result) > 2 and isinstance(result[2], int) and 400 <= result[2] < 600 else 403
+            raise ScriptVeto(message, status)
+        return result[0] if isinstance(result[0], dict) else body
+
+    def on_response(self, body: Dict[str, Any], ctx: Dict[str, Any]) -> Dict[str, Any]:
+        if "on_response" not in self.hooks:
+            return body
+        result = self._call("on_response", body, ctx)
+        return result[0] if isinstance(result[0], dict) else body
+
+    def status(self) -> Dict[str, Any]:
+        with self._lock:
+            return {
+                "path": self.path or None,
+                "hooks": sorted(self.hooks),
+                "error": self.error,
+                "timeout_ms": self.timeout * 1000,
+                "memory_mb": self.memory_mb,
+                "fail_closed": self.fail_closed,
+                **self._stats,
+            }
+
+
+SCRIPT_HOOKS = ScriptHooks(SCRIPT_HOOKS_PATH, SCRIPT_HOOK_TIMEOUT_MS, SCRIPT_HOOK_MEMORY_MB, SCRIPT_HOOKS_FAIL_CLOSED)
@@ -0,0 +1,44 @@
+from __future__ import annotations
+
+import asyncio
+from typing import Any, Optional
+
+from .config import SHUTDOWN_GRACE_PERIOD
+from .drain import DRAIN
+from .logging import logger
+
+# 在宽限期结束前这么多秒通知流式响应收尾，保证错误块和结束标记能在连接关闭前发出
+_CUT_MARGIN_S = 2.0
+
+
+def graceful_server(config: Any, grace_period: float = SHUTDOWN_GRACE_PERIOD) -> Any:
+    """uvicorn.Server that drains on SIGTERM/SIGINT instead of stopping at once.
+
+    The first signal puts the app in drain mode (new requests 503, /readyz not ready),
+    lets uvicorn wait up to `grace_period` seconds for open connections, and asks the
+    remaining SSE streams to finish with a terminator shortly before the deadline. A
+    second signal exits immediately (uvicorn's force exit).
+    """
+    import uvicorn
+
+    config.timeout_graceful_shutdown = grace_period
+
+    class GracefulServer(uvicorn.Server):
+        _loop: Optional[asyncio.AbstractEventLoop] = None
+
+        async def serve(self, sockets: Any = None) -> None:
+            self._loop = asyncio.get_running_loop()
+            await super().serve(sockets=sockets)
+
+        def handle_exit(self, sig: int, frame: Any) -> None:
+            if not self.should_exit and self._loop is not None:
+                logger.warning("[OpenAI Compat] 收到退出信号，停止接收新请求，等待进行中的请求 (最多 %.0fs)，进行中: %d",
+                               grace_period, DRAIN.active)
+                self._loop.call_soon_threadsafe(self._begin_shutdown)
+            super().handle_exit(sig, frame)
+
+        def _begin_shutdown(self) -> None:
+            DRAIN.begin_shutdown()
+            self._loop.call_later(max(0.0, grace_period - _CUT_MARGIN_S), DRAIN.cut_streams)
+
+    return GracefulServer(config)
@@ -0,0 +1,48 @@
+from __future__ import annotations
+
+import asyncio
+import copy
+from typing import Any, Awaitable, Callable, Dict, Tuple
+
+from .config import REQUEST_DEDUP
+
+
+class SingleFlight:
+    """Collapses concurrent calls with the same key into one; every caller gets the result.
+
+    The shared call runs in its own task, so the first caller disconnecting (or timing out)
+    does not cancel it for the others. Each caller receives its own deep copy of the result.
+    """
+
+    def __init__(self, enabled: bool = True):
+        self.enabled = enabled
+        self._calls: Dict[str, asyncio.Task] = {}
+        self.shared_total = 0
+
+    async def do(self, key: str, fn: Callable[[], Awaitable[Any]]) -> Tuple[Any, bool]:
+        """Result of fn() and whether it was shared with an earlier identical call."""
+        if not self.enabled:
+            return await fn(), False
+        task = self._calls.get(key)
+        shared = task is not None
+        if task is None:
+            task = asyncio.ensure_future(fn())
+            self._calls[key] = task
+            task.add_done_callback(lambda t: self._forget(key, t))
+        else:
+            self.shared_total += 1
+        result = await asyncio.shield(task)
+        return copy.deepcopy(result), shared
+
+    def _forget(self, key: str, task: asyncio.Task) -> None:
+        if self._calls.get(key) is task:
+            del self._calls[key]
+        if not task.cancelled():
+            # 所有调用方都已离开时异常无人读取，避免 "exception was never retrieved" 警告
+            task.exception()
+
+    def stats(self) -> Dict[str, Any]:
+        return {"enabled": self.enabled, "in_flight": len(self._calls), "shared_total": self.shared_total}
+
+
+COMPLETIONS_FLIGHT = SingleFlight(REQUEST_DEDUP)
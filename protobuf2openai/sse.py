@@ -0,0 +1,250 @@
+from __future__ import annotations
+
+import asyncio
+import json
+from contextlib import aclosing
+from typing import Any, AsyncIterator, List, Optional
+
+from fastapi.responses import StreamingResponse
+
+from .logging import logger
+
+# 各协议的流结束标记：OpenAI 使用 data: [DONE]，Anthropic Messages 使用 message_stop 事件
+_TERMINATORS = {
+    "openai": "data: [DONE]\n\n",
+    "anthropic": 'event: message_stop\ndata: {"type": "message_stop"}\n\n',
+}
+
+# 复用同一个编码器：json.dumps 带非默认参数时每次调用都会新建 JSONEncoder
+_json_encoder = json.JSONEncoder(ensure_ascii=False)
+
+
+def encode_json(obj: Any) -> str:
+    return _json_encoder.encode(obj)
+
+
+class ChunkTemplate:
+    """Pre-encoded `chat.completion.chunk` envelope for one choice of one stream.
+
+    The id / object / created / model head is encoded once per stream; each content
+    delta then only encodes its text, producing exactly what encode_json would for the
+    full chunk dict without building and walking the nested dicts per token.
+    """
+
+    __slots__ = ("_content_prefix",)
+
+    def __init__(self, completion_id: str, created_ts: int, model_id: str, choice_index: int = 0):
+        head = _json_encoder.encode({"id": completion_id, "object": "chat.completion.chunk", "created": created_ts, "model": model_id})
+        self._content_prefix = head[:-1] + ', "choices": [{"index": ' + str(int(choice_index)) + ', "delta": {"content": '
+
+    def content(self, text: str) -> str:
+        return self._content_prefix + _json_encoder.encode(text) + "}}]}"
+
+
+def format_sse(data: Any, event: Optional[str] = None, event_id: Optional[str] = None, retry_ms: Optional[int] = None) -> str:
+    """Serialize one SSE frame; `id:`/`event:`/`retry:` lines are only emitted when set.
+
+    Non-string data is JSON-encoded; multi-line strings become one `data:` line each.
+    """
+    if event_id is None and not event and retry_ms is None:
+        # 热路径：普通 data 帧直接拼接，避免构建行列表
+        payload = data if isinstance(data, str) else _json_encoder.encode(data)
+        if "\n" not in payload:
+            return "data: " + payload + "\n\n"
+        return "".join("data: " + line + "\n" for line in payload.split("\n")) + "\n"
+    lines = []
+    if event_id is not None:
+        lines.append(f"id: {event_id}")
+    if event:
+        lines.append(f"event: {event}")
+    if retry_ms is not None:
+        lines.append(f"retry: {int(retry_ms)}")
+    payload = data if isinstance(data, str) else _json_encoder.encode(data)
+    for line in payload.split("\n"):
+        lines.append(f"data: {line}")
+    return "\n".join(lines) + "\n\n"
+
+
+def sse_done(protocol: str = "openai") -> str:
+    try:
+        return _TERMINATORS[protocol]
+    except KeyError:
+        raise ValueError(f"unknown SSE protocol: {protocol}")
+
+
+SSE_PING = ": ping\n\n"
+
+
+def streaming_unsupported_reason(request: Any, mode: str = "auto") -> Optional[str]:
+    """Why an SSE stream cannot be delivered on this connection, or None if it can.
+
+    HTTP/1.0 has no chunked transfer encoding, so intermediaries commonly buffer or
+    truncate the body; callers should fall back to a buffered JSON response.
+    """
+    if mode == "off":
+        return "streaming disabled by SSE_STREAMING=off"
+    scope = getattr(request, "scope", None) or {}
+    if scope.get("type") == "http" and scope.get("http_version") == "1.0":
+        return "HTTP/1.0 client connection"
+    return None
+
+
+async def with_heartbeat(frames: AsyncIterator[str], interval: float) -> AsyncIterator[str]:
+    """Relay `frames`, inserting an SSE comment whenever no frame arrived for `interval` seconds."""
+    if interval <= 0:
+        async for frame in frames:
+            yield frame
+        return
+    it = frames.__aiter__()
+    pending: Optional[asyncio.Task] = None
+    try:
+        while True:
+            if pending is None:
+                pending = asyncio.ensure_future(it.__anext__())
+            done, _ = await asyncio.wait({pending}, timeout=interval)
+            if not done:
+                yield SSE_PING
+                continue
+            try:
+                frame = pending.result()
+            except StopAsyncIteration:
+                return
+            finally:
+                pending = None
+            yield frame
+    finally:
+        if pending is not None:
+            pending.cancel()
+            try:
+                await pending
+            except BaseException:
+                pass
+
+
+async def until_event(frames: AsyncIterator[str], event: asyncio.Event, closing: List[str]) -> AsyncIterator[str]:
+    """Relay `frames` until `event` is set, then emit `closing` (e.g. an error chunk and terminator) and stop."""
+    it = frames.__aiter__()
+    pending: Optional[asyncio.Task] = None
+    stop = asyncio.ensure_future(event.wait())
+    try:
+        while True:
+            if pending is None:
+                pending = asyncio.ensure_future(it.__anext__())
+            await asyncio.wait({pending, stop}, return_when=asyncio.FIRST_COMPLETED)
+            if not pending.done():
+                for frame in closing:
+                    yield frame
+                return
+            try:
+                frame = pending.result()
+            except StopAsyncIteration:
+                return
+            finally:
+                pending = None
+            yield frame
+    finally:
+        stop.cancel()
+        if pending is not None:
+            pending.cancel()
+            try:
+                await pending
+            except BaseException:
+                pass
+        aclose = getattr(frames, "aclose", None)
+        if aclose is not None:
+            await aclose()
+
+
+async def coalesce_frames(frames: AsyncIterator[str], max_bytes: int, max_delay: float) -> AsyncIterator[str]:
+    """Batch small SSE frames into one write.
+
+    A batch is flushed once it reaches `max_bytes` or `max_delay` seconds after its
+    first frame, whichever comes first, and always when the source ends. With
+    max_delay <= 0 every frame is passed through unchanged.
+    """
+    if max_delay <= 0:
+        async for frame in frames:
+            yield frame
+        return
+    loop = asyncio.get_running_loop()
+    it = frames.__aiter__()
+    buf: List[str] = []
+    size = 0
+    deadline = 0.0
+    pending: Optional[asyncio.Task] = None
+    try:
+        while True:
+            if pending is None:
+                pending = asyncio.ensure_future(it.__anext__())
+            timeout = max(0.0, deadline - loop.time()) if buf else None
+            done, _ = await asyncio.wait({pending}, timeout=timeout)
+            if not done:
+                yield "".join(buf)
+                buf, size = [], 0
+                continue
+            try:
+                frame = pending.result()
+            except StopAsyncIteration:
+                if buf:
+                    yield "".join(buf)
+                return
+            finally:
+                pending = None
+            if not buf:
+                deadline = loop.time() + max_delay
+            buf.append(frame)
+            size += len(frame)
+            if size >= max_bytes:
+                yield "".join(buf)
+                buf, size = [], 0
+    finally:
+        if pending is not None:
+            pending.cancel()
+            try:
+                await pending
+            except BaseException:
+                pass
+
+
+class SSEWriteTimeout(Exception):
+    pass
+
+
+class SSEStreamingResponse(StreamingResponse):
+    """StreamingResponse that batches frames and bounds how long a single write may block.
+
+    A client that stops reading makes `send` wait on transport backpressure; once a
+    write exceeds `write_timeout` seconds the stream is aborted instead of holding
+    the upstream Warp connection open indefinitely.
+    """
+
+    def __init__(self, content: AsyncIterator[str], flush_interval: float = 0.0, flush_bytes: int = 4096,
+                 write_timeout: float = 0.0, **kwargs: Any):
+        kwargs.setdefault("media_type", "text/event-stream")
+        super().__init__(content, **kwargs)
+        self.flush_interval = flush_interval
+        self.flush_bytes = flush_bytes
+        self.write_timeout = write_timeout
+
+    async def _send(self, send: Any, message: dict) -> None:
+        if self.write_timeout <= 0:
+            await send(message)
+            return
+        try:
+            await asyncio.wait_for(send(message), timeout=self.write_timeout)
+        except asyncio.TimeoutError:
+            logger.warning("[OpenAI Compat] SSE 写入超时 (%.1fs)，客户端未读取，终止流", self.write_timeout)
+            raise SSEWriteTimeout(f"SSE write blocked for more than {self.write_timeout}s")
+
+    async def stream_response(self, send: Any) -> None:
+        await send({"type": "http.response.start", "status": self.status_code, "headers": self.raw_headers})
+        try:
+            async with aclosing(coalesce_frames(self.body_iterator, self.flush_bytes, self.flush_interval)) as batches:
+                async for chunk in batches:
+                    body = chunk if isinstance(chunk, (bytes, memoryview)) else chunk.encode(self.charset)
+                    await self._send(send, {"type": "http.response.body", "body": body, "more_body": True})
+        finally:
+            aclose = getattr(self.body_iterator, "aclose", None)
+            if aclose is not None:
+                await aclose()
+        await self._send(send, {"type": "http.response.body", "body": b"", "more_body": False})
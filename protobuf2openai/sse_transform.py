@@ -1,345 +1,253 @@
 from __future__ import annotations
 
-import json
+import asyncio
+import logging
 import uuid
-from typing import Any, AsyncGenerator, Dict
+from contextlib import aclosing
+from typing import Any, AsyncGenerator, Dict, List, Optional
 
-import httpx
-from .logging import logger
-
-from .config import BRIDGE_BASE_URL
-from .helpers import _get
+from warp2protobuf.core.request_context import record_finish, record_first_token, record_usage
 
+from .logging import logger
 
-async def stream_openai_sse(packet: Dict[str, Any], completion_id: str, created_ts: int, model_id: str) -> AsyncGenerator[str, None]:
+from .sse import ChunkTemplate, encode_json, format_sse, sse_done
+from .transport import get_bridge_transport, BridgeError
+from .upstream_queue import UPSTREAM_QUEUE
+from .helpers import _get, extract_usage_from_event
+from .json_stream import StreamingJSONGuard
+from .post_process import build_post_processor
+from .tokens import local_usage
+
+
+async def stream_openai_sse(packet: Dict[str, Any], completion_id: str, created_ts: int, model_id: str,
+                            choice_index: int = 0, terminate: bool = True, json_mode: bool = False,
+                            prompt_tokens: Optional[int] = None,
+                            post_processors: Optional[List[Dict[str, Any]]] = None) -> AsyncGenerator[str, None]:
+    """Relay one Warp stream as OpenAI chunks for `choices[choice_index]`.
+
+    terminate=False omits the trailing [DONE] so several choices can share one stream.
+    json_mode filters text deltas so the concatenated content is one parseable JSON value.
+    With prompt_tokens, usage Warp does not report is computed locally from the relayed text.
+    post_processors rewrite text deltas (held back while a later chunk could change them).
+    """
+    events = get_bridge_transport().stream_events(packet)
+    json_guard = StreamingJSONGuard() if json_mode else None
+    post = build_post_processor(post_processors)
+
+    def _text(text: str, flush: bool = False) -> str:
+        if post is not None:
+            text = post.feed(text) + (post.flush() if flush else "")
+        if text and json_guard is not None:
+            text = json_guard.feed(text)
+        return text
+    chunks = ChunkTemplate(completion_id, created_ts, model_id, choice_index)
+    # 每个事件都序列化一遍只为打日志代价不小，日志级别高于 INFO 时跳过
+    log_events = logger.isEnabledFor(logging.INFO)
     try:
         first = {
             "id": completion_id,
             "object": "chat.completion.chunk",
             "created": created_ts,
             "model": model_id,
-            "choices": [{"index": 0, "delta": {"role": "assistant"}}],
+            "choices": [{"index": choice_index, "delta": {"role": "assistant"}}],
         }
-        # 打印转换后的首个 SSE 事件（OpenAI 格式）
-        try:
-            logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", json.dumps(first, ensure_ascii=False))
-        except Exception:
-            pass
-        yield f"data: {json.dumps(first, ensure_ascii=False)}\n\n"
-
-        timeout = httpx.Timeout(60.0)
-        async with httpx.AsyncClient(http2=True, timeout=timeout, trust_env=True) as client:
-            def _do_stream():
-                return client.stream(
-                    "POST",
-                    f"{BRIDGE_BASE_URL}/api/warp/send_stream_sse",
-                    headers={"accept": "text/event-stream"},
-                    json={"json_data": packet, "message_type": "warp.multi_agent.v1.Request"},
-                )
-
-            # 首次请求
-            response_cm = _do_stream()
-            async with response_cm as response:
-                if response.status_code == 429:
-                    try:
-                        r = await client.post(f"{BRIDGE_BASE_URL}/api/auth/refresh", timeout=10.0)
-                        logger.warning("[OpenAI Compat] Bridge returned 429. Tried JWT refresh -> HTTP %s", r.status_code)
-                    except Exception as _e:
-                        logger.warning("[OpenAI Compat] JWT refresh attempt failed after 429: %s", _e)
-                    # 重试一次
-                    response_cm2 = _do_stream()
-                    async with response_cm2 as response2:
-                        response = response2
-                        if response.status_code != 200:
-                            error_text = await response.aread()
-                            error_content = error_text.decode("utf-8") if error_text else ""
-                            logger.error(f"[OpenAI Compat] Bridge HTTP error {response.status_code}: {error_content[:300]}")
-                            raise RuntimeError(f"bridge error: {error_content}")
-                        current = ""
-                        tool_calls_emitted = False
-                        async for line in response.aiter_lines():
-                            if line.startswith("data:"):
-                                payload = line[5:].strip()
-                                if not payload:
-                                    continue
-                                # 打印接收到的 Protobuf SSE 原始事件片段
-                                try:
-                                    logger.info("[OpenAI Compat] 接收到的 Protobuf SSE(data): %s", payload)
-                                except Exception:
-                                    pass
-                                if payload == "[DONE]":
-                                    break
-                                current += payload
-                                continue
-                            if (line.strip() == "") and current:
-                                try:
-                                    ev = json.loads(current)
-                                except Exception:
-                                    current = ""
-                                    continue
-                                current = ""
-                                event_data = (ev or {}).get("parsed_data") or {}
+        payload = encode_json(first)
+        logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", payload)
+        yield format_sse(payload)
+
+        tool_calls_emitted = False
+        # 已输出的文本与工具参数，上游未报告用量时用于本地计算 completion tokens
+        emitted: List[str] = []
+        async for ev in events:
+            event_data = (ev or {}).get("parsed_data") or {}
+
+            # 打印接收到的 Protobuf 事件（解析后）
+            if log_events:
+                try:
+                    logger.info("[OpenAI Compat] 接收到的 Protobuf 事件(parsed): %s", encode_json(event_data))
+                except Exception:
+                    pass
 
-                                # 打印接收到的 Protobuf 事件（解析后）
+            if "init" in event_data:
+                pass
+
+            client_actions = _get(event_data, "client_actions", "clientActions")
+            if isinstance(client_actions, dict):
+                actions = _get(client_actions, "actions", "Actions") or []
+                for action in actions:
+                    append_data = _get(action, "append_to_message_content", "appendToMessageContent")
+                    if isinstance(append_data, dict):
+                        message = append_data.get("message", {})
+                        agent_output = _get(message, "agent_output", "agentOutput") or {}
+                        text_content = _text(agent_output.get("text", ""))
+                        if text_content:
+                            payload = chunks.content(text_content)
+                            logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", payload)
+                            record_first_token()
+                            emitted.append(text_content)
+                            yield format_sse(payload)
+
+                    messages_data = _get(action, "add_messages_to_task", "addMessagesToTask")
+                    if isinstance(messages_data, dict):
+                        messages = messages_data.get("messages", [])
+                        for message in messages:
+                            tool_call = _get(message, "tool_call", "toolCall") or {}
+                            call_mcp = _get(tool_call, "call_mcp_tool", "callMcpTool") or {}
+                            if isinstance(call_mcp, dict) and call_mcp.get("name"):
+                                # 工具调用之前先输出后处理器暂存的文本
+                                pending = _text("", flush=True)
+                                if pending:
+                                    record_first_token()
+                                    emitted.append(pending)
+                                    yield format_sse(chunks.content(pending))
                                 try:
-                                    logger.info("[OpenAI Compat] 接收到的 Protobuf 事件(parsed): %s", json.dumps(event_data, ensure_ascii=False))
+                                    args_obj = call_mcp.get("args", {}) or {}
+                                    args_str = encode_json(args_obj)
                                 except Exception:
-                                    pass
-
-                                if "init" in event_data:
-                                    pass
-
-                                client_actions = _get(event_data, "client_actions", "clientActions")
-                                if isinstance(client_actions, dict):
-                                    actions = _get(client_actions, "actions", "Actions") or []
-                                    for action in actions:
-                                        append_data = _get(action, "append_to_message_content", "appendToMessageContent")
-                                        if isinstance(append_data, dict):
-                                            message = append_data.get("message", {})
-                                            agent_output = _get(message, "agent_output", "agentOutput") or {}
-                                            text_content = agent_output.get("text", "")
-                                            if text_content:
-                                                delta = {
-                                                    "id": completion_id,
-                                                    "object": "chat.completion.chunk",
-                                                    "created": created_ts,
-                                                    "model": model_id,
-                                                    "choices": [{"index": 0, "delta": {"content": text_content}}],
-                                                }
-                                                # 打印转换后的 OpenAI SSE 事件
-                                                try:
-                                                    logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", json.dumps(delta, ensure_ascii=False))
-                                                except Exception:
-                                                    pass
-                                                yield f"data: {json.dumps(delta, ensure_ascii=False)}\n\n"
-
-                                        messages_data = _get(action, "add_messages_to_task", "addMessagesToTask")
-                                        if isinstance(messages_data, dict):
-                                            messages = messages_data.get("messages", [])
-                                            for message in messages:
-                                                tool_call = _get(message, "tool_call", "toolCall") or {}
-                                                call_mcp = _get(tool_call, "call_mcp_tool", "callMcpTool") or {}
-                                                if isinstance(call_mcp, dict) and call_mcp.get("name"):
-                                                    try:
-                                                        args_obj = call_mcp.get("args", {}) or {}
-                                                        args_str = json.dumps(args_obj, ensure_ascii=False)
-                                                    except Exception:
-                                                        args_str = "{}"
-                                                    tool_call_id = tool_call.get("tool_call_id") or str(uuid.uuid4())
-                                                    delta = {
-                                                        "id": completion_id,
-                                                        "object": "chat.completion.chunk",
-                                                        "created": created_ts,
-                                                        "model": model_id,
-                                                        "choices": [{
-                                                            "index": 0,
-                                                            "delta": {
-                                                                "tool_calls": [{
-                                                                    "index": 0,
-                                                                    "id": tool_call_id,
-                                                                    "type": "function",
-                                                                    "function": {"name": call_mcp.get("name"), "arguments": args_str},
-                                                                }]
-                                                            }
-                                                        }],
-                                                    }
-                                                    # 打印转换后的 OpenAI 工具调用事件
-                                                    try:
-                                                        logger.info("[OpenAI Compat] 转换后的 SSE(emit tool_calls): %s", json.dumps(delta, ensure_ascii=False))
-                                                    except Exception:
-                                                        pass
-                                                    yield f"data: {json.dumps(delta, ensure_ascii=False)}\n\n"
-                                                    tool_calls_emitted = True
-                                                else:
-                                                    agent_output = _get(message, "agent_output", "agentOutput") or {}
-                                                    text_content = agent_output.get("text", "")
-                                                    if text_content:
-                                                        delta = {
-                                                            "id": completion_id,
-                                                            "object": "chat.completion.chunk",
-                                                            "created": created_ts,
-                                                            "model": model_id,
-                                                            "choices": [{"index": 0, "delta": {"content": text_content}}],
-                                                        }
-                                                        try:
-                                                            logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", json.dumps(delta, ensure_ascii=False))
-                                                        except Exception:
-                                                            pass
-                                                        yield f"data: {json.dumps(delta, ensure_ascii=False)}\n\n"
-
-                                if "finished" in event_data:
-                                    done_chunk = {
-                                        "id": completion_id,
-                                        "object": "chat.completion.chunk",
-                                        "created": created_ts,
-                                        "model": model_id,
-                                        "choices": [{"index": 0, "delta": {}, "finish_reason": ("tool_calls" if tool_calls_emitted else "stop")}],
-                                    }
-                                    try:
-                                        logger.info("[OpenAI Compat] 转换后的 SSE(emit done): %s", json.dumps(done_chunk, ensure_ascii=False))
-                                    except Exception:
-                                        pass
-                                    yield f"data: {json.dumps(done_chunk, ensure_ascii=False)}\n\n"
-
-                        # 打印完成标记
-                        try:
-                            logger.info("[OpenAI Compat] 转换后的 SSE(emit): [DONE]")
-                        except Exception:
-                            pass
-                        yield "data: [DONE]\n\n"
-                        return
-
-                if response.status_code != 200:
-                    error_text = await response.aread()
-                    error_content = error_text.decode("utf-8") if error_text else ""
-                    logger.error(f"[OpenAI Compat] Bridge HTTP error {response.status_code}: {error_content[:300]}")
-                    raise RuntimeError(f"bridge error: {error_content}")
-
-                current = ""
-                tool_calls_emitted = False
-                async for line in response.aiter_lines():
-                    if line.startswith("data:"):
-                        payload = line[5:].strip()
-                        if not payload:
-                            continue
-                        # 打印接收到的 Protobuf SSE 原始事件片段
-                        try:
-                            logger.info("[OpenAI Compat] 接收到的 Protobuf SSE(data): %s", payload)
-                        except Exception:
-                            pass
-                        if payload == "[DONE]":
-                            break
-                        current += payload
-                        continue
-                    if (line.strip() == "") and current:
-                        try:
-                            ev = json.loads(current)
-                        except Exception:
-                            current = ""
-                            continue
-                        current = ""
-                        event_data = (ev or {}).get("parsed_data") or {}
-
-                        # 打印接收到的 Protobuf 事件（解析后）
-                        try:
-                            logger.info("[OpenAI Compat] 接收到的 Protobuf 事件(parsed): %s", json.dumps(event_data, ensure_ascii=False))
-                        except Exception:
-                            pass
-
-                        if "init" in event_data:
-                            pass
-
-                        client_actions = _get(event_data, "client_actions", "clientActions")
-                        if isinstance(client_actions, dict):
-                            actions = _get(client_actions, "actions", "Actions") or []
-                            for action in actions:
-                                append_data = _get(action, "append_to_message_content", "appendToMessageContent")
-                                if isinstance(append_data, dict):
-                                    message = append_data.get("message", {})
-                                    agent_output = _get(message, "agent_output", "agentOutput") or {}
-                                    text_content = agent_output.get("text", "")
-                                    if text_content:
-                                        delta = {
-                                            "id": completion_id,
-                                            "object": "chat.completion.chunk",
-                                            "created": created_ts,
-                                            "model": model_id,
-                                            "choices": [{"index": 0, "delta": {"content": text_content}}],
+                                    args_str = "{}"
+                                tool_call_id = tool_call.get("tool_call_id") or str(uuid.uuid4())
+                                delta = {
+                                    "id": completion_id,
+                                    "object": "chat.completion.chunk",
+                                    "created": created_ts,
+                                    "model": model_id,
+                                    "choices": [{
+                                        "index": choice_index,
+                                        "delta": {
+                                            "tool_calls": [{
+                                                "index": 0,
+                                                "id": tool_call_id,
+                                                "type": "function",
+                                                "function": {"name": call_mcp.get("name"), "arguments": args_str},
+                                            }]
                                         }
-                                        # 打印转换后的 OpenAI SSE 事件
-                                        try:
-                                            logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", json.dumps(delta, ensure_ascii=False))
-                                        except Exception:
-                                            pass
-                                        yield f"data: {json.dumps(delta, ensure_ascii=False)}\n\n"
-
-                                messages_data = _get(action, "add_messages_to_task", "addMessagesToTask")
-                                if isinstance(messages_data, dict):
-                                    messages = messages_data.get("messages", [])
-                                    for message in messages:
-                                        tool_call = _get(message, "tool_call", "toolCall") or {}
-                                        call_mcp = _get(tool_call, "call_mcp_tool", "callMcpTool") or {}
-                                        if isinstance(call_mcp, dict) and call_mcp.get("name"):
-                                            try:
-                                                args_obj = call_mcp.get("args", {}) or {}
-                                                args_str = json.dumps(args_obj, ensure_ascii=False)
-                                            except Exception:
-                                                args_str = "{}"
-                                            tool_call_id = tool_call.get("tool_call_id") or str(uuid.uuid4())
-                                            delta = {
-                                                "id": completion_id,
-                                                "object": "chat.completion.chunk",
-                                                "created": created_ts,
-                                                "model": model_id,
-                                                "choices": [{
-                                                    "index": 0,
-                                                    "delta": {
-                                                        "tool_calls": [{
-                                                            "index": 0,
-                                                            "id": tool_call_id,
-                                                            "type": "function",
-                                                            "function": {"name": call_mcp.get("name"), "arguments": args_str},
-                                                        }]
-                                                    }
-                                                }],
-                                            }
-                                            # 打印转换后的 OpenAI 工具调用事件
-                                            try:
-                                                logger.info("[OpenAI Compat] 转换后的 SSE(emit tool_calls): %s", json.dumps(delta, ensure_ascii=False))
-                                            except Exception:
-                                                pass
-                                            yield f"data: {json.dumps(delta, ensure_ascii=False)}\n\n"
-                                            tool_calls_emitted = True
-                                        else:
-                                            agent_output = _get(message, "agent_output", "agentOutput") or {}
-                                            text_content = agent_output.get("text", "")
-                                            if text_content:
-                                                delta = {
-                                                    "id": completion_id,
-                                                    "object": "chat.completion.chunk",
-                                                    "created": created_ts,
-                                                    "model": model_id,
-                                                    "choices": [{"index": 0, "delta": {"content": text_content}}],
-                                                }
-                                                try:
-                                                    logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", json.dumps(delta, ensure_ascii=False))
-                                                except Exception:
-                                                    pass
-                                                yield f"data: {json.dumps(delta, ensure_ascii=False)}\n\n"
-
-                        if "finished" in event_data:
-                            done_chunk = {
-                                "id": completion_id,
-                                "object": "chat.completion.chunk",
-                                "created": created_ts,
-                                "model": model_id,
-                                "choices": [{"index": 0, "delta": {}, "finish_reason": ("tool_calls" if tool_calls_emitted else "stop")}],
-                            }
-                            try:
-                                logger.info("[OpenAI Compat] 转换后的 SSE(emit done): %s", json.dumps(done_chunk, ensure_ascii=False))
-                            except Exception:
-                                pass
-                            yield f"data: {json.dumps(done_chunk, ensure_ascii=False)}\n\n"
-
-                # 打印完成标记
-                try:
-                    logger.info("[OpenAI Compat] 转换后的 SSE(emit): [DONE]")
-                except Exception:
-                    pass
-                yield "data: [DONE]\n\n"
+                                    }],
+                                }
+                                payload = encode_json(delta)
+                                logger.info("[OpenAI Compat] 转换后的 SSE(emit tool_calls): %s", payload)
+                                record_first_token()
+                                emitted.append(f"{call_mcp.get('name')}{args_str}")
+                                yield format_sse(payload)
+                                tool_calls_emitted = True
+                            else:
+                                agent_output = _get(message, "agent_output", "agentOutput") or {}
+                                text_content = _text(agent_output.get("text", ""))
+                                if text_content:
+                                    payload = chunks.content(text_content)
+                                    logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", payload)
+                                    record_first_token()
+                                    emitted.append(text_content)
+                                    yield format_sse(payload)
+
+            if "finished" in event_data:
+                pending = _text("", flush=True)
+                if pending:
+                    emitted.append(pending)
+                    payload = chunks.content(pending)
+                    logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", payload)
+                    record_first_token()
+                    yield format_sse(payload)
+                json_tail = json_guard.finish() if (json_guard is not None and not tool_calls_emitted) else ""
+                if json_tail:
+                    emitted.append(json_tail)
+                    payload = chunks.content(json_tail)
+                    logger.info("[OpenAI Compat] 转换后的 SSE(emit json tail): %s", payload)
+                    yield format_sse(payload)
+                done_chunk = {
+                    "id": completion_id,
+                    "object": "chat.completion.chunk",
+                    "created": created_ts,
+                    "model": model_id,
+                    "choices": [{"index": choice_index, "delta": {}, "finish_reason": ("tool_calls" if tool_calls_emitted else "stop")}],
+                }
+                record_finish(done_chunk["choices"][0]["finish_reason"])
+                usage = extract_usage_from_event(event_data)
+                if usage is None and prompt_tokens is not None:
+                    usage = local_usage(prompt_tokens, "".join(emitted), model_id)
+                if usage is not None:
+                    done_chunk["usage"] = usage
+                    record_usage(usage)
+                payload = encode_json(done_chunk)
+                logger.info("[OpenAI Compat] 转换后的 SSE(emit done): %s", payload)
+                yield format_sse(payload)
+
+        # 上游没有发送 finished 事件就结束时，后处理器暂存的文本同样要输出
+        pending = _text("", flush=True)
+        if pending:
+            emitted.append(pending)
+            payload = chunks.content(pending)
+            logger.info("[OpenAI Compat] 转换后的 SSE(emit): %s", payload)
+            record_first_token()
+            yield format_sse(payload)
+
+        if terminate:
+            # 打印完成标记
+            try:
+                logger.info("[OpenAI Compat] 转换后的 SSE(emit): [DONE]")
+            except Exception:
+                pass
+            yield sse_done("openai")
     except Exception as e:
         logger.error(f"[OpenAI Compat] Stream processing failed: {e}")
+        record_finish("error", str(e))
+        if isinstance(e, BridgeError) and e.status_code == 429:
+            # 之后的请求先排队，等限流解除
+            UPSTREAM_QUEUE.note_rate_limited()
         error_chunk = {
             "id": completion_id,
             "object": "chat.completion.chunk",
             "created": created_ts,
             "model": model_id,
-            "choices": [{"index": 0, "delta": {}, "finish_reason": "error"}],
+            "choices": [{"index": choice_index, "delta": {}, "finish_reason": "error"}],
             "error": {"message": str(e)},
         }
+        payload = encode_json(error_chunk)
+        logger.info("[OpenAI Compat] 转换后的 SSE(emit error): %s", payload)
+        yield format_sse(payload)
+        if terminate:
+            yield sse_done("openai")
+    finally:
+        # 客户端断开时（生成器被关闭）立即终止上游 Warp 流，避免继续消耗配额
+        await events.aclose() 
+
+async def stream_openai_sse_choices(packet: Dict[str, Any], n: int, completion_id: str, created_ts: int, model_id: str,
+                                   json_mode: bool = False, prompt_tokens: Optional[int] = None,
+                                   post_processors: Optional[List[Dict[str, Any]]] = None) -> AsyncGenerator[str, None]:
+    """Stream `n` choices in one response, interleaving chunks as each upstream produces them.
+
+    Warp has no native `n`, so every choice is its own upstream request; chunks carry
+    their `choices[].index` and a single [DONE] follows the last choice.
+    """
+    if n <= 1:
+        async with aclosing(stream_openai_sse(packet, completion_id, created_ts, model_id, json_mode=json_mode,
+                                                    prompt_tokens=prompt_tokens, post_processors=post_processors)) as frames:
+            async for frame in frames:
+                yield frame
+        return
+
+    queue: asyncio.Queue = asyncio.Queue()
+
+    async def pump(index: int) -> None:
         try:
-            logger.info("[OpenAI Compat] 转换后的 SSE(emit error): %s", json.dumps(error_chunk, ensure_ascii=False))
-        except Exception:
-            pass
-        yield f"data: {json.dumps(error_chunk, ensure_ascii=False)}\n\n"
-        yield "data: [DONE]\n\n" 
\ No newline at end of file
+            async with aclosing(stream_openai_sse(packet, completion_id, created_ts, model_id,
+                                                  choice_index=index, terminate=False, json_mode=json_mode,
+                                                  prompt_tokens=prompt_tokens, post_processors=post_processors)) as frames:
+                async for frame in frames:
+                    await queue.put(frame)
+        finally:
+            queue.put_nowait(None)
+
+    tasks = [asyncio.create_task(pump(i)) for i in range(n)]
+    try:
+        remaining = n
+        while remaining:
+            frame = await queue.get()
+            if frame is None:
+                remaining -= 1
+                continue
+            yield frame
+        yield sse_done("openai")
+    finally:
+        for task in tasks:
+            task.cancel()
+        await asyncio.gather(*tasks, return_exceptions=True)
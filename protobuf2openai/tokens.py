@@ -0,0 +1,110 @@
+from __future__ import annotations
+
+import json
+import math
+from functools import lru_cache
+from typing import Any, Dict, List, Optional
+
+from .helpers import normalize_content_to_list, segments_to_text
+from .logging import logger
+
+# 较新的 OpenAI 模型使用 o200k_base；其他模型（Claude、Gemini 等）没有公开的分词表，用 cl100k_base 近似
+_O200K_PREFIXES = ("gpt-4o", "gpt-4.1", "gpt-5", "o1", "o3", "o4")
+
+# OpenAI chat 格式：每条消息约 3 个包装 token，回复前再加 3 个
+_TOKENS_PER_MESSAGE = 3
+_TOKENS_PER_REPLY = 3
+
+
+def encoding_name(model: Optional[str]) -> str:
+    return "o200k_base" if (model or "").startswith(_O200K_PREFIXES) else "cl100k_base"
+
+
+@lru_cache(maxsize=None)
+def _encoding(name: str) -> Any:
+    """The tiktoken encoding, or None (estimates are used) when tiktoken or its BPE table is unavailable."""
+    try:
+        import tiktoken
+    except ImportError:
+        logger.info("[OpenAI Compat] 未安装 tiktoken，token 数按字节估算 (pip install tiktoken)")
+        return None
+    try:
+        return tiktoken.get_encoding(name)
+    except Exception as e:
+        logger.warning("[OpenAI Compat] 无法加载分词表 %s，token 数按字节估算: %s", name, e)
+        return None
+
+
+def tokenizer_for(model: Optional[str]) -> str:
+    """Name of what count_text uses for this model: a BPE table, or "estimate"."""
+    name = encoding_name(model)
+    return name if _encoding(name) is not None else "estimate"
+
+
+def count_text(text: str, model: Optional[str]) -> int:
+    if not text:
+        return 0
+    encoding = _encoding(encoding_name(model))
+    if encoding is None:
+        return math.ceil(len(text.encode("utf-8")) / 4)
+    return len(encoding.encode(text, disallowed_special=()))
+
+
+def message_text(message: Any) -> str:
+    """Text of a ChatMessage (or a message dict) as the model sees it, tool calls included."""
+    get = message.get if isinstance(message, dict) else (lambda name: getattr(message, name, None))
+    text = segments_to_text(normalize_content_to_list(get("content")))
+    if get("tool_calls"):
+        text += json.dumps(get("tool_calls"), ensure_ascii=False)
+    return text
+
+
+def count_message(message: Any, model: Optional[str]) -> int:
+    get = message.get if isinstance(message, dict) else (lambda name: getattr(message, name, None))
+    return _TOKENS_PER_MESSAGE + count_text(message_text(message), model) + (1 if get("name") else 0)
+
+
+def count_messages(messages: List[Any], model: Optional[str]) -> int:
+    """Prompt tokens of a chat request's messages, the way OpenAI bills them."""
+    return _TOKENS_PER_REPLY + sum(count_message(m, model) for m in messages)
+
+
+def local_usage(prompt_tokens: int, completion_text: str, model: Optional[str]) -> Dict[str, Any]:
+    """A usage object for responses whose upstream reported none."""
+    completion_tokens = count_text(completion_text, model)
+    return {
+        "prompt_tokens": prompt_tokens,
+        "completion_tokens": completion_tokens,
+        "total_tokens": prompt_tokens + completion_tokens,
+    }
+
+
+def _anthropic_block_text(block: Any) -> str:
+    if isinstance(block, str):
+        return block
+    if not isinstance(block, dict):
+        return ""
+    if block.get("type") == "tool_use":
+        return f"{block.get('name', '')}{json.dumps(block.get('input') or {}, ensure_ascii=False)}"
+    if block.get("type") == "tool_result":
+        content = block.get("content")
+        return content if isinstance(content, str) else "".join(_anthropic_block_text(b) for b in content or [])
+    return block.get("text") or ""
+
+
+def count_anthropic_request(body: Dict[str, Any], model: Optional[str]) -> int:
+    """input_tokens of an Anthropic Messages request (system, messages and tool definitions)."""
+    total = 0
+    system = body.get("system")
+    if system:
+        blocks = system if isinstance(system, list) else [system]
+        total += _TOKENS_PER_MESSAGE + count_text("".join(_anthropic_block_text(b) for b in blocks), model)
+    for message in body.get("messages") or []:
+        if not isinstance(message, dict):
+            continue
+        content = message.get("content")
+        blocks = content if isinstance(content, list) else [content]
+        total += _TOKENS_PER_MESSAGE + count_text("".join(_anthropic_block_text(b) for b in blocks), model)
+    if body.get("tools"):
+        total += count_text(json.dumps(body["tools"], ensure_ascii=False), model)
+    return total + _TOKENS_PER_REPLY
@@ -0,0 +1,270 @@
+from __future__ import annotations
+
+import time
+from contextlib import aclosing
+from typing import Any, AsyncIterator, Dict, Optional
+
+from fastapi import HTTPException
+
+from warp2protobuf.api.client import BridgeClient, BridgeClientError
+
+from .logging import logger
+from .metrics import observe_upstream
+from warp2protobuf.core.tracing import end_span, span, start_span
+from .config import BRIDGE_BASE_URL, BRIDGE_TRANSPORT, BRIDGE_TOKEN, BRIDGE_SOCKET
+
+
+WARP_REQUEST_TYPE = "warp.multi_agent.v1.Request"
+
+
+# Bridge call failed with an HTTP-style status code
+BridgeError = BridgeClientError
+
+
+class BridgeTransport:
+    """How the OpenAI-compatible layer reaches the bridge service.
+
+    send_stream returns the bridge's /api/warp/send_stream payload
+    (response, conversation_id, task_id, parsed_events); stream_events yields
+    {"event_number", "event_type", "parsed_data"} dicts as Warp streams them.
+    """
+
+    name = "abstract"
+
+    async def send_stream(self, packet: Dict[str, Any]) -> Dict[str, Any]:
+        raise NotImplementedError
+
+    def stream_events(self, packet: Dict[str, Any]) -> AsyncIterator[Dict[str, Any]]:
+        raise NotImplementedError
+
+    async def readiness(self) -> Dict[str, Any]:
+        """{"ready": bool, ...details} for /readyz: can this transport serve a completion now?"""
+        raise NotImplementedError
+
+    async def healthz(self) -> bool:
+        return True
+
+    async def account_status(self) -> Dict[str, Any]:
+        """Usable / total Warp accounts behind this transport (1 / 1 or 0 / 1 without an account pool)."""
+        raise NotImplementedError
+
+    async def account_usage(self) -> Dict[str, Any]:
+        """The bridge's per-account usage report (/api/accounts/usage)."""
+        raise NotImplementedError
+
+    async def update_account(self, label: str, changes: Dict[str, Any]) -> Dict[str, Any]:
+        """Change a pooled account at runtime (PATCH /api/accounts/{label}): enabled, weight, reset_cooldown."""
+        raise NotImplementedError
+
+    async def list_models(self) -> Dict[str, Any]:
+        from warp2protobuf.config.models import get_all_unique_models
+        return {"object": "list", "data": get_all_unique_models()}
+
+    async def aclose(self) -> None:
+        """Release connections held by the transport (on server shutdown)."""
+
+
+class HttpBridgeTransport(BridgeTransport):
+    """Talks to a separately running bridge over HTTP (default)."""
+
+    name = "http"
+
+    def __init__(self, base_url: str = BRIDGE_BASE_URL):
+        self.client = BridgeClient(base_url, token=BRIDGE_TOKEN, uds=BRIDGE_SOCKET)
+
+    async def _refresh_after_429(self) -> None:
+        try:
+            await self.client.refresh_auth()
+            logger.warning("[OpenAI Compat] Bridge returned 429. Tried JWT refresh -> ok")
+        except Exception as _e:
+            logger.warning("[OpenAI Compat] JWT refresh attempt failed after 429: %s", _e)
+
+    async def healthz(self) -> bool:
+        return await self.client.healthz()
+
+    async def readiness(self) -> Dict[str, Any]:
+        # 桥接服务器的 /readyz 会检查它自己的配置和 Warp 凭据
+        report = await self.client.readyz()
+        return {"ready": report.pop("ready"), "bridge": report}
+
+    async def list_models(self) -> Dict[str, Any]:
+        return await self.client.list_models()
+
+    async def account_status(self) -> Dict[str, Any]:
+        report = await self.client.auth_status()
+        accounts = report.get("accounts")
+        if isinstance(accounts, list):
+            return {"available": sum(1 for a in accounts if a.get("available")), "total": len(accounts)}
+        return {"available": 1 if report.get("authenticated") else 0, "total": 1}
+
+    async def account_usage(self) -> Dict[str, Any]:
+        return await self.client.account_usage()
+
+    async def update_account(self, label: str, changes: Dict[str, Any]) -> Dict[str, Any]:
+        return await self.client.update_account(label, changes)
+
+    async def aclose(self) -> None:
+        await self.client.aclose()
+
+    async def send_stream(self, packet: Dict[str, Any]) -> Dict[str, Any]:
+        try:
+            return await self.client.send_to_warp(packet, WARP_REQUEST_TYPE)
+        except BridgeError as e:
+            if e.status_code != 429:
+                raise
+        await self._refresh_after_429()
+        return await self.client.send_to_warp(packet, WARP_REQUEST_TYPE)
+
+    async def stream_events(self, packet: Dict[str, Any]) -> AsyncIterator[Dict[str, Any]]:
+        for attempt in range(2):
+            started = False
+            try:
+                # aclosing: 调用方提前关闭时立即断开到bridge的流，而不是等待GC
+                async with aclosing(self.client.iter_warp_events(packet, WARP_REQUEST_TYPE)) as events:
+                    async for ev in events:
+                        started = True
+                        yield ev
+                return
+            except BridgeError as e:
+                if e.status_code == 429 and attempt == 0 and not started:
+                    await self._refresh_after_429()
+                    # 重试一次
+                    continue
+                logger.error(f"[OpenAI Compat] Bridge HTTP error {e.status_code}: {str(e.detail)[:300]}")
+                raise
+
+
+class InProcessBridgeTransport(BridgeTransport):
+    """Calls the bridge service layer directly when both run in one process.
+
+    Requests made this way skip the bridge's HTTP routes, so they do not show up
+    in the bridge packet history.
+    """
+
+    name = "inprocess"
+
+    async def readiness(self) -> Dict[str, Any]:
+        from warp2protobuf.core.auth import credential_status
+        ok, detail = credential_status()
+        return {"ready": ok, "credentials": detail}
+
+    async def account_status(self) -> Dict[str, Any]:
+        from warp2protobuf.core.account_pool import get_account_pool
+        from warp2protobuf.core.auth import credential_status
+        pool = get_account_pool()
+        if pool is not None:
+            accounts = pool.status()
+            return {"available": sum(1 for a in accounts if a["available"]), "total": len(accounts)}
+        ok, _detail = credential_status()
+        return {"available": 1 if ok else 0, "total": 1}
+
+    async def account_usage(self) -> Dict[str, Any]:
+        from warp2protobuf.core.account_pool import get_account_pool
+        pool = get_account_pool()
+        if pool is None:
+            return {"mode": "single_token", "accounts": []}
+        return {"mode": "account_pool", "accounts": pool.usage()}
+
+    async def update_account(self, label: str, changes: Dict[str, Any]) -> Dict[str, Any]:
+        # 与桥接服务器的 PATCH /api/accounts/{label} 相同的错误码
+        from warp2protobuf.core.account_pool import update_pooled_account
+        try:
+            return update_pooled_account(label, changes)
+        except LookupError as e:
+            raise BridgeError(404, str(e))
+        except ValueError as e:
+            raise BridgeError(400, str(e))
+
+    async def aclose(self) -> None:
+        from warp2protobuf.warp.http_client import close_warp_http_client
+        await close_warp_http_client()
+
+    def _encode(self, packet: Dict[str, Any]) -> bytes:
+        from warp2protobuf.warp.bridge_service import prepare_warp_request
+        try:
+            _, protobuf_bytes = prepare_warp_request(packet, WARP_REQUEST_TYPE)
+        except ValueError as e:
+            raise BridgeError(400, str(e))
+        except HTTPException as e:
+            raise BridgeError(e.status_code, str(e.detail))
+        return protobuf_bytes
+
+    async def send_stream(self, packet: Dict[str, Any]) -> Dict[str, Any]:
+        from warp2protobuf.warp.bridge_service import send_parsed
+        from warp2protobuf.warp.adaptive_limit import UpstreamBusy
+        try:
+            return await send_parsed(self._encode(packet))
+        except UpstreamBusy as e:
+            raise BridgeError(503, str(e))
+
+    async def stream_events(self, packet: Dict[str, Any]) -> AsyncIterator[Dict[str, Any]]:
+        from warp2protobuf.warp.bridge_service import iter_sse_events
+        protobuf_bytes = self._encode(packet)
+        async with aclosing(iter_sse_events(protobuf_bytes)) as events:
+            async for ev in events:
+                if "error" in ev:
+                    raise BridgeError(int(ev.get("status_code") or 502), ev.get("detail") or ev["error"])
+                yield ev
+
+
+class MeteredTransport:
+    """Wraps a transport to record call counts and durations in the upstream metrics."""
+
+    def __init__(self, inner: BridgeTransport):
+        self._inner = inner
+
+    def __getattr__(self, name: str) -> Any:
+        return getattr(self._inner, name)
+
+    async def send_stream(self, packet: Dict[str, Any]) -> Dict[str, Any]:
+        started = time.perf_counter()
+        outcome = "error"
+        try:
+            with span("bridge.send", transport=self._inner.name):
+                result = await self._inner.send_stream(packet)
+            outcome = "ok"
+            return result
+        finally:
+            observe_upstream(self._inner.name, "send", outcome, time.perf_counter() - started)
+
+    async def stream_events(self, packet: Dict[str, Any]) -> AsyncIterator[Dict[str, Any]]:
+        started = time.perf_counter()
+        outcome = "error"
+        # 不设为当前 span：异步生成器跨 yield 切换上下文
+        stream_span = start_span("bridge.stream", transport=self._inner.name)
+        error: Optional[BaseException] = None
+        events_seen = 0
+        try:
+            async with aclosing(self._inner.stream_events(packet)) as events:
+                async for ev in events:
+                    events_seen += 1
+                    yield ev
+            outcome = "ok"
+        except GeneratorExit:
+            # 客户端断开或关机收尾导致提前关闭
+            outcome = "cancelled"
+            raise
+        except Exception as e:
+            error = e
+            raise
+        finally:
+            observe_upstream(self._inner.name, "stream", outcome, time.perf_counter() - started)
+            end_span(stream_span, error, outcome=outcome, events=events_seen)
+
+
+_transport: Optional[Any] = None
+
+
+def get_bridge_transport() -> BridgeTransport:
+    global _transport
+    if _transport is None:
+        if BRIDGE_TRANSPORT == "inprocess":
+            _transport = MeteredTransport(InProcessBridgeTransport())
+        else:
+            _transport = MeteredTransport(HttpBridgeTransport())
+        logger.info("[OpenAI Compat] Bridge transport: %s", _transport.name)
+    return _transport
+
+
+def is_inprocess() -> bool:
+    return get_bridge_transport().name == "inprocess"
@@ -0,0 +1,162 @@
+from __future__ import annotations
+
+import asyncio
+import math
+import time
+from collections import OrderedDict, deque
+from typing import AsyncIterator, Deque, Dict, Optional
+
+from .config import UPSTREAM_QUEUE_SIZE, UPSTREAM_QUEUE_TIMEOUT, UPSTREAM_RATE_LIMIT_BACKOFF, UPSTREAM_QUEUE_DRAIN_INTERVAL
+from .logging import logger
+
+
+class UpstreamQueueRejected(Exception):
+    """The upstream queue is full, or the wait for a turn timed out."""
+
+    def __init__(self, message: str, retry_after: float):
+        super().__init__(message)
+        self.retry_after = max(1, math.ceil(retry_after))
+
+
+class UpstreamQueue:
+    """Holds requests back while Warp is rate limiting, instead of failing them right away.
+
+    A 429 from upstream (note_rate_limited) closes the gate for `backoff` seconds. Requests
+    arriving while it is closed, or while others are still queued, wait in a per-key FIFO;
+    once the gate reopens the waiters are released one at a time, every `drain_interval`
+    seconds, rotating over the keys so one busy API key cannot starve the rest. Another
+    429 during the drain closes the gate again.
+    """
+
+    def __init__(self, max_waiting: int, max_wait: float, backoff: float, drain_interval: float):
+        self.max_waiting = max_waiting
+        self.max_wait = max_wait
+        self.backoff = backoff
+        self.drain_interval = drain_interval
+        self.limited_until = 0.0
+        self.rate_limited_total = 0
+        self.queued_total = 0
+        self.rejected_total = 0
+        self._queues: "OrderedDict[str, Deque[asyncio.Future]]" = OrderedDict()
+        self._drainer: Optional[asyncio.Task] = None
+
+    @property
+    def enabled(self) -> bool:
+        return self.max_waiting > 0
+
+    def waiting(self) -> int:
+        return sum(len(q) for q in self._queues.values())
+
+    def gated(self) -> bool:
+        return self.enabled and (time.time() < self.limited_until or self.waiting() > 0)
+
+    def note_rate_limited(self, retry_after: Optional[float] = None) -> None:
+        if not self.enabled:
+            return
+        self.rate_limited_total += 1
+        until = time.time() + (retry_after or self.backoff)
+        if until > self.limited_until:
+            self.limited_until = until
+            logger.warning("[OpenAI Compat] Warp 上游限流，新请求排队 %.0f 秒后再逐个放行", until - time.time())
+
+    def check_capacity(self) -> None:
+        """Raise UpstreamQueueRejected when a new request could not even be queued."""
+        if self.gated() and self.waiting() >= self.max_waiting:
+            self.rejected_total += 1
+            raise UpstreamQueueRejected("upstream is rate limited and the wait queue is full", self._retry_after())
+
+    async def queued(self, key: str, report_every: float = 0) -> AsyncIterator[int]:
+        """Wait for this request's turn; yields its queue position every `report_every` seconds meanwhile.
+
+        Returns at once while the gate is open and nobody is waiting.
+        """
+        if not self.gated():
+            return
+        self.check_capacity()
+        waiter = asyncio.get_running_loop().create_future()
+        self._queues.setdefault(key, deque()).append(waiter)
+        self.queued_total += 1
+        self._ensure_drainer()
+        deadline = time.monotonic() + self.max_wait
+        try:
+            while True:
+                remaining = deadline - time.monotonic()
+                if remaining <= 0:
+                    self.rejected_total += 1
+                    raise UpstreamQueueRejected(f"upstream is rate limited, no turn within {self.max_wait:.0f}s", self._retry_after())
+                timeout = min(remaining, report_every) if report_every > 0 else remaining
+                try:
+                    await asyncio.wait_for(asyncio.shield(waiter), timeout=timeout)
+                    return
+                except asyncio.TimeoutError:
+                    if report_every > 0 and time.monotonic() < deadline:
+                        yield self._position(key, waiter)
+        finally:
+            self._discard(key, waiter)
+
+    def _retry_after(self) -> float:
+        return max(self.limited_until - time.time(), 0) + self.waiting() * self.drain_interval
+
+    def _position(self, key: str, waiter: asyncio.Future) -> int:
+        """1-based release order under the round-robin drain."""
+        queue = self._queues.get(key)
+        if queue is None or waiter not in queue:
+            return 0
+        depth = queue.index(waiter)
+        # 前 depth 轮每个 key 各放行一个，第 depth 轮中排在本 key 之前的 key 再各放行一个
+        ahead = sum(min(len(other), depth) for other in self._queues.values())
+        for other_key, other in self._queues.items():
+            if other_key == key:
+                break
+            if len(other) > depth:
+                ahead += 1
+        return ahead + 1
+
+    def _discard(self, key: str, waiter: asyncio.Future) -> None:
+        queue = self._queues.get(key)
+        if queue is None:
+            return
+        try:
+            queue.remove(waiter)
+        except ValueError:
+            pass
+        if not queue:
+            del self._queues[key]
+
+    def _ensure_drainer(self) -> None:
+        if self._drainer is None or self._drainer.done():
+            self._drainer = asyncio.ensure_future(self._drain())
+
+    async def _drain(self) -> None:
+        while self._queues:
+            delay = self.limited_until - time.time()
+            if delay > 0:
+                await asyncio.sleep(delay)
+                continue
+            key, queue = next(iter(self._queues.items()))
+            waiter = queue.popleft()
+            # 轮转：该 key 移到末尾，下一个放行其他 key 的请求
+            if queue:
+                self._queues.move_to_end(key)
+            else:
+                del self._queues[key]
+            if waiter.done():
+                continue
+            waiter.set_result(None)
+            await asyncio.sleep(self.drain_interval)
+
+    def status(self) -> Dict[str, object]:
+        return {
+            "enabled": self.enabled,
+            "rate_limited": time.time() < self.limited_until,
+            "limited_for": round(max(self.limited_until - time.time(), 0), 1),
+            "waiting": self.waiting(),
+            "waiting_keys": len(self._queues),
+            "max_waiting": self.max_waiting,
+            "rate_limited_total": self.rate_limited_total,
+            "queued_total": self.queued_total,
+            "rejected_total": self.rejected_total,
+        }
+
+
+UPSTREAM_QUEUE = UpstreamQueue(UPSTREAM_QUEUE_SIZE, UPSTREAM_QUEUE_TIMEOUT, UPSTREAM_RATE_LIMIT_BACKOFF, UPSTREAM_QUEUE_DRAIN_INTERVAL)
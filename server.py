@@ -27,6 +27,10 @@ from warp2protobuf.core.protobuf_utils import dict_to_protobuf_bytes
 from warp2protobuf.core.schema_sanitizer import sanitize_mcp_input_schema_in_packet
 from warp2protobuf.core.auth import acquire_anonymous_access_token
 from warp2protobuf.config.models import get_all_unique_models
+from warp2protobuf.config.settings import BRIDGE_SOCKET, BRIDGE_SOCKET_MODE, SHUTDOWN_GRACE_PERIOD
+from warp2protobuf.config.validation import check_config_or_exit
+from warp2protobuf.core.listeners import ListenSpec, bind_tcp_socket, bind_unix_socket, close_listeners, reuse_port_enabled
+from warp2protobuf.api.access_log import uvicorn_access_log
 
 
 # ============= 工具：input_schema 清理与校验 =============
@@ -492,16 +496,24 @@ async def startup_tasks():
     logger.info("  POST /api/encode         - JSON -> Protobuf编码")
     logger.info("  POST /api/decode         - Protobuf -> JSON解码")
     logger.info("  POST /api/stream-decode  - 流式protobuf解码")
+    logger.info("  POST /api/debug/wire     - 无schema的wire格式字段树")
     logger.info("  POST /api/warp/send      - JSON -> Protobuf -> Warp API转发")
     logger.info("  POST /api/warp/send_stream - JSON -> Protobuf -> Warp API转发(返回解析事件)")
     logger.info("  POST /api/warp/send_stream_sse - JSON -> Protobuf -> Warp API转发(实时SSE，事件已解析)")
     logger.info("  POST /api/warp/graphql/* - GraphQL请求转发到Warp API（带鉴权）")
+    logger.info("  GET  /api/warp/connection_stats - 上游连接复用统计")
+    logger.info("  GET  /metrics            - Bridge指标 (Prometheus / ?format=json)")
     logger.info("  GET  /api/schemas        - Protobuf schema信息")
+    logger.info("  POST /api/schemas        - 运行时上传 FileDescriptorSet / .proto")
+    logger.info("  GET  /api/schemas/versions - 已加载的schema版本")
+    logger.info("  GET  /api/schemas/diff   - 对比两个schema版本 (?from=&to=)")
     logger.info("  GET  /api/auth/status    - JWT认证状态")
     logger.info("  POST /api/auth/refresh   - 刷新JWT token")
     logger.info("  GET  /api/auth/user_id   - 获取当前用户ID")
     logger.info("  GET  /api/packets/history - 数据包历史记录")
-    logger.info("  WS   /ws                 - WebSocket实时监控")
+    logger.info("  GET  /api/packets/export - 导出数据包历史 (JSONL)")
+    logger.info("  POST /api/packets/{id}/replay - 重放已捕获的Warp请求并对比响应")
+    logger.info("  WS   /ws                 - WebSocket实时监控（?events=encode,decode,... 订阅）")
     logger.info("-"*40)
     logger.info("测试命令:")
     logger.info("  uv run main.py --test basic    - 运行基础测试")
@@ -509,16 +521,8 @@ async def startup_tasks():
     logger.info("="*60)
 
 
-def main():
-    """主函数"""
-    import argparse
-    
-    # 解析命令行参数
-    parser = argparse.ArgumentParser(description="Warp Protobuf编解码服务器")
-    parser.add_argument("--port", type=int, default=28888, help="服务器监听端口 (默认: 28888)")
-    args = parser.parse_args()
-    
-    # 创建应用
+def build_bridge_app() -> FastAPI:
+    """创建带启动任务的bridge应用（每个进程只应调用一次）"""
     app = create_app()
     
     # 添加启动事件
@@ -526,21 +530,62 @@ def main():
     async def startup_event():
         await startup_tasks()
     
+    return app
+
+
+def run_bridge(port: int = 28888, socket_path: str = "", host: str = "0.0.0.0") -> None:
+    """检查配置并以阻塞方式运行bridge服务器"""
+    # 启动前一次性检查全部配置问题
+    check_config_or_exit("bridge")
+    
+    # 创建应用
+    app = build_bridge_app()
+    
     # 启动服务器
+    sock = None
     try:
-        logger.info(f"启动服务器在端口 {args.port}")
-        uvicorn.run(
-            app,
-            host="0.0.0.0",
-            port=args.port,
-            log_level="info",
-            access_log=True
-        )
+        if socket_path:
+            sock = bind_unix_socket(socket_path, BRIDGE_SOCKET_MODE)
+            logger.info(f"启动服务器在Unix socket {socket_path} (mode {oct(BRIDGE_SOCKET_MODE)})")
+            uvicorn.run(app, fd=sock.fileno(), log_level="info", access_log=uvicorn_access_log(),
+                        timeout_graceful_shutdown=SHUTDOWN_GRACE_PERIOD)
+        elif reuse_port_enabled():
+            # SO_REUSEPORT：新进程可在旧进程退出前绑定同一端口
+            sock = bind_tcp_socket(host, port, reuse_port=True)
+            logger.info(f"启动服务器在端口 {port} (SO_REUSEPORT)")
+            uvicorn.run(app, fd=sock.fileno(), log_level="info", access_log=uvicorn_access_log(),
+                        timeout_graceful_shutdown=SHUTDOWN_GRACE_PERIOD)
+        else:
+            logger.info(f"启动服务器在端口 {port}")
+            uvicorn.run(
+                app,
+                host=host,
+                port=port,
+                log_level="info",
+                access_log=uvicorn_access_log(),
+                timeout_graceful_shutdown=SHUTDOWN_GRACE_PERIOD,
+            )
     except KeyboardInterrupt:
         logger.info("服务器被用户停止")
     except Exception as e:
         logger.error(f"服务器启动失败: {e}")
         raise
+    finally:
+        if sock is not None:
+            # 只删除本进程创建的socket文件，并行启动的新进程可能已替换它
+            close_listeners([sock], [ListenSpec(raw=socket_path, path=socket_path)] if socket_path else [])
+
+
+def main():
+    """主函数"""
+    import argparse
+    
+    # 解析命令行参数
+    parser = argparse.ArgumentParser(description="Warp Protobuf编解码服务器")
+    parser.add_argument("--port", type=int, default=28888, help="服务器监听端口 (默认: 28888)")
+    parser.add_argument("--socket", default=BRIDGE_SOCKET, help="监听Unix domain socket路径（设置后不再监听TCP端口，默认读取 BRIDGE_SOCKET）")
+    args = parser.parse_args()
+    run_bridge(args.port, args.socket)
 
 
 if __name__ == "__main__":
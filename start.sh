@@ -150,7 +150,12 @@ start_bridge_server() {
     # 等待服务器启动
     log_info "等待Protobuf桥接服务器启动..."
     for i in {1..30}; do
-        if curl -s http://localhost:$BRIDGE_PORT/healthz >/dev/null 2>&1; then
+        if [ -n "$BRIDGE_SOCKET" ]; then
+            BRIDGE_HEALTH_CMD="curl -s --unix-socket $BRIDGE_SOCKET http://localhost/healthz"
+        else
+            BRIDGE_HEALTH_CMD="curl -s http://localhost:$BRIDGE_PORT/healthz"
+        fi
+        if $BRIDGE_HEALTH_CMD >/dev/null 2>&1; then
             log_success "Protobuf桥接服务器启动成功 (PID: $BRIDGE_PID)"
             log_info "📍 Protobuf桥接服务器地址: http://localhost:$BRIDGE_PORT"
             return 0
@@ -0,0 +1,126 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Structured access logs
+
+One record per request, written when the response body has been fully sent (so
+streamed completions report their real duration and token usage). Handlers add
+fields through request_context.request_fields(): key_id, model, stream,
+prompt_tokens, completion_tokens, account.
+
+ACCESS_LOG=json emits one JSON object per line (for Loki / ELK), text emits
+key=value pairs, off disables it. Either way uvicorn's own access log is turned
+off so every request is logged once. Observers (request metrics) get the same
+end-of-response record whether or not the log itself is enabled.
+"""
+import json
+import logging
+import os
+import sys
+import time
+from datetime import datetime, timezone
+from typing import Any, Callable, Dict, Iterable
+
+from fastapi import FastAPI, Request
+
+from .client_ip import client_ip
+from ..core.redaction import add_redaction
+from ..core.request_context import begin_request_fields, current_request_id, end_request_fields, request_fields
+
+
+class JSONLogFormatter(logging.Formatter):
+    def format(self, record: logging.LogRecord) -> str:
+        entry: Dict[str, Any] = {
+            "ts": datetime.fromtimestamp(record.created, timezone.utc).isoformat(timespec="milliseconds"),
+            "level": record.levelname.lower(),
+            "logger": record.name,
+            "msg": record.getMessage(),
+        }
+        entry.update(getattr(record, "fields", None) or {})
+        return json.dumps(entry, ensure_ascii=False, default=str)
+
+
+class KeyValueLogFormatter(logging.Formatter):
+    def format(self, record: logging.LogRecord) -> str:
+        stamp = datetime.fromtimestamp(record.created).strftime("%Y-%m-%d %H:%M:%S")
+        pairs = " ".join(f"{k}={v}" for k, v in (getattr(record, "fields", None) or {}).items() if v is not None)
+        return f"{stamp} {record.getMessage()} {pairs}"
+
+
+def access_log_enabled(mode: str) -> bool:
+    return mode in ("json", "text")
+
+
+def uvicorn_access_log() -> bool:
+    """Whether uvicorn should keep its own access log (only when ACCESS_LOG=off)."""
+    return not access_log_enabled(os.getenv("ACCESS_LOG", "json").strip().lower())
+
+
+def _access_logger(name: str, mode: str) -> logging.Logger:
+    logger = logging.getLogger(name)
+    logger.setLevel(logging.INFO)
+    logger.propagate = False
+    for handler in logger.handlers[:]:
+        logger.removeHandler(handler)
+    handler = logging.StreamHandler(sys.stdout)
+    handler.setFormatter(JSONLogFormatter() if mode == "json" else KeyValueLogFormatter())
+    add_redaction((handler,))
+    logger.addHandler(handler)
+    return logger
+
+
+# observer(request, status, latency_seconds, fields)
+Observer = Callable[[Request, int, float, Dict[str, Any]], None]
+
+
+def install_access_log(app: FastAPI, name: str, mode: str, observers: Iterable[Observer] = ()) -> None:
+    """Register the access-log middleware on `app` (call before the request-ID middleware)."""
+    observers = list(observers)
+    enabled = access_log_enabled(mode)
+    if not enabled and not observers:
+        return
+    logger = _access_logger(name, mode) if enabled else None
+
+    def emit(request: Request, status: int, started: float, fields: Dict[str, Any]) -> None:
+        latency = time.perf_counter() - started
+        for observer in observers:
+            try:
+                observer(request, status, latency, fields)
+            except Exception:
+                pass
+        if logger is None:
+            return
+        record = {
+            "request_id": getattr(request.state, "request_id", None) or current_request_id(),
+            "method": request.method,
+            "path": request.url.path,
+            "status": status,
+            "latency_ms": round(latency * 1000, 1),
+            "client": client_ip(request),
+        }
+        record.update(fields)
+        logger.info("access", extra={"fields": record})
+
+    @app.middleware("http")
+    async def _access_log(request: Request, call_next):
+        started = time.perf_counter()
+        token = begin_request_fields()
+        fields = request_fields()
+        try:
+            response = await call_next(request)
+        except Exception:
+            emit(request, 500, started, fields)
+            raise
+        finally:
+            end_request_fields(token)
+        body = response.body_iterator
+
+        async def _logged_body():
+            try:
+                async for chunk in body:
+                    yield chunk
+            finally:
+                emit(request, response.status_code, started, fields)
+
+        response.body_iterator = _logged_body()
+        return response
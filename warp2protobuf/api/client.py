@@ -0,0 +1,180 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Typed async client for the bridge HTTP API
+
+Wraps the bridge routes (/api/encode, /api/decode, /api/warp/send_stream,
+/api/warp/send_stream_sse, /api/auth/*) so external scripts and the
+OpenAI-compatible server do not hand-roll HTTP calls. Only depends on httpx;
+the current request's x-request-id is forwarded on every call.
+"""
+import base64
+import json
+import os
+from typing import Any, AsyncIterator, Awaitable, Callable, Dict, Optional, Union
+from urllib.parse import quote
+
+import httpx
+
+from ..core.request_context import with_request_context
+from ..core.tracing import inject_trace_headers
+
+DEFAULT_BRIDGE_URL = "http://127.0.0.1:28888"
+DEFAULT_MESSAGE_TYPE = "warp.multi_agent.v1.Request"
+
+EventCallback = Callable[[Dict[str, Any]], Union[None, Awaitable[None]]]
+
+
+class BridgeClientError(Exception):
+    """Bridge returned a non-2xx status or an in-stream error."""
+
+    def __init__(self, status_code: int, detail: str):
+        super().__init__(f"bridge error: HTTP {status_code} {detail}")
+        self.status_code = status_code
+        self.detail = detail
+
+
+class BridgeClient:
+    """Async client for a running bridge.
+
+    Example:
+        async with BridgeClient() as bridge:
+            pb = await bridge.encode({"input": {...}})
+            await bridge.send_to_warp_stream(packet, on_event=print)
+    """
+
+    def __init__(self, base_url: Optional[str] = None, token: Optional[str] = None,
+                 timeout: float = 180.0, connect_timeout: float = 5.0, http2: bool = True,
+                 uds: Optional[str] = None, stream_read_timeout: Optional[float] = 600.0):
+        self.base_url = (base_url or os.getenv("WARP_BRIDGE_URL") or DEFAULT_BRIDGE_URL).rstrip("/")
+        self.token = token if token is not None else os.getenv("BRIDGE_TOKEN", "")
+        # Unix domain socket of the bridge; base_url is then only used for the Host header
+        self.uds = uds if uds is not None else os.getenv("BRIDGE_SOCKET", "")
+        self._timeout = httpx.Timeout(timeout, connect=connect_timeout)
+        # SSE streams may pause much longer than a normal call between events (None = no limit)
+        self._stream_timeout = httpx.Timeout(timeout, connect=connect_timeout, read=stream_read_timeout)
+        self._http2 = http2
+        self._client: Optional[httpx.AsyncClient] = None
+
+    async def __aenter__(self) -> "BridgeClient":
+        return self
+
+    async def __aexit__(self, *exc) -> None:
+        await self.aclose()
+
+    def headers(self, extra: Optional[Dict[str, str]] = None) -> Dict[str, str]:
+        headers: Dict[str, str] = inject_trace_headers(with_request_context(dict(extra or {})))
+        if self.token:
+            headers["Authorization"] = f"Bearer {self.token}"
+        return headers
+
+    def _get_client(self) -> httpx.AsyncClient:
+        if self._client is None or self._client.is_closed:
+            transport = httpx.AsyncHTTPTransport(uds=self.uds) if self.uds else None
+            self._client = httpx.AsyncClient(http2=self._http2 and not self.uds, timeout=self._timeout,
+                                             trust_env=not self.uds, transport=transport)
+        return self._client
+
+    async def aclose(self) -> None:
+        if self._client is not None and not self._client.is_closed:
+            await self._client.aclose()
+        self._client = None
+
+    async def _request(self, method: str, path: str, **kwargs) -> Any:
+        resp = await self._get_client().request(method, f"{self.base_url}{path}", headers=self.headers(), **kwargs)
+        if resp.status_code != 200:
+            raise BridgeClientError(resp.status_code, resp.text)
+        return resp.json()
+
+    async def healthz(self) -> bool:
+        try:
+            resp = await self._get_client().get(f"{self.base_url}/healthz", timeout=5.0)
+            return resp.status_code == 200
+        except httpx.HTTPError:
+            return False
+
+    async def readyz(self) -> Dict[str, Any]:
+        """The bridge's readiness report; {"ready": False, ...} when it cannot be reached."""
+        try:
+            resp = await self._get_client().get(f"{self.base_url}/readyz", headers=self.headers(), timeout=5.0)
+        except httpx.HTTPError as e:
+            return {"ready": False, "error": f"bridge unreachable: {e}"}
+        try:
+            report = resp.json()
+        except ValueError:
+            report = {}
+        if not isinstance(report, dict):
+            report = {}
+        report["ready"] = resp.status_code == 200
+        return report
+
+    async def encode(self, data: Dict[str, Any], message_type: str = DEFAULT_MESSAGE_TYPE) -> bytes:
+        result = await self._request("POST", "/api/encode", json={"json_data": data, "message_type": message_type})
+        return base64.b64decode(result["protobuf_bytes"])
+
+    async def decode(self, protobuf_bytes: bytes, message_type: str = DEFAULT_MESSAGE_TYPE) -> Dict[str, Any]:
+        body = {"protobuf_bytes": base64.b64encode(protobuf_bytes).decode("ascii"), "message_type": message_type}
+        result = await self._request("POST", "/api/decode", json=body)
+        return result["json_data"]
+
+    async def list_models(self) -> Dict[str, Any]:
+        return await self._request("GET", "/v1/models", timeout=10.0)
+
+    async def auth_status(self) -> Dict[str, Any]:
+        return await self._request("GET", "/api/auth/status")
+
+    async def account_usage(self) -> Dict[str, Any]:
+        return await self._request("GET", "/api/accounts/usage")
+
+    async def update_account(self, label: str, changes: Dict[str, Any]) -> Dict[str, Any]:
+        return await self._request("PATCH", f"/api/accounts/{quote(label, safe='')}", json=changes)
+
+    async def refresh_auth(self) -> Dict[str, Any]:
+        return await self._request("POST", "/api/auth/refresh", timeout=10.0)
+
+    async def send_to_warp(self, packet: Dict[str, Any], message_type: str = DEFAULT_MESSAGE_TYPE) -> Dict[str, Any]:
+        """POST /api/warp/send_stream; returns response text, ids and parsed_events."""
+        body = {"json_data": packet, "message_type": message_type}
+        return await self._request("POST", "/api/warp/send_stream", json=body)
+
+    async def iter_warp_events(self, packet: Dict[str, Any], message_type: str = DEFAULT_MESSAGE_TYPE) -> AsyncIterator[Dict[str, Any]]:
+        """Stream /api/warp/send_stream_sse as parsed event dicts."""
+        body = {"json_data": packet, "message_type": message_type}
+        client = self._get_client()
+        async with client.stream("POST", f"{self.base_url}/api/warp/send_stream_sse",
+                                 headers=self.headers({"accept": "text/event-stream"}), json=body,
+                                 timeout=self._stream_timeout) as response:
+            if response.status_code != 200:
+                error_text = await response.aread()
+                raise BridgeClientError(response.status_code, error_text.decode("utf-8", errors="replace") if error_text else "")
+            current = ""
+            async for line in response.aiter_lines():
+                if line.startswith("data:"):
+                    payload = line[5:].strip()
+                    if not payload:
+                        continue
+                    if payload == "[DONE]":
+                        break
+                    current += payload
+                    continue
+                if (line.strip() == "") and current:
+                    try:
+                        ev = json.loads(current)
+                    except ValueError:
+                        current = ""
+                        continue
+                    current = ""
+                    if isinstance(ev, dict) and "error" in ev and "parsed_data" not in ev:
+                        raise BridgeClientError(502, str(ev.get("error")))
+                    yield ev or {}
+
+    async def send_to_warp_stream(self, packet: Dict[str, Any], on_event: EventCallback,
+                                  message_type: str = DEFAULT_MESSAGE_TYPE) -> int:
+        """Stream events to `on_event` (sync or async callable); returns the event count."""
+        count = 0
+        async for ev in self.iter_warp_events(packet, message_type):
+            count += 1
+            result = on_event(ev)
+            if hasattr(result, "__await__"):
+                await result
+        return count
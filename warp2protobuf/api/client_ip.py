@@ -0,0 +1,80 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Client address of a request, as used for rate limiting and access logs.
+
+Behind a reverse proxy (nginx, Cloudflare) the peer address is the proxy's. When
+the peer is in TRUSTED_PROXIES (comma-separated IPs / CIDRs, "unix" for Unix
+socket peers), X-Forwarded-For is walked from the right, skipping trusted hops,
+and the first untrusted address is the client; X-Real-IP is used when there is
+no X-Forwarded-For. Headers from untrusted peers are ignored, so clients cannot
+spoof their address.
+"""
+import ipaddress
+import os
+from functools import lru_cache
+from typing import Any, List, Optional, Tuple, Union
+
+Network = Union[ipaddress.IPv4Network, ipaddress.IPv6Network]
+
+
+@lru_cache(maxsize=4)
+def parse_trusted_proxies(value: str) -> Tuple[Tuple[Network, ...], bool]:
+    """(networks, trust_unix) from a TRUSTED_PROXIES value; raises ValueError on a bad entry."""
+    networks: List[Network] = []
+    trust_unix = False
+    for item in (part.strip() for part in value.split(",")):
+        if not item:
+            continue
+        if item.lower() == "unix":
+            trust_unix = True
+            continue
+        try:
+            networks.append(ipaddress.ip_network(item, strict=False))
+        except ValueError:
+            raise ValueError(f"TRUSTED_PROXIES 中的地址无效: {item!r}")
+    return tuple(networks), trust_unix
+
+
+def _parse_ip(value: str) -> Optional[Union[ipaddress.IPv4Address, ipaddress.IPv6Address]]:
+    value = value.strip()
+    if value.startswith("[") and "]" in value:
+        # [v6]:port
+        value = value[1:value.index("]")]
+    elif value.count(":") == 1:
+        # v4:port
+        value = value.split(":", 1)[0]
+    try:
+        return ipaddress.ip_address(value)
+    except ValueError:
+        return None
+
+
+def _trusted(address: Optional[str], networks: Tuple[Network, ...], trust_unix: bool) -> bool:
+    if not address:
+        return trust_unix
+    ip = _parse_ip(address)
+    return ip is not None and any(ip in net for net in networks)
+
+
+def client_ip(request: Any) -> str:
+    client = getattr(request, "client", None)
+    peer = client.host if client and client.host else None
+    networks, trust_unix = parse_trusted_proxies(os.getenv("TRUSTED_PROXIES", ""))
+    if (networks or trust_unix) and _trusted(peer, networks, trust_unix):
+        headers = getattr(request, "headers", None) or {}
+        forwarded = [hop.strip() for hop in (headers.get("x-forwarded-for") or "").split(",") if hop.strip()]
+        for hop in reversed(forwarded):
+            if _parse_ip(hop) is None:
+                # 无法解析的跳，停止回溯，避免信任伪造的左侧地址
+                break
+            if not _trusted(hop, networks, False):
+                return str(_parse_ip(hop))
+        else:
+            if forwarded:
+                # 全部是受信代理时取最左侧地址
+                return str(_parse_ip(forwarded[0]))
+            real_ip = _parse_ip(headers.get("x-real-ip") or "")
+            if real_ip is not None:
+                return str(real_ip)
+    return peer or "unknown"
@@ -0,0 +1,112 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Response compression middleware
+
+Compresses complete (single-message) JSON / text responses with gzip, or brotli
+when HTTP_COMPRESSION=br, the client accepts it and the `brotli` package is
+installed. Anything sent in several body messages — SSE streams, JSONL exports —
+is passed through untouched, so streaming latency is never traded for size.
+"""
+import gzip
+from typing import Any, Awaitable, Callable, Dict, List, Optional, Tuple
+
+try:
+    import brotli
+except ImportError:
+    brotli = None
+
+_COMPRESSIBLE = ("application/json", "application/x-ndjson", "application/javascript", "application/xml", "text/")
+
+Message = Dict[str, Any]
+
+
+def _header(headers: List[Tuple[bytes, bytes]], name: bytes) -> Optional[str]:
+    for key, value in headers:
+        if key.lower() == name:
+            return value.decode("latin-1")
+    return None
+
+
+def _accepted(accept_encoding: str) -> Dict[str, float]:
+    accepted: Dict[str, float] = {}
+    for part in accept_encoding.split(","):
+        coding, _, params = part.strip().partition(";")
+        q = 1.0
+        params = params.strip()
+        if params.startswith("q="):
+            try:
+                q = float(params[2:])
+            except ValueError:
+                q = 0.0
+        if coding:
+            accepted[coding.strip().lower()] = q
+    return accepted
+
+
+class CompressionMiddleware:
+    def __init__(self, app: Any, mode: str = "gzip", minimum_size: int = 1024, gzip_level: int = 6):
+        self.app = app
+        self.mode = mode
+        self.minimum_size = minimum_size
+        self.gzip_level = gzip_level
+
+    def _choose(self, scope: Dict[str, Any]) -> Optional[str]:
+        if self.mode == "off":
+            return None
+        raw = _header(scope.get("headers") or [], b"accept-encoding") or ""
+        accepted = _accepted(raw)
+        if self.mode == "br" and brotli is not None and accepted.get("br", 0) > 0:
+            return "br"
+        if accepted.get("gzip", 0) > 0:
+            return "gzip"
+        return None
+
+    def _compress(self, encoding: str, body: bytes) -> bytes:
+        if encoding == "br":
+            return brotli.compress(body, quality=5)
+        return gzip.compress(body, compresslevel=self.gzip_level)
+
+    def _should_compress(self, headers: List[Tuple[bytes, bytes]], body: bytes) -> bool:
+        if len(body) < self.minimum_size or _header(headers, b"content-encoding"):
+            return False
+        content_type = (_header(headers, b"content-type") or "").lower()
+        if content_type.startswith("text/event-stream"):
+            return False
+        return content_type.startswith(_COMPRESSIBLE)
+
+    async def __call__(self, scope: Dict[str, Any], receive: Callable[[], Awaitable[Message]],
+                       send: Callable[[Message], Awaitable[None]]) -> None:
+        encoding = self._choose(scope) if scope["type"] == "http" else None
+        if encoding is None:
+            await self.app(scope, receive, send)
+            return
+
+        start: Optional[Message] = None
+
+        async def send_wrapper(message: Message) -> None:
+            nonlocal start
+            if message["type"] == "http.response.start":
+                # 等第一段正文到达后再决定是否压缩
+                start = message
+                return
+            if message["type"] != "http.response.body" or start is None:
+                await send(message)
+                return
+            pending, start = start, None
+            headers = list(pending.get("headers") or [])
+            body = message.get("body", b"")
+            if message.get("more_body", False) or not self._should_compress(headers, body):
+                await send(pending)
+                await send(message)
+                return
+            compressed = self._compress(encoding, body)
+            headers = [(k, v) for k, v in headers if k.lower() not in (b"content-length", b"vary")]
+            vary = _header(pending.get("headers") or [], b"vary")
+            headers.append((b"content-encoding", encoding.encode("latin-1")))
+            headers.append((b"content-length", str(len(compressed)).encode("latin-1")))
+            headers.append((b"vary", (f"{vary}, Accept-Encoding" if vary else "Accept-Encoding").encode("latin-1")))
+            await send({**pending, "headers": headers})
+            await send({"type": "http.response.body", "body": compressed, "more_body": False})
+
+        await self.app(scope, receive, send_wrapper)
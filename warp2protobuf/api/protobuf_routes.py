@@ -5,24 +5,46 @@ Protobuf编解码API路由
 
 提供纯protobuf数据包编解码服务，包括JWT管理和WebSocket支持。
 """
+import hmac
 import json
+import zlib
 import base64
+import time
 import asyncio
 import httpx
+from contextlib import aclosing
 from typing import Any, Dict, List, Optional
 from datetime import datetime
 
 from fastapi import FastAPI, Request, HTTPException, WebSocket, WebSocketDisconnect, Query
-from fastapi.responses import JSONResponse
+from fastapi.responses import JSONResponse, StreamingResponse, PlainTextResponse
 from fastapi.middleware.cors import CORSMiddleware
 from pydantic import BaseModel
 
 from ..core.logging import logger
-from ..core.protobuf_utils import protobuf_to_dict, dict_to_protobuf_bytes
-from ..core.auth import get_jwt_token, refresh_jwt_if_needed, is_token_expired, get_valid_jwt, acquire_anonymous_access_token
-from ..core.stream_processor import get_stream_processor, set_websocket_manager
+from ..core.protobuf_utils import protobuf_to_dict, dict_to_protobuf_bytes, field_byte_breakdown
+from ..core.auth import get_jwt_token, refresh_jwt_if_needed, is_token_expired, credential_status
+from ..core.account_pool import get_account_pool, update_pooled_account
+from ..core.request_context import (
+    REQUEST_ID_HEADER, accept_request_id, reset_request_caller, reset_request_id, set_request_caller, set_request_id,
+)
+from ..core.stream_processor import get_stream_processor, set_websocket_manager, StreamDecoder
+from ..core.wire_debug import annotate_wire
+from ..core.schema_versions import list_schema_versions, get_schema_version, diff_schema_versions
 from ..config.models import get_all_unique_models
-from ..config.settings import CLIENT_VERSION, OS_CATEGORY, OS_NAME, OS_VERSION, WARP_URL as CONFIG_WARP_URL
+from ..config.settings import PACKET_HISTORY_MAX
+from ..config.settings import BRIDGE_TOKEN
+from ..config.settings import HTTP_COMPRESSION, HTTP_COMPRESSION_MIN_SIZE, ACCESS_LOG
+from .access_log import install_access_log
+from ..core.tracing import install_tracing
+from ..core.redaction import redact_value, redaction_enabled
+from .compression import CompressionMiddleware
+from ..config.settings import PACKET_STORE_PATH, PACKET_STORE_MAX_ROWS, PACKET_STORE_MAX_AGE_HOURS
+from ..core.packet_store import open_packet_store
+from ..core.metrics import bridge_metrics
+from ..core.memory import memory_watch
+from ..core.batching import encode_batcher, decode_batcher
+from ..warp.bridge_service import prepare_warp_request, summarize_event_types, send_parsed as bridge_send_parsed, iter_sse_events as bridge_iter_sse_events, relay_sse_bytes as bridge_relay_sse_bytes
 from ..core.server_message_data import decode_server_message_data, encode_server_message_data
 
 
@@ -67,6 +89,15 @@ def _decode_smd_inplace(obj: Any) -> Any:
     else:
         return obj
 from ..core.schema_sanitizer import sanitize_mcp_input_schema_in_packet
+from ..warp.http_client import get_connection_stats, close_warp_http_client, prewarm_connections
+from ..warp.adaptive_limit import UpstreamBusy, adaptive_limit_status
+
+
+# 顶层传入时组成数据包的字段（未使用 json_data 时）
+_PACKET_FIELDS = (
+    "task_context", "input", "settings", "metadata", "mcp_context", "existing_suggestions",
+    "client_version", "os_category", "os_name", "os_version",
+)
 
 
 class EncodeRequest(BaseModel):
@@ -83,84 +114,198 @@ class EncodeRequest(BaseModel):
     os_category: Optional[str] = None
     os_name: Optional[str] = None
     os_version: Optional[str] = None
+    canonical: bool = False
+    # 调试输出：额外返回 hex 与按字段的字节占用明细
+    return_bytes: bool = False
+    # send_stream_sse: 原样转发 Warp 的 SSE 字节（base64 protobuf 事件），不在桥接端逐条解码再编码
+    passthrough: bool = False
     
     class Config:
         extra = "allow"
     
+    def extra_fields(self) -> Dict[str, Any]:
+        """Top-level keys not declared above (further packet fields of the message)."""
+        extra = getattr(self, "__pydantic_extra__", None)
+        if extra is None:
+            # pydantic v1 把额外字段直接放在 __dict__ 中
+            declared = set(getattr(type(self), "__fields__", {}))
+            extra = {k: v for k, v in self.__dict__.items() if k not in declared}
+        return extra
+
     def get_data(self) -> Dict[str, Any]:
+        """The packet: json_data, or the top-level packet fields plus any extra keys.
+
+        Options (message_type, canonical, return_bytes, passthrough) never end up in the packet.
+        """
         if self.json_data is not None:
             return self.json_data
-        else:
-            data: Dict[str, Any] = {}
-            if self.task_context is not None:
-                data["task_context"] = self.task_context
-            if self.input is not None:
-                data["input"] = self.input
-            if self.settings is not None:
-                data["settings"] = self.settings
-            if self.metadata is not None:
-                data["metadata"] = self.metadata
-            if self.mcp_context is not None:
-                data["mcp_context"] = self.mcp_context
-            if self.existing_suggestions is not None:
-                data["existing_suggestions"] = self.existing_suggestions
-            if self.client_version is not None:
-                data["client_version"] = self.client_version
-            if self.os_category is not None:
-                data["os_category"] = self.os_category
-            if self.os_name is not None:
-                data["os_name"] = self.os_name
-            if self.os_version is not None:
-                data["os_version"] = self.os_version
-            
-            skip_keys = {
-                "json_data", "message_type", "task_context", "input", "settings", "metadata",
-                "mcp_context", "existing_suggestions", "client_version", "os_category", "os_name", "os_version"
-            }
-            try:
-                for k, v in self.__dict__.items():
-                    if v is None:
-                        continue
-                    if k in skip_keys:
-                        continue
-                    if k not in data:
-                        data[k] = v
-            except Exception:
-                pass
-            return data
+        data: Dict[str, Any] = {}
+        for name in _PACKET_FIELDS:
+            value = getattr(self, name)
+            if value is not None:
+                data[name] = value
+        for k, v in self.extra_fields().items():
+            if v is not None and k not in data:
+                data[k] = v
+        return data
 
 
 class DecodeRequest(BaseModel):
     protobuf_bytes: str
     message_type: str = "warp.multi_agent.v1.Request"
+    emit_defaults: bool = False
+    json_names: bool = False
+
+
+class EncodeBatchRequest(BaseModel):
+    items: List[EncodeRequest]
+
+
+class DecodeBatchRequest(BaseModel):
+    items: List[DecodeRequest]
+
+
+# 单次批量请求的最大条目数
+BATCH_MAX_ITEMS = 1000
 
 
 class StreamDecodeRequest(BaseModel):
     protobuf_chunks: List[str]
     message_type: str = "warp.multi_agent.v1.Response"
+    framing: str = "none"  # none: 每块一个消息；varint: varint 长度前缀帧，可跨块
+
+
+class WireDebugRequest(BaseModel):
+    protobuf_bytes: str  # base64
+    max_depth: int = 8
+
+
+class SchemaUploadRequest(BaseModel):
+    descriptor_set: Optional[str] = None  # base64 of a serialized FileDescriptorSet
+    proto_files: Optional[Dict[str, str]] = None  # filename -> .proto source
+    persist: bool = False
+
+
+class EncodeResponse(BaseModel):
+    protobuf_bytes: str  # base64
+    size: int
+    message_type: str
+    # return_bytes 时才有
+    hex: Optional[str] = None
+    fields: Optional[List[Dict[str, Any]]] = None
+    fields_error: Optional[str] = None
+
+
+class DecodeResponse(BaseModel):
+    json_data: Dict[str, Any]
+    size: int
+    message_type: str
+
+
+class SendResponse(BaseModel):
+    response: str
+    conversation_id: Optional[str] = None
+    task_id: Optional[str] = None
+    request_size: int
+    response_size: int
+    message_type: str
+
+
+class SendStreamResponse(SendResponse):
+    parsed_events: List[Dict[str, Any]]
+    events_count: int
+    events_summary: Dict[str, int]
+
+
+def _infer_packet_direction(packet_type: str) -> str:
+    if packet_type.startswith("warp_request") or packet_type == "encode":
+        return "outbound"
+    if packet_type.startswith("warp_response") or packet_type.startswith("decode") or packet_type.startswith("stream_decode"):
+        return "inbound"
+    return "internal"
+
+
+def _parse_time_param(value: Optional[str]) -> Optional[float]:
+    """接受 epoch 秒或 ISO8601 字符串。"""
+    if value is None or value == "":
+        return None
+    try:
+        return float(value)
+    except ValueError:
+        pass
+    try:
+        return datetime.fromisoformat(value.replace("Z", "+00:00")).timestamp()
+    except ValueError:
+        raise HTTPException(400, f"无法解析时间参数: {value}")
+
+
+# WebSocket 订阅的事件类别
+PACKET_EVENT_CLASSES = ("encode", "decode", "warp-request", "warp-response", "auth", "stream")
+
+
+def _packet_event_class(packet_type: str) -> str:
+    if packet_type == "encode":
+        return "encode"
+    if packet_type.startswith("decode") or packet_type.startswith("stream_decode"):
+        return "decode"
+    if packet_type.startswith("warp_request"):
+        return "warp-request"
+    if packet_type.startswith("warp_response") or packet_type.startswith("warp_error"):
+        return "warp-response"
+    if packet_type.startswith("auth"):
+        return "auth"
+    return "stream"
+
+
+def _message_event_class(message: Dict) -> str:
+    packet = message.get("packet")
+    if isinstance(packet, dict) and packet.get("type"):
+        return _packet_event_class(packet["type"])
+    return "stream"
 
 
 class ConnectionManager:
-    def __init__(self):
+    def __init__(self, max_history: int = PACKET_HISTORY_MAX, store=None):
         self.active_connections: List[WebSocket] = []
+        # None 表示订阅全部事件类别
+        self.subscriptions: Dict[WebSocket, Optional[set]] = {}
         self.packet_history: List[Dict] = []
+        self.max_history = max_history
+        self._next_packet_id = 1
+        self.store = store
+        if store is not None:
+            # 恢复重启前的抓包记录
+            self.packet_history = store.load_recent(max_history)
+            self._next_packet_id = store.max_id() + 1
     
-    async def connect(self, websocket: WebSocket):
+    async def connect(self, websocket: WebSocket, events: Optional[set] = None):
         await websocket.accept()
         self.active_connections.append(websocket)
+        self.subscriptions[websocket] = events
         logger.info(f"WebSocket连接建立，当前连接数: {len(self.active_connections)}")
     
     def disconnect(self, websocket: WebSocket):
         if websocket in self.active_connections:
             self.active_connections.remove(websocket)
+        self.subscriptions.pop(websocket, None)
         logger.info(f"WebSocket连接断开，当前连接数: {len(self.active_connections)}")
+
+    def is_subscribed(self, websocket: WebSocket, event_class: str) -> bool:
+        events = self.subscriptions.get(websocket)
+        return events is None or event_class in events
     
     async def broadcast(self, message: Dict):
         if not self.active_connections:
             return
         
+        event_class = _message_event_class(message)
+        if "packet" in message:
+            # 实时推送与导出一样脱敏认证字段
+            message = dict(message, packet=_redact_for_sharing(message["packet"]))
         disconnected = []
-        for connection in self.active_connections:
+        for connection in list(self.active_connections):
+            if not self.is_subscribed(connection, event_class):
+                continue
             try:
                 await connection.send_json(message)
             except Exception as e:
@@ -169,26 +314,141 @@ class ConnectionManager:
         for conn in disconnected:
             self.disconnect(conn)
     
-    async def log_packet(self, packet_type: str, data: Dict, size: int):
+    async def log_packet(self, packet_type: str, data: Dict, size: int, message_type: Optional[str] = None,
+                         status: str = "ok", direction: Optional[str] = None, related_id: Optional[int] = None) -> Dict:
+        now = datetime.now()
+        if redaction_enabled():
+            # 抓包历史（内存、持久化、WebSocket 推送）同样脱敏
+            data = redact_value(data)
         packet_info = {
-            "timestamp": datetime.now().isoformat(),
+            "id": self._next_packet_id,
+            "timestamp": now.isoformat(),
+            "ts": now.timestamp(),
             "type": packet_type,
+            "direction": direction or _infer_packet_direction(packet_type),
+            "status": "error" if "error" in packet_type else status,
+            "message_type": message_type,
             "size": size,
             "data_preview": str(data)[:200] + "..." if len(str(data)) > 200 else str(data),
             "full_data": data
         }
+        if related_id is not None:
+            packet_info["related_id"] = related_id
+        self._next_packet_id += 1
+        bridge_metrics.observe_packet(_packet_event_class(packet_type), packet_type, packet_info["direction"], packet_info["status"], size)
         
         self.packet_history.append(packet_info)
-        if len(self.packet_history) > 100:
-            self.packet_history = self.packet_history[-100:]
+        if len(self.packet_history) > self.max_history:
+            self.packet_history = self.packet_history[-self.max_history:]
+        if self.store is not None:
+            try:
+                # SQLite 写入与提交放到线程中，避免阻塞事件循环
+                await asyncio.to_thread(self.store.add, packet_info)
+            except Exception as e:
+                logger.warning(f"数据包持久化失败: {e}")
         
         await self.broadcast({"event": "packet_captured", "packet": packet_info})
+        return packet_info
+
+    async def get_packet(self, packet_id: int) -> Optional[Dict]:
+        for p in reversed(self.packet_history):
+            if p.get("id") == packet_id:
+                return p
+        # 已移出内存窗口（或重启前捕获）的记录从持久化存储查找
+        if self.store is not None:
+            return await asyncio.to_thread(self.store.get, packet_id)
+        return None
+
+    async def find_related(self, packet_id: int, type_prefix: str = "") -> Optional[Dict]:
+        for p in self.packet_history:
+            if p.get("related_id") == packet_id and p["type"].startswith(type_prefix):
+                return p
+        if self.store is not None:
+            return await asyncio.to_thread(self.store.find_related, packet_id, type_prefix)
+        return None
+
+    def query_history(self, packet_type: Optional[str] = None, direction: Optional[str] = None,
+                      status: Optional[str] = None, message_type: Optional[str] = None,
+                      since: Optional[float] = None, until: Optional[float] = None) -> List[Dict]:
+        def _match(p: Dict) -> bool:
+            if packet_type and not p["type"].startswith(packet_type):
+                return False
+            if direction and p.get("direction") != direction:
+                return False
+            if status and p.get("status") != status:
+                return False
+            if message_type and p.get("message_type") != message_type:
+                return False
+            if since is not None and p.get("ts", 0) < since:
+                return False
+            if until is not None and p.get("ts", 0) > until:
+                return False
+            return True
+        return [p for p in self.packet_history if _match(p)]
 
+    async def page_history(self, limit: Optional[int] = None, offset: int = 0, **filters) -> tuple:
+        """返回 (一页记录, 匹配总数, 记录总数)；offset 从最新记录往前计，limit 为 None 时返回全部。
 
-manager = ConnectionManager()
+        启用持久化时从存储查询：它保留的记录多于内存窗口，并且重启后依然可查。
+        """
+        if self.store is not None:
+            try:
+                page, matched_count = await asyncio.to_thread(self.store.query, limit=limit, offset=offset, **filters)
+                total = await asyncio.to_thread(self.store.count)
+                return page, matched_count, total
+            except Exception as e:
+                logger.warning(f"查询持久化数据包历史失败，改用内存记录: {e}")
+        matched = self.query_history(**filters)
+        end = max(0, len(matched) - offset)
+        start = 0 if limit is None else max(0, end - limit)
+        return matched[start:end], len(matched), len(self.packet_history)
+
+
+manager = ConnectionManager(
+    store=open_packet_store(PACKET_STORE_PATH, PACKET_STORE_MAX_ROWS, PACKET_STORE_MAX_AGE_HOURS)
+)
 set_websocket_manager(manager)
 
 app = FastAPI(title="Warp Protobuf编解码服务器", version="1.0.0")
+@app.middleware("http")
+async def _require_bridge_token(request: Request, call_next):
+    """当配置了 BRIDGE_TOKEN 时，/api/* 需携带 Authorization: Bearer <BRIDGE_TOKEN>"""
+    if BRIDGE_TOKEN and request.url.path.startswith("/api/") and request.method != "OPTIONS":
+        authorization = request.headers.get("authorization") or ""
+        token = authorization[7:] if authorization.startswith("Bearer ") else ""
+        if not hmac.compare_digest(token.encode(), BRIDGE_TOKEN.encode()):
+            return JSONResponse(
+                status_code=401,
+                content={"detail": "invalid or missing bridge token"},
+                headers={"WWW-Authenticate": "Bearer"},
+            )
+    return await call_next(request)
+
+
+# 压缩完整的JSON响应（如 /api/packets/history）；SSE 与 JSONL 导出为多段正文，不压缩
+app.add_middleware(CompressionMiddleware, mode=HTTP_COMPRESSION, minimum_size=HTTP_COMPRESSION_MIN_SIZE)
+
+
+install_access_log(app, "warp_api.access", ACCESS_LOG, observers=[bridge_metrics.observe_request])
+install_tracing(app, "warp2api-bridge")
+
+
+@app.middleware("http")
+async def _request_id(request: Request, call_next):
+    """沿用调用方（OpenAI 兼容服务器）的 x-request-id 及 key / 模型，使日志可跨服务关联"""
+    request_id = accept_request_id(request.headers.get(REQUEST_ID_HEADER))
+    request.state.request_id = request_id
+    token = set_request_id(request_id)
+    caller_token = set_request_caller(request.headers)
+    try:
+        response = await call_next(request)
+    finally:
+        reset_request_caller(caller_token)
+        reset_request_id(token)
+    response.headers[REQUEST_ID_HEADER] = request_id
+    return response
+
+
 app.add_middleware(
     CORSMiddleware,
     allow_origins=["*"],
@@ -208,7 +468,27 @@ async def health_check():
     return {"status": "ok", "timestamp": datetime.now().isoformat()}
 
 
-@app.post("/api/encode")
+@app.get("/livez")
+async def liveness_check():
+    """进程存活即返回 200（不检查任何依赖，避免依赖故障导致容器被反复重启）"""
+    return {"status": "ok"}
+
+
+@app.get("/readyz")
+async def readiness_check():
+    """配置有效且至少有一个可用的 Warp 凭据时才返回 200"""
+    from ..config.validation import validate_config
+    errors, _warnings = validate_config("bridge")
+    credentials_ok, credentials = credential_status()
+    checks = {
+        "config": {"ok": not errors, "errors": errors},
+        "credentials": {"ok": credentials_ok, "detail": credentials},
+    }
+    ready = not errors and credentials_ok
+    return JSONResponse(status_code=200 if ready else 503, content={"status": "ready" if ready else "not_ready", "checks": checks})
+
+
+@app.post("/api/encode", response_model=EncodeResponse, response_model_exclude_none=True)
 async def encode_json_to_protobuf(request: EncodeRequest):
     try:
         logger.info(f"收到编码请求，消息类型: {request.message_type}")
@@ -219,9 +499,9 @@ async def encode_json_to_protobuf(request: EncodeRequest):
         wrapped = sanitize_mcp_input_schema_in_packet(wrapped)
         actual_data = wrapped.get("json_data", actual_data)
         actual_data = _encode_smd_inplace(actual_data)
-        protobuf_bytes = dict_to_protobuf_bytes(actual_data, request.message_type)
+        protobuf_bytes = dict_to_protobuf_bytes(actual_data, request.message_type, canonical=request.canonical)
         try:
-            await manager.log_packet("encode", actual_data, len(protobuf_bytes))
+            await manager.log_packet("encode", actual_data, len(protobuf_bytes), message_type=request.message_type)
         except Exception as log_error:
             logger.warning(f"数据包记录失败: {log_error}")
         result = {
@@ -229,6 +509,13 @@ async def encode_json_to_protobuf(request: EncodeRequest):
             "size": len(protobuf_bytes),
             "message_type": request.message_type
         }
+        if request.return_bytes:
+            result["hex"] = protobuf_bytes.hex()
+            try:
+                result["fields"] = field_byte_breakdown(protobuf_bytes, request.message_type)
+            except Exception as breakdown_error:
+                logger.warning(f"字段字节明细生成失败: {breakdown_error}")
+                result["fields_error"] = str(breakdown_error)
         logger.info(f"✅ JSON编码为protobuf成功: {len(protobuf_bytes)} 字节")
         return result
     except HTTPException:
@@ -238,7 +525,7 @@ async def encode_json_to_protobuf(request: EncodeRequest):
         raise HTTPException(500, f"编码失败: {str(e)}")
 
 
-@app.post("/api/decode")
+@app.post("/api/decode", response_model=DecodeResponse)
 async def decode_protobuf_to_json(request: DecodeRequest):
     try:
         logger.info(f"收到解码请求，消息类型: {request.message_type}")
@@ -251,9 +538,9 @@ async def decode_protobuf_to_json(request: DecodeRequest):
             raise HTTPException(400, f"Base64解码失败: {str(decode_error)}")
         if not protobuf_bytes:
             raise HTTPException(400, "解码后的protobuf数据为空")
-        json_data = protobuf_to_dict(protobuf_bytes, request.message_type)
+        json_data = protobuf_to_dict(protobuf_bytes, request.message_type, emit_defaults=request.emit_defaults, json_names=request.json_names)
         try:
-            await manager.log_packet("decode", json_data, len(protobuf_bytes))
+            await manager.log_packet("decode", json_data, len(protobuf_bytes), message_type=request.message_type)
         except Exception as log_error:
             logger.warning(f"数据包记录失败: {log_error}")
         result = {"json_data": json_data, "size": len(protobuf_bytes), "message_type": request.message_type}
@@ -266,10 +553,50 @@ async def decode_protobuf_to_json(request: DecodeRequest):
         raise HTTPException(500, f"解码失败: {e}")
 
 
+def _encode_item(item: EncodeRequest) -> Dict[str, Any]:
+    actual_data = item.get_data()
+    if not actual_data:
+        raise ValueError("数据包不能为空")
+    actual_data = sanitize_mcp_input_schema_in_packet({"json_data": actual_data}).get("json_data", actual_data)
+    actual_data = _encode_smd_inplace(actual_data)
+    protobuf_bytes = dict_to_protobuf_bytes(actual_data, item.message_type, canonical=item.canonical)
+    return {"protobuf_bytes": base64.b64encode(protobuf_bytes).decode("utf-8"), "size": len(protobuf_bytes), "message_type": item.message_type}
+
+
+def _decode_item(item: DecodeRequest) -> Dict[str, Any]:
+    protobuf_bytes = base64.b64decode(item.protobuf_bytes)
+    if not protobuf_bytes:
+        raise ValueError("解码后的protobuf数据为空")
+    json_data = protobuf_to_dict(protobuf_bytes, item.message_type, emit_defaults=item.emit_defaults, json_names=item.json_names)
+    return {"json_data": json_data, "size": len(protobuf_bytes), "message_type": item.message_type}
+
+
+def _batch_results(results: List[Any]) -> Dict[str, Any]:
+    items = [result if ok else {"error": result} for ok, result in results]
+    return {"items": items, "count": len(items), "errors": sum(1 for ok, _ in results if not ok)}
+
+
+# 批量接口不写入数据包历史，单条失败只体现在对应条目的 error 中
+@app.post("/api/encode/batch")
+async def encode_batch(request: EncodeBatchRequest):
+    if len(request.items) > BATCH_MAX_ITEMS:
+        raise HTTPException(400, f"批量条目过多: {len(request.items)} > {BATCH_MAX_ITEMS}")
+    return _batch_results(await encode_batcher.run(_encode_item, request.items))
+
+
+@app.post("/api/decode/batch")
+async def decode_batch(request: DecodeBatchRequest):
+    if len(request.items) > BATCH_MAX_ITEMS:
+        raise HTTPException(400, f"批量条目过多: {len(request.items)} > {BATCH_MAX_ITEMS}")
+    return _batch_results(await decode_batcher.run(_decode_item, request.items))
+
+
 @app.post("/api/stream-decode")
 async def decode_stream_protobuf(request: StreamDecodeRequest):
     try:
         logger.info(f"收到流式解码请求，数据块数量: {len(request.protobuf_chunks)}")
+        if request.framing == "varint":
+            return await _decode_varint_framed_stream(request)
         results = []
         total_size = 0
         for i, chunk_b64 in enumerate(request.protobuf_chunks):
@@ -279,25 +606,59 @@ async def decode_stream_protobuf(request: StreamDecodeRequest):
                 chunk_result = {"chunk_index": i, "json_data": chunk_json, "size": len(chunk_bytes)}
                 results.append(chunk_result)
                 total_size += len(chunk_bytes)
-                await manager.log_packet(f"stream_decode_chunk_{i}", chunk_json, len(chunk_bytes))
+                await manager.log_packet(f"stream_decode_chunk_{i}", chunk_json, len(chunk_bytes), message_type=request.message_type)
             except Exception as e:
                 logger.warning(f"数据块 {i} 解码失败: {e}")
                 results.append({"chunk_index": i, "error": str(e), "size": 0})
         try:
             all_bytes = b''.join([base64.b64decode(chunk) for chunk in request.protobuf_chunks])
             complete_json = protobuf_to_dict(all_bytes, request.message_type)
-            await manager.log_packet("stream_decode_complete", complete_json, len(all_bytes))
+            await manager.log_packet("stream_decode_complete", complete_json, len(all_bytes), message_type=request.message_type)
             complete_result = {"json_data": complete_json, "size": len(all_bytes)}
         except Exception as e:
             complete_result = {"error": f"无法拼接完整消息: {e}", "size": total_size}
         result = {"chunks": results, "complete": complete_result, "total_chunks": len(request.protobuf_chunks), "total_size": total_size, "message_type": request.message_type}
         logger.info(f"✅ 流式protobuf解码完成: {len(request.protobuf_chunks)} 块，总大小 {total_size} 字节")
         return result
+    except HTTPException:
+        raise
     except Exception as e:
         logger.error(f"❌ 流式protobuf解码失败: {e}")
         raise HTTPException(500, f"流式解码失败: {e}")
 
 
+async def _decode_varint_framed_stream(request: StreamDecodeRequest) -> Dict[str, Any]:
+    decoder = StreamDecoder(request.message_type)
+    events: List[Dict[str, Any]] = []
+    total_size = 0
+    for i, chunk_b64 in enumerate(request.protobuf_chunks):
+        try:
+            chunk_bytes = base64.b64decode(chunk_b64)
+        except Exception as e:
+            raise HTTPException(400, f"数据块 {i} Base64解码失败: {e}")
+        total_size += len(chunk_bytes)
+        try:
+            new_events = decoder.feed(chunk_bytes)
+        except ValueError as e:
+            raise HTTPException(400, f"帧解析失败: {e}")
+        for ev in new_events:
+            if ev.get("parsed_successfully"):
+                await manager.log_packet(f"stream_decode_frame_{ev['frame_index']}", ev["json_data"], ev["size"], message_type=request.message_type)
+        events.extend(new_events)
+    result = {
+        "events": events,
+        "total_frames": decoder.frames_decoded,
+        "total_chunks": len(request.protobuf_chunks),
+        "total_size": total_size,
+        "pending_bytes": decoder.pending_bytes,
+        "message_type": request.message_type,
+    }
+    if decoder.pending_bytes:
+        result["warning"] = f"流结束时残留 {decoder.pending_bytes} 字节不完整帧"
+    logger.info(f"✅ 帧解码完成: {decoder.frames_decoded} 帧，总大小 {total_size} 字节")
+    return result
+
+
 @app.get("/api/schemas")
 async def get_protobuf_schemas():
     try:
@@ -322,9 +683,81 @@ async def get_protobuf_schemas():
         raise HTTPException(500, f"获取schemas失败: {e}")
 
 
+@app.post("/api/schemas")
+async def upload_protobuf_schemas(request: SchemaUploadRequest):
+    from ..core.protobuf import load_descriptor_set, compile_proto_sources
+    if not request.descriptor_set and not request.proto_files:
+        raise HTTPException(400, "需要提供 descriptor_set 或 proto_files")
+    try:
+        if request.descriptor_set:
+            try:
+                descset = base64.b64decode(request.descriptor_set)
+            except Exception as e:
+                raise HTTPException(400, f"Base64解码失败: {e}")
+            source = "upload:descriptor_set"
+        else:
+            descset = await asyncio.to_thread(compile_proto_sources, request.proto_files or {})
+            source = "upload:proto_files"
+        count = load_descriptor_set(descset, persist=request.persist, source=source)
+        version = get_schema_version(None)
+        logger.info(f"✅ 运行时加载schema成功: {count} 个消息类型")
+        return {"success": True, "message_count": count, "descriptor_set_size": len(descset), "persisted": request.persist,
+                "schema_version": version["version"] if version else None}
+    except HTTPException:
+        raise
+    except Exception as e:
+        logger.error(f"❌ 加载schema失败: {e}")
+        raise HTTPException(400, f"加载schema失败: {e}")
+
+
+@app.get("/api/schemas/versions")
+async def list_protobuf_schema_versions():
+    from ..core.protobuf import ensure_proto_runtime
+    ensure_proto_runtime()
+    versions = list_schema_versions()
+    return {"versions": versions, "current": versions[-1]["version"] if versions else None}
+
+
+@app.get("/api/schemas/diff")
+async def diff_protobuf_schemas(
+    from_version: Optional[int] = Query(None, alias="from", description="旧版本号，默认当前版本的上一个"),
+    to_version: Optional[int] = Query(None, alias="to", description="新版本号，默认当前版本"),
+):
+    from ..core.protobuf import ensure_proto_runtime
+    ensure_proto_runtime()
+    new = get_schema_version(to_version)
+    if new is None:
+        raise HTTPException(404, f"schema版本不存在: {to_version}")
+    if from_version is None:
+        older = [v for v in list_schema_versions() if v["version"] < new["version"]]
+        if not older:
+            raise HTTPException(400, "没有可对比的旧版本，请指定 from")
+        from_version = older[-1]["version"]
+    old = get_schema_version(from_version)
+    if old is None:
+        raise HTTPException(404, f"schema版本不存在: {from_version}")
+    return diff_schema_versions(old, new)
+
+
+@app.post("/api/debug/wire")
+async def debug_wire_format(request: WireDebugRequest):
+    try:
+        raw = base64.b64decode(request.protobuf_bytes)
+    except Exception as e:
+        raise HTTPException(400, f"Base64解码失败: {e}")
+    if not raw:
+        raise HTTPException(400, "Protobuf数据不能为空")
+    return annotate_wire(raw, max_depth=max(0, min(request.max_depth, 32)))
+
+
 @app.get("/api/auth/status")
 async def get_auth_status():
     try:
+        pool = get_account_pool()
+        if pool is not None:
+            accounts = pool.status()
+            usable = sum(1 for a in accounts if a["available"])
+            return {"authenticated": usable > 0, "mode": "account_pool", "accounts": accounts, "message": f"账号池: {usable}/{len(accounts)} 个账号可用"}
         jwt_token = get_jwt_token()
         if not jwt_token:
             return {"authenticated": False, "message": "未找到JWT token", "suggestion": "运行 'uv run refresh_jwt.py' 获取token"}
@@ -338,10 +771,31 @@ async def get_auth_status():
         raise HTTPException(500, f"获取认证状态失败: {e}")
 
 
+@app.get("/api/accounts/usage")
+async def get_account_usage():
+    """Requests, tokens, failures and last error per pooled Warp account since start."""
+    pool = get_account_pool()
+    if pool is None:
+        return {"mode": "single_token", "accounts": [], "message": "未配置账号池（accounts）"}
+    return {"mode": "account_pool", "accounts": pool.usage()}
+
+
+@app.patch("/api/accounts/{label}")
+async def update_account(label: str, changes: Dict[str, Any]):
+    """Enable / disable a pooled account, change its weight or end its cooldown (until restart)."""
+    try:
+        return update_pooled_account(label, changes)
+    except LookupError as e:
+        raise HTTPException(404, str(e))
+    except ValueError as e:
+        raise HTTPException(400, str(e))
+
+
 @app.post("/api/auth/refresh")
 async def refresh_auth_token():
     try:
         success = await refresh_jwt_if_needed()
+        await manager.log_packet("auth_refresh", {"success": bool(success)}, 0, status="ok" if success else "error")
         if success:
             return {"success": True, "message": "JWT token刷新成功", "timestamp": datetime.now().isoformat()}
         else:
@@ -366,16 +820,186 @@ async def get_user_id_endpoint():
 
 
 @app.get("/api/packets/history")
-async def get_packet_history(limit: int = 50):
+async def get_packet_history(
+    limit: int = Query(50, ge=1, le=1000),
+    offset: int = Query(0, ge=0, description="从最新记录往前跳过的条数"),
+    type: Optional[str] = Query(None, description="操作类型前缀，如 encode / decode / warp_request"),
+    direction: Optional[str] = Query(None, description="inbound / outbound / internal"),
+    status: Optional[str] = Query(None, description="ok / error"),
+    message_type: Optional[str] = None,
+    since: Optional[str] = Query(None, description="epoch 秒或 ISO8601"),
+    until: Optional[str] = Query(None, description="epoch 秒或 ISO8601"),
+    include_data: bool = Query(True, description="是否返回 full_data"),
+):
     try:
-        history = manager.packet_history[-limit:] if len(manager.packet_history) > limit else manager.packet_history
-        return {"packets": history, "total_count": len(manager.packet_history), "returned_count": len(history)}
+        page, matched_count, total_count = await manager.page_history(
+            limit=limit, offset=offset,
+            packet_type=type, direction=direction, status=status, message_type=message_type,
+            since=_parse_time_param(since), until=_parse_time_param(until),
+        )
+        if not include_data:
+            page = [{k: v for k, v in p.items() if k != "full_data"} for p in page]
+        return {
+            "packets": page,
+            "total_count": total_count,
+            "matched_count": matched_count,
+            "returned_count": len(page),
+            "offset": offset,
+            "limit": limit,
+            "next_offset": offset + len(page) if offset + len(page) < matched_count else None,
+        }
+    except HTTPException:
+        raise
     except Exception as e:
         logger.error(f"❌ 获取数据包历史失败: {e}")
         raise HTTPException(500, f"获取历史记录失败: {e}")
 
 
-@app.post("/api/warp/send")
+def _redact_packet(obj: Any) -> Any:
+    """递归脱敏认证相关字段，便于分享抓包（与日志、抓包使用同一套规则）。"""
+    return redact_value(obj, content=False)
+
+
+def _redact_for_sharing(packet: Dict) -> Dict:
+    """脱敏后的数据包副本（预览同样基于脱敏后的内容），用于导出和 WebSocket 推送。"""
+    item = _redact_packet(packet)
+    preview = str(item.get("full_data"))
+    item["data_preview"] = preview[:200] + "..." if len(preview) > 200 else preview
+    return item
+
+
+@app.get("/api/packets/export")
+async def export_packet_history(
+    type: Optional[str] = Query(None, description="操作类型前缀"),
+    direction: Optional[str] = None,
+    status: Optional[str] = None,
+    message_type: Optional[str] = None,
+    since: Optional[str] = Query(None, description="epoch 秒或 ISO8601"),
+    until: Optional[str] = Query(None, description="epoch 秒或 ISO8601"),
+    gzip: bool = Query(False, description="gzip 压缩输出"),
+    redact: bool = Query(True, description="脱敏认证信息"),
+):
+    packets, _, _ = await manager.page_history(
+        packet_type=type, direction=direction, status=status, message_type=message_type,
+        since=_parse_time_param(since), until=_parse_time_param(until),
+    )
+
+    def _lines():
+        for p in packets:
+            item = _redact_for_sharing(p) if redact else p
+            yield (json.dumps(item, ensure_ascii=False, default=str) + "\n").encode("utf-8")
+
+    def _gzipped():
+        comp = zlib.compressobj(wbits=31)
+        for line in _lines():
+            chunk = comp.compress(line)
+            if chunk:
+                yield chunk
+        yield comp.flush()
+
+    stamp = datetime.now().strftime("%Y%m%d-%H%M%S")
+    filename = f"packets-{stamp}.jsonl" + (".gz" if gzip else "")
+    headers = {"Content-Disposition": f'attachment; filename="{filename}"'}
+    if gzip:
+        return StreamingResponse(_gzipped(), media_type="application/gzip", headers=headers)
+    return StreamingResponse(_lines(), media_type="application/x-ndjson", headers=headers)
+
+
+def _response_diff(original: Optional[Dict], replayed: Dict) -> Dict[str, Any]:
+    import difflib
+    orig = original or {}
+    orig_text = str(orig.get("response", ""))
+    new_text = str(replayed.get("response", ""))
+    orig_events = summarize_event_types(orig.get("parsed_events") or [])
+    new_events = summarize_event_types(replayed.get("parsed_events") or [])
+    return {
+        "has_original": original is not None,
+        "response_identical": orig_text == new_text,
+        "response_diff": list(difflib.unified_diff(orig_text.splitlines(), new_text.splitlines(), "original", "replay", lineterm="")),
+        "events_summary": {"original": orig_events, "replay": new_events},
+        "events_changed": {k: {"original": orig_events.get(k, 0), "replay": new_events.get(k, 0)}
+                           for k in sorted(set(orig_events) | set(new_events)) if orig_events.get(k, 0) != new_events.get(k, 0)},
+        "conversation_id": {"original": orig.get("conversation_id"), "replay": replayed.get("conversation_id")},
+    }
+
+
+@app.post("/api/packets/{packet_id}/replay")
+async def replay_packet(packet_id: int):
+    """重新发送已捕获的 Warp 请求（使用当前有效的 JWT），并与原响应做对比"""
+    packet = await manager.get_packet(packet_id)
+    if packet is None:
+        raise HTTPException(404, f"数据包不存在: {packet_id}")
+    if not packet["type"].startswith("warp_request"):
+        raise HTTPException(400, f"只能重放 warp_request 类数据包，当前类型: {packet['type']}")
+    try:
+        message_type = packet.get("message_type") or "warp.multi_agent.v1.Request"
+        actual_data, protobuf_bytes = prepare_warp_request(packet.get("full_data"), message_type)
+        replayed = await bridge_send_parsed(protobuf_bytes)
+        req_packet = await manager.log_packet("warp_request_replay", actual_data, len(protobuf_bytes), message_type=message_type, related_id=packet_id)
+        await manager.log_packet("warp_response_replay", replayed, len(str(replayed)), related_id=req_packet["id"])
+        original = await manager.find_related(packet_id, "warp_response")
+        return {
+            "packet_id": packet_id,
+            "replay_packet_id": req_packet["id"],
+            "original_response_packet_id": original.get("id") if original else None,
+            "replay": replayed,
+            "diff": _response_diff(original.get("full_data") if original else None, replayed),
+        }
+    except HTTPException:
+        raise
+    except ValueError as ve:
+        raise HTTPException(400, str(ve))
+    except Exception as e:
+        logger.error(f"❌ 重放数据包失败: {e}")
+        raise HTTPException(500, f"重放失败: {e}")
+
+
+@app.get("/metrics")
+async def get_bridge_metrics(format: str = Query("prometheus", description="prometheus | json")):
+    if format == "json":
+        return {**bridge_metrics.snapshot(), "upstream_connections": get_connection_stats()}
+    return PlainTextResponse(bridge_metrics.render_prometheus(), media_type="text/plain; version=0.0.4; charset=utf-8")
+
+
+@app.get("/stats")
+async def get_bridge_stats():
+    """Latency percentiles per route (bridge HTTP) and for upstream Warp responses, plus batch processor stats."""
+    return {
+        "uptime_seconds": round(time.time() - bridge_metrics.started_at, 1),
+        "routes": bridge_metrics.latency_summary("bridge_http_request_duration_seconds", "route"),
+        "warp_response": bridge_metrics.latency_summary("bridge_warp_response_seconds").get("all", {}),
+        "batching": {"encode": encode_batcher.stats(), "decode": decode_batcher.stats()},
+    }
+
+
+@app.get("/api/warp/connection_stats")
+async def get_warp_connection_stats():
+    return get_connection_stats()
+
+
+@app.get("/api/warp/concurrency")
+async def get_warp_concurrency():
+    return adaptive_limit_status()
+
+
+@app.on_event("startup")
+async def _start_memory_watch():
+    memory_watch.start()
+
+
+@app.on_event("startup")
+async def _prewarm_upstream():
+    await prewarm_connections()
+
+
+@app.on_event("shutdown")
+async def _close_upstream_client():
+    await close_warp_http_client()
+    if manager.store is not None:
+        manager.store.close()
+
+
+@app.post("/api/warp/send", response_model=SendResponse)
 async def send_to_warp_api(
     request: EncodeRequest, 
     show_all_events: bool = Query(True, description="Show detailed SSE event breakdown")
@@ -393,11 +1017,13 @@ async def send_to_warp_api(
         logger.info(f"✅ JSON编码为protobuf成功: {len(protobuf_bytes)} 字节")
         from ..warp.api_client import send_protobuf_to_warp_api
         response_text, conversation_id, task_id = await send_protobuf_to_warp_api(protobuf_bytes, show_all_events=show_all_events)
-        await manager.log_packet("warp_request", actual_data, len(protobuf_bytes))
-        await manager.log_packet("warp_response", {"response": response_text, "conversation_id": conversation_id, "task_id": task_id}, len(response_text.encode()))
+        req_packet = await manager.log_packet("warp_request", actual_data, len(protobuf_bytes), message_type=request.message_type)
+        await manager.log_packet("warp_response", {"response": response_text, "conversation_id": conversation_id, "task_id": task_id}, len(response_text.encode()), related_id=req_packet["id"])
         result = {"response": response_text, "conversation_id": conversation_id, "task_id": task_id, "request_size": len(protobuf_bytes), "response_size": len(response_text), "message_type": request.message_type}
         logger.info(f"✅ Warp API调用成功，响应长度: {len(response_text)} 字符")
         return result
+    except UpstreamBusy as e:
+        raise HTTPException(503, str(e))
     except Exception as e:
         import traceback
         error_details = {"error": str(e), "error_type": type(e).__name__, "traceback": traceback.format_exc(), "request_info": {"message_type": request.message_type, "json_size": len(str(actual_data)), "has_tools": "mcp_context" in actual_data, "has_history": "task_context" in actual_data}}
@@ -410,39 +1036,31 @@ async def send_to_warp_api(
         raise HTTPException(500, detail=error_details)
 
 
-@app.post("/api/warp/send_stream")
+@app.post("/api/warp/send_stream", response_model=SendStreamResponse)
 async def send_to_warp_api_parsed(
     request: EncodeRequest
 ):
     try:
         logger.info(f"收到Warp API解析发送请求，消息类型: {request.message_type}")
-        actual_data = request.get_data()
-        if not actual_data:
-            raise HTTPException(400, "数据包不能为空")
-        wrapped = {"json_data": actual_data}
-        wrapped = sanitize_mcp_input_schema_in_packet(wrapped)
-        actual_data = wrapped.get("json_data", actual_data)
-        actual_data = _encode_smd_inplace(actual_data)
-        protobuf_bytes = dict_to_protobuf_bytes(actual_data, request.message_type)
-        logger.info(f"✅ JSON编码为protobuf成功: {len(protobuf_bytes)} 字节")
-        from ..warp.api_client import send_protobuf_to_warp_api_parsed
-        response_text, conversation_id, task_id, parsed_events = await send_protobuf_to_warp_api_parsed(protobuf_bytes)
-        parsed_events = _decode_smd_inplace(parsed_events)
-        await manager.log_packet("warp_request_parsed", actual_data, len(protobuf_bytes))
-        response_data = {"response": response_text, "conversation_id": conversation_id, "task_id": task_id, "parsed_events": parsed_events}
-        await manager.log_packet("warp_response_parsed", response_data, len(str(response_data)))
-        result = {"response": response_text, "conversation_id": conversation_id, "task_id": task_id, "request_size": len(protobuf_bytes), "response_size": len(response_text), "message_type": request.message_type, "parsed_events": parsed_events, "events_count": len(parsed_events), "events_summary": {}}
-        if parsed_events:
-            event_type_counts = {}
-            for event in parsed_events:
-                event_type = event.get("event_type", "UNKNOWN")
-                event_type_counts[event_type] = event_type_counts.get(event_type, 0) + 1
-            result["events_summary"] = event_type_counts
+        try:
+            actual_data, protobuf_bytes = prepare_warp_request(request.get_data(), request.message_type)
+        except ValueError as ve:
+            raise HTTPException(400, str(ve))
+        response_data = await bridge_send_parsed(protobuf_bytes)
+        response_text = response_data["response"]
+        parsed_events = response_data["parsed_events"]
+        req_packet = await manager.log_packet("warp_request_parsed", actual_data, len(protobuf_bytes), message_type=request.message_type)
+        await manager.log_packet("warp_response_parsed", response_data, len(str(response_data)), related_id=req_packet["id"])
+        result = {**response_data, "request_size": len(protobuf_bytes), "response_size": len(response_text), "message_type": request.message_type, "events_count": len(parsed_events), "events_summary": summarize_event_types(parsed_events)}
         logger.info(f"✅ Warp API解析调用成功，响应长度: {len(response_text)} 字符，事件数量: {len(parsed_events)}")
         return result
+    except HTTPException:
+        raise
+    except UpstreamBusy as e:
+        raise HTTPException(503, str(e))
     except Exception as e:
         import traceback
-        error_details = {"error": str(e), "error_type": type(e).__name__, "traceback": traceback.format_exc(), "request_info": {"message_type": request.message_type, "json_size": len(str(actual_data)) if 'actual_data' in locals() else 0, "has_tools": "mcp_context" in (actual_data or {}), "has_history": "task_context" in (actual_data or {})}}
+        error_details = {"error": str(e), "error_type": type(e).__name__, "traceback": traceback.format_exc(), "request_info": {"message_type": request.message_type, "json_size": len(str(actual_data)) if 'actual_data' in locals() else 0, "has_tools": "mcp_context" in (actual_data or {}) if 'actual_data' in locals() else False, "has_history": "task_context" in (actual_data or {}) if 'actual_data' in locals() else False}}
         logger.error(f"❌ Warp API解析调用失败: {e}")
         logger.error(f"错误详情: {error_details}")
         try:
@@ -452,145 +1070,47 @@ async def send_to_warp_api_parsed(
         raise HTTPException(500, detail=error_details)
 
 
+# SSE 中继热路径复用同一个编码器，避免每个事件都新建 JSONEncoder
+_sse_json_encoder = json.JSONEncoder(ensure_ascii=False)
+
+
 @app.post("/api/warp/send_stream_sse")
-async def send_to_warp_api_stream_sse(request: EncodeRequest):
+async def send_to_warp_api_stream_sse(request: EncodeRequest, http_request: Request):
     from fastapi.responses import StreamingResponse
-    import os as _os
-    import re as _re
     try:
-        actual_data = request.get_data()
-        if not actual_data:
-            raise HTTPException(400, "数据包不能为空")
-        wrapped = {"json_data": actual_data}
-        wrapped = sanitize_mcp_input_schema_in_packet(wrapped)
-        actual_data = wrapped.get("json_data", actual_data)
-        actual_data = _encode_smd_inplace(actual_data)
-        protobuf_bytes = dict_to_protobuf_bytes(actual_data, request.message_type)
+        try:
+            _, protobuf_bytes = prepare_warp_request(request.get_data(), request.message_type)
+        except ValueError as ve:
+            raise HTTPException(400, str(ve))
+
+        async def _relay():
+            async with aclosing(bridge_relay_sse_bytes(protobuf_bytes)) as chunks:
+                async for chunk in chunks:
+                    if isinstance(chunk, dict):
+                        yield f"event: error\ndata: {json.dumps({'error': chunk['error']}, ensure_ascii=False)}\n\n"
+                        return
+                    yield chunk
+
         async def _agen():
-            warp_url = CONFIG_WARP_URL
-            def _parse_payload_bytes(data_str: str):
-                s = _re.sub(r"\s+", "", data_str or "")
-                if not s:
-                    return None
-                if _re.fullmatch(r"[0-9a-fA-F]+", s or ""):
-                    try:
-                        return bytes.fromhex(s)
-                    except Exception:
-                        pass
-                pad = "=" * ((4 - (len(s) % 4)) % 4)
-                try:
-                    import base64 as _b64
-                    return _b64.urlsafe_b64decode(s + pad)
-                except Exception:
+            # aclosing: 客户端断开后立即关闭到 Warp 的上游连接
+            async with aclosing(bridge_iter_sse_events(protobuf_bytes)) as events:
+                async for event in events:
+                    if await http_request.is_disconnected():
+                        logger.info("客户端已断开，终止 Warp SSE 上游流")
+                        return
+                    if "error" in event:
+                        yield f"event: error\ndata: {json.dumps({'error': event['error']}, ensure_ascii=False)}\n\n"
+                        break
                     try:
-                        return _b64.b64decode(s + pad)
+                        chunk = _sse_json_encoder.encode(event)
                     except Exception:
-                        return None
-            verify_opt = True
-            insecure_env = _os.getenv("WARP_INSECURE_TLS", "").lower()
-            if insecure_env in ("1", "true", "yes"):
-                verify_opt = False
-                logger.warning("TLS verification disabled via WARP_INSECURE_TLS for Warp API stream endpoint")
-            async with httpx.AsyncClient(http2=True, timeout=httpx.Timeout(60.0), verify=verify_opt, trust_env=True) as client:
-                # 最多尝试两次：第一次失败且为配额429时申请匿名token并重试一次
-                jwt = None
-                for attempt in range(2):
-                    if attempt == 0 or jwt is None:
-                        jwt = await get_valid_jwt()
-                    headers = {
-                        "accept": "text/event-stream",
-                        "content-type": "application/x-protobuf",
-                        "x-warp-client-version": CLIENT_VERSION,
-                        "x-warp-os-category": OS_CATEGORY,
-                        "x-warp-os-name": OS_NAME,
-                        "x-warp-os-version": OS_VERSION,
-                        "authorization": f"Bearer {jwt}",
-                        "content-length": str(len(protobuf_bytes)),
-                    }
-                    async with client.stream("POST", warp_url, headers=headers, content=protobuf_bytes) as response:
-                        if response.status_code != 200:
-                            error_text = await response.aread()
-                            error_content = error_text.decode("utf-8") if error_text else ""
-                            # 429 且包含配额信息时，申请匿名token后重试一次
-                            if response.status_code == 429 and attempt == 0 and (
-                                ("No remaining quota" in error_content) or ("No AI requests remaining" in error_content)
-                            ):
-                                logger.warning("Warp API 返回 429 (配额用尽, SSE 代理)。尝试申请匿名token并重试一次…")
-                                try:
-                                    new_jwt = await acquire_anonymous_access_token()
-                                except Exception:
-                                    new_jwt = None
-                                if new_jwt:
-                                    jwt = new_jwt
-                                    # 重试
-                                    continue
-                            logger.error(f"Warp API HTTP error {response.status_code}: {error_content[:300]}")
-                            yield f"data: {{\"error\": \"HTTP {response.status_code}\"}}\n\n"
-                            yield "data: [DONE]\n\n"
-                            return
-                        try:
-                            logger.info(f"✅ Warp API SSE连接已建立: {warp_url}")
-                            logger.info(f"📦 请求字节数: {len(protobuf_bytes)}")
-                        except Exception:
-                            pass
-                        current_data = ""
-                        event_no = 0
-                        async for line in response.aiter_lines():
-                            if line.startswith("data:"):
-                                payload = line[5:].strip()
-                                if not payload:
-                                    continue
-                                if payload == "[DONE]":
-                                    break
-                                current_data += payload
-                                continue
-                            if (line.strip() == "") and current_data:
-                                raw_bytes = _parse_payload_bytes(current_data)
-                                current_data = ""
-                                if raw_bytes is None:
-                                    continue
-                                try:
-                                    event_data = protobuf_to_dict(raw_bytes, "warp.multi_agent.v1.ResponseEvent")
-                                except Exception:
-                                    continue
-                                def _get(d: Dict[str, Any], *names: str) -> Any:
-                                    for n in names:
-                                        if isinstance(d, dict) and n in d:
-                                            return d[n]
-                                    return None
-                                event_type = "UNKNOWN_EVENT"
-                                if isinstance(event_data, dict):
-                                    if "init" in event_data:
-                                        event_type = "INITIALIZATION"
-                                    else:
-                                        client_actions = _get(event_data, "client_actions", "clientActions")
-                                        if isinstance(client_actions, dict):
-                                            actions = _get(client_actions, "actions", "Actions") or []
-                                            event_type = f"CLIENT_ACTIONS({len(actions)})" if actions else "CLIENT_ACTIONS_EMPTY"
-                                        elif "finished" in event_data:
-                                            event_type = "FINISHED"
-                                event_no += 1
-                                try:
-                                    logger.info(f"🔄 SSE Event #{event_no}: {event_type}")
-                                except Exception:
-                                    pass
-                                out = {"event_number": event_no, "event_type": event_type, "parsed_data": event_data}
-                                try:
-                                    chunk = json.dumps(out, ensure_ascii=False)
-                                except Exception:
-                                    continue
-                                yield f"data: {chunk}\n\n"
-                        try:
-                            logger.info("="*60)
-                            logger.info("📊 SSE STREAM SUMMARY (代理)")
-                            logger.info("="*60)
-                            logger.info(f"📈 Total Events Forwarded: {event_no}")
-                            logger.info("="*60)
-                        except Exception:
-                            pass
-                        yield "data: [DONE]\n\n"
-                        return
-        return StreamingResponse(_agen(), media_type="text/event-stream", headers={"Cache-Control": "no-cache", "Connection": "keep-alive"})
+                        continue
+                    # id 为事件序号，便于客户端定位/去重
+                    yield f"id: {event.get('event_number', '')}\ndata: {chunk}\n\n"
+            yield "data: [DONE]\n\n"
+        # passthrough 时上游的 [DONE] 等内容也原样转发，断开由 StreamingResponse 取消生成器处理
+        body = _relay() if request.passthrough else _agen()
+        return StreamingResponse(body, media_type="text/event-stream", headers={"Cache-Control": "no-cache", "Connection": "keep-alive"})
     except HTTPException:
         raise
     except Exception as e:
@@ -600,17 +1120,85 @@ async def send_to_warp_api_stream_sse(request: EncodeRequest):
         raise HTTPException(500, detail=error_details)
 
 
+def _parse_event_classes(value: Any) -> Optional[set]:
+    if value is None:
+        return None
+    if isinstance(value, str):
+        value = [v for v in value.split(",") if v.strip()]
+    events = {str(v).strip().lower().replace("_", "-") for v in value}
+    unknown = events - set(PACKET_EVENT_CLASSES)
+    if unknown:
+        raise ValueError(f"未知事件类别: {sorted(unknown)}")
+    return events
+
+
 @app.websocket("/ws")
-async def websocket_endpoint(websocket: WebSocket):
-    await manager.connect(websocket)
+async def websocket_endpoint(websocket: WebSocket, events: Optional[str] = None):
+    """实时抓包通道。
+
+    连接时可通过 ?events=encode,decode 订阅（含未知类别时返回 error 消息并以 1008 关闭）；之后发送 JSON 控制消息：
+    {"action": "subscribe"|"unsubscribe", "events": [...]}、{"action": "list"}、{"action": "ping"}
+    配置了 BRIDGE_TOKEN 时需在握手中携带 Authorization: Bearer <BRIDGE_TOKEN> 或 ?token=<BRIDGE_TOKEN>。
+    """
+    if BRIDGE_TOKEN:
+        authorization = websocket.headers.get("authorization") or ""
+        token = authorization[7:] if authorization.startswith("Bearer ") else websocket.query_params.get("token", "")
+        if not hmac.compare_digest(token.encode(), BRIDGE_TOKEN.encode()):
+            await websocket.close(code=1008, reason="invalid or missing bridge token")
+            return
+    try:
+        initial = _parse_event_classes(events)
+    except ValueError as e:
+        # 不能退回到订阅全部事件：客户端会误以为过滤已生效
+        await websocket.accept()
+        await websocket.send_json({"event": "error", "message": str(e), "available_events": list(PACKET_EVENT_CLASSES)})
+        await websocket.close(code=1008, reason="invalid events")
+        return
+    await manager.connect(websocket, initial)
     try:
-        await websocket.send_json({"event": "connected", "message": "WebSocket连接已建立", "timestamp": datetime.now().isoformat()})
+        await websocket.send_json({"event": "connected", "message": "WebSocket连接已建立", "timestamp": datetime.now().isoformat(),
+                                   "available_events": list(PACKET_EVENT_CLASSES),
+                                   "subscribed": sorted(initial) if initial is not None else list(PACKET_EVENT_CLASSES)})
         recent_packets = manager.packet_history[-10:]
         for packet in recent_packets:
-            await websocket.send_json({"event": "packet_history", "packet": packet})
+            if manager.is_subscribed(websocket, _packet_event_class(packet["type"])):
+                await websocket.send_json({"event": "packet_history", "packet": _redact_for_sharing(packet)})
         while True:
             data = await websocket.receive_text()
             logger.debug(f"收到WebSocket消息: {data}")
+            try:
+                msg = json.loads(data)
+            except ValueError:
+                msg = {"action": data.strip().lower()}
+            if not isinstance(msg, dict):
+                await websocket.send_json({"event": "error", "message": "控制消息必须是JSON对象"})
+                continue
+            action = msg.get("action")
+            if action == "ping":
+                await websocket.send_json({"event": "pong", "timestamp": datetime.now().isoformat()})
+                continue
+            if action in ("subscribe", "unsubscribe"):
+                try:
+                    requested = _parse_event_classes(msg.get("events") or [])
+                except ValueError as e:
+                    await websocket.send_json({"event": "error", "message": str(e)})
+                    continue
+                current = manager.subscriptions.get(websocket)
+                if current is None:
+                    current = set(PACKET_EVENT_CLASSES)
+                if action == "subscribe":
+                    # 首次 subscribe 覆盖"全部订阅"的默认值
+                    current = requested if manager.subscriptions.get(websocket) is None else current | requested
+                else:
+                    current = current - requested
+                manager.subscriptions[websocket] = current
+                await websocket.send_json({"event": "subscribed", "events": sorted(current)})
+                continue
+            if action == "list":
+                current = manager.subscriptions.get(websocket)
+                await websocket.send_json({"event": "subscribed", "events": sorted(current) if current is not None else list(PACKET_EVENT_CLASSES)})
+                continue
+            await websocket.send_json({"event": "error", "message": f"未知操作: {action}"})
     except WebSocketDisconnect:
         manager.disconnect(websocket)
     except Exception as e:
@@ -0,0 +1,652 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Configuration file loading
+
+Reads an optional YAML / TOML / JSON config file (format chosen by extension)
+and layers it *under* the environment: a value from the file only applies when
+the corresponding environment variable (or .env entry) is not set. Sections
+that map onto existing settings are exported as environment variables so every
+module keeps reading os.getenv; the structured sections (accounts, keys,
+model_map, model_overrides) are kept as parsed data and read through
+get_config_section().
+
+The file is taken from WARP2API_CONFIG, or the first of config.yaml,
+config.yml, config.toml, config.json found in the working directory or the
+project root. A `profiles:` block holds named overlays (dev / staging / prod);
+the one named by WARP2API_PROFILE is deep-merged over the base sections.
+
+Any of these values, in the file or the environment, may be a secret reference
+(file://, vault://, aws-sm://) that is resolved at load time; see secret_providers.
+"""
+import hashlib
+import json
+import os
+import pathlib
+import re
+from typing import Any, Dict, List, Optional, Tuple
+
+from dotenv import load_dotenv
+
+from .secret_providers import SecretResolutionError, is_secret_ref, resolve_secret, resolve_secrets_in, secret_file
+
+CONFIG_ENV_VAR = "WARP2API_CONFIG"
+PROFILE_ENV_VAR = "WARP2API_PROFILE"
+DEFAULT_NAMES = ("config.yaml", "config.yml", "config.toml", "config.json")
+PROJECT_DIR = pathlib.Path(__file__).resolve().parent.parent.parent
+
+# section -> key -> environment variable
+SECTION_ENV: Dict[str, Dict[str, str]] = {
+    "server": {
+        "host": "HOST",
+        "listen": "OPENAI_LISTEN",
+        "socket_mode": "OPENAI_SOCKET_MODE",
+        "reuse_port": "REUSE_PORT",
+        "trusted_proxies": "TRUSTED_PROXIES",
+        "compression": "HTTP_COMPRESSION",
+        "compression_min_size": "HTTP_COMPRESSION_MIN_SIZE",
+        "access_log": "ACCESS_LOG",
+        "shutdown_grace_period": "SHUTDOWN_GRACE_PERIOD",
+        "verbose": "W2A_VERBOSE",
+        "api_token": "API_TOKEN",
+        "admin_token": "ADMIN_TOKEN",
+        "debug_profiling": "DEBUG_PROFILING",
+    },
+    "logging": {
+        "file": "LOG_FILE",
+        "max_size_mb": "LOG_MAX_SIZE_MB",
+        "rotate_hours": "LOG_ROTATE_HOURS",
+        "max_backups": "LOG_MAX_BACKUPS",
+        "max_age_days": "LOG_MAX_AGE_DAYS",
+        "compress": "LOG_COMPRESS",
+        "redact": "LOG_REDACT",
+        "redact_content": "LOG_REDACT_CONTENT",
+        "tail_buffer": "LOG_TAIL_BUFFER",
+    },
+    "alerts": {
+        "interval": "ALERT_INTERVAL",
+        "for_minutes": "ALERT_FOR_MINUTES",
+        "cooldown_minutes": "ALERT_COOLDOWN_MINUTES",
+        "error_rate_pct": "ALERT_ERROR_RATE_PCT",
+        "p99_latency_ms": "ALERT_P99_LATENCY_MS",
+        "min_available_accounts": "ALERT_MIN_AVAILABLE_ACCOUNTS",
+        "webhook_url": "ALERT_WEBHOOK_URL",
+    },
+    "memory": {
+        "limit_mb": "MEMORY_LIMIT_MB",
+        "check_interval": "MEMORY_CHECK_INTERVAL",
+    },
+    "audit": {
+        "path": "AUDIT_LOG_PATH",
+        "retention_days": "AUDIT_RETENTION_DAYS",
+    },
+    "pii": {
+        "scrub": "PII_SCRUB",
+        "types": "PII_SCRUB_TYPES",
+    },
+    "scripting": {
+        "path": "SCRIPT_HOOKS_PATH",
+        "timeout_ms": "SCRIPT_HOOK_TIMEOUT_MS",
+        "memory_mb": "SCRIPT_HOOK_MEMORY_MB",
+        "fail_closed": "SCRIPT_HOOKS_FAIL_CLOSED",
+    },
+    "post_processing": {
+        "window": "POST_PROCESS_WINDOW",
+    },
+    "prompts": {
+        "system": "SYSTEM_PROMPT",
+        "system_mode": "SYSTEM_PROMPT_MODE",
+    },
+    "conversations": {
+        "store_path": "CONVERSATION_STORE_PATH",
+        "retention_days": "CONVERSATION_RETENTION_DAYS",
+        "context_max_messages": "CONVERSATION_CONTEXT_MAX_MESSAGES",
+    },
+    "context": {
+        "strategy": "CONTEXT_STRATEGY",
+        "window_tokens": "CONTEXT_WINDOW_TOKENS",
+        "reserve_tokens": "CONTEXT_RESERVE_TOKENS",
+        "summary_model": "CONTEXT_SUMMARY_MODEL",
+    },
+    "cache": {
+        "ttl": "RESPONSE_CACHE_TTL",
+        "model_ttls": "RESPONSE_CACHE_MODEL_TTLS",
+        "max_entries": "RESPONSE_CACHE_MAX_ENTRIES",
+        "max_mb": "RESPONSE_CACHE_MAX_MB",
+        "snapshot": "RESPONSE_CACHE_SNAPSHOT",
+        "backend": "RESPONSE_CACHE_BACKEND",
+        "redis_url": "RESPONSE_CACHE_REDIS_URL",
+        "redis_password": "RESPONSE_CACHE_REDIS_PASSWORD",
+        "redis_prefix": "RESPONSE_CACHE_REDIS_PREFIX",
+        "models_ttl": "MODELS_CACHE_TTL",
+        "models_stale": "MODELS_CACHE_STALE",
+        "dedup": "REQUEST_DEDUP",
+    },
+    "tracing": {
+        "endpoint": "OTEL_EXPORTER_OTLP_ENDPOINT",
+        "headers": "OTEL_EXPORTER_OTLP_HEADERS",
+        "service_name": "OTEL_SERVICE_NAME",
+        "sampler": "OTEL_TRACES_SAMPLER",
+        "sampler_arg": "OTEL_TRACES_SAMPLER_ARG",
+    },
+    "bridge": {
+        "url": "WARP_BRIDGE_URL",
+        "transport": "WARP_BRIDGE_TRANSPORT",
+        "token": "BRIDGE_TOKEN",
+        "socket": "BRIDGE_SOCKET",
+        "socket_mode": "BRIDGE_SOCKET_MODE",
+    },
+    "warp": {
+        "refresh_token": "WARP_REFRESH_TOKEN",
+        "jwt": "WARP_JWT",
+        "fingerprint": "WARP_FINGERPRINT",
+        "client_version": "WARP_CLIENT_VERSION",
+        "os_category": "WARP_OS_CATEGORY",
+        "os_name": "WARP_OS_NAME",
+        "os_version": "WARP_OS_VERSION",
+        "descriptor_set": "WARP_DESCRIPTOR_SET",
+        "account_cooldown": "WARP_ACCOUNT_COOLDOWN",
+        "token_store": "WARP_TOKEN_STORE",
+        "token_store_password": "WARP_TOKEN_STORE_PASSWORD",
+        "token_store_lock_timeout": "WARP_TOKEN_STORE_LOCK_TIMEOUT",
+    },
+    "http": {
+        "max_connections": "WARP_HTTP_MAX_CONNECTIONS",
+        "max_keepalive": "WARP_HTTP_MAX_KEEPALIVE",
+        "keepalive_expiry": "WARP_HTTP_KEEPALIVE_EXPIRY",
+        "timeout": "WARP_HTTP_TIMEOUT",
+        "stream_read_timeout": "WARP_STREAM_READ_TIMEOUT",
+        "prewarm": "WARP_HTTP_PREWARM",
+        "insecure_tls": "WARP_INSECURE_TLS",
+        "adaptive_concurrency": "WARP_ADAPTIVE_CONCURRENCY",
+        "adaptive_concurrency_min": "WARP_ADAPTIVE_CONCURRENCY_MIN",
+        "adaptive_latency_target": "WARP_ADAPTIVE_LATENCY_TARGET",
+        "adaptive_queue_timeout": "WARP_ADAPTIVE_QUEUE_TIMEOUT",
+    },
+    "mock": {
+        "enabled": "MOCK_UPSTREAM",
+        "response": "MOCK_UPSTREAM_RESPONSE",
+        "latency_ms": "MOCK_UPSTREAM_LATENCY_MS",
+        "chunk_delay_ms": "MOCK_UPSTREAM_CHUNK_DELAY_MS",
+        "error_every": "MOCK_UPSTREAM_ERROR_EVERY",
+        "error_status": "MOCK_UPSTREAM_ERROR_STATUS",
+    },
+    "cassettes": {
+        "mode": "CASSETTE_MODE",
+        "dir": "CASSETTE_DIR",
+    },
+    "packets": {
+        "history_max": "PACKET_HISTORY_MAX",
+        "store_path": "PACKET_STORE_PATH",
+        "store_max_rows": "PACKET_STORE_MAX_ROWS",
+        "store_max_age_hours": "PACKET_STORE_MAX_AGE_HOURS",
+    },
+    "streaming": {
+        "mode": "SSE_STREAMING",
+        "heartbeat_interval": "SSE_HEARTBEAT_INTERVAL",
+        "flush_interval_ms": "SSE_FLUSH_INTERVAL_MS",
+        "flush_bytes": "SSE_FLUSH_BYTES",
+        "write_timeout": "SSE_WRITE_TIMEOUT",
+    },
+    "limits": {
+        "rate_limit_rps": "RATE_LIMIT_RPS",
+        "rate_limit_burst": "RATE_LIMIT_BURST",
+        "rate_limit_by": "RATE_LIMIT_BY",
+        "rate_limit_max_keys": "RATE_LIMIT_MAX_KEYS",
+        "max_in_flight": "MAX_INFLIGHT_REQUESTS",
+        "queue_size": "INFLIGHT_QUEUE_SIZE",
+        "queue_timeout": "INFLIGHT_QUEUE_TIMEOUT",
+        "upstream_queue_size": "UPSTREAM_QUEUE_SIZE",
+        "upstream_queue_timeout": "UPSTREAM_QUEUE_TIMEOUT",
+        "upstream_rate_limit_backoff": "UPSTREAM_RATE_LIMIT_BACKOFF",
+        "upstream_queue_drain_interval": "UPSTREAM_QUEUE_DRAIN_INTERVAL",
+        "upstream_queue_progress": "UPSTREAM_QUEUE_PROGRESS",
+        "max_choices": "OPENAI_MAX_CHOICES",
+        "request_timeout": "HTTP_REQUEST_TIMEOUT",
+        "completion_timeout": "COMPLETION_TIMEOUT",
+    },
+    "warmup": {
+        "init_retries": "WARP_COMPAT_INIT_RETRIES",
+        "init_delay": "WARP_COMPAT_INIT_DELAY",
+        "request_retries": "WARP_COMPAT_WARMUP_RETRIES",
+        "request_delay": "WARP_COMPAT_WARMUP_DELAY",
+    },
+    "tls": {
+        "cert_file": "TLS_CERT_FILE",
+        "key_file": "TLS_KEY_FILE",
+        "acme_domain": "TLS_ACME_DOMAIN",
+        "acme_email": "TLS_ACME_EMAIL",
+        "acme_cache": "TLS_ACME_CACHE",
+        "acme_directory": "TLS_ACME_DIRECTORY",
+        "acme_http_port": "TLS_ACME_HTTP_PORT",
+    },
+    "proxy": {
+        "http": "HTTP_PROXY",
+        "https": "HTTPS_PROXY",
+        "no_proxy": "NO_PROXY",
+    },
+}
+
+# Settings that hold a file path: secret references are written to a private temp file instead
+FILE_PATH_ENV = ("TLS_CERT_FILE", "TLS_KEY_FILE")
+
+STRUCTURED_SECTIONS = ("accounts", "keys", "model_map", "model_overrides", "prompt_templates", "pii_patterns")
+# 内置的 key id（API_TOKEN 与管理员token），keys 中的 name 不能与之相同
+RESERVED_KEY_NAMES = ("api_token", "admin")
+# POST /admin/reload 可以在运行中重新读取的结构化配置段
+RELOADABLE_SECTIONS = ("keys", "model_map")
+
+# Fields of a prompt_templates entry
+PROMPT_TEMPLATE_FIELDS = ("system_prefix", "system_suffix", "user_prefix", "user_suffix", "tool_preamble", "examples")
+
+# post_processors entry types and their required fields
+POST_PROCESSOR_TYPES = {
+    "regex_replace": ("pattern",),
+    "strip_markdown_fences": (),
+    "trim_after_stop": ("markers",),
+    "dedupe_whitespace": (),
+}
+
+# 需要在 /admin/config、print-config 和日志中遮蔽的环境变量（显式列出，避免误伤 RATE_LIMIT_MAX_KEYS 之类）
+SECRET_ENV_VARS = frozenset({
+    "API_TOKEN", "ADMIN_TOKEN", "BRIDGE_TOKEN", "WARP_JWT", "WARP_REFRESH_TOKEN",
+    "WARP_TOKEN_STORE_PASSWORD", "RESPONSE_CACHE_REDIS_PASSWORD", "VAULT_TOKEN",
+    "OTEL_EXPORTER_OTLP_HEADERS",
+})
+# 结构化配置段（keys / accounts 等）中按完整字段名遮蔽
+_SECRET_FIELDS = frozenset({"key", "api_key", "refresh_token", "jwt", "token", "password", "secret"})
+
+
+class ConfigFileError(ValueError):
+    pass
+
+
+_loaded_path: Optional[pathlib.Path] = None
+_profile: Optional[str] = None
+_sections: Dict[str, Any] = {}
+_applied = False
+
+
+def find_config_file() -> Optional[pathlib.Path]:
+    explicit = os.getenv(CONFIG_ENV_VAR, "").strip()
+    if explicit:
+        path = pathlib.Path(explicit).expanduser()
+        if not path.is_file():
+            raise ConfigFileError(f"{CONFIG_ENV_VAR} 指向的配置文件不存在: {path}")
+        return path
+    for base in (pathlib.Path.cwd(), PROJECT_DIR):
+        for name in DEFAULT_NAMES:
+            candidate = base / name
+            if candidate.is_file():
+                return candidate
+    return None
+
+
+def parse_config_file(path: pathlib.Path) -> Dict[str, Any]:
+    suffix = path.suffix.lower()
+    text = path.read_text(encoding="utf-8")
+    try:
+        if suffix in (".yaml", ".yml"):
+            try:
+                import yaml
+            except ImportError:
+                raise ConfigFileError("读取 YAML 配置需要 PyYAML (pip install pyyaml)")
+            data = yaml.safe_load(text)
+        elif suffix == ".toml":
+            import tomllib
+            data = tomllib.loads(text)
+        elif suffix == ".json":
+            data = json.loads(text)
+        else:
+            raise ConfigFileError(f"不支持的配置文件格式: {path.name}（支持 .yaml/.yml/.toml/.json）")
+    except ConfigFileError:
+        raise
+    except Exception as e:
+        raise ConfigFileError(f"配置文件解析失败 {path}: {e}")
+    if data is None:
+        return {}
+    if not isinstance(data, dict):
+        raise ConfigFileError(f"配置文件顶层必须是映射: {path}")
+    return data
+
+
+def _env_value(value: Any) -> str:
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (list, tuple)):
+        return ",".join(str(v) for v in value)
+    if isinstance(value, dict):
+        # 映射写成 "k=v,k=v"（如 cache.model_ttls）
+        return ",".join(f"{k}={v}" for k, v in value.items())
+    return str(value)
+
+
+def _overlay(base: Dict[str, Any], over: Dict[str, Any]) -> Dict[str, Any]:
+    """Deep-merge mappings; scalars and lists from `over` replace those in `base`."""
+    merged = dict(base)
+    for key, value in over.items():
+        if isinstance(value, dict) and isinstance(merged.get(key), dict):
+            merged[key] = _overlay(merged[key], value)
+        else:
+            merged[key] = value
+    return merged
+
+
+def select_profile(data: Dict[str, Any], profile: Optional[str]) -> Dict[str, Any]:
+    profiles = data.pop("profiles", None) or {}
+    if not isinstance(profiles, dict) or not all(isinstance(v, dict) for v in profiles.values()):
+        raise ConfigFileError("profiles 必须是 名称 -> 配置段 的映射")
+    if not profile:
+        return data
+    if profile not in profiles:
+        available = ", ".join(sorted(profiles)) or "无"
+        raise ConfigFileError(f"配置文件中没有 profile '{profile}'（可用: {available}）")
+    return _overlay(data, profiles[profile])
+
+
+def _resolve_env_secrets(names: List[str]) -> None:
+    """Replace secret references held in these environment variables with their values."""
+    problems: List[str] = []
+    for name in names:
+        value = os.environ.get(name)
+        if not is_secret_ref(value):
+            continue
+        try:
+            os.environ[name] = secret_file(value) if name in FILE_PATH_ENV else resolve_secret(value)
+        except SecretResolutionError as e:
+            problems.append(f"{name}: {e}")
+    if problems:
+        raise ConfigFileError("无法解析密钥引用:\n" + "\n".join(f"  - {p}" for p in problems))
+
+
+def _check_post_processors(where: str, processors: Any) -> None:
+    if processors is None:
+        return
+    if not isinstance(processors, list) or not all(isinstance(p, dict) for p in processors):
+        raise ConfigFileError(f"{where}.post_processors 必须是映射列表")
+    for p in processors:
+        kind = p.get("type")
+        if kind not in POST_PROCESSOR_TYPES:
+            raise ConfigFileError(f"{where}.post_processors 的 type 必须是 {' / '.join(POST_PROCESSOR_TYPES)}")
+        missing = [f for f in POST_PROCESSOR_TYPES[kind] if not p.get(f)]
+        if missing:
+            raise ConfigFileError(f"{where}.post_processors 中的 {kind} 缺少 {', '.join(missing)}")
+        if kind == "regex_replace":
+            try:
+                re.compile(p["pattern"])
+            except (re.error, TypeError) as e:
+                raise ConfigFileError(f"{where}.post_processors 中的 pattern 不是有效的正则表达式: {e}")
+            if p.get("replacement") is not None and not isinstance(p["replacement"], str):
+                raise ConfigFileError(f"{where}.post_processors 中的 replacement 必须是字符串")
+        if kind == "trim_after_stop" and (
+            not isinstance(p["markers"], list) or not all(isinstance(m, str) and m for m in p["markers"])
+        ):
+            raise ConfigFileError(f"{where}.post_processors 中的 markers 必须是非空字符串列表")
+
+
+def _check_structured(data: Dict[str, Any]) -> Dict[str, Any]:
+    out: Dict[str, Any] = {}
+    accounts = data.get("accounts")
+    if accounts is not None:
+        if not isinstance(accounts, list) or not all(isinstance(a, dict) for a in accounts):
+            raise ConfigFileError("accounts 必须是映射列表")
+        labels = set()
+        for i, account in enumerate(accounts):
+            name = account.get("label") or account.get("email") or f"#{i + 1}"
+            unknown = set(account) - {"label", "email", "refresh_token", "weight", "enabled"}
+            if unknown:
+                raise ConfigFileError(f"accounts[{name}] 包含未知字段: {', '.join(sorted(unknown))}")
+            if not isinstance(account.get("refresh_token"), str) or not account["refresh_token"].strip():
+                raise ConfigFileError(f"accounts[{name}] 缺少 refresh_token")
+            weight = account.get("weight", 1)
+            if isinstance(weight, bool) or not isinstance(weight, (int, float)) or weight <= 0:
+                raise ConfigFileError(f"accounts[{name}].weight 必须是正数")
+            if not isinstance(account.get("enabled", True), bool):
+                raise ConfigFileError(f"accounts[{name}].enabled 必须是 true / false")
+            if name in labels:
+                raise ConfigFileError(f"accounts 中的 label 重复: {name}")
+            labels.add(name)
+        out["accounts"] = accounts
+    keys = data.get("keys")
+    if keys is not None:
+        if not isinstance(keys, list):
+            raise ConfigFileError("keys 必须是列表")
+        normalized: List[Dict[str, Any]] = []
+        for item in keys:
+            if isinstance(item, str):
+                normalized.append({"key": item})
+            elif isinstance(item, dict) and isinstance(item.get("key"), str):
+                if item.get("name") is not None and (not isinstance(item["name"], str) or not item["name"].strip()):
+                    raise ConfigFileError("keys 中的 name 必须是非空字符串")
+                if item.get("name") in RESERVED_KEY_NAMES:
+                    raise ConfigFileError(f"keys 中的 name 不能使用保留名称: {item['name']}")
+                if item.get("system_prompt_mode") not in (None, "prepend", "append", "replace"):
+                    raise ConfigFileError("keys 中的 system_prompt_mode 必须是 prepend / append / replace")
+                if not isinstance(item.get("pii_scrub", False), bool):
+                    raise ConfigFileError("keys 中的 pii_scrub 必须是布尔值")
+                _check_post_processors(f"keys[{item.get('name') or '…'}]", item.get("post_processors"))
+                normalized.append(item)
+            else:
+                raise ConfigFileError("keys 中的每一项必须是字符串或包含 key 字段的映射")
+        # key id（name 或由 key 派生）用于会话、缓存与按 key 设置的隔离，必须唯一
+        names = [k["name"] for k in normalized if k.get("name") is not None]
+        duplicates = sorted({n for n in names if names.count(n) > 1})
+        if duplicates:
+            raise ConfigFileError(f"keys 中的 name 重复: {', '.join(duplicates)}")
+        values = [k["key"] for k in normalized]
+        if len(set(values)) != len(values):
+            raise ConfigFileError("keys 中有重复的 key")
+        out["keys"] = normalized
+    model_map = data.get("model_map")
+    if model_map is not None:
+        if not isinstance(model_map, dict) or not all(isinstance(v, str) for v in model_map.values()):
+            raise ConfigFileError("model_map 必须是 别名 -> 模型名 的字符串映射")
+        out["model_map"] = {str(k): v for k, v in model_map.items()}
+    overrides = data.get("model_overrides")
+    if overrides is not None:
+        if not isinstance(overrides, dict) or not all(isinstance(v, dict) for v in overrides.values()):
+            raise ConfigFileError("model_overrides 必须是 模型名 -> 覆盖规则 的映射")
+        for model, rules in overrides.items():
+            for param in ("temperature", "top_p", "max_tokens"):
+                rule = rules.get(param)
+                if rule is None or isinstance(rule, (int, float)):
+                    continue
+                if not isinstance(rule, dict) or set(rule) - {"default", "min", "max", "force"}:
+                    raise ConfigFileError(f"model_overrides.{model}.{param} 必须是数字或包含 default/min/max/force 的映射")
+            _check_post_processors(f"model_overrides.{model}", rules.get("post_processors"))
+        out["model_overrides"] = {str(k): v for k, v in overrides.items()}
+    templates = data.get("prompt_templates")
+    if templates is not None:
+        if not isinstance(templates, dict) or not all(isinstance(v, dict) for v in templates.values()):
+            raise ConfigFileError("prompt_templates 必须是 模板名 -> 模板 的映射")
+        for name, template in templates.items():
+            unknown = set(template) - set(PROMPT_TEMPLATE_FIELDS)
+            if unknown:
+                raise ConfigFileError(f"prompt_templates.{name} 包含未知字段: {', '.join(sorted(unknown))}")
+            for field in PROMPT_TEMPLATE_FIELDS[:-1]:
+                if template.get(field) is not None and not isinstance(template[field], str):
+                    raise ConfigFileError(f"prompt_templates.{name}.{field} 必须是字符串")
+            examples = template.get("examples") or []
+            if not isinstance(examples, list) or not all(
+                isinstance(e, dict) and isinstance(e.get("user"), str) and isinstance(e.get("assistant"), str) for e in examples
+            ):
+                raise ConfigFileError(f"prompt_templates.{name}.examples 必须是包含 user / assistant 字符串的映射列表")
+        out["prompt_templates"] = {str(k): v for k, v in templates.items()}
+    pii_patterns = data.get("pii_patterns")
+    if pii_patterns is not None:
+        if not isinstance(pii_patterns, list) or not all(
+            isinstance(p, dict) and isinstance(p.get("name"), str) and isinstance(p.get("pattern"), str) for p in pii_patterns
+        ):
+            raise ConfigFileError("pii_patterns 必须是包含 name / pattern 字符串的映射列表")
+        for p in pii_patterns:
+            try:
+                re.compile(p["pattern"])
+            except re.error as e:
+                raise ConfigFileError(f"pii_patterns.{p['name']} 不是有效的正则表达式: {e}")
+            if p.get("replacement") is not None and not isinstance(p["replacement"], str):
+                raise ConfigFileError(f"pii_patterns.{p['name']}.replacement 必须是字符串")
+        out["pii_patterns"] = pii_patterns
+    # 引用的模板必须存在
+    known = set(out.get("prompt_templates") or {})
+    referrers = [(f"keys[{k.get('name') or '…'}]", k) for k in out.get("keys") or []]
+    referrers += [(f"model_overrides.{m}", r) for m, r in (out.get("model_overrides") or {}).items()]
+    for where, item in referrers:
+        name = item.get("prompt_template")
+        if name is not None and str(name) not in known:
+            raise ConfigFileError(f"{where}.prompt_template 引用了不存在的模板: {name}")
+    return out
+
+
+def apply_config_file(path: Optional[pathlib.Path] = None, force: bool = False) -> Optional[pathlib.Path]:
+    """Load the config file once and export its settings as environment defaults.
+
+    Precedence: process environment > .env > config file > built-in defaults.
+    """
+    global _loaded_path, _sections, _applied, _profile
+    if _applied and not force:
+        return _loaded_path
+    # .env 必须先加载，否则配置文件写入的默认值会挡住 .env 中的同名变量
+    load_dotenv()
+    path = path or find_config_file()
+    _applied = True
+    env_names = [env for mapping in SECTION_ENV.values() for env in mapping.values()]
+    if path is None:
+        _resolve_env_secrets(env_names)
+        return None
+    _profile = os.getenv(PROFILE_ENV_VAR, "").strip() or None
+    data = select_profile(parse_config_file(path), _profile)
+    for section, mapping in SECTION_ENV.items():
+        values = data.get(section)
+        if values is None:
+            continue
+        if not isinstance(values, dict):
+            raise ConfigFileError(f"配置段 {section} 必须是映射")
+        for key, value in values.items():
+            env_name = mapping.get(key)
+            if env_name is None:
+                raise ConfigFileError(f"未知配置项: {section}.{key}")
+            if value is not None:
+                os.environ.setdefault(env_name, _env_value(value))
+    # env: 原样设置任意环境变量（同样不覆盖已有值）
+    raw_env = data.get("env") or {}
+    if not isinstance(raw_env, dict):
+        raise ConfigFileError("配置段 env 必须是映射")
+    for name, value in raw_env.items():
+        if value is not None:
+            os.environ.setdefault(str(name), _env_value(value))
+    _resolve_env_secrets(env_names + [str(n) for n in raw_env])
+    structured = _check_structured(data)
+    try:
+        _sections = {name: resolve_secrets_in(structured[name]) for name in structured}
+    except SecretResolutionError as e:
+        raise ConfigFileError(f"无法解析密钥引用: {e}")
+    _loaded_path = path
+    return path
+
+
+def reload_config_sections(names: Tuple[str, ...] = RELOADABLE_SECTIONS) -> Dict[str, Any]:
+    """Re-read only the structured sections `names` from the loaded config file and swap them in.
+
+    Environment-mapped settings and the other sections keep their startup values. An
+    invalid file raises ConfigFileError and leaves the running configuration untouched.
+    """
+    global _sections
+    if _loaded_path is None:
+        raise ConfigFileError("启动时没有加载配置文件，无法重新加载")
+    structured = _check_structured(select_profile(parse_config_file(_loaded_path), _profile))
+    # 模板不随之重新加载，新 keys 引用的模板必须已经在运行中
+    known = set(_sections.get("prompt_templates") or {})
+    keys = structured.get("keys") if "keys" in names else None
+    for entry in keys or []:
+        name = entry.get("prompt_template")
+        if name is not None and str(name) not in known:
+            raise ConfigFileError(f"keys[{entry.get('name') or '…'}].prompt_template 引用的模板 {name} 未加载（修改模板需要重启）")
+    try:
+        fresh = {name: resolve_secrets_in(structured[name]) for name in names if name in structured}
+    except SecretResolutionError as e:
+        raise ConfigFileError(f"无法解析密钥引用: {e}")
+    # 整体替换字典，读取方不会看到只更新了一半的配置
+    _sections = {**{k: v for k, v in _sections.items() if k not in names}, **fresh}
+    return {name: _sections.get(name) for name in names}
+
+
+def get_config_section(name: str, default: Any = None) -> Any:
+    """Structured section (accounts / keys / model_map / ...) from the loaded config file."""
+    return _sections.get(name, default)
+
+
+def loaded_config_path() -> Optional[pathlib.Path]:
+    return _loaded_path
+
+
+def is_secret_name(name: str) -> bool:
+    return name in SECRET_ENV_VARS or name.lower() in _SECRET_FIELDS
+
+
+def mask_secret(value: Any) -> Any:
+    """Length plus a short sha256 fingerprint (to tell keys apart); none of the value itself."""
+    if not isinstance(value, str) or not value:
+        return value
+    fingerprint = hashlib.sha256(value.encode("utf-8")).hexdigest()[:8]
+    return f"*** ({len(value)} chars, sha256:{fingerprint})"
+
+
+def configured_secret_values() -> List[str]:
+    """Values of secret-named environment variables and config-file keys (for log redaction)."""
+    values = [v for name, v in os.environ.items() if v and is_secret_name(name)]
+
+    def walk(value: Any) -> None:
+        if isinstance(value, dict):
+            for k, v in value.items():
+                if isinstance(v, str) and v and is_secret_name(str(k)):
+                    values.append(v)
+                else:
+                    walk(v)
+        elif isinstance(value, list):
+            for v in value:
+                walk(v)
+
+    walk(_sections)
+    return values
+
+
+def _redact_structured(value: Any) -> Any:
+    if isinstance(value, dict):
+        return {k: (mask_secret(v) if is_secret_name(str(k)) else _redact_structured(v)) for k, v in value.items()}
+    if isinstance(value, list):
+        return [_redact_structured(v) for v in value]
+    return value
+
+
+def mask_url_credentials(value: Any) -> Any:
+    """Replace the user:password part of a URL (proxy, Redis, ...) with ***."""
+    if not isinstance(value, str) or "@" not in value:
+        return value
+    return re.sub(r"^([A-Za-z][A-Za-z0-9+.-]*://)[^/@\s]+@", r"\1***@", value)
+
+
+def effective_config(redact: bool = True) -> Dict[str, Any]:
+    """Merged configuration as the process sees it (environment after all layering).
+
+    Only keys that are set are included; with redact=True tokens, JWTs and keys are masked,
+    as are credentials embedded in URLs.
+    """
+    out: Dict[str, Any] = {}
+    for section, mapping in SECTION_ENV.items():
+        values: Dict[str, Any] = {}
+        for key, env_name in mapping.items():
+            value = os.getenv(env_name)
+            if value is None:
+                continue
+            if redact:
+                # 代理、Redis 等 URL 可能内嵌 user:pass@
+                value = mask_secret(value) if is_secret_name(env_name) else mask_url_credentials(value)
+            values[key] = value
+        if values:
+            out[section] = values
+    for name in STRUCTURED_SECTIONS:
+        if name in _sections:
+            out[name] = _redact_structured(_sections[name]) if redact else _sections[name]
+    out["config_file"] = str(_loaded_path) if _loaded_path else None
+    out["profile"] = _profile
+    return out
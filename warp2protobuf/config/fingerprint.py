@@ -0,0 +1,104 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Client fingerprint detection for Warp API
+
+Derives x-warp-client-version / x-warp-os-* values from the running host and a
+table of known-good Warp client versions, so requests do not carry a stale
+static fingerprint that Warp may reject.
+"""
+import os
+import platform
+from typing import Dict
+
+# Known-good Warp client versions per OS category (newest first).
+# Update this table when Warp starts rejecting the current entry.
+KNOWN_CLIENT_VERSIONS: Dict[str, list] = {
+    "Windows": ["v0.2025.08.06.08.12.stable_02"],
+    "macOS": ["v0.2025.08.06.08.12.stable_02"],
+    "Linux": ["v0.2025.08.06.08.12.stable_02"],
+}
+
+# Fallback fingerprint used when the host cannot be identified
+DEFAULT_FINGERPRINT = {
+    "client_version": "v0.2025.08.06.08.12.stable_02",
+    "os_category": "Windows",
+    "os_name": "Windows",
+    "os_version": "11 (26100)",
+}
+
+
+def _detect_windows() -> Dict[str, str]:
+    # platform.version() -> "10.0.26100"; Windows 11 still reports major 10
+    build = ""
+    try:
+        parts = platform.version().split(".")
+        build = parts[2] if len(parts) >= 3 else ""
+    except Exception:
+        pass
+    major = "10"
+    try:
+        if build and int(build) >= 22000:
+            major = "11"
+    except ValueError:
+        pass
+    version = f"{major} ({build})" if build else major
+    return {"os_category": "Windows", "os_name": "Windows", "os_version": version}
+
+
+def _detect_macos() -> Dict[str, str]:
+    version = platform.mac_ver()[0] or platform.release()
+    return {"os_category": "macOS", "os_name": "macOS", "os_version": version}
+
+
+def _detect_linux() -> Dict[str, str]:
+    name = "Linux"
+    version = platform.release()
+    try:
+        info = platform.freedesktop_os_release()
+        name = info.get("NAME") or name
+        version = info.get("VERSION_ID") or version
+    except Exception:
+        pass
+    return {"os_category": "Linux", "os_name": name, "os_version": version}
+
+
+def detect_os_fingerprint() -> Dict[str, str]:
+    """Detect OS category/name/version for the current host."""
+    system = platform.system()
+    try:
+        if system == "Windows":
+            return _detect_windows()
+        if system == "Darwin":
+            return _detect_macos()
+        if system == "Linux":
+            return _detect_linux()
+    except Exception:
+        pass
+    return {k: DEFAULT_FINGERPRINT[k] for k in ("os_category", "os_name", "os_version")}
+
+
+def resolve_client_fingerprint() -> Dict[str, str]:
+    """Resolve the effective fingerprint.
+
+    Explicit environment variables (WARP_CLIENT_VERSION, WARP_OS_CATEGORY,
+    WARP_OS_NAME, WARP_OS_VERSION) win; WARP_FINGERPRINT=static disables host
+    detection and uses DEFAULT_FINGERPRINT.
+    """
+    if os.getenv("WARP_FINGERPRINT", "auto").lower() == "static":
+        fp = dict(DEFAULT_FINGERPRINT)
+    else:
+        fp = detect_os_fingerprint()
+        versions = KNOWN_CLIENT_VERSIONS.get(fp["os_category"]) or [DEFAULT_FINGERPRINT["client_version"]]
+        fp["client_version"] = versions[0]
+
+    overrides = {
+        "client_version": os.getenv("WARP_CLIENT_VERSION"),
+        "os_category": os.getenv("WARP_OS_CATEGORY"),
+        "os_name": os.getenv("WARP_OS_NAME"),
+        "os_version": os.getenv("WARP_OS_VERSION"),
+    }
+    for k, v in overrides.items():
+        if v:
+            fp[k] = v
+    return fp
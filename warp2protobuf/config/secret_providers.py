@@ -0,0 +1,165 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+External secret providers
+
+Credential settings may hold a secret reference instead of the plaintext value:
+
+    file:///run/secrets/warp_refresh_token      file contents (trailing newline stripped)
+    vault://secret/warp2api#refresh_token       HashiCorp Vault KV v2 (VAULT_ADDR / VAULT_TOKEN)
+    aws-sm://warp2api/prod#refresh_token        AWS Secrets Manager (boto3, ?region=... optional)
+
+The `#field` suffix selects one key of a JSON / key-value secret. References are
+resolved once at startup by the config loader; TLS material is written to a
+private temporary file via secret_file() because the ssl module only loads
+certificates from paths.
+"""
+import atexit
+import json
+import os
+import pathlib
+import tempfile
+from typing import Any, Dict, List, Optional, Tuple
+from urllib.parse import parse_qs, urlparse
+
+SCHEMES = ("file", "vault", "aws-sm")
+
+_cache: Dict[str, str] = {}
+_temp_files: List[str] = []
+
+
+class SecretResolutionError(ValueError):
+    pass
+
+
+def is_secret_ref(value: object) -> bool:
+    return isinstance(value, str) and any(value.startswith(f"{s}://") for s in SCHEMES)
+
+
+def describe_ref(ref: str) -> str:
+    """Reference without the query string, safe to log."""
+    return ref.split("?", 1)[0]
+
+
+def _pick_field(ref: str, payload: Dict[str, object], field: Optional[str]) -> str:
+    if field:
+        if field not in payload:
+            raise SecretResolutionError(f"{describe_ref(ref)}: 密钥中没有字段 {field}（可用: {', '.join(sorted(payload))}）")
+        return str(payload[field])
+    if len(payload) == 1:
+        return str(next(iter(payload.values())))
+    raise SecretResolutionError(f"{describe_ref(ref)}: 密钥包含多个字段，请用 #字段名 指定")
+
+
+def _split(ref: str) -> Tuple[str, Optional[str]]:
+    body, _, field = ref.partition("#")
+    return body, (field or None)
+
+
+def _read_file(ref: str) -> str:
+    body, _ = _split(ref)
+    path = pathlib.Path(body[len("file://"):]).expanduser()
+    try:
+        return path.read_text(encoding="utf-8").rstrip("\r\n")
+    except OSError as e:
+        raise SecretResolutionError(f"{describe_ref(ref)}: 无法读取文件: {e}")
+
+
+def _read_vault(ref: str) -> str:
+    body, field = _split(ref)
+    addr = os.getenv("VAULT_ADDR", "").rstrip("/")
+    token = os.getenv("VAULT_TOKEN", "")
+    if not addr or not token:
+        raise SecretResolutionError(f"{describe_ref(ref)}: 需要设置 VAULT_ADDR 和 VAULT_TOKEN")
+    mount, _, path = body[len("vault://"):].partition("/")
+    if not mount or not path:
+        raise SecretResolutionError(f"{describe_ref(ref)}: 格式应为 vault://<mount>/<path>#<field>")
+    headers = {"X-Vault-Token": token}
+    if os.getenv("VAULT_NAMESPACE"):
+        headers["X-Vault-Namespace"] = os.environ["VAULT_NAMESPACE"]
+    import httpx
+    try:
+        resp = httpx.get(f"{addr}/v1/{mount}/data/{path}", headers=headers, timeout=10.0)
+    except Exception as e:
+        raise SecretResolutionError(f"{describe_ref(ref)}: 连接 Vault 失败: {e}")
+    if resp.status_code != 200:
+        raise SecretResolutionError(f"{describe_ref(ref)}: Vault 返回 HTTP {resp.status_code}")
+    data = ((resp.json() or {}).get("data") or {}).get("data") or {}
+    return _pick_field(ref, data, field)
+
+
+def _read_aws(ref: str) -> str:
+    body, field = _split(ref)
+    parsed = urlparse(body)
+    secret_id = (parsed.netloc + parsed.path).strip("/")
+    region = (parse_qs(parsed.query).get("region") or [None])[0]
+    try:
+        import boto3
+    except ImportError:
+        raise SecretResolutionError(f"{describe_ref(ref)}: 读取 AWS Secrets Manager 需要 boto3 (pip install boto3)")
+    try:
+        client = boto3.client("secretsmanager", region_name=region)
+        secret = client.get_secret_value(SecretId=secret_id).get("SecretString")
+    except Exception as e:
+        raise SecretResolutionError(f"{describe_ref(ref)}: 读取失败: {e}")
+    if secret is None:
+        raise SecretResolutionError(f"{describe_ref(ref)}: 只支持文本类型的密钥 (SecretString)")
+    if not field:
+        return secret
+    try:
+        payload = json.loads(secret)
+    except ValueError:
+        raise SecretResolutionError(f"{describe_ref(ref)}: 指定了 #{field}，但密钥内容不是 JSON")
+    return _pick_field(ref, payload, field)
+
+
+_PROVIDERS = {
+    "file": _read_file,
+    "vault": _read_vault,
+    "aws-sm": _read_aws,
+}
+
+
+def resolve_secret(value: str) -> str:
+    """Return the secret a reference points to; plain values are returned unchanged."""
+    if not is_secret_ref(value):
+        return value
+    if value not in _cache:
+        scheme = value.split("://", 1)[0]
+        _cache[value] = _PROVIDERS[scheme](value)
+    return _cache[value]
+
+
+def resolve_secrets_in(value: Any) -> Any:
+    """Resolve every reference inside a parsed config structure (lists / mappings)."""
+    if isinstance(value, dict):
+        return {k: resolve_secrets_in(v) for k, v in value.items()}
+    if isinstance(value, list):
+        return [resolve_secrets_in(v) for v in value]
+    return resolve_secret(value) if is_secret_ref(value) else value
+
+
+def _remove_temp_files() -> None:
+    for path in _temp_files:
+        try:
+            os.unlink(path)
+        except OSError:
+            pass
+
+
+def secret_file(value: str, suffix: str = ".pem") -> str:
+    """Path to a file holding the secret: plain paths and file:// refs are used as is,
+    other references are materialised into a 0600 temporary file."""
+    if not is_secret_ref(value):
+        return value
+    body, field = _split(value)
+    if value.startswith("file://") and not field:
+        return str(pathlib.Path(body[len("file://"):]).expanduser())
+    content = resolve_secret(value)
+    fd, path = tempfile.mkstemp(prefix="warp2api-", suffix=suffix)
+    if not _temp_files:
+        atexit.register(_remove_temp_files)
+    _temp_files.append(path)
+    with os.fdopen(fd, "w", encoding="utf-8") as f:
+        f.write(content if content.endswith("\n") else content + "\n")
+    return path
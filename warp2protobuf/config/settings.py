@@ -9,13 +9,22 @@ import os
 import pathlib
 from dotenv import load_dotenv
 
-# Load environment variables
+from .fingerprint import resolve_client_fingerprint
+from .config_file import apply_config_file
+from .validation import ensure_valid_values
+
+# Load environment variables, then config file values for anything still unset
 load_dotenv()
+apply_config_file()
+# Report every malformed value at once instead of failing on the first int()/float() below
+ensure_valid_values()
 
 # Path configurations
 SCRIPT_DIR = pathlib.Path(__file__).resolve().parent.parent.parent
 PROTO_DIR = SCRIPT_DIR / "proto"
 LOGS_DIR = SCRIPT_DIR / "logs"
+# Precompiled FileDescriptorSet; used instead of invoking protoc when up to date
+DESCRIPTOR_SET_FILE = pathlib.Path(os.getenv("WARP_DESCRIPTOR_SET", str(PROTO_DIR / "warp_descriptors.pb")))
 
 # API configuration
 WARP_URL = "https://app.warp.dev/ai/multi-agent"
@@ -25,11 +34,75 @@ HOST = os.getenv("HOST", "0.0.0.0")
 PORT = int(os.getenv("PORT", "8002"))
 WARP_JWT = os.getenv("WARP_JWT")
 
-# Client headers configuration
-CLIENT_VERSION = "v0.2025.08.06.08.12.stable_02"
-OS_CATEGORY = "Windows"
-OS_NAME = "Windows"
-OS_VERSION = "11 (26100)"
+# Shared secret required on bridge /api/* routes; empty disables the check
+BRIDGE_TOKEN = os.getenv("BRIDGE_TOKEN", "")
+# Listen on a Unix domain socket instead of TCP when set
+BRIDGE_SOCKET = os.getenv("BRIDGE_SOCKET", "")
+BRIDGE_SOCKET_MODE = int(os.getenv("BRIDGE_SOCKET_MODE", "600"), 8)
+
+# Compression of complete JSON/text responses: "gzip", "br" (brotli when installed, else gzip) or "off";
+# streamed responses (SSE, JSONL export) are never compressed
+HTTP_COMPRESSION = os.getenv("HTTP_COMPRESSION", "gzip").strip().lower()
+HTTP_COMPRESSION_MIN_SIZE = int(os.getenv("HTTP_COMPRESSION_MIN_SIZE", "1024"))
+
+# Access log per request: "json" (one object per line), "text" (key=value) or "off"
+ACCESS_LOG = os.getenv("ACCESS_LOG", "json").strip().lower()
+
+# Seconds in-flight requests (streams) get to finish after SIGTERM before connections are closed
+SHUTDOWN_GRACE_PERIOD = float(os.getenv("SHUTDOWN_GRACE_PERIOD", "60"))
+
+# Upstream HTTP connection pool (shared HTTP/2 client)
+WARP_HTTP_MAX_CONNECTIONS = int(os.getenv("WARP_HTTP_MAX_CONNECTIONS", "100"))
+WARP_HTTP_MAX_KEEPALIVE = int(os.getenv("WARP_HTTP_MAX_KEEPALIVE", "20"))
+WARP_HTTP_KEEPALIVE_EXPIRY = float(os.getenv("WARP_HTTP_KEEPALIVE_EXPIRY", "300"))
+WARP_HTTP_TIMEOUT = float(os.getenv("WARP_HTTP_TIMEOUT", "60"))
+# Read timeout between events on streaming (SSE) calls; generations can pause far longer than
+# WARP_HTTP_TIMEOUT between tokens, so streams get their own, looser limit (0 = no limit)
+WARP_STREAM_READ_TIMEOUT = float(os.getenv("WARP_STREAM_READ_TIMEOUT", "600"))
+# Open the upstream connections (TCP + TLS handshake + a HEAD request) at bridge startup, so the
+# first user request rides a warm connection instead of paying for the setup
+WARP_HTTP_PREWARM = os.getenv("WARP_HTTP_PREWARM", "true").strip().lower() in ("1", "true", "yes")
+
+# Mock upstream for offline development and CI: Warp requests are answered locally by a
+# deterministic fake (streamed canned text, no credentials or network needed)
+MOCK_UPSTREAM = os.getenv("MOCK_UPSTREAM", "").strip().lower() in ("1", "true", "yes")
+# Reply text of the mock; {query} is replaced with the last user message
+MOCK_UPSTREAM_RESPONSE = os.getenv("MOCK_UPSTREAM_RESPONSE", "This is a mock response to: {query}")
+# Delay before the response headers, and between streamed events
+MOCK_UPSTREAM_LATENCY_MS = float(os.getenv("MOCK_UPSTREAM_LATENCY_MS", "0"))
+MOCK_UPSTREAM_CHUNK_DELAY_MS = float(os.getenv("MOCK_UPSTREAM_CHUNK_DELAY_MS", "20"))
+# Every Nth request fails with MOCK_UPSTREAM_ERROR_STATUS (0 = never)
+MOCK_UPSTREAM_ERROR_EVERY = int(os.getenv("MOCK_UPSTREAM_ERROR_EVERY", "0"))
+MOCK_UPSTREAM_ERROR_STATUS = int(os.getenv("MOCK_UPSTREAM_ERROR_STATUS", "500"))
+
+# Cassettes: "record" saves every Warp conversation exchange as a JSON file in CASSETTE_DIR,
+# "replay" answers requests from those files without network access ("off" = neither)
+CASSETTE_MODE = os.getenv("CASSETTE_MODE", "off").strip().lower()
+CASSETTE_DIR = os.getenv("CASSETTE_DIR", "cassettes")
+# Warp is answered locally (mock or replay): credentials are neither needed nor refreshed
+OFFLINE_UPSTREAM = MOCK_UPSTREAM or CASSETTE_MODE == "replay"
+
+# Adaptive (AIMD) concurrency limit per Warp account (0 = unlimited): halved when Warp answers
+# slower than WARP_ADAPTIVE_LATENCY_TARGET seconds or with 429 / 5xx, regrown on healthy responses
+WARP_ADAPTIVE_CONCURRENCY = int(os.getenv("WARP_ADAPTIVE_CONCURRENCY", "0"))
+WARP_ADAPTIVE_CONCURRENCY_MIN = int(os.getenv("WARP_ADAPTIVE_CONCURRENCY_MIN", "1"))
+WARP_ADAPTIVE_LATENCY_TARGET = float(os.getenv("WARP_ADAPTIVE_LATENCY_TARGET", "10"))
+# How long a request waits for a free slot before the bridge answers 503
+WARP_ADAPTIVE_QUEUE_TIMEOUT = float(os.getenv("WARP_ADAPTIVE_QUEUE_TIMEOUT", "30"))
+
+# Packet history (bridge /api/packets/history)
+PACKET_HISTORY_MAX = int(os.getenv("PACKET_HISTORY_MAX", "500"))
+# Optional SQLite persistence; empty disables it
+PACKET_STORE_PATH = os.getenv("PACKET_STORE_PATH", "")
+PACKET_STORE_MAX_ROWS = int(os.getenv("PACKET_STORE_MAX_ROWS", "10000"))
+PACKET_STORE_MAX_AGE_HOURS = float(os.getenv("PACKET_STORE_MAX_AGE_HOURS", "72"))
+
+# Client headers configuration (auto-detected from host, overridable via env)
+_FINGERPRINT = resolve_client_fingerprint()
+CLIENT_VERSION = _FINGERPRINT["client_version"]
+OS_CATEGORY = _FINGERPRINT["os_category"]
+OS_NAME = _FINGERPRINT["os_name"]
+OS_VERSION = _FINGERPRINT["os_version"]
 
 # Protobuf field names for text detection
 TEXT_FIELD_NAMES = ("text", "prompt", "query", "content", "message", "input")
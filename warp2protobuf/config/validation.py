@@ -0,0 +1,356 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Startup configuration validation
+
+Checks the effective configuration (environment, .env and config file) once,
+before any value is used, and reports every problem at the same time instead of
+crashing on the first int() conversion or failing at request time.
+
+Value problems (unparsable numbers, out-of-range ports, bad URLs, unknown
+choices) are errors everywhere; role checks for the bridge / OpenAI server add
+missing-credential and conflicting-option checks at process startup.
+"""
+import os
+import pathlib
+import socket
+import sys
+from typing import Callable, Dict, List, Optional, Tuple
+from urllib.parse import urlparse
+
+# (env, parser, minimum, maximum, default)
+_NUMERIC: List[Tuple[str, Callable[[str], float], Optional[float], Optional[float], str]] = [
+    ("PORT", int, 1, 65535, "8002"),
+    ("BRIDGE_SOCKET_MODE", lambda v: int(v, 8), 0, 0o777, "600"),
+    ("OPENAI_SOCKET_MODE", lambda v: int(v, 8), 0, 0o777, "600"),
+    ("WARP_HTTP_MAX_CONNECTIONS", int, 1, None, "100"),
+    ("WARP_HTTP_MAX_KEEPALIVE", int, 0, None, "20"),
+    ("WARP_HTTP_KEEPALIVE_EXPIRY", float, 0, None, "300"),
+    ("WARP_HTTP_TIMEOUT", float, 0.1, None, "60"),
+    ("WARP_STREAM_READ_TIMEOUT", float, 0, None, "600"),
+    ("MOCK_UPSTREAM_LATENCY_MS", float, 0, None, "0"),
+    ("MOCK_UPSTREAM_CHUNK_DELAY_MS", float, 0, None, "20"),
+    ("MOCK_UPSTREAM_ERROR_EVERY", int, 0, None, "0"),
+    ("MOCK_UPSTREAM_ERROR_STATUS", int, 400, 599, "500"),
+    ("WARP_ADAPTIVE_CONCURRENCY", int, 0, None, "0"),
+    ("WARP_ADAPTIVE_CONCURRENCY_MIN", int, 1, None, "1"),
+    ("WARP_ADAPTIVE_LATENCY_TARGET", float, 0.1, None, "10"),
+    ("WARP_ADAPTIVE_QUEUE_TIMEOUT", float, 0, None, "30"),
+    ("WARP_ACCOUNT_COOLDOWN", float, 0, None, "3600"),
+    ("WARP_TOKEN_STORE_LOCK_TIMEOUT", float, 1, None, "30"),
+    ("PACKET_HISTORY_MAX", int, 1, None, "500"),
+    ("PACKET_STORE_MAX_ROWS", int, 0, None, "10000"),
+    ("PACKET_STORE_MAX_AGE_HOURS", float, 0, None, "72"),
+    ("OPENAI_MAX_CHOICES", int, 1, 16, "4"),
+    ("HTTP_REQUEST_TIMEOUT", float, 0, None, "30"),
+    ("COMPLETION_TIMEOUT", float, 0, None, "600"),
+    ("SSE_HEARTBEAT_INTERVAL", float, 0, None, "15"),
+    ("SSE_FLUSH_INTERVAL_MS", float, 0, 1000, "20"),
+    ("SSE_FLUSH_BYTES", int, 1, None, "4096"),
+    ("SSE_WRITE_TIMEOUT", float, 0, None, "30"),
+    ("TLS_ACME_HTTP_PORT", int, 1, 65535, "80"),
+    ("HTTP_COMPRESSION_MIN_SIZE", int, 0, None, "1024"),
+    ("RATE_LIMIT_RPS", float, 0, None, "0"),
+    ("RATE_LIMIT_BURST", int, 1, None, "10"),
+    ("RATE_LIMIT_MAX_KEYS", int, 1, None, "10000"),
+    ("MAX_INFLIGHT_REQUESTS", int, 0, None, "0"),
+    ("INFLIGHT_QUEUE_SIZE", int, 0, None, "16"),
+    ("INFLIGHT_QUEUE_TIMEOUT", float, 0, None, "2"),
+    ("UPSTREAM_QUEUE_SIZE", int, 0, None, "0"),
+    ("UPSTREAM_QUEUE_TIMEOUT", float, 0, None, "60"),
+    ("UPSTREAM_RATE_LIMIT_BACKOFF", float, 0, None, "5"),
+    ("UPSTREAM_QUEUE_DRAIN_INTERVAL", float, 0, None, "0.5"),
+    ("SHUTDOWN_GRACE_PERIOD", float, 0, None, "60"),
+    ("AUDIT_RETENTION_DAYS", float, 0, None, "90"),
+    ("CONVERSATION_RETENTION_DAYS", float, 0, None, "30"),
+    ("CONVERSATION_CONTEXT_MAX_MESSAGES", int, 0, None, "200"),
+    ("CONTEXT_WINDOW_TOKENS", int, 0, None, "0"),
+    ("CONTEXT_RESERVE_TOKENS", int, 0, None, "4096"),
+    ("POST_PROCESS_WINDOW", int, 0, None, "256"),
+    ("SCRIPT_HOOK_TIMEOUT_MS", float, 1, None, "50"),
+    ("SCRIPT_HOOK_MEMORY_MB", float, 0, None, "32"),
+    ("MEMORY_LIMIT_MB", float, 0, None, "0"),
+    ("MEMORY_CHECK_INTERVAL", float, 0, None, "10"),
+    ("RESPONSE_CACHE_TTL", float, 0, None, "0"),
+    ("RESPONSE_CACHE_MAX_ENTRIES", int, 0, None, "1000"),
+    ("RESPONSE_CACHE_MAX_MB", float, 0, None, "64"),
+    ("MODELS_CACHE_TTL", float, 0, None, "0"),
+    ("MODELS_CACHE_STALE", float, 0, None, "600"),
+    ("LOG_MAX_SIZE_MB", float, 0, None, "10"),
+    ("LOG_ROTATE_HOURS", float, 0, None, "0"),
+    ("LOG_MAX_BACKUPS", int, 0, None, "5"),
+    ("LOG_MAX_AGE_DAYS", float, 0, None, "14"),
+    ("LOG_TAIL_BUFFER", int, 0, 100000, "1000"),
+    ("ALERT_INTERVAL", float, 0, None, "60"),
+    ("ALERT_FOR_MINUTES", float, 0, None, "5"),
+    ("ALERT_COOLDOWN_MINUTES", float, 0, None, "30"),
+    ("ALERT_ERROR_RATE_PCT", float, 0, 100, "0"),
+    ("ALERT_P99_LATENCY_MS", float, 0, None, "0"),
+    ("ALERT_MIN_AVAILABLE_ACCOUNTS", int, 0, None, "0"),
+    ("WARP_COMPAT_INIT_RETRIES", int, 1, None, "10"),
+    ("WARP_COMPAT_INIT_DELAY", float, 0, None, "0.5"),
+    ("WARP_COMPAT_WARMUP_RETRIES", int, 0, None, "3"),
+    ("WARP_COMPAT_WARMUP_DELAY", float, 0, None, "1.5"),
+]
+
+_CHOICES = {
+    "WARP_BRIDGE_TRANSPORT": ("http", "inprocess"),
+    "SSE_STREAMING": ("auto", "off"),
+    "HTTP_COMPRESSION": ("gzip", "br", "off"),
+    "ACCESS_LOG": ("json", "text", "off"),
+    "RATE_LIMIT_BY": ("ip", "key", "both"),
+    "WARP_FINGERPRINT": ("auto", "static"),
+    "RESPONSE_CACHE_BACKEND": ("memory", "redis"),
+    "CONTEXT_STRATEGY": ("off", "drop_oldest", "summarize_oldest", "error"),
+    "SYSTEM_PROMPT_MODE": ("prepend", "append", "replace"),
+    "CASSETTE_MODE": ("off", "record", "replay"),
+}
+
+_URLS = ("WARP_BRIDGE_URL", "HTTP_PROXY", "HTTPS_PROXY", "TLS_ACME_DIRECTORY", "ALERT_WEBHOOK_URL")
+
+
+class ConfigValidationError(ValueError):
+    def __init__(self, problems: List[str]):
+        self.problems = problems
+        super().__init__("配置无效:\n" + "\n".join(f"  - {p}" for p in problems))
+
+
+def _env(name: str) -> str:
+    return os.getenv(name, "").strip()
+
+
+def parse_model_ttls(raw: str) -> Dict[str, float]:
+    """"model=seconds,model=seconds" -> {model: seconds}; raises ValueError on a malformed entry."""
+    ttls: Dict[str, float] = {}
+    for item in (part.strip() for part in (raw or "").split(",")):
+        if not item:
+            continue
+        model, sep, value = item.rpartition("=")
+        try:
+            ttl = float(value)
+        except ValueError:
+            ttl = -1.0
+        if not sep or not model.strip() or ttl < 0:
+            raise ValueError(f"无效的条目 {item!r}，应形如 model=seconds")
+        ttls[model.strip()] = ttl
+    return ttls
+
+
+def validate_values() -> List[str]:
+    """Format/range problems in any known setting; these would otherwise crash at import."""
+    errors: List[str] = []
+    for name, parse, lo, hi, _default in _NUMERIC:
+        raw = _env(name)
+        if not raw:
+            continue
+        try:
+            value = parse(raw)
+        except ValueError:
+            hint = "八进制权限，例如 600" if name.endswith("_SOCKET_MODE") else ("整数" if parse is int else "数字")
+            errors.append(f"{name}={raw!r} 无法解析，应为{hint}")
+            continue
+        if (lo is not None and value < lo) or (hi is not None and value > hi):
+            bounds = f"{lo if lo is not None else '-∞'} ~ {hi if hi is not None else '∞'}"
+            if name.endswith("_SOCKET_MODE"):
+                bounds = "000 ~ 777"
+            errors.append(f"{name}={raw} 超出范围 ({bounds})")
+    for name, allowed in _CHOICES.items():
+        raw = _env(name).lower()
+        if raw and raw not in allowed:
+            errors.append(f"{name}={raw!r} 无效，可选值: {' | '.join(allowed)}")
+    pii_types = {t.strip() for t in _env("PII_SCRUB_TYPES").split(",") if t.strip()}
+    if pii_types - {"email", "phone", "api_key"}:
+        errors.append(f"PII_SCRUB_TYPES 包含未知类型: {', '.join(sorted(pii_types - {'email', 'phone', 'api_key'}))}（可选 email / phone / api_key）")
+    for name in _URLS:
+        raw = _env(name)
+        if not raw:
+            continue
+        parsed = urlparse(raw)
+        if parsed.scheme not in ("http", "https", "socks5", "socks5h") or not parsed.hostname:
+            errors.append(f"{name}={raw!r} 不是有效的URL，应形如 http://host:port")
+            continue
+        try:
+            parsed.port
+        except ValueError:
+            errors.append(f"{name}={raw!r} 端口无效")
+    from ..core.listeners import parse_listen_spec, split_listen_specs
+    for raw in split_listen_specs(_env("OPENAI_LISTEN")):
+        try:
+            parse_listen_spec(raw)
+        except ValueError as e:
+            errors.append(f"OPENAI_LISTEN: {e}")
+    try:
+        parse_model_ttls(_env("RESPONSE_CACHE_MODEL_TTLS"))
+    except ValueError as e:
+        errors.append(f"RESPONSE_CACHE_MODEL_TTLS: {e}")
+    from ..api.client_ip import parse_trusted_proxies
+    try:
+        parse_trusted_proxies(_env("TRUSTED_PROXIES"))
+    except ValueError as e:
+        errors.append(str(e))
+    return errors
+
+
+def ensure_valid_values() -> None:
+    errors = validate_values()
+    if errors:
+        raise ConfigValidationError(errors)
+
+
+def _num(name: str) -> float:
+    for env, parse, _lo, _hi, default in _NUMERIC:
+        if env == name:
+            return parse(_env(name) or default)
+    raise KeyError(name)
+
+
+def validate_config(role: str) -> Tuple[List[str], List[str]]:
+    """Full startup check for `role` ("bridge" or "openai"); returns (errors, warnings)."""
+    errors = validate_values()
+    warnings: List[str] = []
+    if errors:
+        # 数值本身无效时，下面依赖这些值的组合检查没有意义
+        return errors, warnings
+
+    if _num("WARP_HTTP_MAX_KEEPALIVE") > _num("WARP_HTTP_MAX_CONNECTIONS"):
+        errors.append("WARP_HTTP_MAX_KEEPALIVE 不能大于 WARP_HTTP_MAX_CONNECTIONS")
+
+    from ..core.tracing import tracing_configured
+    if tracing_configured():
+        try:
+            import opentelemetry.sdk  # noqa: F401
+            import opentelemetry.exporter.otlp.proto.http  # noqa: F401
+        except ImportError:
+            warnings.append("已设置 OTEL_EXPORTER_OTLP_ENDPOINT，但未安装 opentelemetry-sdk / opentelemetry-exporter-otlp-proto-http，追踪不会启用")
+
+    if role == "bridge":
+        from .config_file import get_config_section
+        accounts = get_config_section("accounts") or []
+        if accounts:
+            if not any(a.get("enabled", True) for a in accounts):
+                errors.append("配置文件 accounts 中的账号全部被禁用")
+            elif _env("WARP_REFRESH_TOKEN"):
+                warnings.append("已配置 accounts 账号池，WARP_REFRESH_TOKEN 仅在账号池无可用账号时使用")
+        elif not _env("WARP_JWT") and not _env("WARP_REFRESH_TOKEN"):
+            warnings.append("未设置 WARP_REFRESH_TOKEN / WARP_JWT（或配置文件 accounts），将使用匿名token（额度有限）")
+        descset = _env("WARP_DESCRIPTOR_SET")
+        if descset and not pathlib.Path(descset).is_file():
+            errors.append(f"WARP_DESCRIPTOR_SET 指向的文件不存在: {descset}")
+        store = _env("PACKET_STORE_PATH")
+        if store and not pathlib.Path(store).expanduser().resolve().parent.is_dir():
+            errors.append(f"PACKET_STORE_PATH 所在目录不存在: {store}")
+        token_store = _env("WARP_TOKEN_STORE")
+        if token_store.startswith(("redis://", "rediss://")):
+            try:
+                import redis  # noqa: F401
+            except ImportError:
+                errors.append("WARP_TOKEN_STORE 使用 Redis 需要 redis (pip install redis)")
+        elif token_store and not pathlib.Path(token_store).expanduser().resolve().parent.is_dir():
+            errors.append(f"WARP_TOKEN_STORE 所在目录不存在: {token_store}")
+        sock = _env("BRIDGE_SOCKET")
+        if sock and not pathlib.Path(sock).expanduser().resolve().parent.is_dir():
+            errors.append(f"BRIDGE_SOCKET 所在目录不存在: {sock}")
+        mock = _env("MOCK_UPSTREAM").lower() in ("1", "true", "yes")
+        if mock:
+            warnings.append("MOCK_UPSTREAM 已开启，请求不会发送到 Warp，返回的是模拟响应")
+        cassette_mode = _env("CASSETTE_MODE").lower() or "off"
+        cassette_dir = pathlib.Path(_env("CASSETTE_DIR") or "cassettes").expanduser()
+        if cassette_mode != "off" and mock:
+            warnings.append("MOCK_UPSTREAM 已开启，CASSETTE_MODE 不会生效")
+        elif cassette_mode == "replay" and not cassette_dir.is_dir():
+            errors.append(f"CASSETTE_MODE=replay 但 CASSETTE_DIR 不存在: {cassette_dir}")
+        elif cassette_mode == "record" and not cassette_dir.resolve().parent.is_dir():
+            errors.append(f"CASSETTE_DIR 所在目录不存在: {cassette_dir}")
+        if os.getenv("WARP_INSECURE_TLS", "").lower() in ("1", "true", "yes"):
+            warnings.append("WARP_INSECURE_TLS 已开启，上游TLS证书不会被校验")
+
+    if role == "openai":
+        from .config_file import get_config_section
+        if not _env("API_TOKEN") and not (get_config_section("keys") or []):
+            errors.append("未设置 API_TOKEN（或配置文件 keys），所有请求都会被拒绝；请在 .env 中设置 API_TOKEN")
+        elif _env("API_TOKEN") in ("001", "0000"):
+            warnings.append("API_TOKEN 仍为示例值，对外暴露服务前请更换")
+        from ..core.listeners import parse_listen_spec, split_listen_specs
+        listen = [parse_listen_spec(raw) for raw in split_listen_specs(_env("OPENAI_LISTEN"))]
+        seen = set()
+        for spec in listen:
+            if spec.describe() in seen:
+                errors.append(f"OPENAI_LISTEN 中的地址重复: {spec.raw}")
+            seen.add(spec.describe())
+            if spec.is_unix and not pathlib.Path(spec.path).expanduser().resolve().parent.is_dir():
+                errors.append(f"OPENAI_LISTEN 中的socket所在目录不存在: {spec.path}")
+        log_file = _env("LOG_FILE")
+        if log_file and not pathlib.Path(log_file).expanduser().resolve().parent.is_dir():
+            errors.append(f"LOG_FILE 所在目录不存在: {log_file}")
+        audit = _env("AUDIT_LOG_PATH")
+        if audit and not pathlib.Path(audit).expanduser().resolve().parent.is_dir():
+            errors.append(f"AUDIT_LOG_PATH 所在目录不存在: {audit}")
+        conversations = _env("CONVERSATION_STORE_PATH")
+        if conversations and conversations != ":memory:" and not pathlib.Path(conversations).expanduser().resolve().parent.is_dir():
+            errors.append(f"CONVERSATION_STORE_PATH 所在目录不存在: {conversations}")
+        if _env("RESPONSE_CACHE_BACKEND").lower() == "redis":
+            try:
+                import redis  # noqa: F401
+            except ImportError:
+                errors.append("RESPONSE_CACHE_BACKEND=redis 需要 redis (pip install redis)")
+            redis_url = urlparse(_env("RESPONSE_CACHE_REDIS_URL") or "redis://127.0.0.1:6379/0")
+            if redis_url.scheme not in ("redis", "rediss", "unix"):
+                errors.append(f"RESPONSE_CACHE_REDIS_URL={redis_url.geturl()!r} 无效，应形如 redis://host:6379/0")
+            if _env("RESPONSE_CACHE_SNAPSHOT"):
+                warnings.append("RESPONSE_CACHE_BACKEND=redis 时 RESPONSE_CACHE_SNAPSHOT 不会被使用（缓存由 Redis 保存）")
+        snapshot = _env("RESPONSE_CACHE_SNAPSHOT")
+        if snapshot and not pathlib.Path(snapshot).expanduser().resolve().parent.is_dir():
+            errors.append(f"RESPONSE_CACHE_SNAPSHOT 所在目录不存在: {snapshot}")
+        if _env("DEBUG_PROFILING").lower() in ("1", "true", "yes"):
+            if not _env("ADMIN_TOKEN"):
+                errors.append("DEBUG_PROFILING 需要同时设置 ADMIN_TOKEN（/debug/pprof 只接受管理员token）")
+            else:
+                warnings.append("DEBUG_PROFILING 已开启，/debug/pprof 可用于采集 CPU / 内存剖析")
+        if _env("ADMIN_TOKEN") and _env("ADMIN_TOKEN") == _env("API_TOKEN"):
+            warnings.append("ADMIN_TOKEN 与 API_TOKEN 相同，API 调用方也能访问管理端点")
+        if not _env("ADMIN_TOKEN"):
+            warnings.append("未设置 ADMIN_TOKEN，/admin 管理端点已禁用（返回 404）")
+        if _env("REUSE_PORT").lower() in ("1", "true", "yes") and not hasattr(socket, "SO_REUSEPORT"):
+            errors.append("REUSE_PORT 已开启，但当前平台不支持 SO_REUSEPORT")
+        cert, key = _env("TLS_CERT_FILE"), _env("TLS_KEY_FILE")
+        if bool(cert) != bool(key):
+            errors.append("TLS_CERT_FILE 与 TLS_KEY_FILE 必须同时设置")
+        for name, path in (("TLS_CERT_FILE", cert), ("TLS_KEY_FILE", key)):
+            if path and not pathlib.Path(path).expanduser().is_file():
+                errors.append(f"{name} 指向的文件不存在: {path}")
+        if _env("TLS_ACME_DOMAIN"):
+            if cert and key:
+                warnings.append("已设置 TLS_CERT_FILE / TLS_KEY_FILE，TLS_ACME_DOMAIN 不会被使用")
+            else:
+                try:
+                    import cryptography  # noqa: F401
+                except ImportError:
+                    errors.append("TLS_ACME_DOMAIN 需要 cryptography (pip install cryptography)")
+                if not _env("TLS_ACME_EMAIL"):
+                    warnings.append("未设置 TLS_ACME_EMAIL，证书到期提醒将无法送达")
+        transport = _env("WARP_BRIDGE_TRANSPORT").lower() or "http"
+        if transport == "inprocess" and _env("BRIDGE_SOCKET"):
+            warnings.append("WARP_BRIDGE_TRANSPORT=inprocess 时 BRIDGE_SOCKET 不会被使用")
+        if transport == "inprocess" and _env("BRIDGE_TOKEN"):
+            warnings.append("WARP_BRIDGE_TRANSPORT=inprocess 时 BRIDGE_TOKEN 不会被使用")
+        request_timeout = _num("HTTP_REQUEST_TIMEOUT")
+        completion_timeout = _num("COMPLETION_TIMEOUT")
+        if request_timeout and completion_timeout and completion_timeout < request_timeout:
+            warnings.append("COMPLETION_TIMEOUT 小于 HTTP_REQUEST_TIMEOUT，非流式对话会比普通接口更早超时")
+        heartbeat = _num("SSE_HEARTBEAT_INTERVAL")
+        write_timeout = _num("SSE_WRITE_TIMEOUT")
+        if write_timeout and heartbeat and write_timeout < heartbeat:
+            warnings.append("SSE_WRITE_TIMEOUT 小于 SSE_HEARTBEAT_INTERVAL，空闲流上的心跳无法及时发现阻塞的客户端")
+    return errors, warnings
+
+
+def check_config_or_exit(role: str) -> None:
+    """Print every problem at once; exit with status 2 when there are errors."""
+    errors, warnings = validate_config(role)
+    for w in warnings:
+        print(f"⚠️  配置警告: {w}", file=sys.stderr)
+    if errors:
+        print(f"❌ 配置检查失败（{len(errors)} 个问题）:", file=sys.stderr)
+        for e in errors:
+            print(f"   - {e}", file=sys.stderr)
+        raise SystemExit(2)
@@ -0,0 +1,249 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Warp account pool
+
+Built from the config file's `accounts:` section. Each request picks an enabled
+account by weight; its access token is refreshed on demand and kept in memory
+(per account, never written to .env; shared with other instances through
+WARP_TOKEN_STORE when set, see token_store). An account whose quota is exhausted is
+parked for WARP_ACCOUNT_COOLDOWN seconds and the next account is used instead.
+
+Without an `accounts:` section the pool is not used and authentication falls
+back to the single WARP_REFRESH_TOKEN / WARP_JWT flow in auth.py.
+
+Each account keeps usage counters since start (requests, tokens Warp reported,
+last upstream error), attributed through the request's `account` field, for
+/api/accounts/usage.
+"""
+import asyncio
+import os
+import random
+import time
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Optional, Sequence
+
+from ..config.config_file import get_config_section
+from .logging import logger
+from .request_context import request_fields
+from .token_store import refresh_shared
+
+
+@dataclass
+class WarpAccount:
+    label: str
+    refresh_token: str
+    email: Optional[str] = None
+    weight: float = 1.0
+    enabled: bool = True
+    jwt: Optional[str] = field(default=None, repr=False)
+    cooldown_until: float = 0.0
+    requests: int = 0
+    failures: int = 0
+    prompt_tokens: int = 0
+    completion_tokens: int = 0
+    last_used: float = 0.0
+    last_error: Optional[str] = None
+    last_error_at: float = 0.0
+
+    def available(self, now: float) -> bool:
+        return self.enabled and self.cooldown_until <= now
+
+    def note_error(self, message: str) -> None:
+        self.last_error = message[:300]
+        self.last_error_at = time.time()
+
+
+class AccountPool:
+    def __init__(self, accounts: List[WarpAccount], cooldown: float = 3600.0):
+        self.accounts = accounts
+        self.cooldown = cooldown
+        self._lock = asyncio.Lock()
+
+    def pick(self, exclude: Sequence[WarpAccount] = ()) -> Optional[WarpAccount]:
+        now = time.time()
+        candidates = [a for a in self.accounts if a.available(now) and a not in exclude]
+        if not candidates:
+            return None
+        return random.choices(candidates, weights=[a.weight for a in candidates])[0]
+
+    def find_by_label(self, label: Optional[str]) -> Optional[WarpAccount]:
+        for account in self.accounts:
+            if label and account.label == label:
+                return account
+        return None
+
+    def find_by_jwt(self, jwt: Optional[str]) -> Optional[WarpAccount]:
+        for account in self.accounts:
+            if jwt and account.jwt == jwt:
+                return account
+        return None
+
+    async def access_token(self, account: WarpAccount) -> Optional[str]:
+        from .auth import is_token_expired, refresh_jwt_token
+        async with self._lock:
+            if account.jwt and not is_token_expired(account.jwt, buffer_minutes=2):
+                return account.jwt
+            token_data = await refresh_shared(
+                f"account:{account.label}", account.refresh_token, refresh_jwt_token,
+                lambda jwt: not is_token_expired(jwt, buffer_minutes=2),
+            )
+            access = (token_data or {}).get("access_token")
+            if not access:
+                account.failures += 1
+                account.note_error("access token refresh failed")
+                logger.error(f"账号 {account.label} 刷新 access token 失败")
+                return None
+            account.jwt = access
+            return access
+
+    async def get_jwt(self, exclude: Optional[WarpAccount] = None) -> Optional[str]:
+        """Access token of the next usable account; accounts that fail to refresh are skipped."""
+        tried: List[WarpAccount] = [exclude] if exclude is not None else []
+        while True:
+            account = self.pick(tried)
+            if account is None:
+                return None
+            tried.append(account)
+            jwt = await self.access_token(account)
+            if jwt:
+                account.requests += 1
+                account.last_used = time.time()
+                request_fields()["account"] = account.label
+                return jwt
+
+    async def rotate_after_quota_exhausted(self, jwt: Optional[str]) -> Optional[str]:
+        """Park the account that issued `jwt` and return a token from another account, if any."""
+        account = self.find_by_jwt(jwt)
+        if account is not None:
+            account.cooldown_until = time.time() + self.cooldown
+            account.failures += 1
+            account.note_error("quota exhausted (HTTP 429)")
+            logger.warning(f"账号 {account.label} 配额用尽，暂停使用 {self.cooldown:.0f} 秒")
+        return await self.get_jwt(exclude=account)
+
+    def update(self, label: str, enabled: Optional[bool] = None, weight: Optional[float] = None,
+               reset_cooldown: bool = False) -> Optional[Dict[str, Any]]:
+        """Change an account at runtime (not written back to the config file); None if no such label."""
+        account = self.find_by_label(label)
+        if account is None:
+            return None
+        if enabled is not None:
+            account.enabled = enabled
+        if weight is not None:
+            account.weight = weight
+        if reset_cooldown:
+            account.cooldown_until = 0.0
+        logger.info(f"账号 {label} 已更新: enabled={account.enabled} weight={account.weight}")
+        return next(a for a in self.status() if a["label"] == label)
+
+    def status(self) -> List[Dict[str, Any]]:
+        now = time.time()
+        return [
+            {
+                "label": a.label,
+                "email": a.email,
+                "weight": a.weight,
+                "enabled": a.enabled,
+                "available": a.available(now),
+                "cooldown_remaining": max(0, int(a.cooldown_until - now)),
+                "requests": a.requests,
+                "failures": a.failures,
+            }
+            for a in self.accounts
+        ]
+
+    def usage(self) -> List[Dict[str, Any]]:
+        """Per-account usage since start, busiest first."""
+        now = time.time()
+        total_requests = sum(a.requests for a in self.accounts) or 1
+        rows = [
+            {
+                "label": a.label,
+                "email": a.email,
+                "enabled": a.enabled,
+                "available": a.available(now),
+                "cooldown_remaining": max(0, int(a.cooldown_until - now)),
+                "requests": a.requests,
+                "request_share": round(a.requests / total_requests, 3),
+                "prompt_tokens": a.prompt_tokens,
+                "completion_tokens": a.completion_tokens,
+                "total_tokens": a.prompt_tokens + a.completion_tokens,
+                "failures": a.failures,
+                "last_used": _iso(a.last_used),
+                "last_error": a.last_error,
+                "last_error_at": _iso(a.last_error_at),
+            }
+            for a in self.accounts
+        ]
+        return sorted(rows, key=lambda row: row["requests"], reverse=True)
+
+
+def _iso(ts: float) -> Optional[str]:
+    return datetime.fromtimestamp(ts, timezone.utc).isoformat(timespec="seconds") if ts else None
+
+
+def current_account() -> Optional[WarpAccount]:
+    """Pooled account serving the current request (None without a pool or before a token was issued)."""
+    pool = get_account_pool()
+    if pool is None:
+        return None
+    return pool.find_by_label(request_fields().get("account"))
+
+
+def note_account_usage(usage: Optional[Dict[str, Any]]) -> None:
+    account = current_account()
+    if account is None or not isinstance(usage, dict):
+        return
+    account.prompt_tokens += int(usage.get("prompt_tokens") or 0)
+    account.completion_tokens += int(usage.get("completion_tokens") or 0)
+
+
+def note_account_error(message: str) -> None:
+    account = current_account()
+    if account is not None:
+        account.note_error(message)
+
+
+_pool: Optional[AccountPool] = None
+_pool_built = False
+
+
+def get_account_pool() -> Optional[AccountPool]:
+    """The configured pool, or None when the config file has no accounts."""
+    global _pool, _pool_built
+    if not _pool_built:
+        _pool_built = True
+        accounts = [
+            WarpAccount(
+                label=str(item.get("label") or item.get("email") or f"account-{i + 1}"),
+                refresh_token=item["refresh_token"],
+                email=item.get("email"),
+                weight=float(item.get("weight", 1)),
+                enabled=bool(item.get("enabled", True)),
+            )
+            for i, item in enumerate(get_config_section("accounts", []) or [])
+        ]
+        if accounts:
+            cooldown = float(os.getenv("WARP_ACCOUNT_COOLDOWN", "3600"))
+            _pool = AccountPool(accounts, cooldown=cooldown)
+            enabled = sum(1 for a in accounts if a.enabled)
+            logger.info(f"账号池: {len(accounts)} 个账号（{enabled} 个启用）")
+    return _pool
+
+
+def update_pooled_account(label: str, changes: Dict[str, Any]) -> Dict[str, Any]:
+    """Validate and apply {enabled, weight, reset_cooldown}; LookupError / ValueError on bad input."""
+    pool = get_account_pool()
+    if pool is None:
+        raise LookupError("未配置账号池（accounts）")
+    enabled, weight = changes.get("enabled"), changes.get("weight")
+    if enabled is not None and not isinstance(enabled, bool):
+        raise ValueError("enabled 必须是布尔值")
+    if weight is not None and (isinstance(weight, bool) or not isinstance(weight, (int, float)) or weight <= 0):
+        raise ValueError("weight 必须是正数")
+    account = pool.update(label, enabled=enabled, weight=weight, reset_cooldown=bool(changes.get("reset_cooldown")))
+    if account is None:
+        raise LookupError(f"账号不存在: {label}")
+    return account
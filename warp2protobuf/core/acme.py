@@ -0,0 +1,234 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Minimal ACME v2 client (RFC 8555) for automatic certificates
+
+Obtains a certificate for one hostname with the http-01 challenge: a temporary
+HTTP listener (port 80 by default) answers /.well-known/acme-challenge/ while
+the order is validated. Account key, certificate and key are cached in
+TLS_ACME_CACHE and reused until they are within RENEW_BEFORE_DAYS of expiry;
+a running server re-checks periodically and swaps in the renewed certificate
+(listeners.start_certificate_renewal).
+
+Requires the optional `cryptography` package.
+"""
+import base64
+import hashlib
+import json
+import os
+import pathlib
+import threading
+import time
+from datetime import datetime, timedelta, timezone
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from typing import Any, Dict, Optional, Tuple
+
+import httpx
+
+from .logging import logger
+
+LETS_ENCRYPT_DIRECTORY = "https://acme-v02.api.letsencrypt.org/directory"
+RENEW_BEFORE_DAYS = 30
+_CHALLENGE_PREFIX = "/.well-known/acme-challenge/"
+
+
+class ACMEError(RuntimeError):
+    pass
+
+
+def _b64(data: bytes) -> str:
+    return base64.urlsafe_b64encode(data).rstrip(b"=").decode("ascii")
+
+
+def _crypto():
+    try:
+        from cryptography import x509
+        from cryptography.hazmat.primitives import hashes, serialization
+        from cryptography.hazmat.primitives.asymmetric import ec, utils
+        from cryptography.x509.oid import NameOID
+    except ImportError:
+        raise ACMEError("自动申请证书需要 cryptography (pip install cryptography)")
+    return x509, hashes, serialization, ec, utils, NameOID
+
+
+def _load_or_create_key(path: pathlib.Path) -> Any:
+    _x509, _hashes, serialization, ec, _utils, _oid = _crypto()
+    if path.is_file():
+        return serialization.load_pem_private_key(path.read_bytes(), password=None)
+    key = ec.generate_private_key(ec.SECP256R1())
+    path.write_bytes(key.private_bytes(
+        serialization.Encoding.PEM, serialization.PrivateFormat.PKCS8, serialization.NoEncryption()
+    ))
+    os.chmod(path, 0o600)
+    return key
+
+
+def certificate_expiry(cert_path: pathlib.Path) -> Optional[datetime]:
+    if not cert_path.is_file():
+        return None
+    x509 = _crypto()[0]
+    try:
+        return x509.load_pem_x509_certificate(cert_path.read_bytes()).not_valid_after_utc
+    except Exception:
+        return None
+
+
+class _ChallengeHandler(BaseHTTPRequestHandler):
+    tokens: Dict[str, str] = {}
+
+    def do_GET(self) -> None:
+        token = self.path[len(_CHALLENGE_PREFIX):] if self.path.startswith(_CHALLENGE_PREFIX) else ""
+        body = self.tokens.get(token)
+        if body is None:
+            self.send_response(404)
+            self.end_headers()
+            return
+        self.send_response(200)
+        self.send_header("Content-Type", "application/octet-stream")
+        self.end_headers()
+        self.wfile.write(body.encode("ascii"))
+
+    def log_message(self, format: str, *args: Any) -> None:
+        logger.debug("ACME challenge server: " + format % args)
+
+
+class ACMEClient:
+    def __init__(self, directory_url: str, account_key: Any):
+        self.account_key = account_key
+        self.http = httpx.Client(timeout=30.0, trust_env=True)
+        self.directory = self._get_json(directory_url)
+        self.kid: Optional[str] = None
+        self._nonce: Optional[str] = None
+
+    def _get_json(self, url: str) -> Dict[str, Any]:
+        resp = self.http.get(url)
+        if resp.status_code != 200:
+            raise ACMEError(f"ACME directory 请求失败: HTTP {resp.status_code}")
+        return resp.json()
+
+    def _jwk(self) -> Dict[str, str]:
+        numbers = self.account_key.public_key().public_numbers()
+        return {"crv": "P-256", "kty": "EC", "x": _b64(numbers.x.to_bytes(32, "big")), "y": _b64(numbers.y.to_bytes(32, "big"))}
+
+    def thumbprint(self) -> str:
+        canonical = json.dumps(self._jwk(), sort_keys=True, separators=(",", ":")).encode("utf-8")
+        return _b64(hashlib.sha256(canonical).digest())
+
+    def _new_nonce(self) -> str:
+        if self._nonce:
+            nonce, self._nonce = self._nonce, None
+            return nonce
+        return self.http.head(self.directory["newNonce"]).headers["Replay-Nonce"]
+
+    def post(self, url: str, payload: Optional[Dict[str, Any]]) -> httpx.Response:
+        """Signed POST; payload None is a POST-as-GET. Retries once on badNonce."""
+        _x509, hashes, _ser, ec, utils, _oid = _crypto()
+        for attempt in range(2):
+            protected: Dict[str, Any] = {"alg": "ES256", "nonce": self._new_nonce(), "url": url}
+            if self.kid:
+                protected["kid"] = self.kid
+            else:
+                protected["jwk"] = self._jwk()
+            protected_b64 = _b64(json.dumps(protected).encode("utf-8"))
+            payload_b64 = "" if payload is None else _b64(json.dumps(payload).encode("utf-8"))
+            der = self.account_key.sign(f"{protected_b64}.{payload_b64}".encode("ascii"), ec.ECDSA(hashes.SHA256()))
+            r, s = utils.decode_dss_signature(der)
+            body = {"protected": protected_b64, "payload": payload_b64,
+                    "signature": _b64(r.to_bytes(32, "big") + s.to_bytes(32, "big"))}
+            resp = self.http.post(url, json=body, headers={"Content-Type": "application/jose+json"})
+            self._nonce = resp.headers.get("Replay-Nonce")
+            if resp.status_code < 400:
+                return resp
+            detail = resp.json() if resp.headers.get("content-type", "").startswith("application/problem+json") else {}
+            if detail.get("type") == "urn:ietf:params:acme:error:badNonce" and attempt == 0:
+                continue
+            raise ACMEError(f"ACME 请求失败 {url}: HTTP {resp.status_code} {detail.get('detail') or resp.text[:200]}")
+        raise ACMEError(f"ACME 请求失败 {url}")
+
+    def register(self, email: str) -> None:
+        payload: Dict[str, Any] = {"termsOfServiceAgreed": True}
+        if email:
+            payload["contact"] = [f"mailto:{email}"]
+        resp = self.post(self.directory["newAccount"], payload)
+        self.kid = resp.headers["Location"]
+
+    def poll(self, url: str, done: Tuple[str, ...], timeout: float = 120.0) -> Dict[str, Any]:
+        deadline = time.time() + timeout
+        while True:
+            obj = self.post(url, None).json()
+            status = obj.get("status")
+            if status in done:
+                return obj
+            if status == "invalid":
+                raise ACMEError(f"ACME 验证失败: {json.dumps(obj, ensure_ascii=False)[:500]}")
+            if time.time() > deadline:
+                raise ACMEError(f"ACME 等待状态 {done} 超时（当前 {status}）")
+            time.sleep(2)
+
+
+def _issue(domain: str, email: str, cache: pathlib.Path, directory_url: str, http_port: int) -> None:
+    x509, hashes, serialization, ec, _utils, NameOID = _crypto()
+    client = ACMEClient(directory_url, _load_or_create_key(cache / "account.key"))
+    client.register(email)
+    order_resp = client.post(client.directory["newOrder"], {"identifiers": [{"type": "dns", "value": domain}]})
+    order_url = order_resp.headers["Location"]
+    order = order_resp.json()
+
+    _ChallengeHandler.tokens = {}
+    server = ThreadingHTTPServer(("", http_port), _ChallengeHandler)
+    thread = threading.Thread(target=server.serve_forever, name="acme-http-01", daemon=True)
+    thread.start()
+    try:
+        for authz_url in order["authorizations"]:
+            authz = client.post(authz_url, None).json()
+            if authz.get("status") == "valid":
+                continue
+            challenge = next((c for c in authz.get("challenges", []) if c.get("type") == "http-01"), None)
+            if challenge is None:
+                raise ACMEError(f"{domain} 没有可用的 http-01 验证方式")
+            _ChallengeHandler.tokens[challenge["token"]] = f"{challenge['token']}.{client.thumbprint()}"
+            client.post(challenge["url"], {})
+            client.poll(authz_url, ("valid",))
+    finally:
+        server.shutdown()
+        server.server_close()
+
+    domain_key = ec.generate_private_key(ec.SECP256R1())
+    csr = (
+        x509.CertificateSigningRequestBuilder()
+        .subject_name(x509.Name([x509.NameAttribute(NameOID.COMMON_NAME, domain)]))
+        .add_extension(x509.SubjectAlternativeName([x509.DNSName(domain)]), critical=False)
+        .sign(domain_key, hashes.SHA256())
+    )
+    client.post(order["finalize"], {"csr": _b64(csr.public_bytes(serialization.Encoding.DER))})
+    order = client.poll(order_url, ("valid",))
+    chain = client.post(order["certificate"], None).text
+
+    key_path = cache / "key.pem"
+    key_path.write_bytes(domain_key.private_bytes(
+        serialization.Encoding.PEM, serialization.PrivateFormat.PKCS8, serialization.NoEncryption()
+    ))
+    os.chmod(key_path, 0o600)
+    (cache / "cert.pem").write_text(chain, encoding="utf-8")
+
+
+def ensure_certificate(domain: str, email: str, cache_dir: str, directory_url: str = LETS_ENCRYPT_DIRECTORY,
+                       http_port: int = 80) -> Tuple[str, str]:
+    """Return (cert, key) paths for `domain`, issuing or renewing through ACME when needed."""
+    cache = pathlib.Path(cache_dir).expanduser() / domain
+    cache.mkdir(parents=True, exist_ok=True, mode=0o700)
+    cert_path, key_path = cache / "cert.pem", cache / "key.pem"
+    expiry = certificate_expiry(cert_path)
+    if expiry and key_path.is_file() and expiry - datetime.now(timezone.utc) > timedelta(days=RENEW_BEFORE_DAYS):
+        logger.info(f"使用缓存的 {domain} 证书，有效期至 {expiry:%Y-%m-%d}")
+        return str(cert_path), str(key_path)
+    logger.info(f"通过 ACME 为 {domain} 申请证书（http-01，端口 {http_port}）…")
+    try:
+        _issue(domain, email, cache, directory_url, http_port)
+    except Exception as e:
+        if expiry and key_path.is_file() and expiry > datetime.now(timezone.utc):
+            logger.error(f"证书续期失败，继续使用有效期至 {expiry:%Y-%m-%d} 的旧证书: {e}")
+            return str(cert_path), str(key_path)
+        raise
+    logger.info(f"✅ 已获取 {domain} 证书: {cert_path}")
+    return str(cert_path), str(key_path)
@@ -11,12 +11,17 @@ import json
 import os
 import time
 from pathlib import Path
-import httpx
+from typing import Optional, Tuple
 import asyncio
 from dotenv import load_dotenv, set_key
 
-from ..config.settings import REFRESH_TOKEN_B64, REFRESH_URL, CLIENT_VERSION, OS_CATEGORY, OS_NAME, OS_VERSION
+from ..config.settings import REFRESH_TOKEN_B64, REFRESH_URL, CLIENT_VERSION, OS_CATEGORY, OS_NAME, OS_VERSION, OFFLINE_UPSTREAM
 from .logging import logger, log
+from .metrics import bridge_metrics
+from .account_pool import get_account_pool
+from .token_store import refresh_shared
+from .tracing import traced
+from ..warp.http_client import post_auxiliary
 
 
 def decode_jwt_payload(token: str) -> dict:
@@ -47,15 +52,16 @@ def is_token_expired(token: str, buffer_minutes: int = 5) -> bool:
     return (expiry_time - current_time) <= buffer_time
 
 
-async def refresh_jwt_token() -> dict:
+async def refresh_jwt_token(refresh_token: Optional[str] = None) -> dict:
     """Refresh the JWT token using the refresh token.
 
-    Prefers environment variable WARP_REFRESH_TOKEN when present; otherwise
-    falls back to the baked-in REFRESH_TOKEN_B64 payload.
+    Uses `refresh_token` when given (account pool), then environment variable
+    WARP_REFRESH_TOKEN; otherwise falls back to the baked-in REFRESH_TOKEN_B64 payload.
     """
     logger.info("Refreshing JWT token...")
+    bridge_metrics.inc("bridge_auth_refreshes_total")
     # Prefer dynamic refresh token from environment if present
-    env_refresh = os.getenv("WARP_REFRESH_TOKEN")
+    env_refresh = refresh_token or os.getenv("WARP_REFRESH_TOKEN")
     if env_refresh:
         payload = f"grant_type=refresh_token&refresh_token={env_refresh}".encode("utf-8")
     else:
@@ -71,22 +77,24 @@ async def refresh_jwt_token() -> dict:
         "content-length": str(len(payload))
     }
     try:
-        async with httpx.AsyncClient(timeout=30.0, trust_env=True) as client:
-            response = await client.post(
-                REFRESH_URL,
-                headers=headers,
-                content=payload
-            )
-            if response.status_code == 200:
-                token_data = response.json()
-                logger.info("Token refresh successful")
-                return token_data
-            else:
-                logger.error(f"Token refresh failed: {response.status_code}")
-                logger.error(f"Response: {response.text}")
-                return {}
+        response = await post_auxiliary(
+            REFRESH_URL,
+            headers=headers,
+            content=payload,
+            timeout=30.0,
+        )
+        if response.status_code == 200:
+            token_data = response.json()
+            logger.info("Token refresh successful")
+            return token_data
+        else:
+            logger.error(f"Token refresh failed: {response.status_code}")
+            logger.error(f"Response: {response.text}")
+            bridge_metrics.inc("bridge_auth_refresh_failures_total")
+            return {}
     except Exception as e:
         logger.error(f"Error refreshing token: {e}")
+        bridge_metrics.inc("bridge_auth_refresh_failures_total")
         return {}
 
 
@@ -112,18 +120,29 @@ def update_env_refresh_token(refresh_token: str) -> bool:
         return False
 
 
+async def _refresh_default_token() -> dict:
+    """Refresh the WARP_REFRESH_TOKEN credential, coordinated with other instances via WARP_TOKEN_STORE."""
+    return await refresh_shared(
+        "default", os.getenv("WARP_REFRESH_TOKEN") or None, refresh_jwt_token,
+        lambda jwt: not is_token_expired(jwt, buffer_minutes=15),
+    )
+
+
 async def check_and_refresh_token() -> bool:
+    if OFFLINE_UPSTREAM:
+        # 模拟上游 / 回放模式不校验token，也不把假token写入 .env
+        return True
     current_jwt = os.getenv("WARP_JWT")
     if not current_jwt:
         logger.warning("No JWT token found in environment")
-        token_data = await refresh_jwt_token()
+        token_data = await _refresh_default_token()
         if token_data and "access_token" in token_data:
             return update_env_file(token_data["access_token"])
         return False
     logger.debug("Checking current JWT token expiration...")
     if is_token_expired(current_jwt, buffer_minutes=15):
         logger.info("JWT token is expired or expiring soon, refreshing...")
-        token_data = await refresh_jwt_token()
+        token_data = await _refresh_default_token()
         if token_data and "access_token" in token_data:
             new_jwt = token_data["access_token"]
             if not is_token_expired(new_jwt, buffer_minutes=0):
@@ -147,7 +166,17 @@ async def check_and_refresh_token() -> bool:
         return True
 
 
+@traced("auth.warp_jwt")
 async def get_valid_jwt() -> str:
+    if OFFLINE_UPSTREAM:
+        from ..warp.mock_upstream import MOCK_JWT
+        return MOCK_JWT
+    pool = get_account_pool()
+    if pool is not None:
+        jwt = await pool.get_jwt()
+        if jwt:
+            return jwt
+        logger.warning("账号池中没有可用账号，回退到 WARP_JWT / WARP_REFRESH_TOKEN")
     from dotenv import load_dotenv as _load
     _load(override=True)
     jwt = os.getenv("WARP_JWT")
@@ -184,6 +213,37 @@ async def refresh_jwt_if_needed() -> bool:
         return False
 
 
+async def next_account_jwt(exhausted_jwt: Optional[str]) -> Optional[str]:
+    """After a quota 429: a token from another pooled account, or None (no pool / none left)."""
+    pool = get_account_pool()
+    if pool is None:
+        return None
+    return await pool.rotate_after_quota_exhausted(exhausted_jwt)
+
+
+def credential_status() -> Tuple[bool, str]:
+    """Whether a request could be authenticated upstream right now (for readiness probes)."""
+    if OFFLINE_UPSTREAM:
+        return True, "模拟上游 / cassette 回放模式，无需凭据"
+    refresh_token = os.getenv("WARP_REFRESH_TOKEN", "").strip()
+    jwt = os.getenv("WARP_JWT", "").strip()
+    pool = get_account_pool()
+    if pool is not None:
+        usable = sum(1 for a in pool.status() if a["available"])
+        if usable:
+            return True, f"账号池: {usable}/{len(pool.accounts)} 个账号可用"
+        if not (jwt or refresh_token):
+            return False, "账号池中没有可用账号（全部禁用或冷却中）"
+    if jwt and not is_token_expired(jwt, buffer_minutes=0):
+        return True, "WARP_JWT 有效"
+    if refresh_token:
+        return True, "可通过 WARP_REFRESH_TOKEN 刷新token"
+    if jwt:
+        return False, "WARP_JWT 已过期且未设置 WARP_REFRESH_TOKEN"
+    # 未配置任何凭据时按需申请匿名token
+    return True, "使用匿名token"
+
+
 # ============ Anonymous token acquisition (quota refresh) ============
 
 _ANON_GQL_URL = "https://app.warp.dev/graphql/v2?op=CreateAnonymousUser"
@@ -248,12 +308,11 @@ async def _create_anonymous_user() -> dict:
         }
     }
     body = {"query": query, "variables": variables, "operationName": "CreateAnonymousUser"}
-    async with httpx.AsyncClient(timeout=httpx.Timeout(30.0), trust_env=True) as client:
-        resp = await client.post(_ANON_GQL_URL, headers=headers, json=body)
-        if resp.status_code != 200:
-            raise RuntimeError(f"CreateAnonymousUser failed: HTTP {resp.status_code} {resp.text[:200]}")
-        data = resp.json()
-        return data
+    resp = await post_auxiliary(_ANON_GQL_URL, headers=headers, json=body, timeout=30.0)
+    if resp.status_code != 200:
+        raise RuntimeError(f"CreateAnonymousUser failed: HTTP {resp.status_code} {resp.text[:200]}")
+    data = resp.json()
+    return data
 
 
 async def _exchange_id_token_for_refresh_token(id_token: str) -> dict:
@@ -271,11 +330,10 @@ async def _exchange_id_token_for_refresh_token(id_token: str) -> dict:
         "returnSecureToken": "true",
         "token": id_token,
     }
-    async with httpx.AsyncClient(timeout=httpx.Timeout(30.0), trust_env=True) as client:
-        resp = await client.post(url, headers=headers, data=form)
-        if resp.status_code != 200:
-            raise RuntimeError(f"signInWithCustomToken failed: HTTP {resp.status_code} {resp.text[:200]}")
-        return resp.json()
+    resp = await post_auxiliary(url, headers=headers, data=form, timeout=30.0)
+    if resp.status_code != 200:
+        raise RuntimeError(f"signInWithCustomToken failed: HTTP {resp.status_code} {resp.text[:200]}")
+    return resp.json()
 
 
 async def acquire_anonymous_access_token() -> str:
@@ -284,6 +342,7 @@ async def acquire_anonymous_access_token() -> str:
     Returns the new access token string. Raises on failure.
     """
     logger.info("Acquiring anonymous access token via GraphQL + Identity Toolkit…")
+    bridge_metrics.inc("bridge_anonymous_tokens_total")
     data = await _create_anonymous_user()
     id_token = None
     try:
@@ -313,16 +372,15 @@ async def acquire_anonymous_access_token() -> str:
         "accept-encoding": "gzip, br",
         "content-length": str(len(payload))
     }
-    async with httpx.AsyncClient(timeout=httpx.Timeout(30.0), trust_env=True) as client:
-        resp = await client.post(REFRESH_URL, headers=headers, content=payload)
-        if resp.status_code != 200:
-            raise RuntimeError(f"Acquire access_token failed: HTTP {resp.status_code} {resp.text[:200]}")
-        token_data = resp.json()
-        access = token_data.get("access_token")
-        if not access:
-            raise RuntimeError(f"No access_token in response: {token_data}")
-        update_env_file(access)
-        return access
+    resp = await post_auxiliary(REFRESH_URL, headers=headers, content=payload, timeout=30.0)
+    if resp.status_code != 200:
+        raise RuntimeError(f"Acquire access_token failed: HTTP {resp.status_code} {resp.text[:200]}")
+    token_data = resp.json()
+    access = token_data.get("access_token")
+    if not access:
+        raise RuntimeError(f"No access_token in response: {token_data}")
+    update_env_file(access)
+    return access
 
 
 def print_token_info():
@@ -0,0 +1,85 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Adaptive batch processor for CPU-bound packet work
+
+Protobuf encode/decode is synchronous; running a large /api/encode/batch or
+/api/decode/batch request inline would stall the event loop for every other
+connection. BatchProcessor runs the items in a worker thread, a batch at a
+time, and sizes the batches from the observed per-item latency so that each
+batch takes roughly target_seconds: cheap items are grouped into large batches
+(fewer thread hand-offs), expensive ones into small batches (the loop gets
+control back often).
+"""
+import asyncio
+import time
+from typing import Any, Callable, Dict, List, Sequence, Tuple
+
+# 每项耗时的指数滑动平均系数
+_EWMA_ALPHA = 0.2
+
+
+class BatchProcessor:
+    def __init__(self, name: str, target_seconds: float = 0.05, min_size: int = 1, max_size: int = 256):
+        self.name = name
+        self.target_seconds = target_seconds
+        self.min_size = min_size
+        self.max_size = max_size
+        self.item_seconds = 0.0
+        self.items = 0
+        self.errors = 0
+        self.batches = 0
+        self.last_batch_size = 0
+
+    def batch_size(self) -> int:
+        if self.item_seconds <= 0:
+            return self.min_size
+        return max(self.min_size, min(self.max_size, int(self.target_seconds / self.item_seconds)))
+
+    @staticmethod
+    def _run_batch(fn: Callable[[Any], Any], batch: Sequence[Any]) -> List[Tuple[bool, Any]]:
+        results: List[Tuple[bool, Any]] = []
+        for item in batch:
+            try:
+                results.append((True, fn(item)))
+            except Exception as e:
+                results.append((False, str(e)))
+        return results
+
+    async def run(self, fn: Callable[[Any], Any], items: Sequence[Any]) -> List[Tuple[bool, Any]]:
+        """Apply fn to every item; returns (True, result) or (False, error message) per item, in order.
+
+        One item failing does not affect the others.
+        """
+        results: List[Tuple[bool, Any]] = []
+        pos = 0
+        while pos < len(items):
+            size = self.batch_size()
+            batch = items[pos:pos + size]
+            started = time.perf_counter()
+            batch_results = await asyncio.to_thread(self._run_batch, fn, batch)
+            per_item = (time.perf_counter() - started) / len(batch)
+            self.item_seconds = per_item if self.item_seconds <= 0 else (
+                _EWMA_ALPHA * per_item + (1 - _EWMA_ALPHA) * self.item_seconds
+            )
+            self.batches += 1
+            self.last_batch_size = len(batch)
+            self.items += len(batch)
+            self.errors += sum(1 for ok, _ in batch_results if not ok)
+            results.extend(batch_results)
+            pos += len(batch)
+        return results
+
+    def stats(self) -> Dict[str, Any]:
+        return {
+            "items": self.items,
+            "errors": self.errors,
+            "batches": self.batches,
+            "last_batch_size": self.last_batch_size,
+            "next_batch_size": self.batch_size(),
+            "item_ms": round(self.item_seconds * 1000, 3),
+        }
+
+
+encode_batcher = BatchProcessor("encode")
+decode_batcher = BatchProcessor("decode")
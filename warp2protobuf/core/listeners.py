@@ -0,0 +1,286 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Listening sockets
+
+Pre-binds the sockets a server should listen on so a single uvicorn server can
+accept on several addresses at once: TCP (IPv4 / IPv6) and Unix domain sockets.
+
+Listen specs:
+    28889                 port only, on the default host
+    127.0.0.1:28889       IPv4 address
+    [::1]:28889           IPv6 address (IPV6_V6ONLY, so [::] and 0.0.0.0 can be combined)
+    unix:/run/w2a.sock    Unix domain socket (a bare absolute path works too)
+
+Zero-downtime restarts: with reuse_port (SO_REUSEPORT) a new process can bind the
+same TCP address while the old one is still serving, then the old one is sent
+SIGTERM and drains. Sockets handed over by systemd socket activation (LISTEN_FDS)
+are used instead of binding, so the listening socket outlives restarts entirely.
+A Unix socket path is only unlinked on exit by the process that created it.
+
+server_tls_files() picks the certificate the listeners serve: TLS_CERT_FILE /
+TLS_KEY_FILE when set, otherwise one issued through ACME for TLS_ACME_DOMAIN.
+An ACME certificate is re-checked periodically while the server runs and a
+renewed one is loaded into the live SSLContext (start_certificate_renewal).
+"""
+import os
+import pathlib
+import socket
+import stat
+import threading
+import time
+from dataclasses import dataclass
+from typing import Any, Dict, Iterable, List, Optional, Tuple
+
+
+SD_LISTEN_FDS_START = 3
+# 运行中检查 ACME 证书是否需要续期的间隔（秒）
+ACME_RENEW_CHECK_INTERVAL = 12 * 3600
+
+# 本进程创建的 Unix socket 文件 inode；退出时只删除仍是自己创建的文件（新进程可能已替换）
+_bound_unix: Dict[str, int] = {}
+
+
+@dataclass
+class ListenSpec:
+    raw: str
+    host: str = ""
+    port: int = 0
+    path: str = ""
+
+    @property
+    def is_unix(self) -> bool:
+        return bool(self.path)
+
+    def describe(self) -> str:
+        if self.is_unix:
+            return f"unix:{self.path}"
+        return f"[{self.host}]:{self.port}" if ":" in self.host else f"{self.host}:{self.port}"
+
+
+def split_listen_specs(value: Optional[str]) -> List[str]:
+    return [s.strip() for s in (value or "").split(",") if s.strip()]
+
+
+def parse_listen_spec(raw: str, default_host: str = "127.0.0.1") -> ListenSpec:
+    spec = raw.strip()
+    if spec.startswith("unix:") or spec.startswith("/"):
+        path = spec[len("unix:"):] if spec.startswith("unix:") else spec
+        if not path:
+            raise ValueError(f"监听地址 {raw!r} 缺少socket路径")
+        return ListenSpec(raw=raw, path=path)
+    if spec.startswith("["):
+        host, sep, port = spec[1:].partition("]:")
+        if not sep:
+            raise ValueError(f"监听地址 {raw!r} 无效，IPv6 应形如 [::1]:28889")
+    elif ":" in spec:
+        host, _, port = spec.rpartition(":")
+    else:
+        host, port = default_host, spec
+    try:
+        port_num = int(port)
+    except ValueError:
+        raise ValueError(f"监听地址 {raw!r} 的端口无效")
+    if not 0 < port_num < 65536:
+        raise ValueError(f"监听地址 {raw!r} 的端口超出范围 (1 ~ 65535)")
+    return ListenSpec(raw=raw, host=host or "0.0.0.0", port=port_num)
+
+
+def bind_unix_socket(path: str, mode: int) -> socket.socket:
+    """绑定Unix domain socket并限制文件权限（uvicorn 默认会设为 0666）"""
+    if os.path.exists(path):
+        if not stat.S_ISSOCK(os.stat(path).st_mode):
+            raise RuntimeError(f"{path} 已存在且不是socket文件")
+        os.unlink(path)
+    sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    old_umask = os.umask(0o177)
+    try:
+        sock.bind(path)
+    finally:
+        os.umask(old_umask)
+    os.chmod(path, mode)
+    _bound_unix[path] = os.stat(path).st_ino
+    return sock
+
+
+def bind_tcp_socket(host: str, port: int, reuse_port: bool = False) -> socket.socket:
+    family = socket.AF_INET6 if ":" in host else socket.AF_INET
+    sock = socket.socket(family, socket.SOCK_STREAM)
+    sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+    if reuse_port:
+        if not hasattr(socket, "SO_REUSEPORT"):
+            sock.close()
+            raise RuntimeError("当前平台不支持 SO_REUSEPORT")
+        # 新旧进程可同时监听同一端口，内核在两者之间分发新连接
+        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEPORT, 1)
+    if family == socket.AF_INET6:
+        # 仅监听IPv6，否则 [::] 会占用IPv4端口，导致无法同时监听 0.0.0.0
+        sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY, 1)
+    try:
+        sock.bind((host, port))
+    except OSError:
+        sock.close()
+        raise
+    return sock
+
+
+def inherited_sockets() -> List[socket.socket]:
+    """Listening sockets passed in through systemd socket activation (LISTEN_FDS / LISTEN_PID)."""
+    try:
+        count = int(os.getenv("LISTEN_FDS", "0"))
+        pid = int(os.getenv("LISTEN_PID", "0"))
+    except ValueError:
+        return []
+    if count <= 0 or (pid and pid != os.getpid()):
+        return []
+    for name in ("LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"):
+        # 不传给子进程
+        os.environ.pop(name, None)
+    socks = []
+    for fd in range(SD_LISTEN_FDS_START, SD_LISTEN_FDS_START + count):
+        os.set_inheritable(fd, False)
+        socks.append(socket.socket(fileno=fd))
+    return socks
+
+
+def _matches(sock: socket.socket, spec: ListenSpec) -> bool:
+    address = sock.getsockname()
+    if spec.is_unix:
+        return sock.family == socket.AF_UNIX and address == spec.path
+    if sock.family not in (socket.AF_INET, socket.AF_INET6):
+        return False
+    return address[1] == spec.port and socket.inet_pton(sock.family, address[0]) == _packed(sock.family, spec.host)
+
+
+def _packed(family: int, host: str) -> Optional[bytes]:
+    try:
+        return socket.inet_pton(family, host)
+    except OSError:
+        return None
+
+
+def bind_listeners(specs: Iterable[ListenSpec], unix_mode: int = 0o600, reuse_port: bool = False,
+                   inherited: Optional[List[socket.socket]] = None) -> List[socket.socket]:
+    """Bind every spec, reusing a matching inherited socket when there is one.
+
+    On failure the sockets bound so far are closed again.
+    """
+    specs = list(specs)
+    available = list(inherited or [])
+    socks: List[socket.socket] = []
+    try:
+        for spec in specs:
+            match = next((s for s in available if _matches(s, spec)), None)
+            if match is not None:
+                available.remove(match)
+                socks.append(match)
+            elif spec.is_unix:
+                socks.append(bind_unix_socket(spec.path, unix_mode))
+            else:
+                socks.append(bind_tcp_socket(spec.host, spec.port, reuse_port))
+    except Exception:
+        close_listeners(socks, specs[:len(socks)])
+        raise
+    for sock in available:
+        sock.close()
+    return socks
+
+
+def reuse_port_enabled() -> bool:
+    return os.getenv("REUSE_PORT", "").strip().lower() in ("1", "true", "yes")
+
+
+def _spec_of(sock: socket.socket) -> ListenSpec:
+    address = sock.getsockname()
+    if sock.family == socket.AF_UNIX:
+        return ListenSpec(raw=f"fd:{sock.fileno()}", path=address)
+    return ListenSpec(raw=f"fd:{sock.fileno()}", host=address[0], port=address[1])
+
+
+def open_server_sockets(listen: str, default_host: str, default_port: int,
+                        unix_mode: int = 0o600) -> Tuple[List[ListenSpec], List[socket.socket]]:
+    """Sockets for a server: the OPENAI_LISTEN specs (or default host:port), preferring inherited ones.
+
+    Without explicit specs, sockets inherited through socket activation are used as they are.
+    """
+    inherited = inherited_sockets()
+    raw_specs = split_listen_specs(listen)
+    if not raw_specs and inherited:
+        return [_spec_of(s) for s in inherited], inherited
+    specs = [parse_listen_spec(raw, default_host) for raw in raw_specs] or [ListenSpec(raw=str(default_port), host=default_host, port=default_port)]
+    return specs, bind_listeners(specs, unix_mode, reuse_port_enabled(), inherited)
+
+
+def close_listeners(socks: List[socket.socket], specs: Iterable[ListenSpec]) -> None:
+    for sock in socks:
+        sock.close()
+    for spec in specs:
+        if not spec.is_unix or spec.path not in _bound_unix:
+            continue
+        inode = _bound_unix.pop(spec.path)
+        try:
+            if os.stat(spec.path).st_ino == inode:
+                os.unlink(spec.path)
+        except OSError:
+            pass
+
+
+def server_tls_files() -> Tuple[Optional[str], Optional[str]]:
+    """(certfile, keyfile) for the OpenAI server, or (None, None) to serve plain HTTP."""
+    cert, key = os.getenv("TLS_CERT_FILE", "").strip(), os.getenv("TLS_KEY_FILE", "").strip()
+    if cert and key:
+        return cert, key
+    acme = _acme_settings()
+    if acme is None:
+        return None, None
+    from .acme import ensure_certificate
+    return ensure_certificate(*acme)
+
+
+def _acme_settings() -> Optional[Tuple[str, str, str, str, int]]:
+    """ensure_certificate() arguments when the certificate comes from ACME, else None."""
+    domain = os.getenv("TLS_ACME_DOMAIN", "").strip()
+    if not domain or (os.getenv("TLS_CERT_FILE", "").strip() and os.getenv("TLS_KEY_FILE", "").strip()):
+        return None
+    from .acme import LETS_ENCRYPT_DIRECTORY
+    return (
+        domain,
+        os.getenv("TLS_ACME_EMAIL", "").strip(),
+        os.getenv("TLS_ACME_CACHE", "").strip() or "~/.cache/warp2api/acme",
+        os.getenv("TLS_ACME_DIRECTORY", "").strip() or LETS_ENCRYPT_DIRECTORY,
+        int(os.getenv("TLS_ACME_HTTP_PORT", "80")),
+    )
+
+
+def start_certificate_renewal(config: Any, certfile: Optional[str], interval: float = ACME_RENEW_CHECK_INTERVAL) -> None:
+    """Keep an ACME certificate current for a long-running server.
+
+    A daemon thread re-runs ensure_certificate() every `interval` seconds (it only
+    contacts the CA within RENEW_BEFORE_DAYS of expiry) and loads a renewed
+    certificate into `config.ssl`, the SSLContext uvicorn serves with, so new
+    connections get it without a restart. No-op unless TLS_ACME_DOMAIN is used.
+    """
+    acme = _acme_settings()
+    if acme is None or not certfile:
+        return
+    from .acme import certificate_expiry, ensure_certificate
+    from .logging import logger
+
+    def _renew_loop() -> None:
+        current = certificate_expiry(pathlib.Path(certfile))
+        while True:
+            time.sleep(interval)
+            try:
+                cert, key = ensure_certificate(*acme)
+            except Exception as e:
+                logger.error(f"ACME 证书续期失败，{interval / 3600:.0f} 小时后重试: {e}")
+                continue
+            expiry = certificate_expiry(pathlib.Path(cert))
+            # config.ssl 在 uvicorn 加载配置后才存在
+            if expiry == current or getattr(config, "ssl", None) is None:
+                continue
+            config.ssl.load_cert_chain(cert, key)
+            current = expiry
+            logger.info(f"已加载续期后的 {acme[0]} 证书，有效期至 {expiry:%Y-%m-%d}")
+
+    threading.Thread(target=_renew_loop, name="acme-renewal", daemon=True).start()
@@ -0,0 +1,165 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Log file rotation
+
+RotatingLogFileHandler rotates the active log file when it grows past
+LOG_MAX_SIZE_MB or has been open for LOG_ROTATE_HOURS, renaming it to
+<name>-<YYYYmmdd-HHMMSS><ext>, gzip-compressing the archive in the background
+(LOG_COMPRESS) and deleting archives beyond LOG_MAX_BACKUPS or older than
+LOG_MAX_AGE_DAYS, so a long-running server never fills the disk.
+
+LOG_FILE replaces the process's default log file path. Handlers are shared per
+path, so loggers of both servers running in one process rotate one file
+together; separate processes need separate LOG_FILE values.
+"""
+import gzip
+import logging
+import os
+import pathlib
+import shutil
+import threading
+import time
+from datetime import datetime
+from typing import Dict, List, Optional
+
+_ARCHIVE_STAMP = "%Y%m%d-%H%M%S"
+
+_handlers: Dict[str, "RotatingLogFileHandler"] = {}
+_handlers_lock = threading.Lock()
+
+
+class RotatingLogFileHandler(logging.FileHandler):
+    def __init__(self, path: pathlib.Path, max_bytes: int = 0, rotate_seconds: float = 0,
+                 max_backups: int = 0, max_age_seconds: float = 0, compress: bool = True):
+        path.parent.mkdir(parents=True, exist_ok=True)
+        super().__init__(path, mode="a", encoding="utf-8", delay=False)
+        self.path = path
+        self.max_bytes = max_bytes
+        self.rotate_seconds = rotate_seconds
+        self.max_backups = max_backups
+        self.max_age_seconds = max_age_seconds
+        self.compress = compress
+        # 已有文件按其修改时间计算年龄，重启不会重置按时间轮转的周期
+        self.opened_at = path.stat().st_mtime if path.exists() and path.stat().st_size else time.time()
+
+    def emit(self, record: logging.LogRecord) -> None:
+        try:
+            if self._should_rotate():
+                self.rotate()
+        except Exception:
+            self.handleError(record)
+        super().emit(record)
+
+    def _should_rotate(self) -> bool:
+        if self.stream is None or not self.stream.tell():
+            return False
+        if self.max_bytes and self.stream.tell() >= self.max_bytes:
+            return True
+        return bool(self.rotate_seconds) and time.time() - self.opened_at >= self.rotate_seconds
+
+    def rotate(self) -> Optional[pathlib.Path]:
+        """Archive the current file and start a new one; returns the archive path."""
+        self.acquire()
+        try:
+            if self.stream is not None:
+                self.stream.close()
+                self.stream = None
+            archive = archive_log_file(self.path)
+            self.stream = self._open()
+            self.opened_at = time.time()
+        finally:
+            self.release()
+        # 压缩与清理在后台进行，不阻塞写日志的线程
+        threading.Thread(target=self._finish_archive, args=(archive,), name="log-rotation", daemon=True).start()
+        return archive
+
+    def _finish_archive(self, archive: Optional[pathlib.Path]) -> None:
+        if archive is not None and self.compress:
+            compress_file(archive)
+        prune_archives(self.path, self.max_backups, self.max_age_seconds)
+
+
+def archive_log_file(path: pathlib.Path) -> Optional[pathlib.Path]:
+    """Rename a non-empty log file to its timestamped archive name (None when there is nothing to archive)."""
+    if not path.exists() or not path.stat().st_size:
+        return None
+    stamp = datetime.now().strftime(_ARCHIVE_STAMP)
+    archive = path.with_name(f"{path.stem}-{stamp}{path.suffix}")
+    n = 1
+    while archive.exists() or archive.with_name(archive.name + ".gz").exists():
+        archive = path.with_name(f"{path.stem}-{stamp}.{n}{path.suffix}")
+        n += 1
+    os.replace(path, archive)
+    return archive
+
+
+def compress_file(path: pathlib.Path) -> None:
+    target = path.with_name(path.name + ".gz")
+    try:
+        with open(path, "rb") as src, gzip.open(target, "wb") as dst:
+            shutil.copyfileobj(src, dst)
+        path.unlink()
+    except OSError as e:
+        # 压缩失败时保留未压缩的归档
+        target.unlink(missing_ok=True)
+        print(f"Warning: could not compress log archive {path}: {e}")
+
+
+def _archives(path: pathlib.Path) -> List[pathlib.Path]:
+    return sorted(
+        (p for p in path.parent.glob(f"{path.stem}-*{path.suffix}*") if p != path),
+        key=lambda p: p.stat().st_mtime,
+        reverse=True,
+    )
+
+
+def prune_archives(path: pathlib.Path, max_backups: int, max_age_seconds: float) -> None:
+    """Delete archives of `path` beyond the newest max_backups or older than max_age_seconds (0 = no limit)."""
+    now = time.time()
+    try:
+        for index, archive in enumerate(_archives(path)):
+            expired = max_age_seconds and now - archive.stat().st_mtime > max_age_seconds
+            if (max_backups and index >= max_backups) or expired:
+                archive.unlink(missing_ok=True)
+    except OSError as e:
+        print(f"Warning: could not prune log archives of {path}: {e}")
+
+
+def log_file_path(default_path: pathlib.Path) -> pathlib.Path:
+    configured = os.getenv("LOG_FILE", "").strip()
+    return pathlib.Path(configured).expanduser() if configured else default_path
+
+
+def archive_on_startup(default_path: pathlib.Path) -> None:
+    """Archive the previous run's log file before logging starts (skipped if a handler already writes it)."""
+    path = log_file_path(default_path)
+    with _handlers_lock:
+        if str(path.resolve()) in _handlers:
+            return
+        archive = archive_log_file(path)
+    if archive is None:
+        return
+    if os.getenv("LOG_COMPRESS", "true").strip().lower() in ("1", "true", "yes"):
+        compress_file(archive)
+    prune_archives(path, int(os.getenv("LOG_MAX_BACKUPS", "5")), float(os.getenv("LOG_MAX_AGE_DAYS", "14")) * 86400)
+    print(f"Previous log archived as: {archive.name}{'.gz' if not archive.exists() else ''}")
+
+
+def log_file_handler(default_path: pathlib.Path) -> RotatingLogFileHandler:
+    """Shared rotating handler for LOG_FILE (or default_path), configured from the LOG_* settings."""
+    path = log_file_path(default_path)
+    key = str(path.resolve())
+    with _handlers_lock:
+        handler = _handlers.get(key)
+        if handler is None or handler.stream is None:
+            handler = RotatingLogFileHandler(
+                path,
+                max_bytes=int(float(os.getenv("LOG_MAX_SIZE_MB", "10")) * 1024 * 1024),
+                rotate_seconds=float(os.getenv("LOG_ROTATE_HOURS", "0")) * 3600,
+                max_backups=int(os.getenv("LOG_MAX_BACKUPS", "5")),
+                max_age_seconds=float(os.getenv("LOG_MAX_AGE_DAYS", "14")) * 86400,
+                compress=os.getenv("LOG_COMPRESS", "true").strip().lower() in ("1", "true", "yes"),
+            )
+            _handlers[key] = handler
+        return handler
@@ -0,0 +1,127 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+In-memory log tail
+
+LogTail is a logging handler that keeps the last LOG_TAIL_BUFFER records (after
+request-context tagging and redaction) and fans new ones out to live
+subscribers, backing the /admin/logs/stream SSE endpoint. Each entry has a
+sequence number so a reconnecting client can resume with Last-Event-ID.
+"""
+import asyncio
+import logging
+from collections import deque
+from datetime import datetime, timezone
+from typing import Any, AsyncIterator, Deque, Dict, List, Optional, Set, Tuple
+
+# 订阅者读取过慢时最多积压的条数，超出后丢弃并提示
+_SUBSCRIBER_QUEUE = 1000
+
+
+class LogFilter:
+    """Which entries a tail client wants: minimum level, logger prefix, request ID, text substring."""
+
+    def __init__(self, level: str = "", logger: str = "", request_id: str = "", query: str = ""):
+        self.levelno = logging.getLevelName(level.upper()) if level else 0
+        if not isinstance(self.levelno, int):
+            raise ValueError(f"unknown log level: {level}")
+        self.logger = logger
+        self.request_id = request_id
+        self.query = query.lower()
+
+    def matches(self, entry: Dict[str, Any]) -> bool:
+        if entry["levelno"] < self.levelno:
+            return False
+        if self.logger and not entry["logger"].startswith(self.logger):
+            return False
+        if self.request_id and entry["request_id"] != self.request_id:
+            return False
+        if not self.query:
+            return True
+        # 访问日志的内容在 fields 中，一并参与匹配
+        return self.query in entry["message"].lower() or (entry["fields"] is not None and self.query in str(entry["fields"]).lower())
+
+
+class LogTail(logging.Handler):
+    def __init__(self, capacity: int):
+        super().__init__(level=logging.DEBUG)
+        self.entries: Deque[Dict[str, Any]] = deque(maxlen=max(1, capacity))
+        self._seq = 0
+        self._subscribers: Set[Tuple[asyncio.AbstractEventLoop, asyncio.Queue]] = set()
+
+    def emit(self, record: logging.LogRecord) -> None:
+        try:
+            message = record.getMessage()
+            if record.exc_info and not record.exc_text:
+                record.exc_text = logging.Formatter().formatException(record.exc_info)
+            if record.exc_text:
+                message = f"{message}\n{record.exc_text}"
+            self._seq += 1
+            entry = {
+                "seq": self._seq,
+                "ts": datetime.fromtimestamp(record.created, timezone.utc).isoformat(timespec="milliseconds"),
+                "level": record.levelname,
+                "levelno": record.levelno,
+                "logger": record.name,
+                "request_id": getattr(record, "request_id", None) or (getattr(record, "fields", None) or {}).get("request_id") or "-",
+                "context": getattr(record, "request_context", None),
+                "message": message,
+                "fields": getattr(record, "fields", None),
+            }
+            self.entries.append(entry)
+            for loop, queue in list(self._subscribers):
+                # 日志可能来自任意线程，投递回订阅者所在的事件循环
+                loop.call_soon_threadsafe(_offer, queue, entry)
+        except Exception:
+            self.handleError(record)
+
+    def recent(self, log_filter: LogFilter, limit: int, after_seq: int = 0) -> List[Dict[str, Any]]:
+        matched = [e for e in list(self.entries) if e["seq"] > after_seq and log_filter.matches(e)]
+        return matched[-limit:] if limit > 0 else []
+
+    async def follow(self, log_filter: LogFilter, backlog: int, after_seq: int = 0) -> AsyncIterator[Dict[str, Any]]:
+        """Recent matching entries (up to `backlog`, or all after `after_seq` on resume), then live ones."""
+        queue: asyncio.Queue = asyncio.Queue(maxsize=_SUBSCRIBER_QUEUE)
+        subscriber = (asyncio.get_running_loop(), queue)
+        self._subscribers.add(subscriber)
+        try:
+            last = after_seq
+            for entry in self.recent(log_filter, len(self.entries) if after_seq else backlog, after_seq):
+                last = entry["seq"]
+                yield entry
+            while True:
+                entry = await queue.get()
+                if entry is None:
+                    yield {"seq": last, "level": "WARNING", "logger": "log_tail", "dropped": True,
+                           "message": "client too slow, some log entries were dropped", "fields": None}
+                    continue
+                if entry["seq"] <= last or not log_filter.matches(entry):
+                    continue
+                last = entry["seq"]
+                yield entry
+        finally:
+            self._subscribers.discard(subscriber)
+
+
+def _offer(queue: asyncio.Queue, entry: Dict[str, Any]) -> None:
+    try:
+        queue.put_nowait(entry)
+    except asyncio.QueueFull:
+        # 清空积压，放入一个丢弃标记（None）
+        while not queue.empty():
+            queue.get_nowait()
+        queue.put_nowait(None)
+
+
+def open_log_tail(capacity: int, loggers: List[logging.Logger]) -> Optional[LogTail]:
+    """Attach a LogTail to `loggers` (reusing their request-context and redaction filters); None when disabled."""
+    if capacity <= 0:
+        return None
+    tail = LogTail(capacity)
+    for target in loggers:
+        for handler in target.handlers:
+            for log_filter in handler.filters:
+                if log_filter not in tail.filters and type(log_filter) not in {type(f) for f in tail.filters}:
+                    tail.addFilter(log_filter)
+        target.addHandler(tail)
+    return tail
@@ -4,29 +4,21 @@
 Logging system for Warp API server
 
 Provides comprehensive logging with file rotation and console output.
+File rotation, compression and retention follow the LOG_* settings (see log_rotation).
 """
 import logging
-import os
-import shutil
-from datetime import datetime
-from logging.handlers import RotatingFileHandler
 from ..config.settings import LOGS_DIR
+from .log_rotation import RotatingLogFileHandler, archive_on_startup, log_file_handler
+from .redaction import add_redaction
+from .request_context import RequestIdFilter
 
 
 def backup_existing_log():
-    """Backup existing log file with timestamp"""
-    log_file = LOGS_DIR / 'warp_api.log'
-
-    if log_file.exists():
-        timestamp = datetime.now().strftime('%Y%m%d_%H%M%S')
-        backup_name = f'warp_api_{timestamp}.log'
-        backup_path = LOGS_DIR / backup_name
-
-        try:
-            shutil.move(str(log_file), str(backup_path))
-            print(f"Previous log backed up as: {backup_name}")
-        except Exception as e:
-            print(f"Warning: Could not backup log file: {e}")
+    """Archive the previous log file (timestamped, compressed, old archives pruned)"""
+    try:
+        archive_on_startup(LOGS_DIR / 'warp_api.log')
+    except Exception as e:
+        print(f"Warning: Could not backup log file: {e}")
 
 
 def setup_logging():
@@ -41,22 +33,20 @@ def setup_logging():
     for handler in logger.handlers[:]:
         logger.removeHandler(handler)
     
-    file_handler = RotatingFileHandler(
-        LOGS_DIR / 'warp_api.log',
-        maxBytes=10*1024*1024,
-        backupCount=5,
-        encoding='utf-8'
-    )
+    file_handler = log_file_handler(LOGS_DIR / 'warp_api.log')
     file_handler.setLevel(logging.DEBUG)
     
     console_handler = logging.StreamHandler()
     console_handler.setLevel(logging.INFO)
     
     formatter = logging.Formatter(
-        '%(asctime)s - %(name)s - %(levelname)s - %(funcName)s:%(lineno)d - %(message)s'
+        '%(asctime)s - %(name)s - %(levelname)s - [%(request_context)s] %(funcName)s:%(lineno)d - %(message)s'
     )
     file_handler.setFormatter(formatter)
     console_handler.setFormatter(formatter)
+    file_handler.addFilter(RequestIdFilter())
+    console_handler.addFilter(RequestIdFilter())
+    add_redaction((file_handler, console_handler))
     
     logger.addHandler(file_handler)
     logger.addHandler(console_handler)
@@ -86,6 +76,9 @@ def set_log_file(log_file_name: str) -> None:
     for handler in target_logger.handlers[:]:
         try:
             target_logger.removeHandler(handler)
+            # 轮转文件 handler 按路径共享（可能仍被其他 logger 使用），不在这里关闭
+            if isinstance(handler, RotatingLogFileHandler):
+                continue
             try:
                 handler.close()
             except Exception:
@@ -93,22 +86,20 @@ def set_log_file(log_file_name: str) -> None:
         except Exception:
             pass
 
-    file_handler = RotatingFileHandler(
-        LOGS_DIR / log_file_name,
-        maxBytes=10*1024*1024,
-        backupCount=5,
-        encoding='utf-8'
-    )
+    file_handler = log_file_handler(LOGS_DIR / log_file_name)
     file_handler.setLevel(logging.DEBUG)
 
     console_handler = logging.StreamHandler()
     console_handler.setLevel(logging.INFO)
 
     formatter = logging.Formatter(
-        '%(asctime)s - %(name)s - %(levelname)s - %(funcName)s:%(lineno)d - %(message)s'
+        '%(asctime)s - %(name)s - %(levelname)s - [%(request_context)s] %(funcName)s:%(lineno)d - %(message)s'
     )
     file_handler.setFormatter(formatter)
     console_handler.setFormatter(formatter)
+    file_handler.addFilter(RequestIdFilter())
+    console_handler.addFilter(RequestIdFilter())
+    add_redaction((file_handler, console_handler))
 
     target_logger.addHandler(file_handler)
     target_logger.addHandler(console_handler)
@@ -116,6 +107,6 @@ def set_log_file(log_file_name: str) -> None:
     logger = target_logger
 
     try:
-        logger.info(f"Logging redirected to: {LOGS_DIR / log_file_name}")
+        logger.info(f"Logging redirected to: {file_handler.path}")
     except Exception:
         pass 
\ No newline at end of file
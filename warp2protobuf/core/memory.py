@@ -0,0 +1,120 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Process memory watermarks and soft memory limit
+
+Nothing forces periodic garbage collection: CPython frees most objects by
+reference counting and its generational collector runs on allocation
+thresholds. MEMORY_LIMIT_MB adds a soft limit in the spirit of GOMEMLIMIT: a
+background thread samples the resident set size every MEMORY_CHECK_INTERVAL
+seconds and only when it is above the limit runs a full collection (at most
+once per _MIN_COLLECT_GAP seconds), so collections happen under memory
+pressure instead of on a timer in the middle of streams.
+
+The current / peak RSS, the limit and collector statistics are exported as
+gauges on both servers' /metrics.
+"""
+import gc
+import os
+import sys
+import threading
+import time
+from typing import Dict, Iterable, Optional, Tuple
+
+# 超限时两次强制回收之间的最短间隔，避免内存确实不够时反复全量回收
+_MIN_COLLECT_GAP = 30.0
+
+_PAGE_SIZE = os.sysconf("SC_PAGE_SIZE") if hasattr(os, "sysconf") else 4096
+
+
+def rss_bytes() -> Optional[int]:
+    """Current resident set size (Linux /proc; None where unavailable)."""
+    try:
+        with open("/proc/self/statm", "rb") as f:
+            return int(f.read().split()[1]) * _PAGE_SIZE
+    except (OSError, ValueError, IndexError):
+        return None
+
+
+def peak_rss_bytes() -> Optional[int]:
+    try:
+        import resource
+    except ImportError:
+        return None
+    peak = resource.getrusage(resource.RUSAGE_SELF).ru_maxrss
+    # Linux 以 KB 为单位，macOS 以字节为单位
+    return peak if sys.platform == "darwin" else peak * 1024
+
+
+class MemoryWatch:
+    def __init__(self, limit_bytes: int, interval: float):
+        self.limit_bytes = limit_bytes
+        self.interval = interval
+        self.high_watermark = 0
+        self.limit_collections = 0
+        self.last_collect = 0.0
+        self._thread: Optional[threading.Thread] = None
+
+    def start(self) -> None:
+        if self._thread is None and self.interval > 0:
+            self._thread = threading.Thread(target=self._run, name="memory-watch", daemon=True)
+            self._thread.start()
+
+    def _run(self) -> None:
+        while True:
+            time.sleep(self.interval)
+            try:
+                self.check()
+            except Exception as e:
+                print(f"Warning: memory check failed: {e}")
+
+    def check(self) -> None:
+        rss = rss_bytes()
+        if rss is None:
+            return
+        self.high_watermark = max(self.high_watermark, rss)
+        if not self.limit_bytes or rss < self.limit_bytes or time.time() - self.last_collect < _MIN_COLLECT_GAP:
+            return
+        from .logging import logger
+        self.last_collect = time.time()
+        self.limit_collections += 1
+        freed = gc.collect()
+        after = rss_bytes() or rss
+        logger.warning(
+            f"内存超过软上限 {self.limit_bytes / 1048576:.0f} MB（RSS {rss / 1048576:.0f} MB），"
+            f"已执行一次全量回收: 回收 {freed} 个对象，RSS {after / 1048576:.0f} MB"
+        )
+
+    def gauges(self, prefix: str) -> Iterable[Tuple[str, Dict[str, str], float]]:
+        rss = rss_bytes()
+        if rss is not None:
+            self.high_watermark = max(self.high_watermark, rss)
+            yield f"{prefix}_memory_rss_bytes", {}, rss
+            yield f"{prefix}_memory_rss_high_watermark_bytes", {}, self.high_watermark
+        peak = peak_rss_bytes()
+        if peak is not None:
+            yield f"{prefix}_memory_peak_rss_bytes", {}, peak
+        if self.limit_bytes:
+            yield f"{prefix}_memory_limit_bytes", {}, self.limit_bytes
+            yield f"{prefix}_memory_limit_collections", {}, self.limit_collections
+        for generation, stats in enumerate(gc.get_stats()):
+            yield f"{prefix}_gc_collections", {"generation": str(generation)}, stats.get("collections", 0)
+            yield f"{prefix}_gc_collected_objects", {"generation": str(generation)}, stats.get("collected", 0)
+
+
+memory_watch = MemoryWatch(
+    limit_bytes=int(float(os.getenv("MEMORY_LIMIT_MB", "0")) * 1024 * 1024),
+    interval=float(os.getenv("MEMORY_CHECK_INTERVAL", "10")),
+)
+
+
+def memory_help(prefix: str) -> Dict[str, str]:
+    return {
+        f"{prefix}_memory_rss_bytes": "Resident set size of the process",
+        f"{prefix}_memory_rss_high_watermark_bytes": "Highest resident set size sampled since start",
+        f"{prefix}_memory_peak_rss_bytes": "Peak resident set size reported by the OS",
+        f"{prefix}_memory_limit_bytes": "Soft memory limit (MEMORY_LIMIT_MB) above which a full collection runs",
+        f"{prefix}_memory_limit_collections": "Full collections triggered by the soft memory limit since start",
+        f"{prefix}_gc_collections": "Garbage collector runs since start, by generation",
+        f"{prefix}_gc_collected_objects": "Objects freed by the garbage collector since start, by generation",
+    }
@@ -0,0 +1,318 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Metrics
+
+MetricsRegistry holds labelled counters, histograms and gauges and renders
+them in the Prometheus text exposition format (or as JSON). latency_summary()
+estimates p50 / p95 / p99 from the histogram buckets, grouped by one label
+(route or model), for the human-readable /stats endpoints. Gauges that mirror
+live state (account pool, in-flight requests) are read at scrape time through
+collectors instead of being updated on every change.
+
+bridge_metrics covers the bridge: encodes, decodes, Warp forwards and upstream
+latency, auth refreshes, errors, bytes, HTTP requests and the account pool. The
+OpenAI-compatible server keeps its own registry (protobuf2openai.metrics).
+"""
+import threading
+import time
+from collections import defaultdict
+from typing import Any, Callable, Dict, Iterable, List, Optional, Sequence, Tuple
+
+from .memory import memory_help, memory_watch
+
+Labels = Tuple[Tuple[str, str], ...]
+# 采集时回调：返回 (指标名, 标签, 值)，均作为 gauge 输出
+Collector = Callable[[], Iterable[Tuple[str, Dict[str, str], float]]]
+
+DEFAULT_BUCKETS = (0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0, 60.0, 120.0, 300.0)
+SUMMARY_QUANTILES = (0.5, 0.95, 0.99)
+
+
+def _labels(labels: Dict[str, Any]) -> Labels:
+    return tuple(sorted((k, "" if v is None else str(v)) for k, v in labels.items()))
+
+
+def _escape(value: str) -> str:
+    return value.replace("\\", "\\\\").replace("\n", "\\n").replace('"', '\\"')
+
+
+def _label_str(labels: Labels, extra: Optional[Tuple[str, str]] = None) -> str:
+    pairs = list(labels) + ([extra] if extra else [])
+    if not pairs:
+        return ""
+    return "{" + ",".join(f'{k}="{_escape(v)}"' for k, v in pairs) + "}"
+
+
+def _num(value: float) -> str:
+    if value == float("inf"):
+        return "+Inf"
+    return f"{value:g}" if not float(value).is_integer() else str(int(value))
+
+
+class _Histogram:
+    __slots__ = ("buckets", "counts", "sum", "count")
+
+    def __init__(self, buckets: Sequence[float]):
+        self.buckets = tuple(buckets)
+        self.counts = [0] * len(self.buckets)
+        self.sum = 0.0
+        self.count = 0
+
+    def observe(self, value: float) -> None:
+        for i, bound in enumerate(self.buckets):
+            if value <= bound:
+                self.counts[i] += 1
+        self.sum += value
+        self.count += 1
+
+    def copy(self) -> "_Histogram":
+        clone = _Histogram(self.buckets)
+        clone.merge(self)
+        return clone
+
+    def minus(self, earlier: Optional["_Histogram"]) -> "_Histogram":
+        """Observations made since `earlier` (a previous copy of the same series)."""
+        delta = self.copy()
+        if earlier is not None:
+            delta.counts = [a - b for a, b in zip(self.counts, earlier.counts)]
+            delta.sum -= earlier.sum
+            delta.count -= earlier.count
+        return delta
+
+    def merge(self, other: "_Histogram") -> None:
+        for i, bucket_count in enumerate(other.counts):
+            self.counts[i] += bucket_count
+        self.sum += other.sum
+        self.count += other.count
+
+    def quantile(self, q: float) -> float:
+        """Linear interpolation inside the bucket holding the q-th observation (as PromQL histogram_quantile)."""
+        if not self.count:
+            return 0.0
+        rank = q * self.count
+        lower, below = 0.0, 0
+        for bound, cumulative in zip(self.buckets, self.counts):
+            if cumulative >= rank:
+                inside = cumulative - below
+                return lower + (bound - lower) * ((rank - below) / inside if inside else 1.0)
+            lower, below = bound, cumulative
+        # 落在最大桶之外时只能给出最大桶上界
+        return self.buckets[-1] if self.buckets else 0.0
+
+
+class MetricsRegistry:
+    def __init__(self, help_text: Dict[str, str], uptime_metric: str,
+                 buckets: Optional[Dict[str, Sequence[float]]] = None):
+        self._lock = threading.Lock()
+        self._help = help_text
+        self._uptime_metric = uptime_metric
+        self._buckets = buckets or {}
+        self._counters: Dict[Tuple[str, Labels], float] = defaultdict(float)
+        self._histograms: Dict[Tuple[str, Labels], _Histogram] = {}
+        self._gauges: Dict[Tuple[str, Labels], float] = {}
+        self._collectors: List[Collector] = []
+        self.started_at = time.time()
+
+    def inc(self, name: str, value: float = 1, **labels: Any) -> None:
+        key = (name, _labels(labels))
+        with self._lock:
+            self._counters[key] += value
+
+    def observe(self, name: str, value: float, **labels: Any) -> None:
+        key = (name, _labels(labels))
+        with self._lock:
+            hist = self._histograms.get(key)
+            if hist is None:
+                hist = self._histograms[key] = _Histogram(self._buckets.get(name, DEFAULT_BUCKETS))
+            hist.observe(value)
+
+    def set_gauge(self, name: str, value: float, **labels: Any) -> None:
+        with self._lock:
+            self._gauges[(name, _labels(labels))] = value
+
+    def add_collector(self, collector: Collector) -> None:
+        self._collectors.append(collector)
+
+    def _collected(self) -> Dict[Tuple[str, Labels], float]:
+        gauges = dict(self._gauges)
+        for collector in self._collectors:
+            try:
+                for name, labels, value in collector():
+                    gauges[(name, _labels(labels))] = value
+            except Exception:
+                # 采集失败不影响其余指标
+                continue
+        return gauges
+
+    def snapshot(self) -> Dict[str, Any]:
+        out: Dict[str, Any] = {"uptime_seconds": round(time.time() - self.started_at, 1)}
+        with self._lock:
+            counters = list(self._counters.items())
+            histograms = [(key, (h.count, h.sum)) for key, h in self._histograms.items()]
+            gauges = self._collected()
+
+        def put(name: str, labels: Labels, value: Any) -> None:
+            if labels:
+                out.setdefault(name, {})[",".join(f"{k}={lv}" for k, lv in labels)] = value
+            else:
+                out[name] = value
+
+        for (name, labels), value in sorted(counters) + sorted(gauges.items()):
+            put(name, labels, int(value) if float(value).is_integer() else value)
+        for (name, labels), (count, total) in sorted(histograms):
+            put(name, labels, {"count": count, "sum": round(total, 3)})
+        return out
+
+    def counter_series(self, name: str) -> List[Tuple[Dict[str, str], float]]:
+        """(labels, value) of every series of counter `name`."""
+        with self._lock:
+            return [(dict(labels), value) for (metric, labels), value in self._counters.items() if metric == name]
+
+    def merged_histogram(self, name: str, where: Optional[Callable[[Dict[str, str]], bool]] = None) -> Optional[_Histogram]:
+        """Copy of histogram `name` with all series (optionally only those whose labels pass `where`) merged."""
+        merged: Optional[_Histogram] = None
+        with self._lock:
+            for (metric, labels), hist in self._histograms.items():
+                if metric != name or (where is not None and not where(dict(labels))):
+                    continue
+                if merged is None:
+                    merged = _Histogram(hist.buckets)
+                merged.merge(hist)
+        return merged
+
+    def latency_summary(self, name: str, by: Optional[str] = None) -> Dict[str, Dict[str, Any]]:
+        """Per `by` label value (or "all"): count, average and p50 / p95 / p99 (ms) of histogram `name`, other labels merged."""
+        merged: Dict[str, _Histogram] = {}
+        with self._lock:
+            for (metric, labels), hist in self._histograms.items():
+                if metric != name:
+                    continue
+                group = (dict(labels).get(by) or "unknown") if by else "all"
+                target = merged.get(group)
+                if target is None:
+                    target = merged[group] = _Histogram(hist.buckets)
+                target.merge(hist)
+        out: Dict[str, Dict[str, Any]] = {}
+        for group, hist in sorted(merged.items()):
+            entry: Dict[str, Any] = {"count": hist.count, "avg_ms": round(hist.sum / hist.count * 1000, 1) if hist.count else 0}
+            for q in SUMMARY_QUANTILES:
+                entry[f"p{int(q * 100)}_ms"] = round(hist.quantile(q) * 1000, 1)
+            out[group] = entry
+        return out
+
+    def render_prometheus(self) -> str:
+        with self._lock:
+            counters = sorted(self._counters.items())
+            histograms = sorted(
+                ((key, (h.buckets, list(h.counts), h.sum, h.count)) for key, h in self._histograms.items()),
+                key=lambda item: item[0],
+            )
+            gauges = sorted(self._collected().items())
+        lines: List[str] = []
+        seen = set()
+
+        def header(name: str, kind: str) -> None:
+            if name not in seen:
+                seen.add(name)
+                lines.append(f"# HELP {name} {self._help.get(name, name)}")
+                lines.append(f"# TYPE {name} {kind}")
+
+        for (name, labels), value in counters:
+            header(name, "counter")
+            lines.append(f"{name}{_label_str(labels)} {_num(value)}")
+        for (name, labels), (buckets, counts, total, count) in histograms:
+            header(name, "histogram")
+            for bound, bucket_count in zip(buckets, counts):
+                lines.append(f"{name}_bucket{_label_str(labels, ('le', _num(bound)))} {bucket_count}")
+            lines.append(f"{name}_bucket{_label_str(labels, ('le', '+Inf'))} {count}")
+            lines.append(f"{name}_sum{_label_str(labels)} {total:.6f}")
+            lines.append(f"{name}_count{_label_str(labels)} {count}")
+        for (name, labels), value in gauges:
+            header(name, "gauge")
+            lines.append(f"{name}{_label_str(labels)} {_num(value)}")
+        lines.append(f"# HELP {self._uptime_metric} Seconds since the process started")
+        lines.append(f"# TYPE {self._uptime_metric} gauge")
+        lines.append(f"{self._uptime_metric} {time.time() - self.started_at:.1f}")
+        return "\n".join(lines) + "\n"
+
+
+def route_label(request: Any) -> str:
+    """Route template of a request (e.g. /api/packets/{packet_id}/replay), to keep label cardinality bounded."""
+    route = (getattr(request, "scope", None) or {}).get("route")
+    path = getattr(route, "path", None)
+    return path if isinstance(path, str) else "unmatched"
+
+
+_HELP = {
+    "bridge_encodes_total": "JSON -> protobuf encodes",
+    "bridge_decodes_total": "protobuf -> JSON decodes (including stream chunks)",
+    "bridge_warp_forwards_total": "Requests forwarded to the Warp API",
+    "bridge_warp_responses_total": "Responses received from the Warp API",
+    "bridge_warp_requests_total": "Upstream Warp HTTP requests by response status",
+    "bridge_warp_response_seconds": "Time from sending a Warp request until its response headers arrived",
+    "bridge_auth_refreshes_total": "JWT refresh attempts",
+    "bridge_auth_refresh_failures_total": "Failed JWT refresh attempts",
+    "bridge_anonymous_tokens_total": "Anonymous access tokens acquired",
+    "bridge_errors_total": "Captured error packets",
+    "bridge_bytes_in_total": "Protobuf bytes received (decoded / from Warp)",
+    "bridge_bytes_out_total": "Protobuf bytes produced (encoded / sent to Warp)",
+    "bridge_packets_total": "Captured packets by event class",
+    "bridge_http_requests_total": "HTTP requests served by the bridge",
+    "bridge_http_request_duration_seconds": "Bridge HTTP request duration until the response body was sent",
+    "bridge_account_available": "1 when a pooled Warp account can take requests, 0 when disabled or cooling down",
+    "bridge_account_cooldown_seconds": "Seconds until a pooled Warp account leaves its quota cooldown",
+    "bridge_account_requests": "Requests served by a pooled Warp account since start",
+    "bridge_account_failures": "Quota / auth failures of a pooled Warp account since start",
+    "bridge_account_tokens": "Tokens Warp reported for a pooled Warp account since start, by type",
+    **memory_help("bridge"),
+}
+
+
+class BridgeMetrics(MetricsRegistry):
+    def __init__(self):
+        super().__init__(_HELP, "bridge_uptime_seconds")
+        self.add_collector(_account_pool_gauges)
+        self.add_collector(lambda: memory_watch.gauges("bridge"))
+
+    def observe_packet(self, event_class: str, packet_type: str, direction: str, status: str, size: int) -> None:
+        self.inc("bridge_packets_total", event_class=event_class)
+        if event_class == "encode":
+            self.inc("bridge_encodes_total")
+        elif event_class == "decode":
+            self.inc("bridge_decodes_total")
+        elif event_class == "warp-request":
+            self.inc("bridge_warp_forwards_total")
+        elif event_class == "warp-response" and status != "error":
+            self.inc("bridge_warp_responses_total")
+        if status == "error":
+            self.inc("bridge_errors_total", type=packet_type)
+        if size:
+            if direction == "outbound":
+                self.inc("bridge_bytes_out_total", size)
+            elif direction == "inbound":
+                self.inc("bridge_bytes_in_total", size)
+
+    def observe_request(self, request: Any, status: int, latency: float, fields: Dict[str, Any]) -> None:
+        route = route_label(request)
+        self.inc("bridge_http_requests_total", route=route, method=request.method, status=status)
+        self.observe("bridge_http_request_duration_seconds", latency, route=route)
+
+
+def _account_pool_gauges() -> Iterable[Tuple[str, Dict[str, str], float]]:
+    from .account_pool import get_account_pool
+    pool = get_account_pool()
+    if pool is None:
+        return
+    for account in pool.status():
+        labels = {"account": account["label"]}
+        yield "bridge_account_available", labels, 1 if account["available"] else 0
+        yield "bridge_account_cooldown_seconds", labels, account["cooldown_remaining"]
+        yield "bridge_account_requests", labels, account["requests"]
+        yield "bridge_account_failures", labels, account["failures"]
+    for row in pool.usage():
+        yield "bridge_account_tokens", {"account": row["label"], "type": "prompt"}, row["prompt_tokens"]
+        yield "bridge_account_tokens", {"account": row["label"], "type": "completion"}, row["completion_tokens"]
+
+
+bridge_metrics = BridgeMetrics()
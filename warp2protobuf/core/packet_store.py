@@ -0,0 +1,159 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Persistent packet history store
+
+Optional SQLite backing for the bridge packet capture so that a crash or
+restart does not wipe history. Retention is enforced by row count and by age
+on every insert. The bridge calls the blocking methods through
+asyncio.to_thread, and serves /api/packets/history, export and replay from here so
+the persisted rows stay queryable after a restart.
+"""
+import json
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, List, Optional, Tuple
+
+from .logging import logger
+
+
+class PacketStore:
+    """SQLite-backed packet log with max-rows and max-age retention."""
+
+    def __init__(self, path: str, max_rows: int = 10000, max_age_seconds: float = 0):
+        self.path = path
+        self.max_rows = max_rows
+        self.max_age_seconds = max_age_seconds
+        self._lock = threading.Lock()
+        self._conn = sqlite3.connect(path, check_same_thread=False)
+        self._conn.execute("PRAGMA journal_mode=WAL")
+        self._conn.execute(
+            "CREATE TABLE IF NOT EXISTS packets ("
+            " id INTEGER PRIMARY KEY,"
+            " ts REAL NOT NULL,"
+            " type TEXT NOT NULL,"
+            " body TEXT NOT NULL)"
+        )
+        self._conn.execute("CREATE INDEX IF NOT EXISTS idx_packets_ts ON packets(ts)")
+        self._conn.commit()
+        self.prune()
+
+    def add(self, packet: Dict[str, Any]) -> None:
+        body = json.dumps(packet, ensure_ascii=False, default=str)
+        with self._lock:
+            self._conn.execute(
+                "INSERT OR REPLACE INTO packets (id, ts, type, body) VALUES (?, ?, ?, ?)",
+                (packet["id"], packet["ts"], packet["type"], body),
+            )
+            self._prune_locked()
+            self._conn.commit()
+
+    def load_recent(self, limit: int) -> List[Dict[str, Any]]:
+        with self._lock:
+            rows = self._conn.execute(
+                "SELECT body FROM packets ORDER BY id DESC LIMIT ?", (limit,)
+            ).fetchall()
+        return self._decode(reversed(rows))
+
+    def query(self, packet_type: Optional[str] = None, direction: Optional[str] = None,
+              status: Optional[str] = None, message_type: Optional[str] = None,
+              since: Optional[float] = None, until: Optional[float] = None,
+              limit: Optional[int] = None, offset: int = 0) -> Tuple[List[Dict[str, Any]], int]:
+        """按条件查询，返回 (按 id 升序的一页, 匹配总数)；offset 从最新记录往前计。"""
+        where: List[str] = []
+        args: List[Any] = []
+        if packet_type:
+            where.append("substr(type, 1, ?) = ?")
+            args += [len(packet_type), packet_type]
+        for field, value in (("direction", direction), ("status", status), ("message_type", message_type)):
+            if value:
+                where.append(f"json_extract(body, '$.{field}') = ?")
+                args.append(value)
+        if since is not None:
+            where.append("ts >= ?")
+            args.append(since)
+        if until is not None:
+            where.append("ts <= ?")
+            args.append(until)
+        clause = (" WHERE " + " AND ".join(where)) if where else ""
+        with self._lock:
+            matched = self._conn.execute(f"SELECT COUNT(*) FROM packets{clause}", args).fetchone()[0]
+            rows = self._conn.execute(
+                f"SELECT body FROM packets{clause} ORDER BY id DESC LIMIT ? OFFSET ?",
+                args + [-1 if limit is None else limit, offset],
+            ).fetchall()
+        return self._decode(reversed(rows)), int(matched)
+
+    def get(self, packet_id: int) -> Optional[Dict[str, Any]]:
+        with self._lock:
+            row = self._conn.execute("SELECT body FROM packets WHERE id = ?", (packet_id,)).fetchone()
+        found = self._decode([row] if row else [])
+        return found[0] if found else None
+
+    def find_related(self, packet_id: int, type_prefix: str = "") -> Optional[Dict[str, Any]]:
+        """The oldest packet whose related_id is packet_id and whose type starts with type_prefix."""
+        with self._lock:
+            row = self._conn.execute(
+                "SELECT body FROM packets WHERE json_extract(body, '$.related_id') = ?"
+                " AND substr(type, 1, ?) = ? ORDER BY id LIMIT 1",
+                (packet_id, len(type_prefix), type_prefix),
+            ).fetchone()
+        found = self._decode([row] if row else [])
+        return found[0] if found else None
+
+    def count(self) -> int:
+        with self._lock:
+            row = self._conn.execute("SELECT COUNT(*) FROM packets").fetchone()
+        return int(row[0] or 0)
+
+    @staticmethod
+    def _decode(rows) -> List[Dict[str, Any]]:
+        out: List[Dict[str, Any]] = []
+        for (body,) in rows:
+            try:
+                out.append(json.loads(body))
+            except ValueError:
+                continue
+        return out
+
+    def max_id(self) -> int:
+        with self._lock:
+            row = self._conn.execute("SELECT MAX(id) FROM packets").fetchone()
+        return int(row[0] or 0)
+
+    def prune(self) -> None:
+        with self._lock:
+            self._prune_locked()
+            self._conn.commit()
+
+    def _prune_locked(self) -> None:
+        if self.max_age_seconds > 0:
+            self._conn.execute("DELETE FROM packets WHERE ts < ?", (time.time() - self.max_age_seconds,))
+        if self.max_rows > 0:
+            self._conn.execute(
+                "DELETE FROM packets WHERE id <= (SELECT id FROM packets ORDER BY id DESC LIMIT 1 OFFSET ?)",
+                (self.max_rows,),
+            )
+
+    def clear(self) -> None:
+        with self._lock:
+            self._conn.execute("DELETE FROM packets")
+            self._conn.commit()
+
+    def close(self) -> None:
+        with self._lock:
+            self._conn.close()
+
+
+def open_packet_store(path: Optional[str], max_rows: int, max_age_hours: float) -> Optional[PacketStore]:
+    """Open the store if `path` is configured; failures are logged and persistence stays off."""
+    if not path:
+        return None
+    try:
+        store = PacketStore(path, max_rows=max_rows, max_age_seconds=max_age_hours * 3600)
+        logger.info(f"数据包历史持久化已启用: {path} (max_rows={max_rows}, max_age_hours={max_age_hours})")
+        return store
+    except Exception as e:
+        logger.warning(f"无法打开数据包历史存储 {path}: {e}")
+        return None
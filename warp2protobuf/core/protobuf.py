@@ -19,8 +19,9 @@ from google.protobuf.descriptor import FieldDescriptor as FD
 from google.protobuf.message_factory import GetMessageClass
 from google.protobuf import struct_pb2
 
-from ..config.settings import PROTO_DIR, CLIENT_VERSION, OS_CATEGORY, OS_NAME, OS_VERSION, TEXT_FIELD_NAMES, PATH_HINT_BONUS
+from ..config.settings import PROTO_DIR, DESCRIPTOR_SET_FILE, CLIENT_VERSION, OS_CATEGORY, OS_NAME, OS_VERSION, TEXT_FIELD_NAMES, PATH_HINT_BONUS
 from .logging import logger, log
+from .schema_versions import record_schema_version
 
 # Global protobuf state
 _pool: Optional[descriptor_pool.DescriptorPool] = None
@@ -73,21 +74,21 @@ def _build_descset(proto_files: List[str], includes: List[str]) -> bytes:
     except Exception:
         tool_inc = None
 
-    outdir = pathlib.Path(tempfile.mkdtemp(prefix="desc_"))
-    out = outdir / "bundle.pb"
-    args = ["protoc", f"--descriptor_set_out={out}", "--include_imports"]
-    for inc in includes:
-        args.append(f"-I{inc}")
-    if tool_inc:
-        args.append(f"-I{tool_inc}")
-    args.extend(proto_files)
-    rc = protoc.main(args)
-    if rc != 0 or not out.exists():
-        raise RuntimeError("protoc failed to produce descriptor set")
-    return out.read_bytes()
-
-
-def _load_pool_from_descset(descset: bytes):
+    with tempfile.TemporaryDirectory(prefix="desc_") as outdir:
+        out = pathlib.Path(outdir) / "bundle.pb"
+        args = ["protoc", f"--descriptor_set_out={out}", "--include_imports"]
+        for inc in includes:
+            args.append(f"-I{inc}")
+        if tool_inc:
+            args.append(f"-I{tool_inc}")
+        args.extend(proto_files)
+        rc = protoc.main(args)
+        if rc != 0 or not out.exists():
+            raise RuntimeError("protoc failed to produce descriptor set")
+        return out.read_bytes()
+
+
+def _load_pool_from_descset(descset: bytes, source: str = "unknown"):
     global _pool, ALL_MSGS
     fds = descriptor_pb2.FileDescriptorSet()
     fds.ParseFromString(descset)
@@ -105,17 +106,93 @@ def _load_pool_from_descset(descset: bytes):
         for m in fd.message_type:
             walk(m, pkg)
     _pool, ALL_MSGS = pool, names
-    log(f"proto loaded: {len(ALL_MSGS)} message type(s)")
+    ver = record_schema_version(descset, source)
+    log(f"proto loaded: {len(ALL_MSGS)} message type(s), schema version {ver['version']} ({source})")
+
+
+def _descset_is_fresh(descset_path: pathlib.Path, proto_files: List[str]) -> bool:
+    """The embedded descriptor set is usable if it is newer than every .proto source."""
+    if not descset_path.exists():
+        return False
+    try:
+        built_at = descset_path.stat().st_mtime
+        return all(pathlib.Path(f).stat().st_mtime <= built_at for f in proto_files)
+    except OSError:
+        return False
+
+
+def _write_descset(descset: bytes, descset_path: pathlib.Path) -> None:
+    try:
+        descset_path.parent.mkdir(parents=True, exist_ok=True)
+        descset_path.write_bytes(descset)
+        logger.info(f"Descriptor set cached at {descset_path} ({len(descset)} bytes)")
+    except Exception as e:
+        logger.warning(f"Could not cache descriptor set at {descset_path}: {e}")
 
 
 def ensure_proto_runtime():
     if _pool is not None: 
         return
     files = _find_proto_files(PROTO_DIR)
+    if DESCRIPTOR_SET_FILE.exists() and (not files or _descset_is_fresh(DESCRIPTOR_SET_FILE, files)):
+        logger.info(f"Loading embedded descriptor set: {DESCRIPTOR_SET_FILE}")
+        _load_pool_from_descset(DESCRIPTOR_SET_FILE.read_bytes(), "descriptor_set_file")
+        return
     if not files:
-        raise RuntimeError(f"No .proto found under {PROTO_DIR}")
+        raise RuntimeError(f"No .proto found under {PROTO_DIR} and no descriptor set at {DESCRIPTOR_SET_FILE}")
     desc = _build_descset(files, [str(PROTO_DIR)])
-    _load_pool_from_descset(desc)
+    _write_descset(desc, DESCRIPTOR_SET_FILE)
+    _load_pool_from_descset(desc, "protoc")
+
+
+def load_descriptor_set(descset: bytes, persist: bool = False, source: str = "upload") -> int:
+    """Replace the active registry with a serialized FileDescriptorSet.
+
+    Returns the number of message types loaded. When `persist` is set the set
+    is also written to DESCRIPTOR_SET_FILE so it survives restarts.
+    """
+    global _REQ_CACHE
+    _load_pool_from_descset(descset, source)
+    _REQ_CACHE = None
+    if persist:
+        _write_descset(descset, DESCRIPTOR_SET_FILE)
+    return len(ALL_MSGS)
+
+
+def compile_proto_sources(sources: Dict[str, str]) -> bytes:
+    """Compile uploaded .proto sources together with the bundled ones.
+
+    Uploaded files shadow bundled files of the same name; imports resolve
+    against PROTO_DIR so partial uploads can reference existing messages.
+    """
+    with tempfile.TemporaryDirectory(prefix="proto_upload_") as tmp:
+        workdir = pathlib.Path(tmp)
+        names: List[str] = []
+        for name, text in sources.items():
+            safe = pathlib.Path(name).name
+            if not safe.endswith(".proto"):
+                raise ValueError(f"not a .proto file: {name}")
+            (workdir / safe).write_text(text, encoding="utf-8")
+            names.append(safe)
+        bundled = [f for f in _find_proto_files(PROTO_DIR) if pathlib.Path(f).name not in names]
+        files = [str(workdir / n) for n in names] + bundled
+        return _build_descset(files, [str(workdir), str(PROTO_DIR)])
+
+
+def get_pool() -> descriptor_pool.DescriptorPool:
+    """The active descriptor pool, used to resolve google.protobuf.Any type URLs."""
+    ensure_proto_runtime()
+    return _pool  # type: ignore
+
+
+def has_message_type(full: str) -> bool:
+    """Whether `full` names a message type in the loaded registry."""
+    ensure_proto_runtime()
+    try:
+        _pool.FindMessageTypeByName(full)  # type: ignore
+        return True
+    except KeyError:
+        return False
 
 
 def msg_cls(full: str):
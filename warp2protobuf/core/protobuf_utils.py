@@ -5,29 +5,173 @@ Protobuf utility functions
 
 Shared functions for protobuf encoding/decoding across the application.
 """
-from typing import Any, Dict
+from collections import OrderedDict
+from typing import Any, Dict, List
 from fastapi import HTTPException
 from .logging import logger
-from .protobuf import ensure_proto_runtime, msg_cls
-from google.protobuf.json_format import MessageToDict
+from .protobuf import ensure_proto_runtime, msg_cls, has_message_type, get_pool
+from google.protobuf.json_format import MessageToDict, ParseDict
 from google.protobuf import struct_pb2
 from google.protobuf.descriptor import FieldDescriptor as _FD
 from .server_message_data import decode_server_message_data, encode_server_message_data
+import base64
+
+try:
+    from google.protobuf.unknown_fields import UnknownFieldSet as _UnknownFieldSet
+except Exception:  # protobuf < 4.22
+    _UnknownFieldSet = None
+
+# 这些 well-known types 有专门的 JSON 表示（@type、RFC3339 字符串、裸标量等），
+# 交给 json_format 处理并通过当前 registry 解析 Any 的 type URL
+_WELL_KNOWN_JSON_TYPES = {
+    "google.protobuf.Any",
+    "google.protobuf.Timestamp",
+    "google.protobuf.Duration",
+    "google.protobuf.FieldMask",
+    "google.protobuf.Value",
+    "google.protobuf.ListValue",
+    "google.protobuf.DoubleValue",
+    "google.protobuf.FloatValue",
+    "google.protobuf.Int64Value",
+    "google.protobuf.UInt64Value",
+    "google.protobuf.Int32Value",
+    "google.protobuf.UInt32Value",
+    "google.protobuf.BoolValue",
+    "google.protobuf.StringValue",
+    "google.protobuf.BytesValue",
+}
+
+_WIRE_TYPE_NAMES = {0: "varint", 1: "fixed64", 2: "length_delimited", 3: "group", 5: "fixed32"}
+# 已告警的未知字段（LRU，路径含重复字段下标，需限制大小）
+_reported_unknown: "OrderedDict[tuple, None]" = OrderedDict()
+_REPORTED_UNKNOWN_MAX = 1024
+
+
+
+
+
+def _require_message_type(message_type: str) -> None:
+    if not has_message_type(message_type):
+        raise HTTPException(400, f"未知的消息类型: {message_type}")
+
+
+def _message_to_dict(message: Any, emit_defaults: bool = False, json_names: bool = False) -> Dict:
+    """protojson 规范映射：int64 为字符串、bytes 为 base64、枚举为名称、oneof 仅输出已设置成员。"""
+    kwargs: Dict[str, Any] = {"preserving_proto_field_name": not json_names, "descriptor_pool": get_pool()}
+    if emit_defaults:
+        # protobuf>=5.26 重命名了该参数
+        try:
+            return MessageToDict(message, always_print_fields_with_no_presence=True, **kwargs)
+        except TypeError:
+            return MessageToDict(message, including_default_value_fields=True, **kwargs)
+    return MessageToDict(message, **kwargs)
+
+
+def _iter_unknown_fields(message: Any):
+    if _UnknownFieldSet is not None:
+        try:
+            for uf in _UnknownFieldSet(message):
+                yield uf.field_number, uf.wire_type, uf.data
+            return
+        except Exception:
+            pass
+    try:
+        for uf in message.UnknownFields():  # legacy API
+            yield uf.field_number, uf.wire_type, uf.data
+    except Exception:
+        return
+
+
+def _describe_unknown(field_number: int, wire_type: int, data: Any) -> Dict[str, Any]:
+    entry: Dict[str, Any] = {
+        "field_number": field_number,
+        "wire_type": wire_type,
+        "wire_type_name": _WIRE_TYPE_NAMES.get(wire_type, "unknown"),
+    }
+    if isinstance(data, (bytes, bytearray)):
+        entry["raw_base64"] = base64.b64encode(bytes(data)).decode("ascii")
+        entry["size"] = len(data)
+        try:
+            text = bytes(data).decode("utf-8")
+            if text.isprintable():
+                entry["as_string"] = text
+        except UnicodeDecodeError:
+            pass
+    elif isinstance(data, int):
+        entry["value"] = data
+    else:
+        entry["value"] = [_describe_unknown(n, w, d) for n, w, d in _iter_unknown_fields_of_set(data)]
+    return entry
 
 
+def _iter_unknown_fields_of_set(field_set: Any):
+    try:
+        for uf in field_set:
+            yield uf.field_number, uf.wire_type, uf.data
+    except Exception:
+        return
+
+
+def collect_unknown_fields(message: Any, path: str = "") -> List[Dict[str, Any]]:
+    """递归收集消息中未在 schema 中定义的字段（协议漂移检测）。"""
+    found: List[Dict[str, Any]] = []
+    for field_number, wire_type, data in _iter_unknown_fields(message):
+        entry = _describe_unknown(field_number, wire_type, data)
+        entry["path"] = path or "$"
+        found.append(entry)
+    for fd, value in message.ListFields():
+        if fd.type != _FD.TYPE_MESSAGE:
+            continue
+        sub_path = f"{path}.{fd.name}" if path else fd.name
+        if fd.message_type.GetOptions().map_entry:
+            value_fd = fd.message_type.fields_by_name.get("value")
+            if value_fd is not None and value_fd.type == _FD.TYPE_MESSAGE:
+                for mk, mv in value.items():
+                    found.extend(collect_unknown_fields(mv, f"{sub_path}[{mk}]"))
+        elif fd.label == _FD.LABEL_REPEATED:
+            for idx, item in enumerate(value):
+                found.extend(collect_unknown_fields(item, f"{sub_path}[{idx}]"))
+        else:
+            found.extend(collect_unknown_fields(value, sub_path))
+    return found
+
 
+def _warn_unknown_fields(message_type: str, unknown: List[Dict[str, Any]]) -> None:
+    for entry in unknown:
+        key = (message_type, entry["path"], entry["field_number"])
+        if key in _reported_unknown:
+            _reported_unknown.move_to_end(key)
+            continue
+        _reported_unknown[key] = None
+        if len(_reported_unknown) > _REPORTED_UNKNOWN_MAX:
+            _reported_unknown.popitem(last=False)
+        logger.warning(
+            f"检测到未知字段 (可能为Warp协议变更): {message_type} {entry['path']} "
+            f"#{entry['field_number']} ({entry['wire_type_name']})"
+        )
 
 
-def protobuf_to_dict(protobuf_bytes: bytes, message_type: str) -> Dict:
-    """将protobuf字节转换为字典"""
+def protobuf_to_dict(protobuf_bytes: bytes, message_type: str, emit_defaults: bool = False, json_names: bool = False) -> Dict:
+    """将protobuf字节转换为字典
+
+    emit_defaults: 输出未设置的标量字段默认值（protojson EmitDefaults）
+    json_names: 使用 lowerCamelCase 的 json_name 作为键（protojson 默认行为）
+    """
     ensure_proto_runtime()
+    _require_message_type(message_type)
     
     try:
         MessageClass = msg_cls(message_type)
         message = MessageClass()
         message.ParseFromString(protobuf_bytes)
         
-        data = MessageToDict(message, preserving_proto_field_name=True)
+        data = _message_to_dict(message, emit_defaults=emit_defaults, json_names=json_names)
+        
+        # 保留并报告未知字段，避免协议漂移被静默丢弃
+        unknown = collect_unknown_fields(message)
+        if unknown:
+            data["_unknown"] = unknown
+            _warn_unknown_fields(message_type, unknown)
         
         # 在转换阶段自动解析 server_message_data（Base64URL -> 结构化对象）
         data = _decode_smd_inplace(data)
@@ -41,9 +185,14 @@ def protobuf_to_dict(protobuf_bytes: bytes, message_type: str) -> Dict:
 
 
 
-def dict_to_protobuf_bytes(data_dict: Dict, message_type: str = "warp.multi_agent.v1.Request") -> bytes:
-    """字典转protobuf字节的包装函数"""
+def dict_to_protobuf_bytes(data_dict: Dict, message_type: str = "warp.multi_agent.v1.Request", canonical: bool = False) -> bytes:
+    """字典转protobuf字节的包装函数
+
+    canonical: 按 protojson 规则严格解析（接受 json_name/原字段名、字符串 int64、base64 bytes、
+    枚举名称，oneof 冲突报错），与其他语言的 protojson 输出互通。
+    """
     ensure_proto_runtime()
+    _require_message_type(message_type)
     
     try:
         MessageClass = msg_cls(message_type)
@@ -52,6 +201,10 @@ def dict_to_protobuf_bytes(data_dict: Dict, message_type: str = "warp.multi_agen
         # 在转换阶段自动处理 server_message_data（对象 -> Base64URL 字符串）
         safe_dict = _encode_smd_inplace(data_dict)
         
+        if canonical:
+            ParseDict(safe_dict, message, ignore_unknown_fields=False, descriptor_pool=get_pool())
+            return message.SerializeToString()
+        
         _populate_protobuf_from_dict(message, safe_dict, path="$")
         
         return message.SerializeToString()
@@ -61,6 +214,52 @@ def dict_to_protobuf_bytes(data_dict: Dict, message_type: str = "warp.multi_agen
         raise HTTPException(500, f"Protobuf编码失败: {e}")
 
 
+def field_byte_breakdown(protobuf_bytes: bytes, message_type: str, max_depth: int = 4) -> List[Dict[str, Any]]:
+    """按字段统计序列化字节占用（含tag与长度前缀），用于 /api/encode 的 return_bytes 调试输出
+
+    同一字段的多次出现（repeated）合并为一项；单次出现的子消息继续向下展开到 max_depth 层。
+    """
+    from .wire_debug import parse_fields, WIRE_LEN
+
+    def walk(buf: bytes, desc: Any, base_offset: int, depth: int) -> List[Dict[str, Any]]:
+        entries: Dict[int, Dict[str, Any]] = {}
+        slices: Dict[int, List[tuple]] = {}
+        for node in parse_fields(buf, base_offset=base_offset, max_depth=0):
+            num = node["field_number"]
+            fd = desc.fields_by_number.get(num) if desc is not None else None
+            entry = entries.get(num)
+            if entry is None:
+                entry = entries[num] = {
+                    "field": fd.name if fd is not None else None,
+                    "number": num,
+                    "wire_type": node["wire_type_name"],
+                    "offset": node["offset"],
+                    "size": 0,
+                    "count": 0,
+                }
+                if fd is None:
+                    entry["unknown"] = True
+            entry["size"] += node["size"]
+            entry["count"] += 1
+            if node["wire_type"] == WIRE_LEN:
+                start = node["data_offset"] - base_offset
+                slices.setdefault(num, []).append((start, node["length"], node["data_offset"]))
+        if depth < max_depth and desc is not None:
+            for num, entry in entries.items():
+                fd = desc.fields_by_number.get(num)
+                if fd is None or fd.type != _FD.TYPE_MESSAGE or entry["count"] != 1 or num not in slices:
+                    continue
+                start, length, data_offset = slices[num][0]
+                children = walk(buf[start:start + length], fd.message_type, data_offset, depth + 1)
+                if children:
+                    entry["fields"] = children
+        return sorted(entries.values(), key=lambda e: e["offset"])
+
+    ensure_proto_runtime()
+    _require_message_type(message_type)
+    return walk(protobuf_bytes, get_pool().FindMessageTypeByName(message_type), 0, 0)
+
+
 
 
 def _fill_google_value_dynamic(value_msg: Any, py_value: Any) -> None:
@@ -161,6 +360,22 @@ def _populate_protobuf_from_dict(proto_msg, data_dict: Dict, path: str = "$"):
         except Exception as e:
             logger.warning(f"处理 Struct 字段 {current_path} 失败: {e}")
 
+        if (
+            fd is not None
+            and fd.type == _FD.TYPE_MESSAGE
+            and fd.message_type is not None
+            and fd.message_type.full_name in _WELL_KNOWN_JSON_TYPES
+        ):
+            try:
+                if fd.label == _FD.LABEL_REPEATED:
+                    for item in (value if isinstance(value, list) else [value]):
+                        ParseDict(item, field.add(), descriptor_pool=get_pool())
+                else:
+                    ParseDict(value, field, descriptor_pool=get_pool())
+            except Exception as e:
+                logger.warning(f"填充 {fd.message_type.full_name} 字段 {current_path} 失败: {e}")
+            continue
+
         if isinstance(field, struct_pb2.Struct) and isinstance(value, dict):
             try:
                 field.update(value)
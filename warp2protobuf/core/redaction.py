@@ -0,0 +1,138 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Redaction of credentials (and optionally message content)
+
+With LOG_REDACT on (the default) every log line of both servers, the access
+logs and the captured packet history have JWTs, bearer tokens, Warp refresh
+tokens, API keys and the configured secret values masked, so debug logs and
+packet dumps can be shared. LOG_REDACT_CONTENT additionally replaces prompt /
+completion text with its length; captured packets redacted that way can no
+longer be replayed verbatim.
+"""
+import logging
+import os
+import re
+from typing import Any, Iterable, List, Optional
+
+from ..config.config_file import configured_secret_values
+
+_PATTERNS = (
+    # JWT（Warp access token / id token）
+    (re.compile(r"eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]*"), "[REDACTED_JWT]"),
+    # Firebase / Warp refresh token
+    (re.compile(r"AMf-v[A-Za-z0-9_-]{20,}"), "[REDACTED_REFRESH_TOKEN]"),
+    (re.compile(r"(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]{8,}"), r"\1 [REDACTED]"),
+    (re.compile(r"\bsk-[A-Za-z0-9_-]{8,}"), "sk-[REDACTED]"),
+    # key=value / "key": "value" 形式的凭据字段
+    (re.compile(r"""(?i)(["']?\b(?:refresh_token|id_token|access_token|api_key|apikey|x-api-key|password|client_secret)["']?\s*[:=]\s*["']?)([^"'\s,&}]{4,})"""),
+     r"\1[REDACTED]"),
+)
+
+# JSON（双引号）与 Python repr（单引号）两种写法
+_CONTENT_PATTERNS = (
+    re.compile(r'("(?:content|text|query|arguments)"\s*:\s*")((?:[^"\\]|\\.)*)(")'),
+    re.compile(r"('(?:content|text|query|arguments)'\s*:\s*')((?:[^'\\]|\\.)*)(')"),
+)
+_CONTENT_KEYS = ("content", "text", "query", "arguments")
+# 按完整键名匹配（忽略大小写），避免误伤 max_tokens、token_count 等字段
+SECRET_KEYS = frozenset({
+    "authorization", "proxy-authorization", "cookie", "set-cookie",
+    "access_token", "refresh_token", "id_token", "jwt", "token",
+    "api_key", "apikey", "x-api-key", "password", "secret", "client_secret",
+})
+
+_literals: Optional[List[str]] = None
+
+
+def redaction_enabled() -> bool:
+    return os.getenv("LOG_REDACT", "true").strip().lower() in ("1", "true", "yes")
+
+
+def content_redaction_enabled() -> bool:
+    return os.getenv("LOG_REDACT_CONTENT", "").strip().lower() in ("1", "true", "yes")
+
+
+def _secret_literals() -> List[str]:
+    """Configured secret values (longest first), for secrets no pattern recognises."""
+    global _literals
+    if _literals is None:
+        # 过短的值容易误伤普通文本，不做字面替换
+        _literals = sorted({v for v in configured_secret_values() if len(v) >= 12}, key=len, reverse=True)
+    return _literals
+
+
+def reset_secret_literals() -> None:
+    """Forget the cached secret values so keys loaded by a config reload are redacted too."""
+    global _literals
+    _literals = None
+
+
+def _content_placeholder(match: "re.Match[str]") -> str:
+    return f"{match.group(1)}[REDACTED {len(match.group(2))} chars]{match.group(3)}"
+
+
+def redact_text(text: str, content: Optional[bool] = None) -> str:
+    for literal in _secret_literals():
+        if literal in text:
+            text = text.replace(literal, "[REDACTED]")
+    for pattern, replacement in _PATTERNS:
+        text = pattern.sub(replacement, text)
+    if content if content is not None else content_redaction_enabled():
+        for pattern in _CONTENT_PATTERNS:
+            text = pattern.sub(_content_placeholder, text)
+    return text
+
+
+def is_secret_key(name: Any) -> bool:
+    return isinstance(name, str) and name.lower() in SECRET_KEYS
+
+
+def redact_value(value: Any, content: Optional[bool] = None) -> Any:
+    """Recursively redact a JSON-like structure (secret-named keys, token-looking strings, optionally content).
+
+    Used for logs, the packet capture and packet export alike.
+    """
+    if content is None:
+        content = content_redaction_enabled()
+    if isinstance(value, dict):
+        out = {}
+        for k, v in value.items():
+            lowered = k.lower() if isinstance(k, str) else ""
+            if lowered in SECRET_KEYS and v not in (None, ""):
+                out[k] = "[REDACTED]"
+            elif content and lowered in _CONTENT_KEYS and isinstance(v, str) and v:
+                out[k] = f"[REDACTED {len(v)} chars]"
+            else:
+                out[k] = redact_value(v, content)
+        return out
+    if isinstance(value, (list, tuple)):
+        return [redact_value(v, content) for v in value]
+    if isinstance(value, str):
+        return redact_text(value, content)
+    return value
+
+
+class RedactingFilter(logging.Filter):
+    """Rewrite the formatted message (and structured access-log fields) with secrets masked."""
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        if not redaction_enabled() or getattr(record, "_redacted", False):
+            return True
+        try:
+            record.msg = redact_text(record.getMessage())
+            record.args = None
+            fields = getattr(record, "fields", None)
+            if isinstance(fields, dict):
+                record.fields = redact_value(fields)
+        except Exception:
+            # 脱敏失败也不能丢日志
+            pass
+        record._redacted = True
+        return True
+
+
+def add_redaction(handlers: Iterable[logging.Handler]) -> None:
+    for handler in handlers:
+        if not any(isinstance(f, RedactingFilter) for f in handler.filters):
+            handler.addFilter(RedactingFilter())
@@ -0,0 +1,160 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Request correlation IDs
+
+Each inbound request gets an ID (the caller's x-request-id when it looks sane,
+otherwise a fresh one) held in a context variable. Log records carry it via
+RequestIdFilter, responses echo it, and outgoing bridge / Warp calls forward it,
+so one request can be followed across the OpenAI server, the bridge and Warp.
+
+Every log line emitted while serving a request also names the API key and model
+(%(request_context)s). The OpenAI server forwards both to the bridge with
+with_request_context(), so bridge and Warp client lines carry them as well.
+
+request_fields() is a per-request dict that handlers fill in (API key id, model,
+token usage, upstream account) for the access log written when the response ends.
+"""
+import contextvars
+import logging
+import re
+import time
+import uuid
+from typing import Any, Dict, Optional
+
+REQUEST_ID_HEADER = "x-request-id"
+# 仅在 OpenAI 服务器 -> bridge 之间传递，不会发往 Warp
+REQUEST_KEY_HEADER = "x-warp2api-key-id"
+REQUEST_MODEL_HEADER = "x-warp2api-model"
+
+_request_id: contextvars.ContextVar[Optional[str]] = contextvars.ContextVar("request_id", default=None)
+_fields: contextvars.ContextVar[Optional[Dict[str, Any]]] = contextvars.ContextVar("request_fields", default=None)
+_started: contextvars.ContextVar[Optional[float]] = contextvars.ContextVar("request_started", default=None)
+# 由上游服务（OpenAI 服务器）传入的 key / 模型，本进程没有鉴权信息时用于日志
+_caller: contextvars.ContextVar[Optional[Dict[str, str]]] = contextvars.ContextVar("request_caller", default=None)
+_VALID_ID = re.compile(r"^[A-Za-z0-9._:-]{1,128}$")
+_VALID_LABEL = re.compile(r"^[A-Za-z0-9._:@/+-]{1,128}$")
+
+
+def new_request_id() -> str:
+    return uuid.uuid4().hex
+
+
+def accept_request_id(incoming: Optional[str]) -> str:
+    """Use the caller's ID when it is safe to log and forward, otherwise generate one."""
+    if incoming and _VALID_ID.match(incoming):
+        return incoming
+    return new_request_id()
+
+
+def current_request_id() -> Optional[str]:
+    return _request_id.get()
+
+
+def set_request_id(request_id: Optional[str]) -> contextvars.Token:
+    return _request_id.set(request_id)
+
+
+def reset_request_id(token: contextvars.Token) -> None:
+    _request_id.reset(token)
+
+
+def with_request_id(headers: dict) -> dict:
+    """Add the current request ID to outgoing headers (no-op outside a request)."""
+    request_id = _request_id.get()
+    if request_id:
+        headers[REQUEST_ID_HEADER] = request_id
+    return headers
+
+
+def with_request_context(headers: dict) -> dict:
+    """with_request_id() plus the current API key id and model, for calls to the bridge."""
+    with_request_id(headers)
+    key_id, model = _identity()
+    if key_id:
+        headers[REQUEST_KEY_HEADER] = key_id
+    if model:
+        headers[REQUEST_MODEL_HEADER] = model
+    return headers
+
+
+def set_request_caller(headers: Any) -> contextvars.Token:
+    """Adopt the key id / model forwarded by the calling service (ignored unless they look sane)."""
+    caller = {}
+    for name, header in (("key_id", REQUEST_KEY_HEADER), ("model", REQUEST_MODEL_HEADER)):
+        value = headers.get(header)
+        if value and _VALID_LABEL.match(value):
+            caller[name] = value
+    return _caller.set(caller or None)
+
+
+def reset_request_caller(token: contextvars.Token) -> None:
+    _caller.reset(token)
+
+
+def _identity() -> tuple:
+    fields = _fields.get() or {}
+    caller = _caller.get() or {}
+    return fields.get("key_id") or caller.get("key_id"), fields.get("model") or caller.get("model")
+
+
+def begin_request_fields() -> contextvars.Token:
+    # 同一个dict在复制出的子任务上下文中共享，流式响应结束时仍能读到处理过程中写入的字段
+    _started.set(time.perf_counter())
+    return _fields.set({})
+
+
+def end_request_fields(token: contextvars.Token) -> None:
+    _fields.reset(token)
+
+
+def request_fields() -> Dict[str, Any]:
+    """Mutable access-log fields of the current request (a throwaway dict outside a request)."""
+    fields = _fields.get()
+    return fields if fields is not None else {}
+
+
+def record_usage(usage: Optional[Dict[str, Any]]) -> None:
+    """Add an OpenAI-style usage dict to the current request's token counts."""
+    if not isinstance(usage, dict):
+        return
+    fields = request_fields()
+    for key in ("prompt_tokens", "completion_tokens"):
+        value = usage.get(key)
+        if isinstance(value, int):
+            fields[key] = fields.get(key, 0) + value
+
+
+def record_finish(reason: Optional[str], error: Optional[str] = None) -> None:
+    """Note how the current completion ended (finish_reason, and the error message if any)."""
+    fields = request_fields()
+    if reason:
+        fields["finish_reason"] = reason
+    if error:
+        fields["error"] = error[:500]
+
+
+def record_first_token() -> None:
+    """Note the time to the first streamed content / tool call delta (ttft_ms); later calls are ignored."""
+    started = _started.get()
+    fields = request_fields()
+    if started is not None and "ttft_ms" not in fields:
+        fields["ttft_ms"] = round((time.perf_counter() - started) * 1000, 1)
+
+
+class RequestIdFilter(logging.Filter):
+    """Expose the current request ID as %(request_id)s ("-" outside a request) and
+    %(request_context)s: the request ID followed by key=<api key id> model=<model> once known."""
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        request_id = _request_id.get()
+        record.request_id = request_id or "-"
+        context = record.request_id
+        if request_id:
+            key_id, model = _identity()
+            if key_id:
+                context += f" key={key_id}"
+            if model:
+                context += f" model={model}"
+        record.request_context = context
+        return True
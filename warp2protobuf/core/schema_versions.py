@@ -0,0 +1,127 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Schema registry version tracking
+
+Every FileDescriptorSet loaded into the runtime (startup, protoc rebuild,
+runtime upload) is recorded as a numbered version with a flattened field map,
+so two versions can be diffed to spot breaking Warp protocol changes
+(added/removed/renumbered/retyped fields).
+"""
+import hashlib
+import time
+from typing import Any, Dict, List, Optional
+
+from google.protobuf import descriptor_pb2
+from google.protobuf.descriptor_pb2 import FieldDescriptorProto
+
+MAX_VERSIONS = 20
+
+_versions: List[Dict[str, Any]] = []
+
+
+def _field_type_name(f: FieldDescriptorProto) -> str:
+    if f.type_name:
+        return f.type_name.lstrip(".")
+    return FieldDescriptorProto.Type.Name(f.type).replace("TYPE_", "").lower()
+
+
+def _flatten(fds: descriptor_pb2.FileDescriptorSet) -> Dict[str, Dict[str, Dict[str, Any]]]:
+    messages: Dict[str, Dict[str, Dict[str, Any]]] = {}
+
+    def walk(m: descriptor_pb2.DescriptorProto, prefix: str) -> None:
+        full = f"{prefix}.{m.name}" if prefix else m.name
+        messages[full] = {
+            f.name: {
+                "number": f.number,
+                "type": _field_type_name(f),
+                "label": FieldDescriptorProto.Label.Name(f.label).replace("LABEL_", "").lower(),
+            }
+            for f in m.field
+        }
+        for nested in m.nested_type:
+            walk(nested, full)
+
+    for fd in fds.file:
+        for m in fd.message_type:
+            walk(m, fd.package)
+    return messages
+
+
+def record_schema_version(descset: bytes, source: str) -> Dict[str, Any]:
+    """Record a loaded descriptor set; identical consecutive sets are not duplicated."""
+    digest = hashlib.sha256(descset).hexdigest()
+    if _versions and _versions[-1]["sha256"] == digest:
+        return _versions[-1]
+    fds = descriptor_pb2.FileDescriptorSet()
+    fds.ParseFromString(descset)
+    version = {
+        "version": (_versions[-1]["version"] + 1) if _versions else 1,
+        "sha256": digest,
+        "source": source,
+        "loaded_at": time.time(),
+        "files": [fd.name for fd in fds.file],
+        "messages": _flatten(fds),
+    }
+    _versions.append(version)
+    if len(_versions) > MAX_VERSIONS:
+        del _versions[: len(_versions) - MAX_VERSIONS]
+    return version
+
+
+def list_schema_versions() -> List[Dict[str, Any]]:
+    return [
+        {k: v for k, v in ver.items() if k != "messages"} | {"message_count": len(ver["messages"])}
+        for ver in _versions
+    ]
+
+
+def get_schema_version(version: Optional[int]) -> Optional[Dict[str, Any]]:
+    if not _versions:
+        return None
+    if version is None:
+        return _versions[-1]
+    for ver in _versions:
+        if ver["version"] == version:
+            return ver
+    return None
+
+
+def diff_schema_versions(old: Dict[str, Any], new: Dict[str, Any]) -> Dict[str, Any]:
+    old_msgs, new_msgs = old["messages"], new["messages"]
+    changed: Dict[str, Any] = {}
+    breaking = False
+    for name in sorted(set(old_msgs) & set(new_msgs)):
+        a, b = old_msgs[name], new_msgs[name]
+        entry: Dict[str, Any] = {}
+        added = {f: b[f] for f in b if f not in a}
+        removed = {f: a[f] for f in a if f not in b}
+        renumbered = {f: {"from": a[f]["number"], "to": b[f]["number"]} for f in a if f in b and a[f]["number"] != b[f]["number"]}
+        retyped = {
+            f: {"from": f"{a[f]['label']} {a[f]['type']}", "to": f"{b[f]['label']} {b[f]['type']}"}
+            for f in a if f in b and (a[f]["type"], a[f]["label"]) != (b[f]["type"], b[f]["label"])
+        }
+        # A field number reused by a different name is as breaking as a renumber
+        old_by_num = {v["number"]: f for f, v in a.items()}
+        reused = {str(v["number"]): {"from": old_by_num[v["number"]], "to": f} for f, v in b.items()
+                  if v["number"] in old_by_num and old_by_num[v["number"]] != f and f not in a}
+        for key, val in (("added", added), ("removed", removed), ("renumbered", renumbered),
+                         ("retyped", retyped), ("number_reused", reused)):
+            if val:
+                entry[key] = val
+        if entry:
+            changed[name] = entry
+            if removed or renumbered or retyped or reused:
+                breaking = True
+    removed_messages = sorted(set(old_msgs) - set(new_msgs))
+    return {
+        "from": old["version"],
+        "to": new["version"],
+        "from_sha256": old["sha256"],
+        "to_sha256": new["sha256"],
+        "identical": old["sha256"] == new["sha256"],
+        "breaking": breaking or bool(removed_messages),
+        "added_messages": sorted(set(new_msgs) - set(old_msgs)),
+        "removed_messages": removed_messages,
+        "changed_messages": changed,
+    }
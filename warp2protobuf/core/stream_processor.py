@@ -184,6 +184,70 @@ class StreamSession:
         logger.debug(f"流式会话 {self.session_id} 已关闭")
 
 
+class StreamDecoder:
+    """varint 长度前缀帧解码器
+
+    按任意边界切分的原始字节块依次 feed()，跨块拼接不完整的帧，每凑齐一个
+    完整消息就解码出一个 JSON 事件。
+    """
+
+    def __init__(self, message_type: str = "warp.multi_agent.v1.ResponseEvent", max_frame_size: int = 16 * 1024 * 1024):
+        self.message_type = message_type
+        self.max_frame_size = max_frame_size
+        self._buffer = bytearray()
+        self.frames_decoded = 0
+        self.bytes_consumed = 0
+
+    @staticmethod
+    def _read_varint(buf: bytearray) -> Optional[tuple]:
+        """返回 (value, header_len)；数据不足时返回 None。"""
+        value = 0
+        shift = 0
+        for i, b in enumerate(buf):
+            value |= (b & 0x7F) << shift
+            if not (b & 0x80):
+                return value, i + 1
+            shift += 7
+            if shift > 63:
+                raise ValueError("invalid varint length prefix")
+        return None
+
+    def feed(self, chunk: bytes) -> List[Dict[str, Any]]:
+        self._buffer.extend(chunk)
+        events: List[Dict[str, Any]] = []
+        while self._buffer:
+            header = self._read_varint(self._buffer)
+            if header is None:
+                break
+            length, header_len = header
+            if length > self.max_frame_size:
+                raise ValueError(f"frame too large: {length} bytes")
+            if len(self._buffer) < header_len + length:
+                break
+            frame = bytes(self._buffer[header_len:header_len + length])
+            del self._buffer[:header_len + length]
+            self.bytes_consumed += header_len + length
+            event: Dict[str, Any] = {"frame_index": self.frames_decoded, "size": length}
+            try:
+                event["json_data"] = protobuf_to_dict(frame, self.message_type)
+                event["parsed_successfully"] = True
+            except Exception as e:
+                event["error"] = str(getattr(e, "detail", e))
+                event["parsed_successfully"] = False
+            self.frames_decoded += 1
+            events.append(event)
+        return events
+
+    @property
+    def pending_bytes(self) -> int:
+        return len(self._buffer)
+
+    def close(self) -> None:
+        """结束输入；残留的不完整帧视为错误。"""
+        if self._buffer:
+            raise ValueError(f"stream ended with {len(self._buffer)} bytes of incomplete frame")
+
+
 class StreamPacketAnalyzer:
     """流式数据包分析器"""
     
@@ -0,0 +1,235 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Shared Warp token store
+
+Warp rotates refresh tokens: once one instance exchanges a refresh token, the
+copies other replicas hold can stop working. With WARP_TOKEN_STORE set, every
+refresh of the single WARP_REFRESH_TOKEN credential and of each pooled account
+goes through a store shared by all instances (a SQLite file on a shared volume,
+or Redis), under a cross-instance lock: the first instance refreshes and saves
+the new access token and the rotated refresh token, the others wait for the
+lock and then reuse what it saved instead of refreshing again.
+
+Without WARP_TOKEN_STORE refreshes stay per process (an in-process lock still
+keeps concurrent requests of one instance from refreshing twice).
+"""
+import asyncio
+import hashlib
+import json
+import os
+import sqlite3
+import time
+import uuid
+from contextlib import asynccontextmanager
+from typing import Any, AsyncIterator, Awaitable, Callable, Dict, Optional
+
+from .logging import logger
+
+_local_locks: Dict[str, asyncio.Lock] = {}
+
+
+class TokenStoreLockTimeout(TimeoutError):
+    """Another instance held the refresh lock for longer than the wait allows."""
+
+
+class TokenStore:
+    """Saved token records ({access_token, refresh_token, updated_at}) plus a named lock."""
+
+    name = "none"
+
+    def __init__(self, lock_timeout: float):
+        # 锁的租期：持有者崩溃后最多这么久锁会自动失效
+        self.lock_timeout = lock_timeout
+
+    async def get(self, key: str) -> Optional[Dict[str, Any]]:
+        raise NotImplementedError
+
+    async def put(self, key: str, record: Dict[str, Any]) -> None:
+        raise NotImplementedError
+
+    async def _try_lock(self, key: str, owner: str) -> bool:
+        raise NotImplementedError
+
+    async def _unlock(self, key: str, owner: str) -> None:
+        raise NotImplementedError
+
+    @asynccontextmanager
+    async def lock(self, key: str) -> AsyncIterator[None]:
+        owner = uuid.uuid4().hex
+        # 等待时间超过一个租期，即使持有者崩溃也能拿到锁
+        deadline = time.monotonic() + self.lock_timeout * 2
+        while not await self._try_lock(key, owner):
+            if time.monotonic() >= deadline:
+                raise TokenStoreLockTimeout(f"token store lock {key} not acquired within {self.lock_timeout * 2:.0f}s")
+            await asyncio.sleep(0.2)
+        try:
+            yield
+        finally:
+            await self._unlock(key, owner)
+
+
+class SQLiteTokenStore(TokenStore):
+    name = "sqlite"
+
+    def __init__(self, path: str, lock_timeout: float):
+        super().__init__(lock_timeout)
+        self.path = path
+        with self._connect() as conn:
+            conn.execute("PRAGMA journal_mode=WAL")
+            conn.execute("CREATE TABLE IF NOT EXISTS tokens (key TEXT PRIMARY KEY, record TEXT NOT NULL, updated_at REAL NOT NULL)")
+            conn.execute("CREATE TABLE IF NOT EXISTS token_locks (key TEXT PRIMARY KEY, owner TEXT NOT NULL, expires_at REAL NOT NULL)")
+
+    def _connect(self) -> sqlite3.Connection:
+        return sqlite3.connect(self.path, timeout=10.0)
+
+    def _get(self, key: str) -> Optional[Dict[str, Any]]:
+        with self._connect() as conn:
+            row = conn.execute("SELECT record FROM tokens WHERE key = ?", (key,)).fetchone()
+        return json.loads(row[0]) if row else None
+
+    def _put(self, key: str, record: Dict[str, Any]) -> None:
+        with self._connect() as conn:
+            conn.execute("INSERT OR REPLACE INTO tokens (key, record, updated_at) VALUES (?, ?, ?)",
+                         (key, json.dumps(record), time.time()))
+
+    def _lock_row(self, key: str, owner: str) -> bool:
+        now = time.time()
+        conn = self._connect()
+        try:
+            conn.isolation_level = None
+            conn.execute("BEGIN IMMEDIATE")
+            conn.execute("DELETE FROM token_locks WHERE key = ? AND expires_at <= ?", (key, now))
+            acquired = conn.execute("INSERT OR IGNORE INTO token_locks (key, owner, expires_at) VALUES (?, ?, ?)",
+                                    (key, owner, now + self.lock_timeout)).rowcount == 1
+            conn.execute("COMMIT")
+            return acquired
+        finally:
+            conn.close()
+
+    def _unlock_row(self, key: str, owner: str) -> None:
+        with self._connect() as conn:
+            conn.execute("DELETE FROM token_locks WHERE key = ? AND owner = ?", (key, owner))
+
+    async def get(self, key: str) -> Optional[Dict[str, Any]]:
+        return await asyncio.to_thread(self._get, key)
+
+    async def put(self, key: str, record: Dict[str, Any]) -> None:
+        await asyncio.to_thread(self._put, key, record)
+
+    async def _try_lock(self, key: str, owner: str) -> bool:
+        return await asyncio.to_thread(self._lock_row, key, owner)
+
+    async def _unlock(self, key: str, owner: str) -> None:
+        await asyncio.to_thread(self._unlock_row, key, owner)
+
+
+# 只有仍持有锁（owner 相同）时才删除，避免误删租期过后被别人拿到的锁
+_REDIS_UNLOCK = "if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) else return 0 end"
+
+
+class RedisTokenStore(TokenStore):
+    name = "redis"
+
+    def __init__(self, url: str, password: str, lock_timeout: float, prefix: str = "warp2api:tokens:"):
+        super().__init__(lock_timeout)
+        import redis.asyncio as redis
+        self.prefix = prefix
+        self._client = redis.from_url(url, password=password or None, decode_responses=True)
+
+    async def get(self, key: str) -> Optional[Dict[str, Any]]:
+        raw = await self._client.get(self.prefix + key)
+        return json.loads(raw) if raw else None
+
+    async def put(self, key: str, record: Dict[str, Any]) -> None:
+        await self._client.set(self.prefix + key, json.dumps(record))
+
+    async def _try_lock(self, key: str, owner: str) -> bool:
+        return bool(await self._client.set(f"{self.prefix}lock:{key}", owner, nx=True, px=int(self.lock_timeout * 1000)))
+
+    async def _unlock(self, key: str, owner: str) -> None:
+        await self._client.eval(_REDIS_UNLOCK, 1, f"{self.prefix}lock:{key}", owner)
+
+
+_store: Optional[TokenStore] = None
+_store_built = False
+
+
+def get_token_store() -> Optional[TokenStore]:
+    """Store selected by WARP_TOKEN_STORE (redis:// / rediss:// URL, or a SQLite file path); None when unset."""
+    global _store, _store_built
+    if not _store_built:
+        _store_built = True
+        target = os.getenv("WARP_TOKEN_STORE", "").strip()
+        lock_timeout = float(os.getenv("WARP_TOKEN_STORE_LOCK_TIMEOUT", "30"))
+        if target.startswith(("redis://", "rediss://")):
+            _store = RedisTokenStore(target, os.getenv("WARP_TOKEN_STORE_PASSWORD", ""), lock_timeout)
+        elif target:
+            _store = SQLiteTokenStore(os.path.expanduser(target), lock_timeout)
+        if _store is not None:
+            logger.info(f"共享token存储已启用: {_store.name}")
+    return _store
+
+
+async def refresh_shared(
+    key: str,
+    refresh_token: Optional[str],
+    refresh: Callable[[Optional[str]], Awaitable[Dict[str, Any]]],
+    still_valid: Callable[[str], bool],
+) -> Dict[str, Any]:
+    """Refresh the credential `key` once across instances; returns token data like refresh_jwt_token.
+
+    Inside the lock the store is read again: if another instance refreshed meanwhile, its
+    access token is returned as is; otherwise the newest saved refresh token (Warp may
+    have rotated the configured one) is exchanged and the result saved for the others.
+    A lock timeout falls back to the saved token only; refreshing locally is reserved for
+    a store that cannot be reached at all.
+    """
+    local = _local_locks.setdefault(key, asyncio.Lock())
+    async with local:
+        store = get_token_store()
+        if store is None:
+            return await refresh(refresh_token)
+        token_data: Optional[Dict[str, Any]] = None
+        refreshing = False
+        try:
+            async with store.lock(key):
+                saved = await store.get(key) or {}
+                if saved.get("access_token") and still_valid(saved["access_token"]):
+                    logger.info(f"使用其他实例刷新的token: {key}")
+                    token_data = saved
+                    return saved
+                # 配置中的 refresh token 被更换后，不再沿用按旧 token 轮换出来的值
+                seed = hashlib.sha256((refresh_token or "").encode("utf-8")).hexdigest()[:16]
+                current = saved.get("refresh_token") if saved.get("seed") == seed else None
+                current = current or refresh_token
+                refreshing = True
+                token_data = await refresh(current)
+                refreshing = False
+                if token_data and token_data.get("access_token"):
+                    await store.put(key, {
+                        "access_token": token_data["access_token"],
+                        # Warp 未返回新的 refresh token 时沿用当前的
+                        "refresh_token": token_data.get("refresh_token") or current,
+                        "seed": seed,
+                        "updated_at": time.time(),
+                    })
+                return token_data
+        except TokenStoreLockTimeout:
+            # 存储可用，只是持锁的实例刷新得慢：改用它保存的结果，不能自己拿配置中的 refresh token 刷新
+            saved = await store.get(key) or {}
+            if saved.get("access_token") and still_valid(saved["access_token"]):
+                logger.info(f"等待token刷新锁超时，使用其他实例刷新的token: {key}")
+                return saved
+            raise
+        except Exception as e:
+            if refreshing:
+                # 刷新本身出错不是存储故障：不能再用配置中的 refresh token 重试，它可能已被 Warp 轮换作废
+                raise
+            if token_data is not None:
+                # 已刷新成功但未能保存：其他实例下次会用旧的 refresh token 重试
+                logger.warning(f"token已刷新但写入共享存储失败（{e}）: {key}")
+                return token_data
+            # 共享存储无法访问时退化为本实例单独刷新
+            logger.warning(f"共享token存储不可用（{e}），本实例单独刷新: {key}")
+            return await refresh(refresh_token)
@@ -0,0 +1,173 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+OpenTelemetry tracing
+
+Enabled when OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)
+is set and the optional opentelemetry-sdk / opentelemetry-exporter-otlp-proto-http
+packages are installed; otherwise every helper here is a cheap no-op. The rest of
+the exporter configuration uses the standard OTEL_* variables (OTEL_SERVICE_NAME,
+OTEL_EXPORTER_OTLP_HEADERS, OTEL_TRACES_SAMPLER, OTEL_TRACES_SAMPLER_ARG).
+
+A request produces one server span per service, linked across the OpenAI server
+and the bridge through the W3C traceparent header, with child spans for API key
+auth, Warp JWT retrieval, protobuf encoding, bridge calls and the upstream Warp
+HTTP request, so a slow completion can be broken down into those stages.
+"""
+import functools
+import inspect
+import os
+import threading
+from contextlib import contextmanager
+from typing import Any, Callable, Dict, Iterator, Optional
+
+from .logging import logger
+
+_lock = threading.Lock()
+_tracer: Any = None
+_configured = False
+
+
+def tracing_configured() -> bool:
+    return bool(os.getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "").strip() or os.getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "").strip())
+
+
+def setup_tracing(default_service: str) -> bool:
+    """Install the OTLP exporter once per process; returns whether tracing is active."""
+    global _tracer, _configured
+    with _lock:
+        if _configured:
+            return _tracer is not None
+        _configured = True
+        if not tracing_configured():
+            return False
+        try:
+            from opentelemetry import trace
+            from opentelemetry.exporter.otlp.proto.http.trace_exporter import OTLPSpanExporter
+            from opentelemetry.sdk.resources import Resource
+            from opentelemetry.sdk.trace import TracerProvider
+            from opentelemetry.sdk.trace.export import BatchSpanProcessor
+        except ImportError:
+            logger.warning("已设置 OTEL_EXPORTER_OTLP_ENDPOINT，但未安装 opentelemetry-sdk / opentelemetry-exporter-otlp-proto-http，追踪未启用")
+            return False
+        service = os.getenv("OTEL_SERVICE_NAME", "").strip() or default_service
+        provider = TracerProvider(resource=Resource.create({"service.name": service}))
+        # 端点、请求头、采样率均由 SDK 从标准 OTEL_* 环境变量读取
+        provider.add_span_processor(BatchSpanProcessor(OTLPSpanExporter()))
+        trace.set_tracer_provider(provider)
+        _tracer = trace.get_tracer("warp2api")
+        logger.info(f"OpenTelemetry 追踪已启用: service={service}")
+        return True
+
+
+def tracing_enabled() -> bool:
+    return _tracer is not None
+
+
+@contextmanager
+def span(name: str, **attributes: Any) -> Iterator[Any]:
+    """Child span of the current span (None when tracing is off)."""
+    if _tracer is None:
+        yield None
+        return
+    with _tracer.start_as_current_span(name, attributes=_clean(attributes)) as current:
+        yield current
+
+
+def start_span(name: str, kind: str = "internal", **attributes: Any) -> Any:
+    """A span that is not made current, for work that outlives the calling frame (streams)."""
+    if _tracer is None:
+        return None
+    from opentelemetry.trace import SpanKind
+    return _tracer.start_span(name, kind=getattr(SpanKind, kind.upper()), attributes=_clean(attributes))
+
+
+def end_span(current: Any, error: Optional[BaseException] = None, **attributes: Any) -> None:
+    if current is None:
+        return
+    for key, value in _clean(attributes).items():
+        current.set_attribute(key, value)
+    if error is not None:
+        from opentelemetry.trace import Status, StatusCode
+        current.record_exception(error)
+        current.set_status(Status(StatusCode.ERROR, str(error)[:200]))
+    current.end()
+
+
+def traced(name: str) -> Callable[[Callable[..., Any]], Callable[..., Any]]:
+    """Decorator wrapping a sync or async function in a span."""
+    def decorate(fn: Callable[..., Any]) -> Callable[..., Any]:
+        if inspect.iscoroutinefunction(fn):
+            @functools.wraps(fn)
+            async def async_wrapper(*args: Any, **kwargs: Any) -> Any:
+                with span(name):
+                    return await fn(*args, **kwargs)
+            return async_wrapper
+
+        @functools.wraps(fn)
+        def wrapper(*args: Any, **kwargs: Any) -> Any:
+            with span(name):
+                return fn(*args, **kwargs)
+        return wrapper
+    return decorate
+
+
+def inject_trace_headers(headers: Dict[str, str]) -> Dict[str, str]:
+    """Add traceparent / tracestate for the current span to outgoing (bridge) headers."""
+    if _tracer is not None:
+        from opentelemetry.propagate import inject
+        inject(headers)
+    return headers
+
+
+def _clean(attributes: Dict[str, Any]) -> Dict[str, Any]:
+    return {k: v for k, v in attributes.items() if v is not None}
+
+
+def install_tracing(app: Any, service: str) -> None:
+    """Server span per request, continuing the caller's trace (register just inside the request-ID middleware)."""
+    if not setup_tracing(service):
+        return
+    from opentelemetry import context, trace
+    from opentelemetry.propagate import extract
+    from opentelemetry.trace import SpanKind, Status, StatusCode
+    from .metrics import route_label
+
+    @app.middleware("http")
+    async def _trace_request(request: Any, call_next: Any) -> Any:
+        parent = extract(dict(request.headers))
+        server_span = _tracer.start_span(
+            f"{request.method} {request.url.path}",
+            context=parent,
+            kind=SpanKind.SERVER,
+            attributes={"http.request.method": request.method, "url.path": request.url.path,
+                        "request_id": getattr(request.state, "request_id", "") or ""},
+        )
+        token = context.attach(trace.set_span_in_context(server_span, parent))
+        try:
+            response = await call_next(request)
+        except Exception as e:
+            server_span.record_exception(e)
+            server_span.set_status(Status(StatusCode.ERROR, str(e)[:200]))
+            server_span.end()
+            raise
+        finally:
+            context.detach(token)
+        route = route_label(request)
+        server_span.update_name(f"{request.method} {route}")
+        server_span.set_attribute("http.route", route)
+        server_span.set_attribute("http.response.status_code", response.status_code)
+        if response.status_code >= 500:
+            server_span.set_status(Status(StatusCode.ERROR))
+        body = response.body_iterator
+
+        async def _traced_body():
+            # 流式响应在正文发送完毕后才结束 span，span 时长即包含流式输出时间
+            try:
+                async for chunk in body:
+                    yield chunk
+            finally:
+                server_span.end()
+
+        response.body_iterator = _traced_body()
+        return response
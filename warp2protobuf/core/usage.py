@@ -0,0 +1,54 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token usage reported by Warp
+
+Warp reports token usage in the StreamFinished event. Both the bridge (per
+account accounting) and the OpenAI-compatible layer (`usage` objects) read it
+through extract_usage_from_event.
+"""
+from typing import Any, Dict, Optional
+
+
+def _get(d: Dict[str, Any], *names: str) -> Any:
+    for n in names:
+        if isinstance(d, dict) and n in d:
+            return d[n]
+    return None
+
+
+def extract_usage_from_event(event_data: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+    """Build an OpenAI `usage` object from a Warp StreamFinished event, if present."""
+    finished = _get(event_data, "finished")
+    if not isinstance(finished, dict):
+        return None
+    entries = _get(finished, "token_usage", "tokenUsage") or []
+    if not isinstance(entries, list) or not entries:
+        return None
+    prompt_tokens = 0
+    completion_tokens = 0
+    cached_tokens = 0
+    cost_in_cents = 0.0
+    for entry in entries:
+        if not isinstance(entry, dict):
+            continue
+        try:
+            prompt_tokens += int(_get(entry, "total_input", "totalInput") or 0)
+            completion_tokens += int(_get(entry, "output") or 0)
+            cached_tokens += int(_get(entry, "input_cache_read", "inputCacheRead") or 0)
+            cost_in_cents += float(_get(entry, "cost_in_cents", "costInCents") or 0)
+        except (TypeError, ValueError):
+            continue
+    usage: Dict[str, Any] = {
+        "prompt_tokens": prompt_tokens,
+        "completion_tokens": completion_tokens,
+        "total_tokens": prompt_tokens + completion_tokens,
+    }
+    if cached_tokens:
+        usage["prompt_tokens_details"] = {"cached_tokens": cached_tokens}
+    request_cost = _get(finished, "request_cost", "requestCost")
+    if isinstance(request_cost, dict) and request_cost.get("exact") is not None:
+        usage["warp_request_cost"] = request_cost.get("exact")
+    elif cost_in_cents:
+        usage["warp_cost_in_cents"] = cost_in_cents
+    return usage
@@ -0,0 +1,158 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Schema-less protobuf wire-format annotator
+
+Walks raw protobuf bytes and returns an annotated field tree (tag, wire type,
+offsets, candidate interpretations) without needing a descriptor. Used to
+reverse-engineer fields that newer Warp versions add before the .proto files
+are updated.
+"""
+import struct
+from typing import Any, Dict, List, Optional, Tuple
+
+WIRE_VARINT = 0
+WIRE_FIXED64 = 1
+WIRE_LEN = 2
+WIRE_START_GROUP = 3
+WIRE_END_GROUP = 4
+WIRE_FIXED32 = 5
+
+_WIRE_NAMES = {
+    WIRE_VARINT: "varint",
+    WIRE_FIXED64: "fixed64",
+    WIRE_LEN: "length_delimited",
+    WIRE_START_GROUP: "start_group",
+    WIRE_END_GROUP: "end_group",
+    WIRE_FIXED32: "fixed32",
+}
+
+
+class WireFormatError(ValueError):
+    pass
+
+
+def _read_varint(buf: bytes, i: int) -> Tuple[int, int]:
+    shift = 0
+    val = 0
+    while i < len(buf):
+        b = buf[i]
+        i += 1
+        val |= (b & 0x7F) << shift
+        if not (b & 0x80):
+            return val, i
+        shift += 7
+        if shift > 63:
+            break
+    raise WireFormatError(f"invalid varint at offset {i}")
+
+
+def _zigzag(v: int) -> int:
+    return (v >> 1) ^ -(v & 1)
+
+
+def _as_signed64(v: int) -> int:
+    return v - (1 << 64) if v >= (1 << 63) else v
+
+
+def _try_packed_varints(data: bytes) -> Optional[List[int]]:
+    out: List[int] = []
+    i = 0
+    try:
+        while i < len(data):
+            v, i = _read_varint(data, i)
+            out.append(v)
+    except WireFormatError:
+        return None
+    return out if out else None
+
+
+def _interpret_len(data: bytes, base_offset: int, depth: int, max_depth: int) -> Dict[str, Any]:
+    attempts: Dict[str, Any] = {}
+    try:
+        text = data.decode("utf-8")
+        if all(c.isprintable() or c in "\r\n\t" for c in text):
+            attempts["string"] = text
+    except UnicodeDecodeError:
+        pass
+    if data and depth < max_depth:
+        try:
+            sub = parse_fields(data, base_offset=base_offset, depth=depth + 1, max_depth=max_depth)
+            if sub:
+                attempts["submessage"] = sub
+        except WireFormatError:
+            pass
+    packed = _try_packed_varints(data)
+    if packed is not None and "submessage" not in attempts and "string" not in attempts:
+        attempts["packed_varints"] = packed
+    attempts["hex"] = data[:64].hex() + ("…" if len(data) > 64 else "")
+    return attempts
+
+
+def parse_fields(buf: bytes, base_offset: int = 0, depth: int = 0, max_depth: int = 8) -> List[Dict[str, Any]]:
+    """Parse `buf` as a sequence of protobuf fields; raises WireFormatError on malformed input."""
+    fields: List[Dict[str, Any]] = []
+    i = 0
+    while i < len(buf):
+        start = i
+        key, i = _read_varint(buf, i)
+        field_number = key >> 3
+        wire_type = key & 0x07
+        if field_number == 0:
+            raise WireFormatError(f"field number 0 at offset {base_offset + start}")
+        if wire_type not in _WIRE_NAMES:
+            raise WireFormatError(f"invalid wire type {wire_type} at offset {base_offset + start}")
+        node: Dict[str, Any] = {
+            "field_number": field_number,
+            "wire_type": wire_type,
+            "wire_type_name": _WIRE_NAMES[wire_type],
+            "offset": base_offset + start,
+        }
+        if wire_type == WIRE_VARINT:
+            v, i = _read_varint(buf, i)
+            node["attempts"] = {"uint": v, "int": _as_signed64(v), "sint": _zigzag(v)}
+            if v in (0, 1):
+                node["attempts"]["bool"] = bool(v)
+        elif wire_type == WIRE_FIXED64:
+            if i + 8 > len(buf):
+                raise WireFormatError(f"truncated fixed64 at offset {base_offset + i}")
+            raw = buf[i:i + 8]
+            i += 8
+            node["attempts"] = {
+                "fixed64": struct.unpack("<Q", raw)[0],
+                "sfixed64": struct.unpack("<q", raw)[0],
+                "double": struct.unpack("<d", raw)[0],
+            }
+        elif wire_type == WIRE_FIXED32:
+            if i + 4 > len(buf):
+                raise WireFormatError(f"truncated fixed32 at offset {base_offset + i}")
+            raw = buf[i:i + 4]
+            i += 4
+            node["attempts"] = {
+                "fixed32": struct.unpack("<I", raw)[0],
+                "sfixed32": struct.unpack("<i", raw)[0],
+                "float": struct.unpack("<f", raw)[0],
+            }
+        elif wire_type == WIRE_LEN:
+            length, data_start = _read_varint(buf, i)
+            if data_start + length > len(buf):
+                raise WireFormatError(f"truncated length-delimited field at offset {base_offset + start}")
+            data = buf[data_start:data_start + length]
+            i = data_start + length
+            node["length"] = length
+            node["data_offset"] = base_offset + data_start
+            node["attempts"] = _interpret_len(data, base_offset + data_start, depth, max_depth)
+        else:
+            # Groups are deprecated and not used by Warp; report and stop descending
+            node["note"] = "group wire types are not expanded"
+        node["size"] = i - start
+        fields.append(node)
+    return fields
+
+
+def annotate_wire(buf: bytes, max_depth: int = 8) -> Dict[str, Any]:
+    """Annotate a whole buffer; malformed input is reported via `valid`/`error` instead of raising."""
+    try:
+        return {"size": len(buf), "fields": parse_fields(buf, max_depth=max_depth), "valid": True}
+    except WireFormatError as e:
+        return {"size": len(buf), "fields": [], "valid": False, "error": str(e)}
@@ -0,0 +1,152 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Adaptive (AIMD) concurrency limits toward Warp
+
+With WARP_ADAPTIVE_CONCURRENCY set, every upstream call holds a slot of the
+limiter of the account it is made with (pooled account label, "default"
+without a pool). Each limit starts at WARP_ADAPTIVE_CONCURRENCY and adapts to
+how Warp behaves for that account:
+
+- a response that takes longer than WARP_ADAPTIVE_LATENCY_TARGET seconds to
+  send its headers, an HTTP 429 / 5xx or a failed connection halves the limit
+  (not below WARP_ADAPTIVE_CONCURRENCY_MIN), once per round of in-flight
+  requests;
+- every other response grows it by 1/limit, i.e. by one per window of
+  successful requests, back up to WARP_ADAPTIVE_CONCURRENCY.
+
+Requests over the limit wait up to WARP_ADAPTIVE_QUEUE_TIMEOUT seconds for a
+slot and are then rejected with 503, so a degraded upstream sees fewer
+concurrent requests instead of more retries.
+"""
+import asyncio
+import contextvars
+import time
+from contextlib import asynccontextmanager
+from typing import Any, AsyncIterator, Dict, Optional
+
+from ..core.logging import logger
+from ..core.request_context import request_fields
+from ..config.settings import (
+    WARP_ADAPTIVE_CONCURRENCY,
+    WARP_ADAPTIVE_CONCURRENCY_MIN,
+    WARP_ADAPTIVE_LATENCY_TARGET,
+    WARP_ADAPTIVE_QUEUE_TIMEOUT,
+)
+
+# 超载时的乘性回退系数
+_BACKOFF = 0.5
+
+
+class UpstreamBusy(Exception):
+    """No upstream slot became free within the queue timeout."""
+
+
+class AIMDLimiter:
+    def __init__(self, max_limit: int, min_limit: int = 1, latency_target: float = 10.0):
+        self.max_limit = max_limit
+        self.min_limit = max(1, min(min_limit, max_limit))
+        self.latency_target = latency_target
+        self.limit = float(max_limit)
+        self.in_flight = 0
+        self.decreases = 0
+        self.rejected = 0
+        # 上次回退的时间；在此之前发出的请求的失败不再重复回退
+        self._decreased_at = 0.0
+        self._cond = asyncio.Condition()
+
+    async def acquire(self, timeout: float) -> float:
+        """Wait for a slot; returns the time it was granted (pass it back to on_result)."""
+        async with self._cond:
+            try:
+                await asyncio.wait_for(self._cond.wait_for(lambda: self.in_flight < int(self.limit)), timeout)
+            except asyncio.TimeoutError:
+                self.rejected += 1
+                raise UpstreamBusy(f"upstream concurrency limit {int(self.limit)} reached")
+            self.in_flight += 1
+        return time.monotonic()
+
+    async def release(self) -> None:
+        async with self._cond:
+            self.in_flight -= 1
+            self._cond.notify_all()
+
+    def on_result(self, granted_at: float, overloaded: bool) -> None:
+        if overloaded:
+            if granted_at < self._decreased_at or self.limit <= self.min_limit:
+                return
+            self.limit = max(float(self.min_limit), self.limit * _BACKOFF)
+            self._decreased_at = time.monotonic()
+            self.decreases += 1
+        else:
+            self.limit = min(float(self.max_limit), self.limit + 1 / self.limit)
+
+    def status(self) -> Dict[str, Any]:
+        return {
+            "limit": int(self.limit),
+            "max_limit": self.max_limit,
+            "min_limit": self.min_limit,
+            "in_flight": self.in_flight,
+            "decreases": self.decreases,
+            "rejected": self.rejected,
+        }
+
+
+_limiters: Dict[str, AIMDLimiter] = {}
+# 当前上游请求占用的 (limiter, 获得时间, 是否已反馈)，供响应钩子反馈延迟与状态码
+_current: contextvars.ContextVar[Optional[list]] = contextvars.ContextVar("w2a_upstream_slot", default=None)
+
+
+def limiter_for(key: str) -> AIMDLimiter:
+    limiter = _limiters.get(key)
+    if limiter is None:
+        limiter = _limiters[key] = AIMDLimiter(
+            WARP_ADAPTIVE_CONCURRENCY, WARP_ADAPTIVE_CONCURRENCY_MIN, WARP_ADAPTIVE_LATENCY_TARGET
+        )
+    return limiter
+
+
+@asynccontextmanager
+async def upstream_slot() -> AsyncIterator[None]:
+    """Hold a concurrency slot of the current request's account for one upstream call."""
+    if WARP_ADAPTIVE_CONCURRENCY <= 0:
+        yield
+        return
+    key = request_fields().get("account") or "default"
+    limiter = limiter_for(key)
+    granted_at = await limiter.acquire(WARP_ADAPTIVE_QUEUE_TIMEOUT)
+    slot = [limiter, granted_at, False]
+    token = _current.set(slot)
+    try:
+        yield
+    except Exception:
+        # 收到响应头之前失败（连接失败、超时）；客户端断开（取消）不计入
+        if not slot[2]:
+            slot[2] = True
+            limiter.on_result(granted_at, overloaded=True)
+        raise
+    finally:
+        _current.reset(token)
+        await limiter.release()
+
+
+def observe_upstream_response(status_code: int, latency: float) -> None:
+    """Feed the response headers of the current upstream call back into its limiter."""
+    slot = _current.get()
+    if slot is None or slot[2]:
+        return
+    limiter, granted_at, _ = slot
+    slot[2] = True
+    overloaded = status_code == 429 or status_code >= 500 or latency > limiter.latency_target
+    before = int(limiter.limit)
+    limiter.on_result(granted_at, overloaded)
+    if int(limiter.limit) < before:
+        logger.warning(f"Warp 上游过载（HTTP {status_code}，{latency:.1f}s），并发上限降为 {int(limiter.limit)}")
+
+
+def adaptive_limit_status() -> Dict[str, Any]:
+    return {
+        "enabled": WARP_ADAPTIVE_CONCURRENCY > 0,
+        "latency_target": WARP_ADAPTIVE_LATENCY_TARGET,
+        "accounts": {key: limiter.status() for key, limiter in _limiters.items()},
+    }
@@ -15,8 +15,11 @@ import socket
 
 from ..core.logging import logger
 from ..core.protobuf_utils import protobuf_to_dict
-from ..core.auth import get_valid_jwt, acquire_anonymous_access_token
-from ..config.settings import WARP_URL as CONFIG_WARP_URL
+from ..core.request_context import with_request_id
+from ..core.auth import get_valid_jwt, acquire_anonymous_access_token, next_account_jwt
+from .http_client import warp_http_client, stream_timeout
+from .adaptive_limit import upstream_slot
+from ..config.settings import WARP_URL as CONFIG_WARP_URL, CLIENT_VERSION, OS_CATEGORY, OS_NAME, OS_VERSION
 
 
 def _get(d: Dict[str, Any], *names: str) -> Any:
@@ -77,27 +80,21 @@ async def send_protobuf_to_warp_api(
         all_events = []
         event_count = 0
         
-        verify_opt = True
-        insecure_env = os.getenv("WARP_INSECURE_TLS", "").lower()
-        if insecure_env in ("1", "true", "yes"):
-            verify_opt = False
-            logger.warning("TLS verification disabled via WARP_INSECURE_TLS for Warp API client")
-
-        async with httpx.AsyncClient(http2=True, timeout=httpx.Timeout(60.0), verify=verify_opt, trust_env=True) as client:
+        async with warp_http_client() as client:
             # 最多尝试两次：第一次失败且为配额429时申请匿名token并重试一次
             for attempt in range(2):
                 jwt = await get_valid_jwt() if attempt == 0 else jwt  # keep existing unless refreshed explicitly
-                headers = {
+                headers = with_request_id({
                     "accept": "text/event-stream",
                     "content-type": "application/x-protobuf", 
-                    "x-warp-client-version": "v0.2025.08.06.08.12.stable_02",
-                    "x-warp-os-category": "Windows",
-                    "x-warp-os-name": "Windows", 
-                    "x-warp-os-version": "11 (26100)",
+                    "x-warp-client-version": CLIENT_VERSION,
+                    "x-warp-os-category": OS_CATEGORY,
+                    "x-warp-os-name": OS_NAME,
+                    "x-warp-os-version": OS_VERSION,
                     "authorization": f"Bearer {jwt}",
                     "content-length": str(len(protobuf_bytes)),
-                }
-                async with client.stream("POST", warp_url, headers=headers, content=protobuf_bytes) as response:
+                })
+                async with upstream_slot(), client.stream("POST", warp_url, headers=headers, content=protobuf_bytes, timeout=stream_timeout()) as response:
                     if response.status_code != 200:
                         error_text = await response.aread()
                         error_content = error_text.decode('utf-8') if error_text else "No error content"
@@ -105,11 +102,14 @@ async def send_protobuf_to_warp_api(
                         if response.status_code == 429 and attempt == 0 and (
                             ("No remaining quota" in error_content) or ("No AI requests remaining" in error_content)
                         ):
-                            logger.warning("WARP API 返回 429 (配额用尽)。尝试申请匿名token并重试一次…")
-                            try:
-                                new_jwt = await acquire_anonymous_access_token()
-                            except Exception:
-                                new_jwt = None
+                            logger.warning("WARP API 返回 429 (配额用尽)。尝试切换账号或申请匿名token并重试一次…")
+                            # 配置了账号池时先换用其他账号，都不可用再申请匿名token
+                            new_jwt = await next_account_jwt(jwt)
+                            if not new_jwt:
+                                try:
+                                    new_jwt = await acquire_anonymous_access_token()
+                                except Exception:
+                                    new_jwt = None
                             if new_jwt:
                                 jwt = new_jwt
                                 # 跳出当前响应并进行下一次尝试
@@ -261,27 +261,21 @@ async def send_protobuf_to_warp_api_parsed(protobuf_bytes: bytes) -> tuple[str,
         parsed_events = []
         event_count = 0
         
-        verify_opt = True
-        insecure_env = os.getenv("WARP_INSECURE_TLS", "").lower()
-        if insecure_env in ("1", "true", "yes"):
-            verify_opt = False
-            logger.warning("TLS verification disabled via WARP_INSECURE_TLS for Warp API client")
-
-        async with httpx.AsyncClient(http2=True, timeout=httpx.Timeout(60.0), verify=verify_opt, trust_env=True) as client:
+        async with warp_http_client() as client:
             # 最多尝试两次：第一次失败且为配额429时申请匿名token并重试一次
             for attempt in range(2):
                 jwt = await get_valid_jwt() if attempt == 0 else jwt  # keep existing unless refreshed explicitly
-                headers = {
+                headers = with_request_id({
                     "accept": "text/event-stream",
                     "content-type": "application/x-protobuf", 
-                    "x-warp-client-version": "v0.2025.08.06.08.12.stable_02",
-                    "x-warp-os-category": "Windows",
-                    "x-warp-os-name": "Windows", 
-                    "x-warp-os-version": "11 (26100)",
+                    "x-warp-client-version": CLIENT_VERSION,
+                    "x-warp-os-category": OS_CATEGORY,
+                    "x-warp-os-name": OS_NAME,
+                    "x-warp-os-version": OS_VERSION,
                     "authorization": f"Bearer {jwt}",
                     "content-length": str(len(protobuf_bytes)),
-                }
-                async with client.stream("POST", warp_url, headers=headers, content=protobuf_bytes) as response:
+                })
+                async with upstream_slot(), client.stream("POST", warp_url, headers=headers, content=protobuf_bytes, timeout=stream_timeout()) as response:
                     if response.status_code != 200:
                         error_text = await response.aread()
                         error_content = error_text.decode('utf-8') if error_text else "No error content"
@@ -289,11 +283,14 @@ async def send_protobuf_to_warp_api_parsed(protobuf_bytes: bytes) -> tuple[str,
                         if response.status_code == 429 and attempt == 0 and (
                             ("No remaining quota" in error_content) or ("No AI requests remaining" in error_content)
                         ):
-                            logger.warning("WARP API 返回 429 (配额用尽, 解析模式)。尝试申请匿名token并重试一次…")
-                            try:
-                                new_jwt = await acquire_anonymous_access_token()
-                            except Exception:
-                                new_jwt = None
+                            logger.warning("WARP API 返回 429 (配额用尽, 解析模式)。尝试切换账号或申请匿名token并重试一次…")
+                            # 配置了账号池时先换用其他账号，都不可用再申请匿名token
+                            new_jwt = await next_account_jwt(jwt)
+                            if not new_jwt:
+                                try:
+                                    new_jwt = await acquire_anonymous_access_token()
+                                except Exception:
+                                    new_jwt = None
                             if new_jwt:
                                 jwt = new_jwt
                                 # 跳出当前响应并进行下一次尝试
@@ -0,0 +1,271 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Bridge service layer
+
+Transport-independent implementation of the bridge's Warp forwarding
+operations. The HTTP routes in api/protobuf_routes.py are thin wrappers around
+these functions, and the OpenAI-compatible server can call them directly when
+both components run in one process (no JSON/HTTP round trip over localhost).
+"""
+import base64
+import re
+from contextlib import asynccontextmanager
+from typing import Any, AsyncIterator, Dict, Optional, Tuple, Union
+
+import httpx
+
+from ..core.logging import logger
+from ..core.account_pool import note_account_usage
+from ..core.usage import extract_usage_from_event
+from ..core.request_context import with_request_id
+from ..core.tracing import traced
+from ..core.auth import get_valid_jwt, acquire_anonymous_access_token, next_account_jwt
+from ..core.protobuf_utils import protobuf_to_dict, dict_to_protobuf_bytes, _encode_smd_inplace, _decode_smd_inplace
+from ..core.schema_sanitizer import sanitize_mcp_input_schema_in_packet
+from ..config.settings import CLIENT_VERSION, OS_CATEGORY, OS_NAME, OS_VERSION, WARP_URL
+from .http_client import warp_http_client, stream_timeout
+from .adaptive_limit import UpstreamBusy, upstream_slot
+
+RESPONSE_EVENT_TYPE = "warp.multi_agent.v1.ResponseEvent"
+
+
+@traced("warp.encode")
+def prepare_warp_request(actual_data: Optional[Dict[str, Any]], message_type: str) -> Tuple[Dict[str, Any], bytes]:
+    """Sanitize and encode a request packet; returns (sanitized dict, protobuf bytes)."""
+    if not actual_data:
+        raise ValueError("数据包不能为空")
+    wrapped = {"json_data": actual_data}
+    wrapped = sanitize_mcp_input_schema_in_packet(wrapped)
+    actual_data = wrapped.get("json_data", actual_data)
+    actual_data = _encode_smd_inplace(actual_data)
+    protobuf_bytes = dict_to_protobuf_bytes(actual_data, message_type)
+    logger.info(f"✅ JSON编码为protobuf成功: {len(protobuf_bytes)} 字节")
+    return actual_data, protobuf_bytes
+
+
+def summarize_event_types(parsed_events: list) -> Dict[str, int]:
+    counts: Dict[str, int] = {}
+    for event in parsed_events or []:
+        event_type = event.get("event_type", "UNKNOWN")
+        counts[event_type] = counts.get(event_type, 0) + 1
+    return counts
+
+
+async def send_parsed(protobuf_bytes: bytes) -> Dict[str, Any]:
+    """Send an encoded request and collect all parsed response events."""
+    from .api_client import send_protobuf_to_warp_api_parsed
+    response_text, conversation_id, task_id, parsed_events = await send_protobuf_to_warp_api_parsed(protobuf_bytes)
+    parsed_events = _decode_smd_inplace(parsed_events)
+    for event in parsed_events or []:
+        data = event.get("parsed_data") if isinstance(event, dict) else None
+        if isinstance(data, dict) and "finished" in data:
+            note_account_usage(extract_usage_from_event(data))
+    return {
+        "response": response_text,
+        "conversation_id": conversation_id,
+        "task_id": task_id,
+        "parsed_events": parsed_events,
+    }
+
+
+def parse_payload_bytes(data_str: str) -> Optional[bytes]:
+    s = re.sub(r"\s+", "", data_str or "")
+    if not s:
+        return None
+    if re.fullmatch(r"[0-9a-fA-F]+", s):
+        try:
+            return bytes.fromhex(s)
+        except Exception:
+            pass
+    pad = "=" * ((4 - (len(s) % 4)) % 4)
+    try:
+        return base64.urlsafe_b64decode(s + pad)
+    except Exception:
+        try:
+            return base64.b64decode(s + pad)
+        except Exception:
+            return None
+
+
+def classify_event(event_data: Any) -> str:
+    def _get(d: Dict[str, Any], *names: str) -> Any:
+        for n in names:
+            if isinstance(d, dict) and n in d:
+                return d[n]
+        return None
+    if not isinstance(event_data, dict):
+        return "UNKNOWN_EVENT"
+    if "init" in event_data:
+        return "INITIALIZATION"
+    client_actions = _get(event_data, "client_actions", "clientActions")
+    if isinstance(client_actions, dict):
+        actions = _get(client_actions, "actions", "Actions") or []
+        return f"CLIENT_ACTIONS({len(actions)})" if actions else "CLIENT_ACTIONS_EMPTY"
+    if "finished" in event_data:
+        return "FINISHED"
+    return "UNKNOWN_EVENT"
+
+
+@asynccontextmanager
+async def open_warp_sse(protobuf_bytes: bytes) -> AsyncIterator[Tuple[Optional[httpx.Response], Optional[Dict[str, Any]]]]:
+    """Open Warp's SSE response for an encoded request; yields (response, None) or (None, error item).
+
+    The error item is {"error": "HTTP <code>", "status_code", "detail"}; a quota 429
+    is retried once with another pooled account or an anonymous token first.
+    """
+    async with warp_http_client() as client:
+        # 最多尝试两次：第一次失败且为配额429时申请匿名token并重试一次
+        jwt = None
+        for attempt in range(2):
+            if attempt == 0 or jwt is None:
+                jwt = await get_valid_jwt()
+            headers = with_request_id({
+                "accept": "text/event-stream",
+                "content-type": "application/x-protobuf",
+                "x-warp-client-version": CLIENT_VERSION,
+                "x-warp-os-category": OS_CATEGORY,
+                "x-warp-os-name": OS_NAME,
+                "x-warp-os-version": OS_VERSION,
+                "authorization": f"Bearer {jwt}",
+                "content-length": str(len(protobuf_bytes)),
+            })
+            try:
+                async with upstream_slot(), client.stream("POST", WARP_URL, headers=headers, content=protobuf_bytes, timeout=stream_timeout()) as response:
+                    if response.status_code != 200:
+                        error_text = await response.aread()
+                        error_content = error_text.decode("utf-8") if error_text else ""
+                        # 429 且包含配额信息时，申请匿名token后重试一次
+                        if response.status_code == 429 and attempt == 0 and (
+                            ("No remaining quota" in error_content) or ("No AI requests remaining" in error_content)
+                        ):
+                            logger.warning("Warp API 返回 429 (配额用尽, SSE 代理)。尝试切换账号或申请匿名token并重试一次…")
+                            # 配置了账号池时先换用其他账号，都不可用再申请匿名token
+                            new_jwt = await next_account_jwt(jwt)
+                            if not new_jwt:
+                                try:
+                                    new_jwt = await acquire_anonymous_access_token()
+                                except Exception:
+                                    new_jwt = None
+                            if new_jwt:
+                                jwt = new_jwt
+                                continue
+                        logger.error(f"Warp API HTTP error {response.status_code}: {error_content[:300]}")
+                        yield None, {"error": f"HTTP {response.status_code}", "status_code": response.status_code, "detail": error_content[:1000]}
+                        return
+                    try:
+                        logger.info(f"✅ Warp API SSE连接已建立: {WARP_URL}")
+                        logger.info(f"📦 请求字节数: {len(protobuf_bytes)}")
+                    except Exception:
+                        pass
+                    yield response, None
+                    return
+            except UpstreamBusy as e:
+                logger.warning(f"Warp 上游并发已满，拒绝请求: {e}")
+                yield None, {"error": "HTTP 503", "status_code": 503, "detail": str(e)}
+                return
+
+
+def _log_stream_summary(event_no: int) -> None:
+    try:
+        logger.info("="*60)
+        logger.info("📊 SSE STREAM SUMMARY (代理)")
+        logger.info("="*60)
+        logger.info(f"📈 Total Events Forwarded: {event_no}")
+        logger.info("="*60)
+    except Exception:
+        pass
+
+
+async def iter_sse_events(protobuf_bytes: bytes) -> AsyncIterator[Dict[str, Any]]:
+    """Stream Warp's SSE response as parsed event dicts.
+
+    Yields {"event_number", "event_type", "parsed_data"} per event. An upstream
+    HTTP failure is reported as a single {"error": "HTTP <code>", ...} item.
+    """
+    async with open_warp_sse(protobuf_bytes) as (response, error):
+        if error is not None:
+            yield error
+            return
+        current_data = ""
+        event_no = 0
+        async for line in response.aiter_lines():
+            if line.startswith("data:"):
+                payload = line[5:].strip()
+                if not payload:
+                    continue
+                if payload == "[DONE]":
+                    break
+                current_data += payload
+                continue
+            if (line.strip() == "") and current_data:
+                raw_bytes = parse_payload_bytes(current_data)
+                current_data = ""
+                if raw_bytes is None:
+                    continue
+                try:
+                    event_data = protobuf_to_dict(raw_bytes, RESPONSE_EVENT_TYPE)
+                except Exception:
+                    continue
+                event_type = classify_event(event_data)
+                event_no += 1
+                if "finished" in event_data:
+                    note_account_usage(extract_usage_from_event(event_data))
+                try:
+                    logger.info(f"🔄 SSE Event #{event_no}: {event_type}")
+                except Exception:
+                    pass
+                yield {"event_number": event_no, "event_type": event_type, "parsed_data": event_data}
+        _log_stream_summary(event_no)
+
+
+class _SseScanner:
+    """Incremental SSE line splitter that only counts events and keeps the last data payload."""
+
+    def __init__(self):
+        self._partial = b""
+        self._current: list = []
+        self.last_payload = b""
+        self.events = 0
+
+    def feed(self, chunk: bytes) -> None:
+        lines = (self._partial + chunk).split(b"\n")
+        self._partial = lines.pop()
+        for line in lines:
+            line = line.rstrip(b"\r")
+            if line.startswith(b"data:"):
+                payload = line[5:].strip()
+                if payload and payload != b"[DONE]":
+                    self._current.append(payload)
+            elif not line.strip() and self._current:
+                self.last_payload = b"".join(self._current)
+                self._current = []
+                self.events += 1
+
+
+async def relay_sse_bytes(protobuf_bytes: bytes) -> AsyncIterator[Union[bytes, Dict[str, Any]]]:
+    """Relay Warp's SSE body to the caller byte for byte, without decoding each event.
+
+    Chunks are passed on as they arrive; a line scanner only counts events and keeps
+    the last payload, which is decoded once at the end to record the account's usage
+    (Warp sends the "finished" event last). An upstream HTTP failure is reported as a
+    single error dict, like iter_sse_events.
+    """
+    async with open_warp_sse(protobuf_bytes) as (response, error):
+        if error is not None:
+            yield error
+            return
+        scanner = _SseScanner()
+        async for chunk in response.aiter_bytes():
+            scanner.feed(chunk)
+            yield chunk
+        scanner.feed(b"\n\n")
+        raw_bytes = parse_payload_bytes(scanner.last_payload.decode("ascii", errors="ignore"))
+        if raw_bytes is not None:
+            try:
+                event_data = protobuf_to_dict(raw_bytes, RESPONSE_EVENT_TYPE)
+                if "finished" in event_data:
+                    note_account_usage(extract_usage_from_event(event_data))
+            except Exception:
+                pass
+        _log_stream_summary(scanner.events)
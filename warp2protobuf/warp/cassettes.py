@@ -0,0 +1,165 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Record / replay cassettes for Warp conversations
+
+CASSETTE_MODE=record puts this transport in front of the real upstream client
+and saves each conversation exchange with Warp to a JSON file in CASSETTE_DIR:
+the decoded request and the response status, content type and body. With
+CASSETTE_MODE=replay the same requests are answered from those files without
+network access, so the whole translation pipeline (OpenAI request → protobuf
+→ Warp events → OpenAI response) can be regression-tested deterministically.
+
+Requests are matched on their decoded protobuf content with UUIDs (message,
+task and tool call ids generated per request) replaced by their order of
+appearance, so a re-run of the same client calls finds its recordings. Token
+refreshes and other auxiliary calls are forwarded but never recorded.
+"""
+import base64
+import hashlib
+import json
+import os
+import re
+import time
+from pathlib import Path
+from typing import Any, AsyncIterator, Dict, List, Optional, Tuple
+from urllib.parse import urlsplit
+
+import httpx
+
+from ..core.logging import logger
+from ..core.protobuf_utils import protobuf_to_dict
+from ..config.settings import CASSETTE_DIR, WARP_URL
+
+REQUEST_TYPE = "warp.multi_agent.v1.Request"
+# 只保留回放需要的响应头；压缩与长度头在解压后不再成立
+_KEPT_HEADERS = ("content-type",)
+
+_UUID_RE = re.compile(r"[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}")
+
+
+def normalize_request(body: bytes) -> Tuple[Optional[Dict[str, Any]], str]:
+    """The decoded request with per-request UUIDs replaced, and the cassette key derived from it."""
+    try:
+        decoded = protobuf_to_dict(body, REQUEST_TYPE)
+    except Exception:
+        return None, hashlib.sha256(body).hexdigest()
+    seen: Dict[str, str] = {}
+
+    def _placeholder(match: "re.Match[str]") -> str:
+        return seen.setdefault(match.group(0).lower(), f"<uuid-{len(seen) + 1}>")
+
+    text = _UUID_RE.sub(_placeholder, json.dumps(decoded, ensure_ascii=False, sort_keys=True))
+    return json.loads(text), hashlib.sha256(text.encode("utf-8")).hexdigest()
+
+
+def cassette_path(key: str) -> Path:
+    return Path(CASSETTE_DIR).expanduser() / f"{key[:24]}.json"
+
+
+def _encode_body(body: bytes) -> Dict[str, str]:
+    try:
+        return {"body": body.decode("utf-8")}
+    except UnicodeDecodeError:
+        return {"body_base64": base64.b64encode(body).decode("ascii")}
+
+
+def _decode_body(response: Dict[str, Any]) -> bytes:
+    if "body_base64" in response:
+        return base64.b64decode(response["body_base64"])
+    return str(response.get("body", "")).encode("utf-8")
+
+
+def _split_events(body: bytes) -> List[bytes]:
+    # 回放时按 SSE 事件分块返回，和真实上游一样逐个到达
+    parts = [p + b"\n\n" for p in body.split(b"\n\n") if p.strip()]
+    return parts or [body]
+
+
+class _ReplayStream(httpx.AsyncByteStream):
+    def __init__(self, chunks: List[bytes]):
+        self.chunks = chunks
+
+    async def __aiter__(self) -> AsyncIterator[bytes]:
+        for chunk in self.chunks:
+            yield chunk
+
+
+class _RecordingStream(httpx.AsyncByteStream):
+    """Passes the upstream body through and writes the cassette once it has been read completely."""
+
+    def __init__(self, upstream: httpx.Response, path: Path, record: Dict[str, Any]):
+        self.upstream = upstream
+        self.path = path
+        self.record = record
+
+    async def __aiter__(self) -> AsyncIterator[bytes]:
+        chunks: List[bytes] = []
+        async for chunk in self.upstream.aiter_bytes():
+            chunks.append(chunk)
+            yield chunk
+        self.record["response"].update(_encode_body(b"".join(chunks)))
+        try:
+            self.path.parent.mkdir(parents=True, exist_ok=True)
+            tmp = self.path.with_suffix(".tmp")
+            tmp.write_text(json.dumps(self.record, ensure_ascii=False, indent=2), encoding="utf-8")
+            os.replace(tmp, self.path)
+            logger.info(f"📼 已录制 cassette: {self.path}")
+        except OSError as e:
+            logger.error(f"写入 cassette 失败 {self.path}: {e}")
+
+    async def aclose(self) -> None:
+        await self.upstream.aclose()
+
+
+class CassetteTransport(httpx.AsyncBaseTransport):
+    """Records conversation exchanges through `upstream` ("record"), or serves them from files ("replay")."""
+
+    def __init__(self, mode: str, upstream: Optional[httpx.AsyncClient] = None):
+        self.mode = mode
+        self.upstream = upstream
+        self._conversation_path = urlsplit(WARP_URL).path
+
+    def _is_conversation(self, request: httpx.Request) -> bool:
+        return request.method == "POST" and request.url.path == self._conversation_path
+
+    async def handle_async_request(self, request: httpx.Request) -> httpx.Response:
+        if self.mode == "replay":
+            return await self._replay(request)
+        if not self._is_conversation(request):
+            return await self.upstream.send(request, stream=True)
+        return await self._record(request)
+
+    async def _replay(self, request: httpx.Request) -> httpx.Response:
+        if not self._is_conversation(request):
+            # 回放模式不访问网络；token 刷新等请求由认证层跳过
+            return httpx.Response(404, text="not available in cassette replay mode", request=request)
+        _normalized, key = normalize_request(await request.aread())
+        path = cassette_path(key)
+        try:
+            record = json.loads(path.read_text(encoding="utf-8"))
+        except FileNotFoundError:
+            logger.warning(f"📼 没有匹配的 cassette: {path}（请先用 CASSETTE_MODE=record 录制）")
+            return httpx.Response(404, text=f"no cassette recorded for this request ({path.name})", request=request)
+        response = record["response"]
+        logger.info(f"📼 回放 cassette: {path}")
+        return httpx.Response(response["status_code"], headers=response.get("headers") or {},
+                              stream=_ReplayStream(_split_events(_decode_body(response))), request=request)
+
+    async def aclose(self) -> None:
+        if self.upstream is not None:
+            await self.upstream.aclose()
+
+    async def _record(self, request: httpx.Request) -> httpx.Response:
+        body = await request.aread()
+        normalized, key = normalize_request(body)
+        upstream = await self.upstream.send(request, stream=True)
+        headers = {k: v for k, v in upstream.headers.items() if k.lower() in _KEPT_HEADERS}
+        record = {
+            "key": key,
+            "recorded_at": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+            "request": {"method": request.method, "url": str(request.url), "body": normalized},
+            "response": {"status_code": upstream.status_code, "headers": headers},
+        }
+        return httpx.Response(upstream.status_code, headers=headers,
+                              stream=_RecordingStream(upstream, cassette_path(key), record), request=request)
@@ -0,0 +1,230 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Shared upstream HTTP client for Warp API
+
+A single long-lived httpx.AsyncClient (HTTP/2, generous keep-alive, shared TLS
+context) is reused for every call to Warp, including token refreshes and
+anonymous sign-ups (through post_auxiliary), so that requests multiplex
+over warm connections instead of paying a TCP+TLS handshake each time.
+Connection reuse is tracked through httpcore trace events. With
+WARP_HTTP_PREWARM the connections to Warp are opened at startup, so the first
+request does not pay for the handshake either. With MOCK_UPSTREAM the client is
+backed by mock_upstream.py instead of the network; CASSETTE_MODE records or
+replays conversations through cassettes.py.
+"""
+import asyncio
+import os
+import ssl
+import time
+from contextlib import asynccontextmanager
+from typing import Any, AsyncIterator, Dict, List, Optional
+from urllib.parse import urlsplit
+
+import httpx
+
+from ..core.logging import logger
+from ..core.account_pool import note_account_error
+from ..core.metrics import bridge_metrics
+from ..core.tracing import end_span, start_span
+from .adaptive_limit import observe_upstream_response
+from ..config.settings import (
+    WARP_HTTP_MAX_CONNECTIONS,
+    WARP_HTTP_MAX_KEEPALIVE,
+    WARP_HTTP_KEEPALIVE_EXPIRY,
+    WARP_HTTP_TIMEOUT,
+    WARP_STREAM_READ_TIMEOUT,
+    WARP_HTTP_PREWARM,
+    MOCK_UPSTREAM,
+    CASSETTE_MODE,
+    CASSETTE_DIR,
+    OFFLINE_UPSTREAM,
+    WARP_URL,
+    REFRESH_URL,
+)
+
+
+class ConnectionStats:
+    """Counters for upstream requests vs. newly opened connections."""
+
+    def __init__(self):
+        self.requests = 0
+        self.new_connections = 0
+        self.tls_handshakes = 0
+        self.handshake_seconds_total = 0.0
+        self.started_at = time.time()
+        # origin -> 最近一次预热结果
+        self.prewarm: Dict[str, Dict[str, Any]] = {}
+
+    def snapshot(self) -> Dict[str, Any]:
+        reused = max(0, self.requests - self.new_connections)
+        return {
+            "requests": self.requests,
+            "new_connections": self.new_connections,
+            "reused_connections": reused,
+            "reuse_ratio": round(reused / self.requests, 4) if self.requests else 0.0,
+            "tls_handshakes": self.tls_handshakes,
+            "avg_tls_handshake_ms": round(self.handshake_seconds_total / self.tls_handshakes * 1000, 2) if self.tls_handshakes else 0.0,
+            "uptime_seconds": round(time.time() - self.started_at, 1),
+            "prewarm": {"enabled": WARP_HTTP_PREWARM, "origins": dict(self.prewarm)},
+        }
+
+
+_stats = ConnectionStats()
+_client: Optional[httpx.AsyncClient] = None
+
+
+def _insecure_tls() -> bool:
+    return os.getenv("WARP_INSECURE_TLS", "").lower() in ("1", "true", "yes")
+
+
+def _build_ssl_context() -> Any:
+    if _insecure_tls():
+        logger.warning("TLS verification disabled via WARP_INSECURE_TLS for Warp API client")
+        return False
+    # One context for all connections so TLS session tickets can be reused
+    return ssl.create_default_context()
+
+
+def _make_trace():
+    tls_started: Dict[str, float] = {}
+
+    async def _trace(event_name: str, info: Dict[str, Any]) -> None:
+        if event_name == "connection.connect_tcp.complete":
+            _stats.new_connections += 1
+        elif event_name == "connection.start_tls.started":
+            tls_started["t"] = time.perf_counter()
+        elif event_name == "connection.start_tls.complete":
+            _stats.tls_handshakes += 1
+            started = tls_started.pop("t", None)
+            if started is not None:
+                _stats.handshake_seconds_total += time.perf_counter() - started
+
+    return _trace
+
+
+async def _on_request(request: httpx.Request) -> None:
+    _stats.requests += 1
+    request.extensions["trace"] = _make_trace()
+    request.extensions["w2a_started"] = time.perf_counter()
+    # 上游 span 覆盖到收到响应头为止（首字节时间），之后的读取计入 bridge 的服务端 span
+    request.extensions["w2a_span"] = start_span(f"warp {request.method} {request.url.path}", kind="client",
+                                                **{"http.request.method": request.method, "server.address": request.url.host})
+
+
+async def _on_response(response: httpx.Response) -> None:
+    if response.request.extensions.get("w2a_auxiliary"):
+        end_span(response.request.extensions.get("w2a_span"), **{"http.response.status_code": response.status_code})
+        return
+    started = response.request.extensions.get("w2a_started")
+    bridge_metrics.inc("bridge_warp_requests_total", status=response.status_code)
+    end_span(response.request.extensions.get("w2a_span"), **{"http.response.status_code": response.status_code})
+    if started is not None:
+        bridge_metrics.observe("bridge_warp_response_seconds", time.perf_counter() - started)
+        observe_upstream_response(response.status_code, time.perf_counter() - started)
+    if response.status_code >= 400:
+        note_account_error(f"Warp HTTP {response.status_code}")
+
+
+def get_warp_http_client() -> httpx.AsyncClient:
+    """Return the process-wide upstream client, creating it on first use."""
+    global _client
+    if _client is None or _client.is_closed:
+        limits = httpx.Limits(
+            max_connections=WARP_HTTP_MAX_CONNECTIONS,
+            max_keepalive_connections=WARP_HTTP_MAX_KEEPALIVE,
+            keepalive_expiry=WARP_HTTP_KEEPALIVE_EXPIRY,
+        )
+        hooks = {"request": [_on_request], "response": [_on_response]}
+        # 模拟上游与 cassette 使用同一个客户端（事件钩子、指标照常），只是换掉了底层 transport
+        if MOCK_UPSTREAM:
+            from .mock_upstream import MockWarpTransport
+            _client = httpx.AsyncClient(transport=MockWarpTransport(), timeout=httpx.Timeout(WARP_HTTP_TIMEOUT), event_hooks=hooks)
+            logger.warning("MOCK_UPSTREAM 已开启: Warp 请求由模拟上游应答，不会发送到 Warp")
+            return _client
+        if CASSETTE_MODE == "replay":
+            from .cassettes import CassetteTransport
+            _client = httpx.AsyncClient(transport=CassetteTransport("replay"), timeout=httpx.Timeout(WARP_HTTP_TIMEOUT), event_hooks=hooks)
+            logger.warning(f"CASSETTE_MODE=replay: Warp 请求由 {CASSETTE_DIR} 中录制的 cassette 应答")
+            return _client
+        _client = httpx.AsyncClient(
+            http2=True,
+            timeout=httpx.Timeout(WARP_HTTP_TIMEOUT),
+            limits=limits,
+            verify=_build_ssl_context(),
+            trust_env=True,
+            event_hooks=hooks if CASSETTE_MODE != "record" else None,
+        )
+        if CASSETTE_MODE == "record":
+            # 录制时真实请求仍由网络客户端发出（代理、HTTP/2、连接池不变），外层客户端负责钩子
+            from .cassettes import CassetteTransport
+            _client = httpx.AsyncClient(transport=CassetteTransport("record", _client), timeout=httpx.Timeout(WARP_HTTP_TIMEOUT), event_hooks=hooks)
+            logger.warning(f"CASSETTE_MODE=record: Warp 对话请求将录制到 {CASSETTE_DIR}")
+        logger.info(
+            f"Warp上游HTTP客户端已创建: http2=True, max_connections={WARP_HTTP_MAX_CONNECTIONS}, "
+            f"keepalive={WARP_HTTP_MAX_KEEPALIVE}, keepalive_expiry={WARP_HTTP_KEEPALIVE_EXPIRY}s"
+        )
+    return _client
+
+
+async def post_auxiliary(url: str, **kwargs: Any) -> httpx.Response:
+    """POST over the shared pool without counting as a Warp conversation request."""
+    # 认证等辅助请求（token 刷新、匿名账号）不计入 Warp 请求指标与自适应并发
+    return await get_warp_http_client().post(url, extensions={"w2a_auxiliary": True}, **kwargs)
+
+
+@asynccontextmanager
+async def warp_http_client() -> AsyncIterator[httpx.AsyncClient]:
+    """Drop-in replacement for `async with httpx.AsyncClient(...)` that keeps the pool open."""
+    yield get_warp_http_client()
+
+
+async def close_warp_http_client() -> None:
+    global _client
+    if _client is not None and not _client.is_closed:
+        await _client.aclose()
+    _client = None
+
+
+def _upstream_origins() -> List[str]:
+    origins: List[str] = []
+    for url in (WARP_URL, REFRESH_URL):
+        parts = urlsplit(url)
+        origin = f"{parts.scheme}://{parts.netloc}"
+        if origin not in origins:
+            origins.append(origin)
+    return origins
+
+
+async def _prewarm_origin(client: httpx.AsyncClient, origin: str) -> None:
+    started = time.perf_counter()
+    try:
+        # 任意状态码都说明连接与 TLS 握手已完成，连接随后留在池中供真实请求复用
+        response = await client.head(f"{origin}/", extensions={"w2a_auxiliary": True})
+        result: Dict[str, Any] = {"ok": True, "status_code": response.status_code, "http_version": response.http_version}
+    except httpx.HTTPError as e:
+        result = {"ok": False, "error": str(e) or type(e).__name__}
+    result["seconds"] = round(time.perf_counter() - started, 3)
+    result["at"] = time.time()
+    _stats.prewarm[origin] = result
+    if result["ok"]:
+        logger.info(f"Warp上游连接已预热: {origin} ({result['http_version']}, {result['seconds']}s)")
+    else:
+        logger.warning(f"Warp上游连接预热失败: {origin}: {result['error']}")
+
+
+async def prewarm_connections() -> None:
+    """Open a connection to every Warp origin ahead of the first request (WARP_HTTP_PREWARM)."""
+    if not WARP_HTTP_PREWARM or OFFLINE_UPSTREAM:
+        return
+    client = get_warp_http_client()
+    await asyncio.gather(*(_prewarm_origin(client, origin) for origin in _upstream_origins()))
+
+
+def stream_timeout() -> httpx.Timeout:
+    """Per-request timeout for streaming calls: normal connect/write limits, long read limit."""
+    return httpx.Timeout(WARP_HTTP_TIMEOUT, read=WARP_STREAM_READ_TIMEOUT or None)
+
+
+def get_connection_stats() -> Dict[str, Any]:
+    return _stats.snapshot()
@@ -0,0 +1,142 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Mock Warp upstream
+
+With MOCK_UPSTREAM the shared upstream HTTP client (http_client.py) gets this
+transport instead of a network one, so every code path that talks to Warp —
+streamed and collected conversations, token refreshes — is served by a
+deterministic fake: the reply is MOCK_UPSTREAM_RESPONSE (by default an
+echo of the last user message) streamed word by word as real ResponseEvent
+protobufs, followed by a "finished" event with token usage. Latency and
+failures can be injected for client and CI testing; no Warp credentials or
+network access are needed.
+"""
+import asyncio
+import base64
+import hashlib
+import itertools
+import json
+import re
+import uuid
+from typing import Any, AsyncIterator, Dict, List
+from urllib.parse import urlsplit
+
+import httpx
+
+from ..core.logging import logger
+from ..core.protobuf_utils import dict_to_protobuf_bytes, protobuf_to_dict
+from ..config.settings import (
+    MOCK_UPSTREAM_RESPONSE,
+    MOCK_UPSTREAM_LATENCY_MS,
+    MOCK_UPSTREAM_CHUNK_DELAY_MS,
+    MOCK_UPSTREAM_ERROR_EVERY,
+    MOCK_UPSTREAM_ERROR_STATUS,
+    WARP_URL,
+    REFRESH_URL,
+)
+
+RESPONSE_EVENT_TYPE = "warp.multi_agent.v1.ResponseEvent"
+REQUEST_TYPE = "warp.multi_agent.v1.Request"
+
+
+def _b64(data: bytes) -> str:
+    return base64.urlsafe_b64encode(data).rstrip(b"=").decode("ascii")
+
+
+# 形式合法、2100 年才过期的 JWT，认证相关的过期检查都能通过
+MOCK_JWT = ".".join([
+    _b64(b'{"alg":"none","typ":"JWT"}'),
+    _b64(json.dumps({"sub": "mock-upstream", "user_id": "mock-upstream", "exp": 4102444800}).encode()),
+    "mock",
+])
+
+
+def _last_user_query(body: bytes) -> str:
+    try:
+        request = protobuf_to_dict(body, REQUEST_TYPE)
+    except Exception:
+        return ""
+    inputs = ((request.get("input") or {}).get("user_inputs") or {}).get("inputs") or []
+    for item in reversed(inputs):
+        query = (item.get("user_query") or {}).get("query")
+        if query:
+            return str(query)
+    return ""
+
+
+def _tokens(text: str) -> int:
+    return max(1, len(text) // 4)
+
+
+def _sse(event: Dict[str, Any]) -> bytes:
+    return f"data: {_b64(dict_to_protobuf_bytes(event, RESPONSE_EVENT_TYPE))}\n\n".encode("ascii")
+
+
+def build_events(body: bytes) -> List[Dict[str, Any]]:
+    """The ResponseEvents answering one encoded request; identical requests get identical events."""
+    query = _last_user_query(body)
+    text = MOCK_UPSTREAM_RESPONSE.replace("{query}", query)
+    digest = hashlib.sha256(body).hexdigest()
+    conversation_id = str(uuid.uuid5(uuid.NAMESPACE_URL, f"warp2api-mock:{digest}"))
+    task_id = str(uuid.uuid5(uuid.NAMESPACE_URL, f"warp2api-mock-task:{digest}"))
+    message_id = str(uuid.uuid5(uuid.NAMESPACE_URL, f"warp2api-mock-message:{digest}"))
+    # 按词切分（保留空白），模拟逐步生成
+    words = re.findall(r"\S+\s*|\s+", text) or [""]
+    events: List[Dict[str, Any]] = [
+        {"init": {"conversation_id": conversation_id, "request_id": digest[:32]}},
+        {"client_actions": {"actions": [{"add_messages_to_task": {"task_id": task_id, "messages": [
+            {"id": message_id, "task_id": task_id, "agent_output": {"text": words[0]}},
+        ]}}]}},
+    ]
+    for word in words[1:]:
+        events.append({"client_actions": {"actions": [{"append_to_message_content": {
+            "task_id": task_id,
+            "message": {"id": message_id, "task_id": task_id, "agent_output": {"text": word}},
+        }}]}})
+    events.append({"finished": {
+        "done": {},
+        "token_usage": [{"model_id": "mock", "total_input": _tokens(query), "output": _tokens(text)}],
+    }})
+    return events
+
+
+class _EventStream(httpx.AsyncByteStream):
+    def __init__(self, events: List[Dict[str, Any]], delay: float):
+        self.events = events
+        self.delay = delay
+
+    async def __aiter__(self) -> AsyncIterator[bytes]:
+        for i, event in enumerate(self.events):
+            if i and self.delay:
+                await asyncio.sleep(self.delay)
+            yield _sse(event)
+
+
+class MockWarpTransport(httpx.AsyncBaseTransport):
+    """httpx transport answering Warp's conversation and token endpoints locally."""
+
+    def __init__(self):
+        self._requests = itertools.count(1)
+        self._conversation_path = urlsplit(WARP_URL).path
+        self._refresh_path = urlsplit(REFRESH_URL).path
+
+    async def handle_async_request(self, request: httpx.Request) -> httpx.Response:
+        if request.method == "POST" and request.url.path == self._conversation_path:
+            return await self._conversation(request)
+        if request.method == "POST" and request.url.path == self._refresh_path:
+            return httpx.Response(200, json={"access_token": MOCK_JWT, "refresh_token": "mock-refresh-token",
+                                             "expires_in": "3600", "token_type": "Bearer"}, request=request)
+        # 预热的 HEAD 请求及其它接口
+        return httpx.Response(404, text="not served by the mock upstream", request=request)
+
+    async def _conversation(self, request: httpx.Request) -> httpx.Response:
+        n = next(self._requests)
+        body = await request.aread()
+        if MOCK_UPSTREAM_LATENCY_MS:
+            await asyncio.sleep(MOCK_UPSTREAM_LATENCY_MS / 1000)
+        if MOCK_UPSTREAM_ERROR_EVERY and n % MOCK_UPSTREAM_ERROR_EVERY == 0:
+            logger.info(f"模拟上游: 第 {n} 个请求注入错误 HTTP {MOCK_UPSTREAM_ERROR_STATUS}")
+            return httpx.Response(MOCK_UPSTREAM_ERROR_STATUS, text=f"mock upstream error (request #{n})", request=request)
+        return httpx.Response(200, headers={"content-type": "text/event-stream"},
+                              stream=_EventStream(build_events(body), MOCK_UPSTREAM_CHUNK_DELAY_MS / 1000), request=request)
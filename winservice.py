@@ -0,0 +1,117 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Windows service wrapper
+
+`warp2api service install` registers Warp2ApiService with the Service Control
+Manager. The service runs both servers in one process, exactly like
+`warp2api all`, starts with Windows and keeps running after the user logs
+off. The working directory, config file, profile and ports given at install
+time are stored as service options and restored on every start, so .env and
+relative paths resolve as they did in the installing shell.
+
+Requires pywin32 (pip install pywin32) and an administrator prompt for
+install / remove / start / stop.
+"""
+import asyncio
+import os
+import signal
+import sys
+from typing import Any, Dict, List
+
+import servicemanager
+import win32service
+import win32serviceutil
+
+DEFAULT_SERVICE_NAME = "Warp2Api"
+# 安装时保存、启动时恢复的服务选项 -> 对应的环境变量
+ENV_OPTIONS = {"config": "WARP2API_CONFIG", "profile": "WARP2API_PROFILE"}
+
+_STATES = {
+    win32service.SERVICE_STOPPED: "stopped",
+    win32service.SERVICE_START_PENDING: "starting",
+    win32service.SERVICE_STOP_PENDING: "stopping",
+    win32service.SERVICE_RUNNING: "running",
+    win32service.SERVICE_CONTINUE_PENDING: "resuming",
+    win32service.SERVICE_PAUSE_PENDING: "pausing",
+    win32service.SERVICE_PAUSED: "paused",
+}
+
+
+class Warp2ApiService(win32serviceutil.ServiceFramework):
+    _svc_name_ = DEFAULT_SERVICE_NAME
+    _svc_display_name_ = "Warp2Api"
+    _svc_description_ = "Warp AI 到 OpenAI API 的兼容代理（protobuf 桥接 + OpenAI 兼容服务器）"
+
+    def __init__(self, args: Any):
+        super().__init__(args)
+        # 以 --name 安装的服务用自己的名称读取选项
+        self.name = args[0]
+        self.servers: List[Any] = []
+
+    def _option(self, key: str, default: Any = None) -> Any:
+        return win32serviceutil.GetServiceCustomOption(self.name, key, default)
+
+    def SvcDoRun(self) -> None:
+        os.chdir(self._option("cwd") or os.getcwd())
+        os.makedirs("logs", exist_ok=True)
+        # 服务进程没有控制台，uvicorn 与未捕获异常的输出写入文件
+        sys.stdout = sys.stderr = open(os.path.join("logs", "service.log"), "a", encoding="utf-8", buffering=1)
+        for key, env_name in ENV_OPTIONS.items():
+            value = self._option(key)
+            if value:
+                os.environ[env_name] = value
+        servicemanager.LogInfoMsg(f"{self.name}: starting in {os.getcwd()}")
+        from cli import serve_all
+        from warp2protobuf.config.validation import check_config_or_exit
+        try:
+            check_config_or_exit("bridge")
+            check_config_or_exit("openai")
+            asyncio.run(serve_all(int(self._option("bridge_port", 28888)), int(self._option("port", 28889)),
+                                  os.getenv("BRIDGE_SOCKET", ""), self.servers))
+        except SystemExit:
+            servicemanager.LogErrorMsg(f"{self.name}: 配置无效，详见 {os.path.abspath('logs/service.log')}")
+        except Exception as e:
+            servicemanager.LogErrorMsg(f"{self.name}: {type(e).__name__}: {e}")
+            raise
+
+    def SvcStop(self) -> None:
+        self.ReportServiceStatus(win32service.SERVICE_STOP_PENDING)
+        # 与 SIGTERM 相同：OpenAI 服务器先排空进行中的请求，再停止 bridge
+        for server in self.servers:
+            server.handle_exit(signal.SIGTERM, None)
+
+
+def install(name: str, options: Dict[str, Any], auto_start: bool) -> None:
+    win32serviceutil.InstallService(
+        win32serviceutil.GetServiceClassString(Warp2ApiService),
+        name,
+        name if name != DEFAULT_SERVICE_NAME else Warp2ApiService._svc_display_name_,
+        startType=win32service.SERVICE_AUTO_START if auto_start else win32service.SERVICE_DEMAND_START,
+        description=Warp2ApiService._svc_description_,
+    )
+    for key, value in options.items():
+        if value is not None:
+            win32serviceutil.SetServiceCustomOption(name, key, value)
+
+
+def remove(name: str) -> None:
+    win32serviceutil.RemoveService(name)
+
+
+def start(name: str) -> None:
+    win32serviceutil.StartService(name)
+
+
+def stop(name: str) -> None:
+    win32serviceutil.StopService(name)
+
+
+def status(name: str) -> str:
+    state = win32serviceutil.QueryServiceStatus(name)[1]
+    return _STATES.get(state, str(state))
+
+
+if __name__ == "__main__":
+    # pythonservice.exe 之外直接运行本文件时，沿用 pywin32 的标准命令行（install / debug / start ...）
+    win32serviceutil.HandleCommandLine(Warp2ApiService)